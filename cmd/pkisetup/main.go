@@ -22,19 +22,98 @@ package main
 
 import (
 	"flag"
-	pki "github.com/edgexfoundry/security-secret-store/internal/pkg/pkisetup"
 	"log"
 	"os"
-	"strconv"
+	"strings"
+	"time"
+
+	model "github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/edgexfoundry/security-secret-store/internal/pkg/logging"
+	pki "github.com/edgexfoundry/security-secret-store/internal/pkg/pkisetup"
 )
 
 func main() {
 
-	var configFile string
+	var configFile, reason, listen, csrFile, profile, host, out string
+	var days int
+	var debug, unsafeDebug, jsonOutput bool
 	// Handling the command flags
 	log.SetFlags(0)
+	log.SetOutput(logging.NewStdWriter(logging.NewClient("pkisetup", "")))
+
+	// Optional command before the flags: "revoke <serial|file>", "crl", "ocsp-serve", "csr", "sign",
+	// "renew", "inspect <file|dir>" or "verify", the default sets up the PKI
+	command := ""
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
 	flag.StringVar(&configFile, "config", "", "use a JSON file as configuration: /path/to/file.json")
-	flag.Parse()
+	flag.BoolVar(&debug, "debug", false, "output debug informations, with private keys redacted")
+	flag.BoolVar(&unsafeDebug, "unsafe-debug", false, "output debug informations, including private keys in clear")
+	flag.StringVar(&reason, "reason", "unspecified", "RFC 5280 revocation reason of the revoke command, e.g. keyCompromise or superseded")
+	flag.StringVar(&listen, "listen", "", "address of the ocsp-serve command, e.g. :8888 (default: x509_ocsp_parameters.listen_address)")
+	flag.StringVar(&host, "host", "", "tls_host of the TLS server whose key and certificate request the csr command generates, or the renew and verify commands handle (default: all)")
+	flag.StringVar(&csrFile, "csr", "", "certificate request signed by the sign command: /path/to/file.csr")
+	flag.StringVar(&profile, "profile", pki.ProfileServer, "certificate profile of the sign command")
+	flag.IntVar(&days, "days", 0, "validity of the certificate issued by the sign command (default: x509_csr_policy.max_validity_days)")
+	flag.BoolVar(&jsonOutput, "json", false, "print the report of the inspect and verify commands as JSON, the logs going to stderr")
+	flag.StringVar(&out, "out", "", "output directory of the csr command (default: current directory), certificate file of the sign command (default: next to the request)")
+	flag.CommandLine.Parse(args)
+
+	switch command {
+	case "", "crl", "ocsp-serve", "renew", "verify":
+	case "inspect":
+		if flag.NArg() != 1 {
+			log.Println("ERROR: usage: pkisetup inspect [--json] <file|directory>")
+			os.Exit(1)
+		}
+	case "csr":
+		if host == "" {
+			log.Println("ERROR: usage: pkisetup csr --config /path/to/file.json --host tls_host [--out directory]")
+			os.Exit(1)
+		}
+	case "sign":
+		if csrFile == "" {
+			log.Println("ERROR: usage: pkisetup sign --config /path/to/file.json --csr /path/to/file.csr [--profile profile] [--days days] [--out file.pem]")
+			os.Exit(1)
+		}
+	case "revoke":
+		if flag.NArg() != 1 {
+			log.Println("ERROR: usage: pkisetup revoke --config /path/to/file.json [--reason reason] <serial|certificate file>")
+			os.Exit(1)
+		}
+		if _, ok := pki.RevocationReasons[reason]; !ok {
+			log.Printf("ERROR: unknown revocation reason %q", reason)
+			os.Exit(1)
+		}
+	default:
+		log.Printf("ERROR: unknown command: %s", command)
+		log.Println(pki.CmdUsageMsg)
+		flag.PrintDefaults()
+		os.Exit(1)
+	}
+
+	// Keep stdout for the JSON report
+	if jsonOutput {
+		log.SetOutput(os.Stderr)
+	}
+	if debug || unsafeDebug {
+		logging.SetLevel(model.DebugLog)
+	}
+	if unsafeDebug {
+		logging.SetUnsafe(true)
+		log.Println("WARN: Unsafe debugging mode activated: private keys will be written to the logs in clear")
+	}
+	// The inspection only reads PEM files, without configuration
+	if command == "inspect" {
+		infos, err := pki.Inspect(flag.Arg(0))
+		fatalIfErr(err, "Inspection")
+		fatalIfErr(pki.WriteInspection(os.Stdout, infos, jsonOutput), "Inspection")
+		return
+	}
+
 	// Missing --config flag
 	if configFile == "" {
 		log.Println("ERROR: missing mandatory parameter: --config | -config")
@@ -47,26 +126,122 @@ func main() {
 	log.Printf("Config file      : %s \n", configFile)
 	x509config, err := pki.ReadConfig(&configFile)
 	if err != nil {
-		pki.FatalIfErr(err, "Opening configuration file")
+		fatalIfErr(err, "Opening configuration file")
+	}
+
+	// The key and certificate request of a service do not need the CA
+	if command == "csr" {
+		if out == "" {
+			out = "."
+		}
+		_, _, err = pki.GenCSR(&x509config, host, out)
+		fatalIfErr(err, "Certificate request generation")
+		return
+	}
+
+	// The other commands work on the existing PKI setup directory, which must not be wiped
+	if command != "" {
+		x509config.CreateNewRootCA = false
 	}
 
 	// Create and initialize the fs environment and global vars for the PKI materials
 	cf, err := pki.CreateEnv(&x509config)
 	if err != nil {
-		pki.FatalIfErr(err, "Environment initialization")
+		fatalIfErr(err, "Environment initialization")
 	}
 
-	newCA, err := strconv.ParseBool(x509config.CreateNewRootCA)
+	switch command {
+	case "revoke":
+		_, err = pki.Revoke(&cf, flag.Arg(0), pki.RevocationReasons[reason], time.Now())
+		fatalIfErr(err, "Revocation")
+		return
+	case "crl":
+		fatalIfErr(pki.GenCRLs(&cf, time.Now()), "CRL generation")
+		return
+	case "ocsp-serve":
+		fatalIfErr(pki.ServeOCSP(&cf, listen), "OCSP responder")
+		return
+	case "sign":
+		_, err = pki.SignCSR(&cf, csrFile, profile, days, out)
+		fatalIfErr(err, "Certificate request signing")
+		return
+	case "renew":
+		results, err := pki.Renew(&cf, host, time.Now())
+		for _, r := range results {
+			status := "kept"
+			if r.Renewed {
+				status = "renewed"
+			}
+			log.Printf("%s: %s (%s), SHA-256 fingerprint %s, expires %s", r.Host, status, r.Reason, r.Fingerprint, r.NotAfter.UTC().Format(time.RFC3339))
+		}
+		fatalIfErr(err, "Renewal")
+		return
+	case "verify":
+		results, err := pki.Verify(&cf, host, time.Now())
+		fatalIfErr(err, "Verification")
+		fatalIfErr(pki.WriteVerification(os.Stdout, results, jsonOutput), "Verification")
+		os.Exit(verifyExitCode(results))
+	}
 
 	// Optionaly generate the Root CA PKI materials (RSA or EC)
-	if newCA {
+	if x509config.CreateNewRootCA && x509config.ExternalCA != nil {
+		// The enterprise CA issues the TLS server certificates instead of a generated Root CA
+		if _, _, err = pki.ImportCA(&cf); err != nil {
+			fatalIfErr(err, "External CA import")
+		}
+	} else if x509config.CreateNewRootCA {
 		if _, _, err = pki.GenCA(&cf); err != nil {
-			pki.FatalIfErr(err, "Root CA generation")
+			fatalIfErr(err, "Root CA generation")
+		}
+		// Optionaly sign an intermediate CA issuing the TLS server certificates
+		if x509config.IntermediateCA != nil {
+			if _, _, err = pki.GenIntermediateCA(&cf); err != nil {
+				fatalIfErr(err, "Intermediate CA generation")
+			}
+		}
+	}
+
+	// Generate the PKI materials of every TLS server (RSA or EC)
+	if _, _, err = pki.GenCerts(&cf); err != nil {
+		fatalIfErr(err, "TLS server generation")
+	}
+
+	// Optionaly issue the delegated OCSP signing certificates used by ocsp-serve
+	if x509config.OCSP != nil && x509config.OCSP.DelegatedSigner {
+		if _, err = pki.GenOCSPSigners(&cf); err != nil {
+			fatalIfErr(err, "OCSP signer generation")
 		}
 	}
 
-	// Generate the TLS server PKI materials (RSA or EC)
-	if _, _, err = pki.GenCert(&cf); err != nil {
-		pki.FatalIfErr(err, "TLS server generation")
+	// Optionaly sign the initial CRLs, re-signed by the crl command before their next update
+	if x509config.CRL != nil {
+		fatalIfErr(pki.GenCRLs(&cf, time.Now()), "CRL generation")
+	}
+}
+
+// Exit codes of the verify command, beyond 1 for errors
+const (
+	exitVerifyFailed   = 2 // a certificate does not verify
+	exitVerifyExpiring = 3 // every certificate verifies, some expire within the renewal window
+)
+
+// verifyExitCode returns the exit code of the verify command for its results
+func verifyExitCode(results []pki.VerifyResult) int {
+	code := 0
+	for _, r := range results {
+		if len(r.Problems) > 0 {
+			return exitVerifyFailed
+		}
+		if r.Expiring {
+			code = exitVerifyExpiring
+		}
+	}
+	return code
+}
+
+// fatalIfErr logs the failed step with its error and exits: the pkisetup library only returns errors
+func fatalIfErr(err error, msg string) {
+	if err != nil {
+		log.Fatalf("ERROR: %s: %s", msg, err)
 	}
 }
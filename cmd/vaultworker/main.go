@@ -23,48 +23,85 @@ package main
 import (
 	"crypto/tls"
 	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	logger "github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
 	model "github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/edgexfoundry/security-secret-store/internal/pkg/logging"
 	worker "github.com/edgexfoundry/security-secret-store/internal/pkg/vaultworker"
 )
 
 var debug = false
 var lc = CreateLogging()
+var metricsFile *string
 
 // CreateLogging Logger functionality
 func CreateLogging() logger.LoggingClient {
-	return logger.NewClient(worker.SecurityService, false, fmt.Sprintf("%s-%s.log", worker.SecurityService, time.Now().Format("2006-01-02")), model.InfoLog)
+	return logging.NewClient(worker.SecurityService, fmt.Sprintf("%s-%s.log", worker.SecurityService, time.Now().Format("2006-01-02")))
 }
 
 func main() {
 
+	// Route the standard log package (fatal errors) through the JSON logger
+	log.SetFlags(0)
+	log.SetOutput(logging.NewStdWriter(lc))
+
 	lc.Info("-------------------- Vault Worker Cycle ------------------------")
 
 	if len(os.Args) < 2 {
 		worker.HelpCallback()
 	}
 
+	// Optional command before the flags: "bootstrap" is the same as --init=true
+	command := ""
+	args := os.Args[1:]
+	if !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
+
 	useConsul := flag.Bool("consul", false, "retrieve configuration from consul server")
 	initNeeded := flag.Bool("init", false, "run init procedure for security service.")
-	debugActive := flag.Bool("debug", false, "output sensitive debug informations for security service.")
+	debugActive := flag.Bool("debug", false, "output debug informations for security service, with secrets redacted.")
+	unsafeDebug := flag.Bool("unsafe-debug", false, "output debug informations for security service, including secrets in clear.")
 	insecureSkipVerify := flag.Bool("insureskipverify", true, "skip server side SSL verification, mainly for self-signed cert.")
 	configFileLocation := flag.String("configfile", "res/configuration.toml", "configuration file")
 	waitInterval := flag.Int("wait", 30, "time to wait between checking Vault status in seconds.")
+	metricsAddr := flag.String("metricsaddr", "", "serve Prometheus metrics on this address, e.g. :9090 (disabled if empty).")
+	metricsFile = flag.String("metricsfile", "", "write Prometheus metrics to this file on exit (disabled if empty).")
+	overwriteInit := flag.Bool("overwriteinit", false, "allow replacing an existing Vault init response file (the previous one is kept as .bak).")
+	backupFile := flag.String("backupfile", "vault-backup.bin", "encrypted archive written by the backup command and read by the restore command.")
+	passphraseFile := flag.String("passphrasefile", "", "file holding the backup passphrase (default: EDGEX_BACKUP_PASSPHRASE environment variable).")
+	dryRun := flag.Bool("dry-run", false, "print the bootstrap plan against the current Vault state without changing anything.")
 
 	flag.Usage = worker.HelpCallback
-	flag.Parse()
+	flag.CommandLine.Parse(args)
+
+	switch command {
+	case "":
+	case "bootstrap", "backup", "restore":
+		*initNeeded = true
+	default:
+		lc.Error(fmt.Sprintf("Unknown command: %s", command))
+		worker.HelpCallback()
+	}
 
-	if *debugActive {
+	if *debugActive || *unsafeDebug {
+		lc.SetLogLevel(model.DebugLog)
 		lc.Info("Debugging mode activated.")
 		debug = true
 	}
+	if *unsafeDebug {
+		logging.SetUnsafe(true)
+		lc.Warn("Unsafe debugging mode activated: secrets will be written to the logs in clear.")
+	}
 	if *useConsul {
 		lc.Info("Retrieving config data from Consul...")
 	}
@@ -74,10 +111,50 @@ func main() {
 		os.Exit(0)
 	}
 
+	if *metricsAddr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", worker.MetricsHandler())
+			lc.Info(fmt.Sprintf("Serving metrics on %s/metrics", *metricsAddr))
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				lc.Error(fmt.Sprintf("Metrics endpoint stopped: %s", err.Error()))
+			}
+		}()
+	}
+
 	config, err := worker.LoadTomlConfig(*configFileLocation)
 	if err != nil {
 		lc.Error("Failed to retrieve config data from local file. Please make sure res/configuration.toml file exists with correct format.")
-		return
+		exit(1)
+	}
+	if *overwriteInit {
+		config.SecretService.OverwriteInit = true
+	}
+	if err = worker.CheckPKIEngine(config); err != nil {
+		lc.Error(fmt.Sprintf("Invalid PKI engine configuration: %s", err.Error()))
+		exit(1)
+	}
+	if err = worker.CheckCertBundles(config); err != nil {
+		lc.Error(fmt.Sprintf("Invalid certificates configuration: %s", err.Error()))
+		exit(1)
+	}
+
+	if command == "backup" {
+		passphrase, err := worker.ReadPassphrase(*passphraseFile)
+		if err != nil {
+			lc.Error(err.Error())
+			exit(1)
+		}
+		archive, err := worker.CreateBackup(config, passphrase)
+		if err == nil {
+			err = worker.WriteBackup(*backupFile, archive)
+		}
+		if err != nil {
+			lc.Error(fmt.Sprintf("Failed to create the backup archive: %s", err.Error()))
+			exit(1)
+		}
+		lc.Info(fmt.Sprintf("Backup archive successfully written to %s", *backupFile))
+		exit(0)
 	}
 
 	// Prepare the HTTP Client to use with Vault REST API
@@ -92,7 +169,7 @@ func main() {
 		caCert, err := ioutil.ReadFile(config.SecretService.CAFilePath)
 		if err != nil {
 			lc.Error("Failed to load rootCA certificate.")
-			os.Exit(0)
+			exit(0)
 		}
 		lc.Info("Successful loading the rootCA certificate.")
 		caCertPool := x509.NewCertPool()
@@ -106,9 +183,57 @@ func main() {
 			TLSHandshakeTimeout: 5 * time.Second,
 		}
 	}
+	// Present a client certificate to Vault for mutual TLS if configured
+	clientCerts, err := worker.LoadVaultClientCert(config)
+	if err != nil {
+		lc.Error(err.Error())
+		exit(1)
+	}
+	if clientCerts != nil {
+		lc.Info(fmt.Sprintf("Presenting the client certificate %s to Vault.", config.SecretService.ClientCertFilePath))
+		tr.TLSClientConfig.Certificates = clientCerts
+	}
 
 	// 2/2 Build HTTP Client
-	client := &http.Client{Transport: tr, Timeout: 10 * time.Second}
+	client := worker.InstrumentClient(&http.Client{Transport: tr, Timeout: 10 * time.Second})
+
+	if command == "restore" {
+		passphrase, err := worker.ReadPassphrase(*passphraseFile)
+		if err != nil {
+			lc.Error(err.Error())
+			exit(1)
+		}
+		archive, err := ioutil.ReadFile(*backupFile)
+		if err != nil {
+			lc.Error(fmt.Sprintf("Failed to read the backup archive: %s", err.Error()))
+			exit(1)
+		}
+		if _, err = worker.RestoreBackup(config, archive, passphrase); err != nil {
+			lc.Error(fmt.Sprintf("Failed to restore the backup archive: %s", err.Error()))
+			exit(1)
+		}
+		checks, err := worker.VerifyRestore(config, client)
+		for _, check := range checks {
+			fmt.Println(check.String())
+		}
+		if err != nil || worker.RestoreFailed(checks) {
+			lc.Error("The restored assets do not match the live Vault.")
+			exit(1)
+		}
+		lc.Info("Backup successfully restored and verified against Vault.")
+		exit(0)
+	}
+
+	if *dryRun {
+		lc.Info("Dry-run requested: evaluating the bootstrap plan, nothing will be changed.")
+		plan, err := worker.BuildPlan(config, client)
+		if err != nil {
+			lc.Error(fmt.Sprintf("Failed to build the bootstrap plan: %s", err.Error()))
+			exit(1)
+		}
+		fmt.Print(plan.String())
+		exit(0)
+	}
 
 	// Loop duration interval between Vault init and unseal retries
 	intervalDuration := time.Duration(*waitInterval) * time.Second
@@ -128,6 +253,10 @@ func main() {
 		case 501:
 			lc.Info(fmt.Sprintf("Vault is not initialized (Status Code: %d). Starting initialisation and unseal phases.", sCode))
 			_, err = worker.VaultInit(config, client, debug)
+			if errors.Is(err, worker.ErrInitRefused) {
+				lc.Error("Vault initialization refused, retrying would not help: move the init response file away or use --overwriteinit.")
+				exit(1)
+			}
 			if err == nil {
 				_, err = worker.VaultUnseal(config, client, debug)
 				if err == nil {
@@ -162,7 +291,7 @@ func main() {
 	rootToken, err := worker.GetSecret(config.SecretService.TokenFolderPath + "/" + config.SecretService.VaultInitParm)
 	if err != nil {
 		lc.Error("Fatal Error fetching Vault root token.")
-		worker.FatalIfErr(err, "Root token fetch failure")
+		fatalIfErr(err, "Root token fetch failure")
 	}
 
 	/*
@@ -189,13 +318,13 @@ func main() {
 	policyFile := config.SecretService.PolicyPath4Admin
 	_, err = worker.HashFile(&policyFile, debug)
 	if err != nil {
-		worker.FatalIfErr(err, "Calculating policy file hash (SHA256)")
+		fatalIfErr(err, "Calculating policy file hash (SHA256)")
 	}
 	lc.Info("Reading Admin policy file.")
 	policyRequest, err := worker.GetPolicyFromFile(&policyFile)
 	if err != nil {
 		lc.Error("Fatal Error opening Admin policy file.")
-		worker.FatalIfErr(err, "Opening policy file (Admin)")
+		fatalIfErr(err, "Opening policy file (Admin)")
 	}
 
 	// Import the Admin policy data into Vault
@@ -203,7 +332,7 @@ func main() {
 	err = worker.ImportPolicy(config.SecretService.PolicyName4Admin, &policyRequest, rootToken.Token, config, client)
 	if err != nil {
 		lc.Error("Fatal Error importing Admin policy in Vault.")
-		worker.FatalIfErr(err, "Import policy failure")
+		fatalIfErr(err, "Import policy failure")
 	}
 
 	// Create Admin token associated with admin policy in Vault
@@ -211,7 +340,7 @@ func main() {
 	err = worker.CreateToken(config.SecretService.TokenName4Admin, config.SecretService.PolicyName4Admin, rootToken.Token, config, client)
 	if err != nil {
 		lc.Error("Fatal Error creating Admin token in Vault.")
-		worker.FatalIfErr(err, "Create token failure (Admin)")
+		fatalIfErr(err, "Create token failure (Admin)")
 	}
 
 	// ------------------ Kong Vault Policies and associated token ----------------------
@@ -220,14 +349,14 @@ func main() {
 	policyFile = config.SecretService.PolicyPath4Kong
 	_, err = worker.HashFile(&policyFile, debug)
 	if err != nil {
-		worker.FatalIfErr(err, "Calculating policy file hash (SHA256)")
+		fatalIfErr(err, "Calculating policy file hash (SHA256)")
 	}
 	lc.Info("Reading Kong policy file.")
 	policyFile = config.SecretService.PolicyPath4Kong
 	policyRequest, err = worker.GetPolicyFromFile(&policyFile)
 	if err != nil {
 		lc.Error("Fatal Error opening Kong policy file.")
-		worker.FatalIfErr(err, "Opening policy file (Kong)")
+		fatalIfErr(err, "Opening policy file (Kong)")
 	}
 
 	// Import the Kong policy data into Vault
@@ -235,7 +364,7 @@ func main() {
 	err = worker.ImportPolicy(config.SecretService.PolicyName4Kong, &policyRequest, rootToken.Token, config, client)
 	if err != nil {
 		lc.Error("Fatal Error importing Kong policy in Vault.")
-		worker.FatalIfErr(err, "Import policy failure")
+		fatalIfErr(err, "Import policy failure")
 	}
 
 	// Create Kong token associated with kong policy in Vault
@@ -243,7 +372,28 @@ func main() {
 	err = worker.CreateToken(config.SecretService.TokenName4Kong, config.SecretService.PolicyName4Kong, rootToken.Token, config, client)
 	if err != nil {
 		lc.Error("Fatal Error creating Kong token in Vault.")
-		worker.FatalIfErr(err, "Create token failure (Kong)")
+		fatalIfErr(err, "Create token failure (Kong)")
+	}
+
+	// ------------------ Vault PKI secrets engine (optional) ----------------------------
+	if config.PKIEngine.Enabled {
+		err = worker.SetupPKIEngine(config, rootToken.Token, client)
+		if err != nil {
+			lc.Error("Fatal Error setting up the Vault PKI secrets engine.")
+			fatalIfErr(err, "PKI secrets engine setup failure")
+		}
+	}
+
+	// ------------------ TLS certificates read policies and consumer tokens -------------
+	err = worker.ImportCertBundlePolicies(config, rootToken.Token, client)
+	if err != nil {
+		lc.Error("Fatal Error importing TLS certificates read policies in Vault.")
+		fatalIfErr(err, "Import policy failure")
+	}
+	err = worker.CreateConsumerTokens(config, rootToken.Token, client)
+	if err != nil {
+		lc.Error("Fatal Error creating TLS certificates consumer tokens in Vault.")
+		fatalIfErr(err, "Create token failure (TLS consumers)")
 	}
 
 	secretServiceBaseURL := fmt.Sprintf("https://%s:%s/", config.SecretService.Server, config.SecretService.Port)
@@ -255,34 +405,34 @@ func main() {
 	//	os.Exit(1)
 	//}
 
-	hasCertKeyPair, err := worker.CertKeyPairInStore(config, secretServiceBaseURL, client, debug)
-	if err != nil {
-		lc.Error(fmt.Sprintf("Failed to check if the API Gateway TLS certificate and key are in the secret store: %s", err.Error()))
-		os.Exit(1)
-	}
-
-	if hasCertKeyPair == true {
-		lc.Info("API Gateway TLS certificate and key already in the secret store, skip uploading phase.")
-		os.Exit(0)
+	for _, bundle := range config.CertBundles() {
+		decision, err := worker.SyncCertBundle(config, bundle, secretServiceBaseURL, client, debug, time.Second*time.Duration(*waitInterval))
+		if err != nil {
+			lc.Error(err.Error())
+			exit(1)
+		}
+		if decision.Action == worker.CertKeep {
+			lc.Info(fmt.Sprintf("TLS certificate and key %s already in the secret store, skip uploading phase.", bundle.Name))
+		}
 	}
-	lc.Info("API Gateway TLS certificate and key are not in the secret store yet, uploading them.")
+	exit(0)
+}
 
-	cert, sk, err := worker.LoadCertKeyPair(config.SecretService.CertFilePath, config.SecretService.KeyFilePath)
+// fatalIfErr logs err and exits with status 1 through exit, so that the metrics of the failed run
+// are flushed too
+func fatalIfErr(err error, msg string) {
 	if err != nil {
-		lc.Error("Failed to load API Gateway TLS certificate and key from volume:")
-		lc.Error(fmt.Sprintf("--> Certificate path: %s", config.SecretService.CertFilePath))
-		lc.Error(fmt.Sprintf("--> Private Key path: %s.", config.SecretService.KeyFilePath))
-		os.Exit(1)
+		log.Printf("ERROR: %s: %s", msg, err)
+		exit(1)
 	}
-	lc.Info("API Gateway TLS certificate and key successfully loaded from volume, now will upload to secret store.")
+}
 
-	for {
-		done, _ := worker.UploadProxyCerts(config, secretServiceBaseURL, cert, sk, client)
-		if done == true {
-			os.Exit(0)
-		} else {
-			lc.Info(fmt.Sprintf("Will retry uploading in %d seconds.", *waitInterval))
+// exit flushes the metrics file, if requested, before terminating the worker
+func exit(code int) {
+	if metricsFile != nil && *metricsFile != "" {
+		if err := worker.WriteMetricsFile(*metricsFile); err != nil {
+			lc.Error(fmt.Sprintf("Failed to write metrics file %s: %s", *metricsFile, err.Error()))
 		}
-		time.Sleep(time.Second * time.Duration(*waitInterval))
 	}
+	os.Exit(code)
 }
@@ -1,10 +1,22 @@
 module github.com/edgexfoundry/security-secret-store
 
+go 1.24.0
+
 require (
 	github.com/BurntSushi/toml v0.3.1
 	github.com/dghubble/sling v1.2.0
 	github.com/edgexfoundry/go-mod-core-contracts v0.1.0
+	github.com/google/uuid v1.1.1
+	github.com/youmark/pkcs8 v0.0.0-20240726163527-a2c0da244d78
+	golang.org/x/crypto v0.48.0
+	software.sslmate.com/src/go-pkcs12 v0.5.0
+)
+
+require (
+	github.com/go-kit/kit v0.8.0 // indirect
+	github.com/go-logfmt/logfmt v0.4.0 // indirect
 	github.com/go-stack/stack v1.8.0 // indirect
 	github.com/google/go-querystring v1.0.0 // indirect
-	github.com/google/uuid v1.1.1 // indirect
+	github.com/kr/logfmt v0.0.0-20140226030751-b84e30acd515 // indirect
+	github.com/ugorji/go v1.1.4 // indirect
 )
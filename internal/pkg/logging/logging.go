@@ -0,0 +1,212 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *
+ * @version: 1.0.0
+ *******************************************************************************/
+
+// Package logging is the logging layer shared by the pkisetup and vaultworker binaries.
+// Records are written as one JSON object per line, carry the correlation ID of the
+// current bootstrap run and go through a redaction filter that masks Vault tokens,
+// unseal key shares and PEM private keys unless unsafe debugging has been enabled.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
+	model "github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/google/uuid"
+)
+
+// levels from the most to the least verbose
+var levels = []string{model.TraceLog, model.DebugLog, model.InfoLog, model.WarnLog, model.ErrorLog}
+
+var (
+	mu       sync.Mutex
+	minLevel = model.InfoLog
+	unsafe   = false
+	runID    = uuid.New().String()
+)
+
+// SetLevel sets the minimum severity of the records written by every logger
+func SetLevel(level string) error {
+	if !logger.IsValidLogLevel(level) {
+		return fmt.Errorf("invalid log level: %s", level)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	minLevel = level
+	return nil
+}
+
+// SetUnsafe disables (true) or enables (false) the redaction filter for every logger
+func SetUnsafe(enabled bool) {
+	mu.Lock()
+	defer mu.Unlock()
+	unsafe = enabled
+}
+
+// CorrelationID returns the identifier shared by every record of the current run
+func CorrelationID() string {
+	return runID
+}
+
+func levelIndex(level string) int {
+	for i, l := range levels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+func enabled(level string) bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return levelIndex(level) >= levelIndex(minLevel)
+}
+
+// Client writes JSON log records; it satisfies the EdgeX logger.LoggingClient interface
+type Client struct {
+	app string
+	out io.Writer
+}
+
+// fileWriter appends every record to a log file, opened on each write like the EdgeX file logger
+type fileWriter struct {
+	fileName string
+}
+
+func (f *fileWriter) Write(p []byte) (int, error) {
+	file, err := os.OpenFile(f.fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY|os.O_SYNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.Write(p)
+}
+
+// NewClient creates a JSON logger for the application, writing to stdout and to logTarget if not empty
+func NewClient(app string, logTarget string) logger.LoggingClient {
+	var out io.Writer = os.Stdout
+	if logTarget != "" {
+		out = io.MultiWriter(os.Stdout, &fileWriter{fileName: logTarget})
+	}
+	return NewWriterClient(app, out)
+}
+
+// NewWriterClient creates a JSON logger for the application writing to out
+func NewWriterClient(app string, out io.Writer) *Client {
+	return &Client{app: app, out: out}
+}
+
+// SetLogLevel sets the minimum log level, shared by every logger of the process
+func (c *Client) SetLogLevel(logLevel string) error {
+	return SetLevel(logLevel)
+}
+
+// Trace logs a message at the TRACE severity level
+func (c *Client) Trace(msg string, args ...interface{}) {
+	c.log(model.TraceLog, msg, args...)
+}
+
+// Debug logs a message at the DEBUG severity level
+func (c *Client) Debug(msg string, args ...interface{}) {
+	c.log(model.DebugLog, msg, args...)
+}
+
+// Info logs a message at the INFO severity level
+func (c *Client) Info(msg string, args ...interface{}) {
+	c.log(model.InfoLog, msg, args...)
+}
+
+// Warn logs a message at the WARN severity level
+func (c *Client) Warn(msg string, args ...interface{}) {
+	c.log(model.WarnLog, msg, args...)
+}
+
+// Error logs a message at the ERROR severity level
+func (c *Client) Error(msg string, args ...interface{}) {
+	c.log(model.ErrorLog, msg, args...)
+}
+
+// log builds the record from the message and the key/value pairs in args
+func (c *Client) log(level string, msg string, args ...interface{}) {
+	if !enabled(level) {
+		return
+	}
+
+	record := map[string]interface{}{
+		"ts":             time.Now().UTC().Format(time.RFC3339Nano),
+		"level":          level,
+		"app":            c.app,
+		"correlation_id": runID,
+		"msg":            Redact(msg),
+	}
+	if len(args)%2 == 1 {
+		// add an empty string to keep k/v pairs correct
+		args = append(args, "")
+	}
+	for i := 0; i < len(args); i += 2 {
+		key := fmt.Sprint(args[i])
+		if _, reserved := record[key]; reserved {
+			key = "arg_" + key
+		}
+		record[key] = Redact(fmt.Sprint(args[i+1]))
+	}
+
+	var line bytes.Buffer
+	enc := json.NewEncoder(&line)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(record); err != nil {
+		return
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	c.out.Write(line.Bytes())
+}
+
+// StdWriter adapts a Client to an io.Writer so that the standard log package can be routed
+// through it. Lines starting with "ERROR:" or "WARN:" are logged at the matching level.
+type StdWriter struct {
+	client logger.LoggingClient
+}
+
+// NewStdWriter returns a writer suitable for log.SetOutput
+func NewStdWriter(c logger.LoggingClient) *StdWriter {
+	return &StdWriter{client: c}
+}
+
+func (w *StdWriter) Write(p []byte) (int, error) {
+	// The log package issues one Write per call: keep multi-line output in a single record
+	msg := strings.TrimSpace(string(p))
+	switch {
+	case msg == "":
+	case strings.HasPrefix(msg, "ERROR:"):
+		w.client.Error(strings.TrimSpace(strings.TrimPrefix(msg, "ERROR:")))
+	case strings.HasPrefix(msg, "WARN:"):
+		w.client.Warn(strings.TrimSpace(strings.TrimPrefix(msg, "WARN:")))
+	case strings.HasPrefix(msg, "DEBUG:"):
+		w.client.Debug(strings.TrimSpace(strings.TrimPrefix(msg, "DEBUG:")))
+	default:
+		w.client.Info(msg)
+	}
+	return len(p), nil
+}
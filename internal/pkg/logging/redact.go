@@ -0,0 +1,70 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *
+ * @version: 1.0.0
+ *******************************************************************************/
+package logging
+
+import (
+	"regexp"
+)
+
+// Mask replaces every redacted value
+const Mask = "[REDACTED]"
+
+type redaction struct {
+	pattern *regexp.Regexp
+	replace string
+}
+
+var redactions = []redaction{
+	// PEM private keys, whatever their algorithm or encryption
+	{
+		regexp.MustCompile(`-----BEGIN ([A-Z0-9 ]*PRIVATE KEY)-----[\s\S]*?-----END [A-Z0-9 ]*PRIVATE KEY-----`),
+		"-----BEGIN $1-----" + Mask + "-----END $1-----",
+	},
+	// Vault JSON documents: tokens, accessors, key shares and private keys
+	{
+		regexp.MustCompile(`("(?:root_token|client_token|token|accessor|private_key|key|keys|keys_base64|unseal_keys_b64|unseal_keys_hex)"\s*:\s*)(?:"(?:[^"\\]|\\.)*"|\[[^\]]*\])`),
+		`${1}"` + Mask + `"`,
+	},
+	// Vault service tokens (s.xxx, b.xxx, r.xxx)
+	{
+		regexp.MustCompile(`\b[sbr]\.[A-Za-z0-9]{20,}\b`),
+		Mask,
+	},
+	// Tokens and key shares printed in free text
+	{
+		regexp.MustCompile(`(?i)((?:X-Vault-Token|key share to apply[^:]*|root token)\s*[:=]\s*)\S+`),
+		"${1}" + Mask,
+	},
+	// Private keys dumped by the key generation debug output
+	{
+		regexp.MustCompile(`(>> (?:RSA|ECDSA|ED25519) SK: ).*`),
+		"${1}" + Mask,
+	},
+}
+
+// Redact masks tokens, key shares and PEM private keys in s, unless unsafe debugging is enabled
+func Redact(s string) string {
+	mu.Lock()
+	skip := unsafe
+	mu.Unlock()
+	if skip {
+		return s
+	}
+	for _, r := range redactions {
+		s = r.pattern.ReplaceAllString(s, r.replace)
+	}
+	return s
+}
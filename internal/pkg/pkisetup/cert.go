@@ -28,8 +28,8 @@ import (
 	"crypto/x509/pkix"
 	"encoding/asn1"
 	"encoding/pem"
+	"fmt"
 	"io/ioutil"
-	"log"
 	"math/big"
 	"time"
 )
@@ -37,12 +37,12 @@ import (
 //GenCA creates a new CA certificate, saves it to PEM file and returns the x509 certificate and crypto private key.*/
 func GenCA(cf *CertConfig) (*x509.Certificate, crypto.PrivateKey, error) {
 
-	log.Println("")
-	log.Println("<Phase 1> Generating CA PKI materials")
-	log.Println("Generating Root CA key pair (sk,pk)")
+	lg.Println("")
+	lg.Println("<Phase 1> Generating CA PKI materials")
+	lg.Println("Generating Root CA key pair (sk,pk)")
 
 	// Generate RSA or EC based SK
-	caSK, err := genSK(cf)
+	caSK, err := genSK(cf.keyParams)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -55,19 +55,25 @@ func GenCA(cf *CertConfig) (*x509.Certificate, crypto.PrivateKey, error) {
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	FatalIfErr(err, "failed to generate serial number")
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, "serial number", err)
+	}
 
-	spkiASN1, err := x509.MarshalPKIXPublicKey(caPK)
-	FatalIfErr(err, "failed to encode public key")
+	skid, err := subjectKeyID(caPK)
+	if err != nil {
+		return nil, nil, err
+	}
 
-	var spki struct {
-		Algorithm        pkix.AlgorithmIdentifier
-		SubjectPublicKey asn1.BitString
+	notBefore, notAfter, err := cf.caValidity.bounds(time.Now(), cf.backdate, nil, false)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", err, cf.caCertFile)
 	}
-	_, err = asn1.Unmarshal(spkiASN1, &spki)
-	FatalIfErr(err, "failed to decode public key")
 
-	skid := sha1.Sum(spki.SubjectPublicKey.Bytes)
+	// The CA contact address is only known from the TLS server domain
+	var caEmails []string
+	if cf.caDomain != "" {
+		caEmails = []string{cf.caName + "@" + cf.caDomain}
+	}
 
 	caCertTemplate := &x509.Certificate{
 		SerialNumber: serialNumber,
@@ -80,140 +86,322 @@ func GenCA(cf *CertConfig) (*x509.Certificate, crypto.PrivateKey, error) {
 			Country:            []string{cf.caCountry},
 		},
 
-		EmailAddresses: []string{cf.caName + "@" + cf.tlsDomain},
+		EmailAddresses: caEmails,
+
+		SubjectKeyId: skid,
 
-		SubjectKeyId: skid[:],
+		NotAfter:  notAfter,
+		NotBefore: notBefore,
 
-		NotAfter:  time.Now().AddDate(10, 0, 0),
-		NotBefore: time.Now(),
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
 
-		KeyUsage: x509.KeyUsageCertSign,
+		SignatureAlgorithm: signatureAlgorithm(caSK),
 
 		BasicConstraintsValid: true,
 		IsCA:                  true,
 		MaxPathLenZero:        true,
 	}
+	// The root signs the intermediate CA, which signs the TLS server certificates
+	if cf.intermediate != nil {
+		caCertTemplate.MaxPathLen = cf.intermediate.pathLen + 1
+		caCertTemplate.MaxPathLenZero = false
+	}
 
-	log.Printf("Generating Root CA certificate")
+	lg.Printf("Generating Root CA certificate")
 	caDER, err := x509.CreateCertificate(rand.Reader, caCertTemplate, caCertTemplate, caPK, caSK)
-	FatalIfErr(err, "failed to generate CA certificate (DER)")
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, cf.caCertFile, err)
+	}
 
 	caCert, err := x509.ParseCertificate(caDER)
-	FatalIfErr(err, "failed to parse Root CA certificate")
-
-	log.Printf("Saving Root CA private key to PEM file: %s", cf.caKeyFile)
-	skPKCS8, err := x509.MarshalPKCS8PrivateKey(caSK)
-	FatalIfErr(err, "failed to encode CA private key")
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, cf.caCertFile, err)
+	}
 
-	err = ioutil.WriteFile(cf.caKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: skPKCS8}), 0400)
-	FatalIfErr(err, "failed to save CA private key")
+	lg.Printf("Saving Root CA private key to PEM file: %s", cf.caKeyFile)
+	if err = cf.protection.writeCAKey(cf.caKeyFile, caSK, 0400); err != nil {
+		return nil, nil, err
+	}
 
-	log.Printf("Saving Root CA certificate to PEM file: %s", cf.caCertFile)
+	lg.Printf("Saving Root CA certificate to PEM file: %s", cf.caCertFile)
 	err = ioutil.WriteFile(cf.caCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0644)
-	FatalIfErr(err, "failed to save CA certificate")
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrWriteFailed, cf.caCertFile, err)
+	}
 
-	log.Printf("New local Root CA successfully created!")
+	lg.Printf("New local Root CA successfully created!")
 
 	return caCert, caSK, nil
 }
 
-/*GenCert creates a new TLS server certificate, saves it to PEM file and returns the x509 certificate and crypto private key. */
-func GenCert(cf *CertConfig) (*x509.Certificate, crypto.PrivateKey, error) {
+/*subjectKeyID computes the key identifier of a public key: the SHA-1 hash of its subject public key bit string.*/
+func subjectKeyID(pk crypto.PublicKey) ([]byte, error) {
+	spkiASN1, err := x509.MarshalPKIXPublicKey(pk)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, "public key encoding", err)
+	}
 
-	log.Println("")
-	log.Println("<Phase 2> Generating TLS server PKI materials")
+	var spki struct {
+		Algorithm        pkix.AlgorithmIdentifier
+		SubjectPublicKey asn1.BitString
+	}
+	_, err = asn1.Unmarshal(spkiASN1, &spki)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, "public key decoding", err)
+	}
+
+	skid := sha1.Sum(spki.SubjectPublicKey.Bytes)
+	return skid[:], nil
+}
+
+/*LoadCA reads and parses the CA certificate and private key PEM files issuing the TLS server certificates: the intermediate CA if configured, the Root CA otherwise.*/
+func LoadCA(cf *CertConfig) (*x509.Certificate, crypto.PrivateKey, error) {
+	if cf.intermediate != nil {
+		return cf.loadCAFiles(cf.intermediate.caCertFile, cf.intermediate.caKeyFile)
+	}
+	return cf.loadCAFiles(cf.caCertFile, cf.caKeyFile)
+}
+
+/*loadCAFiles reads and parses a CA certificate and private key PEM files, the key being decrypted with the configured password if encrypted.*/
+func (cf *CertConfig) loadCAFiles(caCertFile string, caKeyFile string) (*x509.Certificate, crypto.PrivateKey, error) {
 
 	// Root CA certificate fetch --------------------------------------------------------
-	log.Printf("Loading Root CA certificate: %s", cf.caCertFile)
-	certPEMBlock, err := ioutil.ReadFile(cf.caCertFile) // Load Root CA certificate
-	FatalIfErr(err, "failed to read the Root CA certificate")
+	lg.Printf("Loading Root CA certificate: %s", caCertFile)
+	certPEMBlock, err := ioutil.ReadFile(caCertFile) // Load Root CA certificate
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrCACertUnreadable, caCertFile, err)
+	}
 
-	log.Println("- Decoding the Root CA certificate")
+	lg.Println("- Decoding the Root CA certificate")
 	certDERBlock, _ := pem.Decode(certPEMBlock) // Decode Root CA certificate
 	if certDERBlock == nil || certDERBlock.Type != "CERTIFICATE" {
-		log.Fatalln("ERROR: failed to read the Root CA certificate: unexpected content")
+		return nil, nil, fmt.Errorf("%w: %w: %s: expected a CERTIFICATE block", ErrCACertUnreadable, ErrCertTypeMismatch, caCertFile)
 	}
 
-	log.Println("- Parsing the Root CA certificate")
+	lg.Println("- Parsing the Root CA certificate")
 	caCert, err := x509.ParseCertificate(certDERBlock.Bytes) // Parse Root CA certificate
-	FatalIfErr(err, "failed to parse the Root CA certificate")
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrCACertUnreadable, caCertFile, err)
+	}
 
 	// Root CA private key fetch --------------------------------------------------------
-	log.Printf("Loading the Root CA private key: %s", cf.caKeyFile)
-	keyPEMBlock, err := ioutil.ReadFile(cf.caKeyFile)
-	FatalIfErr(err, "failed to read the Root CA private key")
+	lg.Printf("Loading the Root CA private key: %s", caKeyFile)
+	keyPEMBlock, err := ioutil.ReadFile(caKeyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrCAKeyUnreadable, caKeyFile, err)
+	}
 
-	log.Println("- Decoding the Root CA private key")
-	keyDERBlock, _ := pem.Decode(keyPEMBlock) // Decode Root CA private key
-	if keyDERBlock == nil || keyDERBlock.Type != "PRIVATE KEY" {
-		log.Fatalln("ERROR: failed to read the Root CA key: unexpected content")
+	lg.Println("- Decoding the Root CA private key")
+	caSK, err := decodePrivateKey(keyPEMBlock, cf.protection.password) // Decode Root CA private key, encrypted or not
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %w", ErrCAKeyUnreadable, caKeyFile, err)
 	}
 
-	log.Println("- Parsing the Root CA private key")
-	caSK, err := x509.ParsePKCS8PrivateKey(keyDERBlock.Bytes) // Parse Root CA private key
-	FatalIfErr(err, "failed to parse the Root CA key")
+	return caCert, caSK, nil
+}
+
+/*issueCert creates a new TLS server key pair and certificate signed by the CA, saves them to PEM files, records the certificate in the issuance index and returns the x509 certificate and crypto private key. Below an intermediate or external CA, the certificate followed by its chain is also saved to the full-chain PEM file. */
+func (cf *CertConfig) issueCert(caCert *x509.Certificate, caSK crypto.PrivateKey, s serverParams) (*x509.Certificate, crypto.PrivateKey, error) {
 
 	// TLS server certificate preparation -----------------------------------------------
-	log.Println("Generating TLS server key pair (sk,pk)")
+	lg.Printf("Generating TLS server %s key pair (sk,pk)", s.tlsHost)
 
 	// Generate RSA or EC based SK
-	tlsSK, err := genSK(cf)
+	tlsSK, err := genSK(s.keyParams)
 	if err != nil {
 		return nil, nil, err
 	}
 	// Extract PK from RSA or EC generated SK
 	tlsPK := tlsSK.(crypto.Signer).Public()
 	// Debug the key pair generation/extraction
-	if cf.dumpKeys {
+	if s.dumpKeys {
 		dumpKeyPair(tlsSK, tlsPK)
 	}
 
+	tlsCert, err := cf.signCert(caCert, caSK, s, tlsPK, s.subject())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lg.Printf("Saving TLS server private key to PEM file: %s", s.tlsKeyFile)
+	if err = writePrivateKey(s.tlsKeyFile, tlsSK, 0600); err != nil {
+		return nil, nil, err
+	}
+
+	if err = cf.writePKCS12(s, tlsSK, tlsCert, caCert); err != nil {
+		return nil, nil, err
+	}
+
+	lg.Printf("New TLS server %s certificate/key successfully created!", s.tlsHost)
+
+	return tlsCert, tlsSK, nil
+}
+
+/*subject returns the certificate subject of a TLS server.*/
+func (s serverParams) subject() pkix.Name {
+	return pkix.Name{
+		CommonName:         s.tlsNames.commonName,
+		Organization:       []string{s.tlsHost},
+		OrganizationalUnit: []string{s.tlsOrg},
+		Locality:           []string{s.tlsLocality},
+		Province:           []string{s.tlsState},
+		Country:            []string{s.tlsCountry},
+	}
+}
+
+/*signCert creates the certificate of a public key signed by the CA, saves it to PEM file, records it in the issuance index and returns the x509 certificate. Below an intermediate or external CA, the certificate followed by its chain is also saved to the full-chain PEM file. */
+func (cf *CertConfig) signCert(caCert *x509.Certificate, caSK crypto.PrivateKey, s serverParams, tlsPK crypto.PublicKey, subject pkix.Name) (*x509.Certificate, error) {
+
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
-	FatalIfErr(err, "failed to generate serial number")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, "serial number", err)
+	}
+
+	keyUsage, extKeyUsage := profileUsage(s.profile, s.rsaKey())
+	lg.Printf("- Certificate profile: %s", profileName(s.profile))
+
+	// The certificate cannot outlive its CA
+	notBefore, notAfter, err := s.validity.bounds(time.Now(), cf.backdate, caCert, cf.allowCap)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, s.tlsCertFile)
+	}
 
 	tlsCertTemplate := &x509.Certificate{
 		SerialNumber: serialNumber,
-		Subject: pkix.Name{
-			CommonName:         cf.tlsFQDN,
-			Organization:       []string{cf.tlsHost},
-			OrganizationalUnit: []string{cf.tlsOrg},
-			Locality:           []string{cf.tlsLocality},
-			Province:           []string{cf.tlsState},
-			Country:            []string{cf.tlsCountry},
-		},
+		Subject:      subject,
 
-		EmailAddresses: []string{"admin@" + cf.tlsDomain},
-		DNSNames:       []string{cf.tlsFQDN, cf.tlsAltFQDN}, // Alternative Names
+		// Alternative Names
+		DNSNames:       s.tlsNames.dnsNames,
+		IPAddresses:    s.tlsNames.ips,
+		URIs:           s.tlsNames.uris,
+		EmailAddresses: s.tlsNames.emails,
 
-		NotAfter:  time.Now().AddDate(10, 0, 0),
-		NotBefore: time.Now(),
+		NotAfter:  notAfter,
+		NotBefore: notBefore,
 
-		KeyUsage:    x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    keyUsage,
+		ExtKeyUsage: extKeyUsage,
+
+		// The signature algorithm follows the CA key, whatever the certificate key
+		SignatureAlgorithm: signatureAlgorithm(caSK),
 
 		BasicConstraintsValid: true,
 	}
+	if s.profile == profileOCSPSigning {
+		// Clients do not check the revocation of the OCSP responder itself
+		tlsCertTemplate.ExtraExtensions = []pkix.Extension{ocspNoCheckExtension}
+	} else {
+		tlsCertTemplate.CRLDistributionPoints = cf.crlDistributionPoints(cf.issuerName(caCert.Subject.CommonName))
+		tlsCertTemplate.OCSPServer = cf.ocspServers(cf.issuerName(caCert.Subject.CommonName))
+	}
 
-	log.Printf("Generating TLS server certificate (Self-signed with our local Root CA)")
+	lg.Printf("Generating TLS server certificate %s (signed with our local Root CA)", s.tlsHost)
 	tlsDER, err := x509.CreateCertificate(rand.Reader, tlsCertTemplate, caCert, tlsPK, caSK)
-	FatalIfErr(err, "failed to generate TLS server certificate - DER")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, s.tlsCertFile, err)
+	}
 
 	tlsCert, err := x509.ParseCertificate(tlsDER)
-	FatalIfErr(err, "failed to parse TLS server certificate")
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, s.tlsCertFile, err)
+	}
 
-	log.Printf("Saving TLS server private key to PEM file: %s", cf.tlsKeyFile)
-	skPKCS8, err := x509.MarshalPKCS8PrivateKey(tlsSK)
-	FatalIfErr(err, "failed to encode TLS server key")
+	lg.Printf("Saving TLS server certificate to PEM file: %s", s.tlsCertFile)
+	err = ioutil.WriteFile(s.tlsCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsDER}), 0644)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrWriteFailed, s.tlsCertFile, err)
+	}
+
+	if err = cf.recordIssued(tlsCert, s.tlsCertFile); err != nil {
+		return nil, err
+	}
+
+	chain, err := cf.issuerChain(caCert)
+	if err != nil {
+		return nil, err
+	}
+	if len(chain) > 0 {
+		lg.Printf("Saving TLS server full-chain certificate to PEM file: %s", s.tlsChainFile)
+		if err = writeCertChain(s.tlsChainFile, append([]*x509.Certificate{tlsCert}, chain...)); err != nil {
+			return nil, err
+		}
+	}
 
-	err = ioutil.WriteFile(cf.tlsKeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: skPKCS8}), 0600)
-	FatalIfErr(err, "failed to save TLS server private key")
+	return tlsCert, nil
+}
 
-	log.Printf("Saving Root CA certificate to PEM file: %s", cf.caCertFile)
-	err = ioutil.WriteFile(cf.tlsCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsDER}), 0644)
-	FatalIfErr(err, "failed to save TLS server certificate")
+/*GenCerts creates every TLS server certificate of the configuration, loading the CA once. The x509 certificates and crypto private keys are returned in configuration order.*/
+func GenCerts(cf *CertConfig) ([]*x509.Certificate, []crypto.PrivateKey, error) {
 
-	log.Printf("New TLS server certificate/key successfully created!")
+	lg.Println("")
+	lg.Println("<Phase 2> Generating TLS server PKI materials")
 
-	return tlsCert, tlsSK, nil
+	caCert, caSK, err := LoadCA(cf)
+	if err != nil {
+		return nil, nil, err
+	}
+	certs := make([]*x509.Certificate, 0, len(cf.servers))
+	keys := make([]crypto.PrivateKey, 0, len(cf.servers))
+	for _, s := range cf.servers {
+		cert, key, err := cf.issueCert(caCert, caSK, s)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, cert)
+		keys = append(keys, key)
+	}
+	return certs, keys, nil
+}
+
+/*GenCert creates the TLS server certificate of one host of the configuration, saves it to PEM file and returns the x509 certificate and crypto private key.*/
+func GenCert(cf *CertConfig, host string) (*x509.Certificate, crypto.PrivateKey, error) {
+	for _, s := range cf.servers {
+		if s.tlsHost != host {
+			continue
+		}
+		lg.Println("")
+		lg.Printf("<Phase 2> Generating TLS server %s PKI materials", host)
+		caCert, caSK, err := LoadCA(cf)
+		if err != nil {
+			return nil, nil, err
+		}
+		return cf.issueCert(caCert, caSK, s)
+	}
+	return nil, nil, fmt.Errorf("%w: %s", ErrUnknownServer, host)
+}
+
+/*issuerChain returns the CA certificates following a TLS server certificate in its full chain: the intermediate CA, or the external CA up to the enterprise root, none when the generated Root CA issues the certificate.*/
+func (cf *CertConfig) issuerChain(caCert *x509.Certificate) ([]*x509.Certificate, error) {
+	switch {
+	case cf.external != nil:
+		chain, err := readCertChain(cf.caChainFile)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrCACertUnreadable, err)
+		}
+		return chain, nil
+	case cf.intermediate == nil || caCert.Subject.CommonName != cf.intermediate.caName:
+		return nil, nil
+	}
+	return []*x509.Certificate{caCert}, nil
+}
+
+/*issuerName returns the configuration name of the CA whose certificate has the common name: the intermediate CA, else the Root CA, whose common name differs when it is an imported external CA.*/
+func (cf *CertConfig) issuerName(commonName string) string {
+	if cf.intermediate != nil && commonName == cf.intermediate.caName {
+		return commonName
+	}
+	return cf.caName
+}
+
+/*writeCertChain saves certificates, leaf first, to a PEM file.*/
+func writeCertChain(file string, certs []*x509.Certificate) error {
+	var chainPEM []byte
+	for _, c := range certs {
+		chainPEM = append(chainPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Raw})...)
+	}
+	if err := ioutil.WriteFile(file, chainPEM, 0644); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrWriteFailed, file, err)
+	}
+	return nil
 }
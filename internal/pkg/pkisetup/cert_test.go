@@ -20,6 +20,9 @@
 package pkisetup
 
 import (
+	"errors"
+	"net"
+	"path/filepath"
 	"testing"
 )
 
@@ -36,25 +39,32 @@ var testConfig = CertConfig{
 	caState:    "testcaState",
 	caLocality: "testcaLocality",
 	caOrg:      "testcaOrg",
+	caValidity: days(3650),
 
-	// TLS Server Certificate
-	tlsHost:     "testtlsHost",
-	tlsDomain:   "testtlsDomain",
-	tlsFQDN:     "testtlsFQDN",
-	tlsAltFQDN:  "testtlsAltFQDN",
-	tlsKeyFile:  "testtlsKeyFile",
-	tlsCertFile: "testtlsCertFile",
-	tlsCountry:  "testtlsCountry",
-	tlsState:    "testtlsState",
-	tlsLocality: "testtlsLocality",
-	tlsOrg:      "testtlsOrg",
+	// Root CA Key Generation
+	keyParams: keyParams{
+		dumpKeys:  true,
+		algorithm: "rsa-4096",
+	},
 
-	// Key Generation
-	dumpKeys:   true,
-	rsaScheme:  true,
-	rsaKeySize: 4096,
-	ecScheme:   true,
-	ecCurve:    "224",
+	// TLS Server Certificates
+	servers: []serverParams{{
+		keyParams:   keyParams{algorithm: "ecdsa-p256"},
+		tlsHost:     "testtlsHost",
+		tlsDomain:   "testtlsDomain",
+		tlsKeyFile:  "testtlsKeyFile",
+		tlsCertFile: "testtlsCertFile",
+		tlsCountry:  "testtlsCountry",
+		tlsState:    "testtlsState",
+		tlsLocality: "testtlsLocality",
+		tlsOrg:      "testtlsOrg",
+		tlsNames: subjectAltNames{
+			commonName: "testtlsFQDN",
+			dnsNames:   []string{"testtlsFQDN", "testtlsAltFQDN"},
+			ips:        []net.IP{net.ParseIP("127.0.0.1")},
+		},
+		validity: days(3650),
+	}},
 }
 
 func TestGenCAWithValidConfig(t *testing.T) {
@@ -67,8 +77,37 @@ func TestGenCAWithValidConfig(t *testing.T) {
 
 func TestGenCertWithValidConfig(t *testing.T) {
 	myconfig := testConfig
-	_, _, err := GenCert(&myconfig)
+	myconfig.pkiCaDir = t.TempDir() // issuance index
+	_, _, err := GenCert(&myconfig, "testtlsHost")
 	if err != nil {
 		t.Errorf("Failed to create cert with correct configuration data.")
 	}
 }
+
+func TestGenCertMissingCAKey(t *testing.T) {
+	myconfig := testConfig
+	myconfig.caKeyFile = filepath.Join(t.TempDir(), "missing.priv.key")
+	_, _, err := GenCert(&myconfig, "testtlsHost")
+	if !errors.Is(err, ErrCAKeyUnreadable) {
+		t.Errorf("Expected %v, got %v", ErrCAKeyUnreadable, err)
+	}
+}
+
+func TestGenCertCATypeMismatch(t *testing.T) {
+	// The CA key given in place of the CA certificate
+	myconfig := testConfig
+	myconfig.caCertFile = myconfig.caKeyFile
+	_, _, err := GenCert(&myconfig, "testtlsHost")
+	if !errors.Is(err, ErrCACertUnreadable) || !errors.Is(err, ErrCertTypeMismatch) {
+		t.Errorf("Expected %v and %v, got %v", ErrCACertUnreadable, ErrCertTypeMismatch, err)
+	}
+}
+
+func TestGenCAWriteFailed(t *testing.T) {
+	myconfig := testConfig
+	myconfig.caKeyFile = filepath.Join(t.TempDir(), "missing", "ca.priv.key")
+	_, _, err := GenCA(&myconfig)
+	if !errors.Is(err, ErrWriteFailed) {
+		t.Errorf("Expected %v, got %v", ErrWriteFailed, err)
+	}
+}
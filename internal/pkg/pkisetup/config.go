@@ -21,112 +21,758 @@
 package pkisetup
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
-	"log"
-	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 )
 
-// KeyScheme parameters (RSA vs EC)
-// RSA: 1024, 2048, 4096
-// EC: 224, 256, 384, 521
+// FlexBool is a JSON boolean that also accepts the legacy string form ("true", "false")
+type FlexBool bool
+
+// UnmarshalJSON accepts true, false and their quoted forms understood by strconv.ParseBool
+func (b *FlexBool) UnmarshalJSON(data []byte) error {
+	v, err := parseFlexBool(data)
+	if err != nil {
+		return err
+	}
+	*b = FlexBool(v)
+	return nil
+}
+
+func parseFlexBool(data []byte) (bool, error) {
+	var v interface{}
+	if err := json.Unmarshal(data, &v); err != nil {
+		return false, err
+	}
+	switch t := v.(type) {
+	case bool:
+		return t, nil
+	case string:
+		parsed, err := strconv.ParseBool(strings.TrimSpace(t))
+		if err != nil {
+			return false, fmt.Errorf("expected a boolean, got %q", t)
+		}
+		return parsed, nil
+	}
+	return false, fmt.Errorf("expected a boolean, got %s", string(data))
+}
+
+// FlexInt is a JSON integer that also accepts the legacy string form ("4096")
+type FlexInt int
+
+// UnmarshalJSON accepts an integer or a quoted integer
+func (i *FlexInt) UnmarshalJSON(data []byte) error {
+	v, err := parseFlexInt(data)
+	if err != nil {
+		return err
+	}
+	*i = FlexInt(v)
+	return nil
+}
+
+func parseFlexInt(data []byte) (int, error) {
+	var v interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil {
+		return 0, err
+	}
+	text := ""
+	switch t := v.(type) {
+	case json.Number:
+		text = t.String()
+	case string:
+		text = strings.TrimSpace(t)
+	default:
+		return 0, fmt.Errorf("expected an integer, got %s", string(data))
+	}
+	parsed, err := strconv.Atoi(text)
+	if err != nil {
+		return 0, fmt.Errorf("expected an integer, got %q", text)
+	}
+	return parsed, nil
+}
+
+// ConfigError is a configuration problem located by its JSON path, e.g. key_scheme.rsa_key_size
+type ConfigError struct {
+	Path string
+	Msg  string
+}
+
+func (e ConfigError) Error() string {
+	return e.Path + ": " + e.Msg
+}
+
+// ConfigErrors lists every problem found in a configuration
+type ConfigErrors []ConfigError
+
+func (e ConfigErrors) Error() string {
+	lines := make([]string, 0, len(e))
+	for _, err := range e {
+		lines = append(lines, err.Error())
+	}
+	return fmt.Sprintf("%d configuration error(s):\n%s", len(e), strings.Join(lines, "\n"))
+}
+
+func (e *ConfigErrors) add(path string, format string, args ...interface{}) {
+	*e = append(*e, ConfigError{Path: path, Msg: fmt.Sprintf(format, args...)})
+}
+
+// orNil returns nil rather than an empty error list
+func (e ConfigErrors) orNil() error {
+	if len(e) == 0 {
+		return nil
+	}
+	return e
+}
+
+// KeyScheme parameters
+// key_algorithm: rsa-2048, rsa-3072, rsa-4096, ecdsa-p256, ecdsa-p384, ecdsa-p521, ed25519
+// Without key_algorithm, the legacy settings: rsa with rsa_key_size (2048, 3072, 4096), or ec
+// with ec_curve (256, 384, 521). The weak rsa-1024 and ecdsa-p224 need allow_weak_keys.
 type KeyScheme struct {
-	DumpKeys   string `json:"dump_keys"`
-	RSA        string `json:"rsa"`
-	RSAKeySize string `json:"rsa_key_size"`
-	EC         string `json:"ec"`
-	ECCurve    string `json:"ec_curve"`
+	DumpKeys      FlexBool `json:"dump_keys"`
+	KeyAlgorithm  string   `json:"key_algorithm"`
+	AllowWeakKeys FlexBool `json:"allow_weak_keys"`
+	RSA           FlexBool `json:"rsa"`
+	RSAKeySize    FlexInt  `json:"rsa_key_size"`
+	EC            FlexBool `json:"ec"`
+	ECCurve       string   `json:"ec_curve"`
 }
 
 // RootCA parameters from JSON: x509_root_ca_parameters
+// Like every certificate, the Root CA is valid until the not_after date (RFC 3339) if set, else
+// for the validity duration ("87600h", "3650d") if set, else for validity_days (3650 if not set).
 type RootCA struct {
-	CAName     string `json:"ca_name"`
-	CACountry  string `json:"ca_c"`
-	CAState    string `json:"ca_st"`
-	CALocality string `json:"ca_l"`
-	CAOrg      string `json:"ca_o"`
+	CAName       string  `json:"ca_name"`
+	CACountry    string  `json:"ca_c"`
+	CAState      string  `json:"ca_st"`
+	CALocality   string  `json:"ca_l"`
+	CAOrg        string  `json:"ca_o"`
+	ValidityDays FlexInt `json:"validity_days"`
+	Validity     string  `json:"validity"`
+	NotAfter     string  `json:"not_after"`
+}
+
+// IntermediateCA parameters from JSON config: x509_intermediate_ca_parameters (optional)
+// The intermediate CA is signed by the Root CA and signs the TLS server certificates, so that the
+// Root CA private key can be moved offline. path_len limits the CAs below it (0 if not set); the
+// name constraints restrict the names it may issue certificates for.
+type IntermediateCA struct {
+	CAName              string   `json:"ca_name"`
+	CACountry           string   `json:"ca_c"`
+	CAState             string   `json:"ca_st"`
+	CALocality          string   `json:"ca_l"`
+	CAOrg               string   `json:"ca_o"`
+	PathLen             FlexInt  `json:"path_len"`
+	ValidityDays        FlexInt  `json:"validity_days"`
+	Validity            string   `json:"validity"`
+	NotAfter            string   `json:"not_after"`
+	PermittedDNSDomains []string `json:"permitted_dns_domains"`
+	ExcludedDNSDomains  []string `json:"excluded_dns_domains"`
+	PermittedIPRanges   []string `json:"permitted_ip_ranges"`
+	ExcludedIPRanges    []string `json:"excluded_ip_ranges"`
+}
+
+// CRL parameters from JSON config: x509_crl_parameters (optional)
+// The CRLs are re-signed with a next update next_update_days ahead (7 if not set). The
+// distribution_points URLs are embedded in the issued certificates, {ca} standing for the name of
+// the issuing CA, e.g. "http://edgex-vault:8080/crl/{ca}.crl".
+type CRLParameters struct {
+	NextUpdateDays     FlexInt  `json:"next_update_days"`
+	DistributionPoints []string `json:"distribution_points"`
+}
+
+// OCSP parameters from JSON config: x509_ocsp_parameters (optional)
+// The responder_urls are embedded in the authority information access of the issued certificates,
+// {ca} standing for the name of the issuing CA. The ocsp-serve command listens on listen_address
+// (":8888" if not set) and answers with responses valid next_update_hours (24 if not set). With
+// delegated_signer, each CA issues an OCSP signing certificate <ca>-ocsp valid
+// signer_validity_days (365 if not set) instead of signing the responses itself.
+type OCSPParameters struct {
+	ResponderURLs      []string `json:"responder_urls"`
+	ListenAddress      string   `json:"listen_address"`
+	NextUpdateHours    FlexInt  `json:"next_update_hours"`
+	DelegatedSigner    FlexBool `json:"delegated_signer"`
+	SignerValidityDays FlexInt  `json:"signer_validity_days"`
+}
+
+// CSR policy from JSON config: x509_csr_policy (optional)
+// The sign command only issues certificates for the names matching allowed_domains (RFC 5280
+// name constraint semantics, also applied to email addresses and DNS-like common names),
+// allowed_ip_ranges and allowed_uri_prefixes (on a path boundary), none if not set. Single label
+// host names, such as the tls_host of the legacy tls_host/tls_domain entries, are only allowed
+// with allow_bare_hosts. Keys are checked against key_types, e.g. "rsa-3072" or "ecdsa-p256"
+// (every strong key algorithm if not set), profiles against profiles (all if not set) and
+// validity against max_validity_days (365 if not set).
+type CSRPolicy struct {
+	AllowedDomains     []string `json:"allowed_domains"`
+	AllowBareHosts     FlexBool `json:"allow_bare_hosts"`
+	AllowedIPRanges    []string `json:"allowed_ip_ranges"`
+	AllowedURIPrefixes []string `json:"allowed_uri_prefixes"`
+	KeyTypes           []string `json:"key_types"`
+	Profiles           []string `json:"profiles"`
+	MaxValidityDays    FlexInt  `json:"max_validity_days"`
+}
+
+// Renewal parameters from JSON config: x509_renewal_parameters (optional)
+// The renew command re-issues the TLS server certificates expiring within renew_before_days (30
+// if not set), with their current private key if reuse_key is set, a new one otherwise.
+type RenewalParameters struct {
+	RenewBeforeDays FlexInt  `json:"renew_before_days"`
+	ReuseKey        FlexBool `json:"reuse_key"`
+}
+
+// KeyProtection parameters from JSON config: x509_key_protection_parameters (optional)
+// With encrypt_keys, the Root and intermediate CA private keys are saved as encrypted PKCS#8
+// (PBES2 with PBKDF2 and AES-256-CBC). The TLS server keys stay in clear: Vault, Kong and
+// vaultworker read them as is. The vaultworker PKI engine decrypts the CA key with its
+// cakeypasswordfile or cakeypasswordenv, which must hold the same password. With pkcs12, the private key, certificate and chain of every TLS
+// server are also bundled in a <tls_host>.p12 file. The password is read from password_file if set, else from
+// the password_env environment variable (PKCS12_PASSWORD if not set).
+type KeyProtection struct {
+	EncryptKeys  FlexBool `json:"encrypt_keys"`
+	PKCS12       FlexBool `json:"pkcs12"`
+	PasswordFile string   `json:"password_file"`
+	PasswordEnv  string   `json:"password_env"`
+}
+
+// ExternalCA parameters from JSON config: x509_external_ca_parameters (optional)
+// An existing enterprise CA signs the TLS server certificates instead of a Root CA generated by
+// pkisetup. Its certificate and private key are read from cert_file and key_file, PEM or DER, or
+// from the pkcs12_file bundle. The CAs above it, up to the enterprise root, come from the extra
+// certificates of these files and from chain_files. The password of an encrypted key or of the
+// bundle is read from password_file if set, else from the password_env environment variable. The
+// imported CA is saved under the ca_name of x509_root_ca_parameters; a key encrypted at its source
+// requires encrypt_keys of x509_key_protection_parameters, not to be saved in clear.
+type ExternalCA struct {
+	CertFile     string   `json:"cert_file"`
+	KeyFile      string   `json:"key_file"`
+	PKCS12File   string   `json:"pkcs12_file"`
+	ChainFiles   []string `json:"chain_files"`
+	PasswordFile string   `json:"password_file"`
+	PasswordEnv  string   `json:"password_env"`
 }
 
 // TLSServer parameters from JSON config: x509_tls_server_parameters
+// tls_host names the key and certificate files. The certificate is issued for the explicit
+// dns_names, ip_addresses, uris and email_addresses, or for the names derived from tls_host and
+// tls_domain when dns_names is not set. tls_cn is optional.
 type TLSServer struct {
-	TLSHost     string `json:"tls_host"`
-	TLSDomain   string `json:"tls_domain"`
-	TLSCountry  string `json:"tls_c"`
-	TLSSate     string `json:"tls_st"`
-	TLSLocality string `json:"tls_l"`
-	TLSOrg      string `json:"tls_o"`
+	TLSHost        string   `json:"tls_host"`
+	TLSDomain      string   `json:"tls_domain"`
+	TLSCommonName  string   `json:"tls_cn"`
+	TLSCountry     string   `json:"tls_c"`
+	TLSSate        string   `json:"tls_st"`
+	TLSLocality    string   `json:"tls_l"`
+	TLSOrg         string   `json:"tls_o"`
+	DNSNames       []string `json:"dns_names"`
+	IPAddresses    []string `json:"ip_addresses"`
+	URIs           []string `json:"uris"`
+	EmailAddresses []string `json:"email_addresses"`
+
+	// Optional per server settings, the global key_scheme and a 10 years validity otherwise. The
+	// certificate never outlives its CA.
+	KeyScheme    *KeyScheme `json:"key_scheme"`
+	ValidityDays FlexInt    `json:"validity_days"`
+	Validity     string     `json:"validity"`
+	NotAfter     string     `json:"not_after"`
+
+	// Certificate profile, "server" if empty. Client certificates identify the service_name by
+	// their common name and, with a trust_domain, by a SPIFFE ID URI.
+	Profile     string `json:"profile"`
+	ServiceName string `json:"service_name"`
+	TrustDomain string `json:"trust_domain"`
+}
+
+// TLSServerList holds the x509_tls_server_parameters: a single server object, or an array of
+// them to issue every server certificate from one run
+type TLSServerList []TLSServer
+
+// UnmarshalJSON accepts a single TLS server object or an array of them
+func (l *TLSServerList) UnmarshalJSON(data []byte) error {
+	if bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		var servers []TLSServer
+		if err := json.Unmarshal(data, &servers); err != nil {
+			return err
+		}
+		*l = servers
+		return nil
+	}
+	var server TLSServer
+	if err := json.Unmarshal(data, &server); err != nil {
+		return err
+	}
+	*l = TLSServerList{server}
+	return nil
+}
+
+// path locates the i-th server in the configuration; a single server keeps the object path
+func (l TLSServerList) path(i int) string {
+	if len(l) == 1 {
+		return "x509_tls_server_parameters"
+	}
+	return fmt.Sprintf("x509_tls_server_parameters[%d]", i)
 }
 
 // X509Config JSON config file main structure
 type X509Config struct {
-	CreateNewRootCA string    `json:"create_new_rootca"`
-	WorkingDir      string    `json:"working_dir"`
-	PKISetupDir     string    `json:"pki_setup_dir"`
-	DumpConfig      string    `json:"dump_config"`
-	KeyScheme       KeyScheme `json:"key_scheme"`
-	RootCA          RootCA    `json:"x509_root_ca_parameters"`
-	TLSServer       TLSServer `json:"x509_tls_server_parameters"`
+	CreateNewRootCA FlexBool           `json:"create_new_rootca"`
+	WorkingDir      string             `json:"working_dir"`
+	PKISetupDir     string             `json:"pki_setup_dir"`
+	DumpConfig      FlexBool           `json:"dump_config"`
+	Backdate        string             `json:"not_before_backdate"` // e.g. "5m", for the clients whose clock is late
+	AllowCap        FlexBool           `json:"allow_validity_cap"`  // shorten a validity that outlives its issuer
+	KeyScheme       KeyScheme          `json:"key_scheme"`
+	RootCA          RootCA             `json:"x509_root_ca_parameters"`
+	IntermediateCA  *IntermediateCA    `json:"x509_intermediate_ca_parameters"`
+	CRL             *CRLParameters     `json:"x509_crl_parameters"`
+	OCSP            *OCSPParameters    `json:"x509_ocsp_parameters"`
+	CSRPolicy       *CSRPolicy         `json:"x509_csr_policy"`
+	Renewal         *RenewalParameters `json:"x509_renewal_parameters"`
+	KeyProtection   *KeyProtection     `json:"x509_key_protection_parameters"`
+	ExternalCA      *ExternalCA        `json:"x509_external_ca_parameters"`
+	TLSServers      TLSServerList      `json:"x509_tls_server_parameters"`
 }
 
-/*ReadConfig load the configuration from filesystem and return X509Config struct*/
-func ReadConfig(configFilePtr *string) (X509Config, error) {
+// Defaults applied to the settings missing from the JSON configuration
+const (
+	defaultWorkingDir  = "."
+	defaultPKISetupDir = "pki"
+	defaultRSAKeySize  = 4096
+	defaultECCurve     = "384"
+	defaultValidity    = 3650 // days
+	defaultCAValidity  = 1825 // days, intermediate CA
+	defaultCRLUpdate   = 7    // days
+	defaultOCSPUpdate  = 24   // hours
+	defaultOCSPSigner  = 365  // days, delegated OCSP signing certificates
+	defaultOCSPListen  = ":8888"
+	defaultCSRValidity = 365 // days, certificates issued by the sign command
+	defaultRenewBefore = 30  // days
+	defaultPasswordEnv = "PKCS12_PASSWORD"
+)
 
-	var jsonX509Config X509Config
+var (
+	keyAlgorithms     = []string{"rsa-2048", "rsa-3072", "rsa-4096", "ecdsa-p256", "ecdsa-p384", "ecdsa-p521", "ed25519"}
+	weakKeyAlgorithms = []string{"rsa-1024", "ecdsa-p224"} // below the minimum strength
+)
 
-	// Open JSON config file
-	jsonFile, err := os.Open(*configFilePtr)
-	if err != nil {
-		return jsonX509Config, err
+// checkSchema verifies every JSON value against the type of its field in the configuration
+// structure (booleans and integers accept their legacy string form) and reports unknown keys
+func checkSchema(path string, raw json.RawMessage, t reflect.Type, errs *ConfigErrors) {
+	switch t {
+	case reflect.TypeOf(FlexBool(false)):
+		if _, err := parseFlexBool(raw); err != nil {
+			errs.add(path, "%s", err.Error())
+		}
+		return
+	case reflect.TypeOf(FlexInt(0)):
+		if _, err := parseFlexInt(raw); err != nil {
+			errs.add(path, "%s", err.Error())
+		}
+		return
+	case reflect.TypeOf(TLSServerList{}):
+		if !bytes.HasPrefix(bytes.TrimSpace(raw), []byte("[")) {
+			checkSchema(path, raw, t.Elem(), errs)
+			return
+		}
 	}
 
-	// Read JSON config file into byteArray
-	byteValue, err := ioutil.ReadAll(jsonFile)
-	if err != nil {
-		return jsonX509Config, err
+	switch t.Kind() {
+	case reflect.Ptr:
+		checkSchema(path, raw, t.Elem(), errs)
+	case reflect.String:
+		var s string
+		if json.Unmarshal(raw, &s) != nil {
+			errs.add(path, "expected a string, got %s", string(raw))
+		}
+	case reflect.Slice:
+		var items []json.RawMessage
+		if json.Unmarshal(raw, &items) != nil {
+			errs.add(path, "expected an array, got %s", string(raw))
+			return
+		}
+		for i, item := range items {
+			checkSchema(fmt.Sprintf("%s[%d]", path, i), item, t.Elem(), errs)
+		}
+	case reflect.Struct:
+		var obj map[string]json.RawMessage
+		if json.Unmarshal(raw, &obj) != nil || obj == nil {
+			errs.add(path, "expected an object, got %s", string(raw))
+			return
+		}
+		fields := map[string]reflect.Type{}
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			fields[name] = t.Field(i).Type
+		}
+		keys := make([]string, 0, len(obj))
+		for key := range obj {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			fieldPath := key
+			if path != "" {
+				fieldPath = path + "." + key
+			}
+			ft, ok := fields[key]
+			if !ok {
+				errs.add(fieldPath, "unknown setting")
+				continue
+			}
+			checkSchema(fieldPath, obj[key], ft, errs)
+		}
 	}
+}
 
-	// Initialize the final X509 Configuration array
-	// Unmarshal byteArray with the jsonFile's content into jsonX509Config
-	json.Unmarshal(byteValue, &jsonX509Config)
-	if err != nil {
-		return jsonX509Config, err
+// jsonHasKey tells whether a dotted path is set in a JSON document
+func jsonHasKey(raw []byte, path string) bool {
+	var obj map[string]json.RawMessage
+	for _, key := range strings.Split(path, ".") {
+		if json.Unmarshal(raw, &obj) != nil {
+			return false
+		}
+		var ok bool
+		if raw, ok = obj[key]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// applyDefaults fills the settings missing from the JSON document. Without any key scheme, EC
+// with the P-384 curve is used.
+func (c *X509Config) applyDefaults(raw []byte) {
+	if c.WorkingDir == "" {
+		c.WorkingDir = defaultWorkingDir
+	}
+	if c.PKISetupDir == "" {
+		c.PKISetupDir = defaultPKISetupDir
+	}
+	if !jsonHasKey(raw, "key_scheme.key_algorithm") && !jsonHasKey(raw, "key_scheme.rsa") && !jsonHasKey(raw, "key_scheme.ec") {
+		c.KeyScheme.EC = true
+	}
+	if c.KeyScheme.RSAKeySize == 0 {
+		c.KeyScheme.RSAKeySize = defaultRSAKeySize
+	}
+	if c.KeyScheme.ECCurve == "" {
+		c.KeyScheme.ECCurve = defaultECCurve
+	}
+	for i := range c.TLSServers {
+		s := &c.TLSServers[i]
+		if s.KeyScheme != nil {
+			s.KeyScheme.inherit(c.KeyScheme)
+		}
+	}
+}
+
+// inherit completes a server key scheme with the global one: the scheme itself when the server
+// sets neither key_algorithm, rsa nor ec, the RSA key size or EC curve when not set, dump_keys
+// and allow_weak_keys
+func (ks *KeyScheme) inherit(global KeyScheme) {
+	ks.DumpKeys = ks.DumpKeys || global.DumpKeys
+	ks.AllowWeakKeys = ks.AllowWeakKeys || global.AllowWeakKeys
+	if ks.KeyAlgorithm == "" && !ks.RSA && !ks.EC {
+		ks.KeyAlgorithm, ks.RSA, ks.EC = global.KeyAlgorithm, global.RSA, global.EC
+	}
+	if ks.RSAKeySize == 0 {
+		ks.RSAKeySize = global.RSAKeySize
+	}
+	if ks.ECCurve == "" {
+		ks.ECCurve = global.ECCurve
+	}
+}
+
+// keyScheme returns the key scheme a server key is generated with
+func (c *X509Config) keyScheme(s TLSServer) KeyScheme {
+	if s.KeyScheme != nil {
+		return *s.KeyScheme
+	}
+	return c.KeyScheme
+}
+
+// Validate reports every inconsistent setting of the configuration with its JSON path
+func (c *X509Config) Validate() error {
+	errs := ConfigErrors{}
+	c.KeyScheme.validate("key_scheme", &errs)
+	if c.RootCA.CAName == "" {
+		errs.add("x509_root_ca_parameters.ca_name", "is required")
+	} else if strings.ContainsAny(c.RootCA.CAName, `/\`) {
+		errs.add("x509_root_ca_parameters.ca_name", "must not contain a path separator")
+	}
+	if c.RootCA.ValidityDays < 0 {
+		errs.add("x509_root_ca_parameters.validity_days", "must be positive")
+	}
+	validateValidity("x509_root_ca_parameters", c.RootCA.ValidityDays, c.RootCA.Validity, c.RootCA.NotAfter, &errs)
+	if c.Backdate != "" {
+		if d, err := parseDuration(c.Backdate); err != nil || d < 0 {
+			errs.add("not_before_backdate", "%q is not a positive duration such as \"5m\"", c.Backdate)
+		}
+	}
+	if len(c.TLSServers) == 0 {
+		errs.add("x509_tls_server_parameters", "is required")
+	}
+	hosts := map[string]bool{}
+	for i, s := range c.TLSServers {
+		path := c.TLSServers.path(i)
+		switch {
+		case s.TLSHost == "":
+			errs.add(path+".tls_host", "is required")
+		case strings.ContainsAny(s.TLSHost, `/\`):
+			errs.add(path+".tls_host", "must not contain a path separator")
+		case s.TLSHost == c.RootCA.CAName || hosts[s.TLSHost]:
+			errs.add(path+".tls_host", "%q is already used, the key and certificate files would be overwritten", s.TLSHost)
+		}
+		hosts[s.TLSHost] = true
+		if s.KeyScheme != nil {
+			s.KeyScheme.validate(path+".key_scheme", &errs)
+		}
+		if s.ValidityDays < 0 {
+			errs.add(path+".validity_days", "must be positive")
+		}
+		validateValidity(path, s.ValidityDays, s.Validity, s.NotAfter, &errs)
+		s.validateProfile(path, &errs)
+		s.validateNames(path, &errs)
+		if c.IntermediateCA != nil {
+			c.IntermediateCA.checkNames(path, s.names(), &errs)
+		}
+	}
+	if c.IntermediateCA != nil {
+		c.IntermediateCA.validate(c.RootCA.CAName, hosts, &errs)
+	}
+	if c.CRL != nil {
+		if c.CRL.NextUpdateDays < 0 {
+			errs.add("x509_crl_parameters.next_update_days", "must be positive")
+		}
+		for i, dp := range c.CRL.DistributionPoints {
+			if err := checkURI(strings.Replace(dp, "{ca}", "ca", -1)); err != nil {
+				errs.add(fmt.Sprintf("x509_crl_parameters.distribution_points[%d]", i), "%s", err.Error())
+			}
+		}
+	}
+	if c.OCSP != nil {
+		c.OCSP.validate(c, hosts, &errs)
+	}
+	if c.CSRPolicy != nil {
+		c.CSRPolicy.validate(bool(c.KeyScheme.AllowWeakKeys), &errs)
+	}
+	if c.Renewal != nil && c.Renewal.RenewBeforeDays < 0 {
+		errs.add("x509_renewal_parameters.renew_before_days", "must be positive")
+	}
+	if c.KeyProtection != nil {
+		c.KeyProtection.validate(&errs)
 	}
+	if c.ExternalCA != nil {
+		c.ExternalCA.validate(c.IntermediateCA != nil, &errs)
+		if c.ExternalCA.encrypted() && (c.KeyProtection == nil || !bool(c.KeyProtection.EncryptKeys)) {
+			errs.add("x509_key_protection_parameters.encrypt_keys", "is required to import the encrypted key of x509_external_ca_parameters, it would be saved in clear")
+		}
+	}
+	return errs.orNil()
+}
+
+// algorithm returns the key algorithm of the scheme, e.g. ecdsa-p384, from key_algorithm or
+// else from the legacy rsa and ec settings
+func (ks KeyScheme) algorithm() string {
+	switch {
+	case ks.KeyAlgorithm != "":
+		return ks.KeyAlgorithm
+	case bool(ks.RSA):
+		return fmt.Sprintf("rsa-%d", ks.RSAKeySize)
+	case bool(ks.EC):
+		return "ecdsa-p" + ks.ECCurve
+	}
+	return ""
+}
+
+// validate reports an ambiguous key scheme, or an unsupported or weak key algorithm, under path
+func (ks KeyScheme) validate(path string, errs *ConfigErrors) {
+	rsa, ec := bool(ks.RSA), bool(ks.EC)
+	field := path + ".key_algorithm"
+	switch {
+	case ks.KeyAlgorithm != "" && (rsa || ec):
+		errs.add(field, "conflicts with rsa and ec, set either key_algorithm or the legacy key scheme")
+		return
+	case ks.KeyAlgorithm != "":
+	case rsa && ec:
+		errs.add(path, "rsa and ec are both enabled, choose one key scheme")
+		return
+	case rsa:
+		field = path + ".rsa_key_size"
+	case ec:
+		field = path + ".ec_curve"
+	default:
+		errs.add(path, "neither key_algorithm, rsa nor ec is set, choose one key scheme")
+		return
+	}
+	checkKeyAlgorithm(field, ks.algorithm(), bool(ks.AllowWeakKeys), errs)
+}
 
-	// Close JSON config file
-	if err = jsonFile.Close(); err != nil {
-		return jsonX509Config, err
+// checkKeyAlgorithm reports under path an unsupported key algorithm, or a weak one unless allowed
+func checkKeyAlgorithm(path string, algorithm string, allowWeak bool, errs *ConfigErrors) {
+	switch {
+	case containsString(keyAlgorithms, algorithm):
+	case containsString(weakKeyAlgorithms, algorithm):
+		if !allowWeak {
+			errs.add(path, "%s is below the minimum key strength, set allow_weak_keys to use it anyway", algorithm)
+		}
+	default:
+		errs.add(path, "unsupported key algorithm %q, expected one of %v", algorithm, keyAlgorithms)
+	}
+}
+
+func containsString(list []string, v string) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseConfig decodes a JSON configuration, checking every setting, applying the defaults and
+// validating the result. All the problems found are returned at once as ConfigErrors.
+func ParseConfig(data []byte) (X509Config, error) {
+	var x509config X509Config
+
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return x509config, fmt.Errorf("invalid JSON: %s", err.Error())
+	}
+	errs := ConfigErrors{}
+	checkSchema("", data, reflect.TypeOf(x509config), &errs)
+	if len(errs) > 0 {
+		return x509config, errs
 	}
+	if err := json.Unmarshal(data, &x509config); err != nil {
+		return x509config, err
+	}
+	x509config.applyDefaults(data)
+	return x509config, x509config.Validate()
+}
 
-	return jsonX509Config, nil
+/*ReadConfig load the configuration from filesystem and return X509Config struct*/
+func ReadConfig(configFilePtr *string) (X509Config, error) {
+	byteValue, err := ioutil.ReadFile(*configFilePtr)
+	if err != nil {
+		return X509Config{}, err
+	}
+	x509config, err := ParseConfig(byteValue)
+	if err != nil {
+		return x509config, fmt.Errorf("%s: %w", *configFilePtr, err)
+	}
+	return x509config, nil
 }
 
 func dumpJSONConfig(x509config *X509Config) error {
 
-	log.Println("")
-	log.Println("Configuration Parameters:")
-	log.Println("- create_new_rootca: " + x509config.CreateNewRootCA)
-	log.Println("- working_dir      : " + x509config.WorkingDir)
-	log.Println("- pki_setup_dir    : " + x509config.PKISetupDir)
-	log.Println("- dump_config      : " + x509config.DumpConfig)
-	log.Println("Key Schemes Parameters:")
-	log.Println("- dump_keys        : " + x509config.KeyScheme.DumpKeys)
-	log.Println("- rsa              : " + x509config.KeyScheme.RSA)
-	log.Println("- rsa_key_size     : " + x509config.KeyScheme.RSAKeySize)
-	log.Println("- ec               : " + x509config.KeyScheme.EC)
-	log.Println("- ec_curve         : " + x509config.KeyScheme.ECCurve)
-	log.Println("Root CA Parameters:")
-	log.Println("- ca_name          : " + x509config.RootCA.CAName)
-	log.Println("- ca_c             : " + x509config.RootCA.CACountry)
-	log.Println("- ca_st            : " + x509config.RootCA.CAState)
-	log.Println("- ca_l             : " + x509config.RootCA.CALocality)
-	log.Println("- ca_o             : " + x509config.RootCA.CAOrg)
-	log.Println("TLS Server Parameters:")
-	log.Println("- tls_host         : " + x509config.TLSServer.TLSHost)
-	log.Println("- tls_domain       : " + x509config.TLSServer.TLSDomain)
-	log.Println("- tls_c            : " + x509config.TLSServer.TLSCountry)
-	log.Println("- tls_st           : " + x509config.TLSServer.TLSSate)
-	log.Println("- tls_l            : " + x509config.TLSServer.TLSLocality)
-	log.Println("- tls_o            : " + x509config.TLSServer.TLSOrg)
+	lg.Println("")
+	lg.Println("Configuration Parameters:")
+	lg.Printf("- create_new_rootca: %t", x509config.CreateNewRootCA)
+	lg.Println("- working_dir      : " + x509config.WorkingDir)
+	lg.Println("- pki_setup_dir    : " + x509config.PKISetupDir)
+	lg.Printf("- dump_config      : %t", x509config.DumpConfig)
+	lg.Println("- not_before_backdate: " + x509config.Backdate)
+	lg.Printf("- allow_validity_cap: %t", x509config.AllowCap)
+	lg.Println("Key Schemes Parameters:")
+	lg.Printf("- dump_keys        : %t", x509config.KeyScheme.DumpKeys)
+	lg.Println("- key_algorithm    : " + x509config.KeyScheme.KeyAlgorithm)
+	lg.Printf("- allow_weak_keys  : %t", x509config.KeyScheme.AllowWeakKeys)
+	lg.Printf("- rsa              : %t", x509config.KeyScheme.RSA)
+	lg.Printf("- rsa_key_size     : %d", x509config.KeyScheme.RSAKeySize)
+	lg.Printf("- ec               : %t", x509config.KeyScheme.EC)
+	lg.Println("- ec_curve         : " + x509config.KeyScheme.ECCurve)
+	lg.Println("Root CA Parameters:")
+	lg.Println("- ca_name          : " + x509config.RootCA.CAName)
+	lg.Println("- ca_c             : " + x509config.RootCA.CACountry)
+	lg.Println("- ca_st            : " + x509config.RootCA.CAState)
+	lg.Println("- ca_l             : " + x509config.RootCA.CALocality)
+	lg.Println("- ca_o             : " + x509config.RootCA.CAOrg)
+	lg.Printf("- validity         : %s", validityName(x509config.RootCA.ValidityDays, x509config.RootCA.Validity, x509config.RootCA.NotAfter))
+	if ica := x509config.IntermediateCA; ica != nil {
+		lg.Println("Intermediate CA Parameters:")
+		lg.Println("- ca_name          : " + ica.CAName)
+		lg.Println("- ca_c             : " + ica.CACountry)
+		lg.Println("- ca_st            : " + ica.CAState)
+		lg.Println("- ca_l             : " + ica.CALocality)
+		lg.Println("- ca_o             : " + ica.CAOrg)
+		lg.Printf("- path_len         : %d", ica.PathLen)
+		lg.Printf("- validity         : %s", validityName(ica.ValidityDays, ica.Validity, ica.NotAfter))
+		lg.Printf("- permitted_dns    : %v", ica.PermittedDNSDomains)
+		lg.Printf("- excluded_dns     : %v", ica.ExcludedDNSDomains)
+		lg.Printf("- permitted_ips    : %v", ica.PermittedIPRanges)
+		lg.Printf("- excluded_ips     : %v", ica.ExcludedIPRanges)
+	}
+	if crl := x509config.CRL; crl != nil {
+		lg.Println("CRL Parameters:")
+		lg.Printf("- next_update_days : %d", crl.NextUpdateDays)
+		lg.Printf("- distribution_pts : %v", crl.DistributionPoints)
+	}
+	if ocsp := x509config.OCSP; ocsp != nil {
+		lg.Println("OCSP Parameters:")
+		lg.Printf("- responder_urls   : %v", ocsp.ResponderURLs)
+		lg.Println("- listen_address   : " + ocsp.ListenAddress)
+		lg.Printf("- next_update_hours: %d", ocsp.NextUpdateHours)
+		lg.Printf("- delegated_signer : %t", ocsp.DelegatedSigner)
+		lg.Printf("- signer_validity  : %d", ocsp.SignerValidityDays)
+	}
+	if policy := x509config.CSRPolicy; policy != nil {
+		lg.Println("CSR Policy:")
+		lg.Printf("- allowed_domains  : %v", policy.AllowedDomains)
+		lg.Printf("- allow_bare_hosts : %t", policy.AllowBareHosts)
+		lg.Printf("- allowed_ips      : %v", policy.AllowedIPRanges)
+		lg.Printf("- allowed_uris     : %v", policy.AllowedURIPrefixes)
+		lg.Printf("- key_types        : %v", policy.KeyTypes)
+		lg.Printf("- profiles         : %v", policy.Profiles)
+		lg.Printf("- max_validity_days: %d", policy.MaxValidityDays)
+	}
+	if renewal := x509config.Renewal; renewal != nil {
+		lg.Println("Renewal Parameters:")
+		lg.Printf("- renew_before_days: %d", renewal.RenewBeforeDays)
+		lg.Printf("- reuse_key        : %t", renewal.ReuseKey)
+	}
+	if kp := x509config.KeyProtection; kp != nil {
+		lg.Println("Key Protection Parameters:")
+		lg.Printf("- encrypt_keys     : %t", kp.EncryptKeys)
+		lg.Printf("- pkcs12           : %t", kp.PKCS12)
+		lg.Println("- password_file    : " + kp.PasswordFile)
+		lg.Println("- password_env     : " + kp.PasswordEnv)
+	}
+	if eca := x509config.ExternalCA; eca != nil {
+		lg.Println("External CA Parameters:")
+		lg.Println("- cert_file        : " + eca.CertFile)
+		lg.Println("- key_file         : " + eca.KeyFile)
+		lg.Println("- pkcs12_file      : " + eca.PKCS12File)
+		lg.Printf("- chain_files      : %v", eca.ChainFiles)
+		lg.Println("- password_file    : " + eca.PasswordFile)
+		lg.Println("- password_env     : " + eca.PasswordEnv)
+	}
+	for i, s := range x509config.TLSServers {
+		lg.Printf("TLS Server Parameters (%d/%d):", i+1, len(x509config.TLSServers))
+		lg.Println("- tls_host         : " + s.TLSHost)
+		lg.Println("- tls_domain       : " + s.TLSDomain)
+		lg.Println("- tls_cn           : " + s.TLSCommonName)
+		lg.Println("- tls_c            : " + s.TLSCountry)
+		lg.Println("- tls_st           : " + s.TLSSate)
+		lg.Println("- tls_l            : " + s.TLSLocality)
+		lg.Println("- tls_o            : " + s.TLSOrg)
+		lg.Printf("- dns_names        : %v", s.DNSNames)
+		lg.Printf("- ip_addresses     : %v", s.IPAddresses)
+		lg.Printf("- uris             : %v", s.URIs)
+		lg.Printf("- email_addresses  : %v", s.EmailAddresses)
+		ks := x509config.keyScheme(s)
+		lg.Println("- key_algorithm    : " + ks.algorithm())
+		lg.Printf("- validity         : %s", validityName(s.ValidityDays, s.Validity, s.NotAfter))
+		lg.Println("- profile          : " + profileName(s.Profile))
+		lg.Println("- service_name     : " + s.ServiceName)
+		lg.Println("- trust_domain     : " + s.TrustDomain)
+	}
 
 	return nil
 }
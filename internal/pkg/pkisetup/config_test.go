@@ -0,0 +1,146 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"errors"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+const legacyConfig = `{
+    "create_new_rootca": "true",
+    "working_dir": "./config",
+    "pki_setup_dir": "pki",
+    "dump_config": "false",
+    "key_scheme": {
+        "dump_keys": "false",
+        "rsa": "false",
+        "rsa_key_size": "4096",
+        "ec": "true",
+        "ec_curve": "384"
+    },
+    "x509_root_ca_parameters": {"ca_name": "EdgeXFoundryCA", "ca_c": "US"},
+    "x509_tls_server_parameters": {"tls_host": "edgex-kong", "tls_domain": "local"}
+}`
+
+const typedConfig = `{
+    "create_new_rootca": true,
+    "key_scheme": {"rsa": true, "rsa_key_size": 3072},
+    "x509_root_ca_parameters": {"ca_name": "EdgeXFoundryCA"},
+    "x509_tls_server_parameters": {"tls_host": "edgex-kong", "tls_domain": "local"}
+}`
+
+func TestParseConfigLegacyStrings(t *testing.T) {
+	config, err := ParseConfig([]byte(legacyConfig))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !config.CreateNewRootCA || config.DumpConfig || config.KeyScheme.RSA || !config.KeyScheme.EC || config.KeyScheme.RSAKeySize != 4096 {
+		t.Errorf("Legacy string values not decoded: %+v", config)
+	}
+}
+
+func TestParseConfigTypedWithDefaults(t *testing.T) {
+	config, err := ParseConfig([]byte(typedConfig))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !config.KeyScheme.RSA || config.KeyScheme.EC || config.KeyScheme.RSAKeySize != 3072 {
+		t.Errorf("Unexpected key scheme: %+v", config.KeyScheme)
+	}
+	if config.WorkingDir != defaultWorkingDir || config.PKISetupDir != defaultPKISetupDir || config.KeyScheme.ECCurve != defaultECCurve {
+		t.Errorf("Defaults not applied: %+v", config)
+	}
+
+	// Without any key scheme, EC is used
+	config, err = ParseConfig([]byte(`{"x509_root_ca_parameters": {"ca_name": "CA"}, "x509_tls_server_parameters": {"tls_host": "h", "tls_domain": "local"}}`))
+	if err != nil || !config.KeyScheme.EC || config.KeyScheme.RSA {
+		t.Errorf("Expected the EC default key scheme, got %+v (%v)", config.KeyScheme, err)
+	}
+}
+
+func errorPaths(t *testing.T, err error) []string {
+	var errs ConfigErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("Expected ConfigErrors, got %v", err)
+	}
+	var paths []string
+	for _, e := range errs {
+		paths = append(paths, e.Path)
+	}
+	sort.Strings(paths)
+	return paths
+}
+
+func TestParseConfigReportsEveryError(t *testing.T) {
+	_, err := ParseConfig([]byte(`{
+        "create_new_rootca": "ture",
+        "dump_confg": true,
+        "key_scheme": {"rsa_key_size": "4k", "ec": 1},
+        "x509_root_ca_parameters": []
+    }`))
+	expected := []string{"create_new_rootca", "dump_confg", "key_scheme.ec", "key_scheme.rsa_key_size", "x509_root_ca_parameters"}
+	if paths := errorPaths(t, err); len(paths) != len(expected) {
+		t.Fatalf("Expected errors at %v, got %v", expected, paths)
+	} else {
+		for i := range expected {
+			if paths[i] != expected[i] {
+				t.Errorf("Expected errors at %v, got %v", expected, paths)
+				break
+			}
+		}
+	}
+}
+
+func TestParseConfigValidation(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected []string
+	}{
+		{"both schemes", `{"key_scheme": {"rsa": true, "ec": true}}`, []string{"key_scheme"}},
+		{"no scheme", `{"key_scheme": {"rsa": false, "ec": false}}`, []string{"key_scheme"}},
+		{"rsa size", `{"key_scheme": {"rsa": true, "ec": false, "rsa_key_size": 1024}}`, []string{"key_scheme.rsa_key_size"}},
+		{"ec curve", `{"key_scheme": {"ec": true, "ec_curve": "P-999"}}`, []string{"key_scheme.ec_curve"}},
+	}
+	for _, tt := range tests {
+		config := tt.config[:len(tt.config)-1] + `, "x509_root_ca_parameters": {"ca_name": "CA"}, "x509_tls_server_parameters": {"tls_host": "h", "tls_domain": "local"}}`
+		_, err := ParseConfig([]byte(config))
+		paths := errorPaths(t, err)
+		if len(paths) != len(tt.expected) || paths[0] != tt.expected[0] {
+			t.Errorf("%s: expected errors at %v, got %v", tt.name, tt.expected, paths)
+		}
+	}
+
+	_, err := ParseConfig([]byte(`{}`))
+	if paths := errorPaths(t, err); len(paths) != 2 {
+		t.Errorf("Expected the CA name and TLS servers to be required, got %v", paths)
+	}
+}
+
+func TestReadConfigShippedFiles(t *testing.T) {
+	for _, f := range []string{"pkisetup.json"} {
+		path := filepath.Join("..", "..", "..", "configs", f)
+		if _, err := ReadConfig(&path); err != nil {
+			t.Errorf("%s: %s", f, err.Error())
+		}
+	}
+}
@@ -21,7 +21,21 @@
 package pkisetup
 
 const (
-	CmdUsageMsg = "Usage of ./pkisetup:"
+	CmdUsageMsg = "Usage of ./pkisetup: [command] [flags]\n" +
+		"  (no command) --config file.json                     set up the Root CA and the TLS server certificates\n" +
+		"  revoke       --config file.json [--reason reason] <serial|certificate file>\n" +
+		"                                                      revoke a certificate and re-sign the CRL of its issuer\n" +
+		"  crl          --config file.json                     re-sign the CRL of every CA\n" +
+		"  ocsp-serve   --config file.json [--listen address]  run the OCSP responder\n" +
+		"  csr          --config file.json --host tls_host [--out directory]\n" +
+		"                                                      generate the key and certificate request of a TLS server\n" +
+		"  sign         --config file.json --csr file.csr [--profile profile] [--days days] [--out file.pem]\n" +
+		"                                                      issue a certificate for a request, within x509_csr_policy\n" +
+		"  renew        --config file.json [--host tls_host]   re-issue the certificates expiring soon\n" +
+		"  inspect      [--json] <file|directory>              describe the PEM files, without configuration\n" +
+		"  verify       --config file.json [--host tls_host] [--json]\n" +
+		"                                                      verify the chains, keys, revocations and expiries\n" +
+		"Flags:"
 	skFileExt   = ".priv.key"
 	certFileExt = ".pem"
 )
@@ -0,0 +1,339 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+const csrFileExt = ".csr"
+
+/* csrPolicyParams holds the policy applied by the sign command */
+type csrPolicyParams struct {
+	allowedDomains     []string
+	allowBareHosts     bool
+	allowedIPs         []*net.IPNet
+	allowedURIPrefixes []string
+	keyTypes           []string
+	profiles           []string
+	maxValidityDays    int
+}
+
+func newCSRPolicyParams(policy *CSRPolicy) csrPolicyParams {
+	p := csrPolicyParams{keyTypes: keyAlgorithms, profiles: validProfiles, maxValidityDays: defaultCSRValidity}
+	if policy == nil {
+		return p
+	}
+	p.allowedDomains = policy.AllowedDomains
+	p.allowBareHosts = bool(policy.AllowBareHosts)
+	p.allowedIPs = parseIPRanges(policy.AllowedIPRanges)
+	p.allowedURIPrefixes = policy.AllowedURIPrefixes
+	if len(policy.KeyTypes) > 0 {
+		p.keyTypes = policy.KeyTypes
+	}
+	if len(policy.Profiles) > 0 {
+		p.profiles = policy.Profiles
+	}
+	if policy.MaxValidityDays > 0 {
+		p.maxValidityDays = int(policy.MaxValidityDays)
+	}
+	return p
+}
+
+// validate reports the malformed settings of the CSR policy. Weak key types are only allowed
+// along with weak keys in the key scheme.
+func (p CSRPolicy) validate(allowWeak bool, errs *ConfigErrors) {
+	const path = "x509_csr_policy"
+	for i, domain := range p.AllowedDomains {
+		if strings.Contains(domain, "*") || checkDNSName(strings.TrimPrefix(domain, ".")) != nil {
+			errs.add(fmt.Sprintf("%s.allowed_domains[%d]", path, i), "%q is not a DNS domain", domain)
+		}
+	}
+	for i, cidr := range p.AllowedIPRanges {
+		if _, _, err := net.ParseCIDR(cidr); err != nil {
+			errs.add(fmt.Sprintf("%s.allowed_ip_ranges[%d]", path, i), "%q is not a CIDR IP range", cidr)
+		}
+	}
+	for i, prefix := range p.AllowedURIPrefixes {
+		if err := checkURI(prefix); err != nil {
+			errs.add(fmt.Sprintf("%s.allowed_uri_prefixes[%d]", path, i), "%s", err.Error())
+		}
+	}
+	for i, kt := range p.KeyTypes {
+		checkKeyAlgorithm(fmt.Sprintf("%s.key_types[%d]", path, i), kt, allowWeak, errs)
+	}
+	for i, profile := range p.Profiles {
+		if !containsString(validProfiles, profile) {
+			errs.add(fmt.Sprintf("%s.profiles[%d]", path, i), "unknown profile %q, expected one of %v", profile, validProfiles)
+		}
+	}
+	if p.MaxValidityDays < 0 {
+		errs.add(path+".max_validity_days", "must be positive")
+	}
+}
+
+// check returns the reasons the policy denies a certificate for the names and key of a CSR
+func (p csrPolicyParams) check(csr *x509.CertificateRequest, profile string, validityDays int) []string {
+	var denied []string
+	if !containsString(p.profiles, profile) {
+		denied = append(denied, fmt.Sprintf("profile %q is not allowed", profile))
+	}
+	if kt := keyAlgorithm(csr.PublicKey); !containsString(p.keyTypes, kt) {
+		denied = append(denied, fmt.Sprintf("key type %q is not allowed", kt))
+	}
+	if validityDays > p.maxValidityDays {
+		denied = append(denied, fmt.Sprintf("validity of %d days exceeds %d days", validityDays, p.maxValidityDays))
+	}
+	if len(csr.DNSNames)+len(csr.IPAddresses)+len(csr.URIs)+len(csr.EmailAddresses) == 0 && !clientProfile(profile) {
+		denied = append(denied, "no subject alternative name")
+	}
+
+	// A common name looking like a host name must be allowed as such, others only name the
+	// service of client certificates, also by a single label such as edgex-vaultworker
+	cn := csr.Subject.CommonName
+	switch {
+	case len(cn) > maxCommonNameLength:
+		denied = append(denied, fmt.Sprintf("common name longer than %d characters", maxCommonNameLength))
+	case cn == "" || (clientProfile(profile) && !strings.Contains(cn, ".")):
+	case checkDNSName(cn) != nil:
+		if !clientProfile(profile) {
+			denied = append(denied, fmt.Sprintf("common name %q is not a DNS name", cn))
+		}
+	case !p.nameAllowed(cn):
+		denied = append(denied, fmt.Sprintf("common name %q is %s", cn, p.nameDenial(cn)))
+	}
+
+	for _, name := range csr.DNSNames {
+		if checkDNSName(name) != nil || !p.nameAllowed(name) {
+			denied = append(denied, fmt.Sprintf("DNS name %q is %s", name, p.nameDenial(name)))
+		}
+	}
+	for _, email := range csr.EmailAddresses {
+		at := strings.LastIndex(email, "@")
+		if at < 0 || !p.domainAllowed(email[at+1:]) {
+			denied = append(denied, fmt.Sprintf("email address %q is outside of the allowed domains", email))
+		}
+	}
+	for _, ip := range csr.IPAddresses {
+		if len(p.allowedIPs) == 0 || !ipAllowed(ip, p.allowedIPs, nil) {
+			denied = append(denied, fmt.Sprintf("IP address %s is outside of the allowed ranges", ip))
+		}
+	}
+	for _, uri := range csr.URIs {
+		allowed := false
+		for _, prefix := range p.allowedURIPrefixes {
+			allowed = allowed || uriAllowed(uri.String(), prefix)
+		}
+		if !allowed {
+			denied = append(denied, fmt.Sprintf("URI %q is outside of the allowed prefixes", uri))
+		}
+	}
+	return denied
+}
+
+// domainAllowed tells whether a name is in the allowed domains; none are allowed by default
+func (p csrPolicyParams) domainAllowed(name string) bool {
+	return len(p.allowedDomains) > 0 && domainAllowed(name, p.allowedDomains, nil)
+}
+
+// nameAllowed tells whether a DNS name is allowed: a single label host name with
+// allow_bare_hosts, any other in the allowed domains
+func (p csrPolicyParams) nameAllowed(name string) bool {
+	if bareHost(name) {
+		return p.allowBareHosts
+	}
+	return p.domainAllowed(name)
+}
+
+// nameDenial explains why a DNS name is not allowed
+func (p csrPolicyParams) nameDenial(name string) string {
+	if checkDNSName(name) == nil && bareHost(name) {
+		return "a bare host name, not allowed without allow_bare_hosts"
+	}
+	return "outside of the allowed domains"
+}
+
+func bareHost(name string) bool {
+	return !strings.Contains(strings.TrimSuffix(name, "."), ".")
+}
+
+// uriAllowed tells whether a URI is the prefix or below it on a path boundary, so that the prefix
+// spiffe://edgex/ns allows spiffe://edgex/ns/vault but not spiffe://edgex/ns-other
+func uriAllowed(uri string, prefix string) bool {
+	if !strings.HasPrefix(uri, prefix) {
+		return false
+	}
+	rest := uri[len(prefix):]
+	return rest == "" || strings.HasSuffix(prefix, "/") || rest[0] == '/'
+}
+
+// checkNameConstraints returns the names of a CSR the intermediate CA name constraints forbid
+func (ip *intermediateParams) checkNameConstraints(csr *x509.CertificateRequest) []string {
+	var denied []string
+	for _, name := range csr.DNSNames {
+		if !domainAllowed(name, ip.permittedDNS, ip.excludedDNS) {
+			denied = append(denied, fmt.Sprintf("DNS name %q is outside of the intermediate CA name constraints", name))
+		}
+	}
+	for _, addr := range csr.IPAddresses {
+		if !ipAllowed(addr, ip.permittedIPs, ip.excludedIPs) {
+			denied = append(denied, fmt.Sprintf("IP address %s is outside of the intermediate CA name constraints", addr))
+		}
+	}
+	return denied
+}
+
+// readCSR reads and checks the signature of a PEM certificate signing request
+func readCSR(csrFile string) (*x509.CertificateRequest, error) {
+	data, err := ioutil.ReadFile(csrFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCSRInvalid, csrFile, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || (block.Type != "CERTIFICATE REQUEST" && block.Type != "NEW CERTIFICATE REQUEST") {
+		return nil, fmt.Errorf("%w: %w: %s: expected a CERTIFICATE REQUEST block", ErrCSRInvalid, ErrCertTypeMismatch, csrFile)
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCSRInvalid, csrFile, err)
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCSRInvalid, csrFile, err)
+	}
+	return csr, nil
+}
+
+// SignCSR issues a certificate of a profile for a certificate signing request, from the existing
+// CA files. The requested names, key type and validity must be allowed by the CSR policy; the
+// other extensions of the request are ignored. The certificate is saved to certFile, next to the
+// request if empty.
+func SignCSR(cf *CertConfig, csrFile string, profile string, validityDays int, certFile string) (*x509.Certificate, error) {
+	lg.Println("")
+	lg.Printf("<Phase 2> Signing certificate request %s", csrFile)
+
+	csr, err := readCSR(csrFile)
+	if err != nil {
+		return nil, err
+	}
+	if profile == "" {
+		profile = ProfileServer
+	}
+	validity := days(validityDays)
+	if validityDays == 0 {
+		validityDays = cf.csrPolicy.maxValidityDays
+		validity = days(validityDays)
+	} else {
+		validity.explicit = true
+	}
+	denied := cf.csrPolicy.check(csr, profile, validityDays)
+	if cf.intermediate != nil {
+		denied = append(denied, cf.intermediate.checkNameConstraints(csr)...)
+	}
+	if len(denied) > 0 {
+		return nil, fmt.Errorf("%w: %s: %s", ErrCSRPolicy, csrFile, strings.Join(denied, "; "))
+	}
+
+	caCert, caSK, err := LoadCA(cf)
+	if err != nil {
+		return nil, err
+	}
+	if certFile == "" {
+		certFile = strings.TrimSuffix(csrFile, csrFileExt) + certFileExt
+	}
+	s := serverParams{
+		keyParams:    keyParams{algorithm: keyAlgorithm(csr.PublicKey)},
+		tlsHost:      strings.TrimSuffix(filepath.Base(certFile), certFileExt),
+		tlsNames:     subjectAltNames{commonName: csr.Subject.CommonName, dnsNames: csr.DNSNames, ips: csr.IPAddresses, uris: csr.URIs, emails: csr.EmailAddresses},
+		tlsCertFile:  certFile,
+		tlsChainFile: strings.TrimSuffix(certFile, certFileExt) + chainFileExt,
+		validity:     validity,
+		profile:      profile,
+	}
+	cert, err := cf.signCert(caCert, caSK, s, csr.PublicKey, csr.Subject)
+	if err != nil {
+		return nil, err
+	}
+	lg.Printf("Certificate request %s successfully signed!", csrFile)
+	return cert, nil
+}
+
+// GenCSR generates the private key and certificate signing request of a TLS server of the
+// configuration, with its subject and names, and saves them to PEM files in dir. The CA is not
+// needed: the request is signed later on by the sign command.
+func GenCSR(x509config *X509Config, host string, dir string) (*x509.CertificateRequest, crypto.PrivateKey, error) {
+	if err := x509config.Validate(); err != nil {
+		return nil, nil, err
+	}
+	for _, t := range x509config.TLSServers {
+		if t.TLSHost != host {
+			continue
+		}
+		s := newServerParams(x509config, t, dir)
+		csrFile := filepath.Join(dir, host+csrFileExt)
+
+		lg.Printf("Generating TLS server %s key pair (sk,pk)", host)
+		sk, err := genSK(s.keyParams)
+		if err != nil {
+			return nil, nil, err
+		}
+		if s.dumpKeys {
+			dumpKeyPair(sk, sk.(crypto.Signer).Public())
+		}
+
+		lg.Printf("Generating TLS server %s certificate request", host)
+		template := &x509.CertificateRequest{
+			Subject:        s.subject(),
+			DNSNames:       s.tlsNames.dnsNames,
+			IPAddresses:    s.tlsNames.ips,
+			URIs:           s.tlsNames.uris,
+			EmailAddresses: s.tlsNames.emails,
+
+			SignatureAlgorithm: signatureAlgorithm(sk),
+		}
+		csrDER, err := x509.CreateCertificateRequest(rand.Reader, template, sk)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, csrFile, err)
+		}
+		csr, err := x509.ParseCertificateRequest(csrDER)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, csrFile, err)
+		}
+
+		lg.Printf("Saving TLS server private key to PEM file: %s", s.tlsKeyFile)
+		if err = writePrivateKey(s.tlsKeyFile, sk, 0600); err != nil {
+			return nil, nil, err
+		}
+
+		lg.Printf("Saving TLS server certificate request to PEM file: %s", csrFile)
+		err = ioutil.WriteFile(csrFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: csrDER}), 0644)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%w: %s: %v", ErrWriteFailed, csrFile, err)
+		}
+		return csr, sk, nil
+	}
+	return nil, nil, fmt.Errorf("%w: %s", ErrUnknownServer, host)
+}
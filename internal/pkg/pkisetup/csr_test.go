@@ -0,0 +1,198 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const csrConfig = `{
+    "create_new_rootca": true,
+    "working_dir": "%s",
+    "key_scheme": {"ec": true, "ec_curve": "256"},
+    "x509_root_ca_parameters": {"ca_name": "TestCA"},
+    "x509_csr_policy": {
+        "allowed_domains": ["local"],
+        "allow_bare_hosts": true,
+        "allowed_ip_ranges": ["10.0.0.0/8"],
+        "allowed_uri_prefixes": ["spiffe://edgex/ns"],
+        "key_types": ["ecdsa-p256", "ecdsa-p384"],
+        "profiles": ["server", "client"],
+        "max_validity_days": 90
+    },
+    "x509_tls_server_parameters": [
+        {"tls_host": "edgex-vault", "tls_domain": "local"},
+        {"tls_host": "edgex-redis", "dns_names": ["edgex-redis.local"], "ip_addresses": ["10.0.0.7"], "tls_o": "Redis"}
+    ]
+}`
+
+func writeCSR(t *testing.T, dir string, template *x509.CertificateRequest) string {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, sk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "request.csr")
+	if err = ioutil.WriteFile(file, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestSignCSR(t *testing.T) {
+	cf, ca, _ := newTestCA(t, csrConfig)
+
+	// The service generates its key and request on its own disk, from its own configuration
+	serviceConfig := parseTestConfig(t, csrConfig)
+	serviceDir := t.TempDir()
+	csr, _, err := GenCSR(&serviceConfig, "edgex-redis", serviceDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if csr.Subject.CommonName != "" || csr.DNSNames[0] != "edgex-redis.local" || !csr.IPAddresses[0].Equal(net.ParseIP("10.0.0.7")) {
+		t.Errorf("Unexpected certificate request %v %v %v", csr.Subject, csr.DNSNames, csr.IPAddresses)
+	}
+	if _, err = ioutil.ReadFile(filepath.Join(serviceDir, "edgex-redis"+skFileExt)); err != nil {
+		t.Errorf("Private key not saved: %s", err.Error())
+	}
+
+	csrFile := filepath.Join(serviceDir, "edgex-redis.csr")
+	cert, err := SignCSR(&cf, csrFile, "", 30, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if cert.CheckSignatureFrom(ca) != nil || cert.ExtKeyUsage[0] != x509.ExtKeyUsageServerAuth || cert.Subject.OrganizationalUnit[0] != "Redis" {
+		t.Errorf("Unexpected certificate %v %v", cert.Subject, cert.ExtKeyUsage)
+	}
+	if days := cert.NotAfter.Sub(cert.NotBefore); days != 30*24*time.Hour {
+		t.Errorf("Expected a 30 days validity, got %s", days)
+	}
+	if saved := readCerts(t, filepath.Join(serviceDir, "edgex-redis.pem")); len(saved) != 1 || !saved[0].Equal(cert) {
+		t.Errorf("Certificate not saved next to the request")
+	}
+	index, err := ReadIndex(&cf)
+	if err != nil || len(index.Certificates) != 1 || index.Certificates[0].Serial != serialHex(cert.SerialNumber) {
+		t.Errorf("Certificate not recorded in the issuance index: %v %v", index, err)
+	}
+
+	// A legacy tls_host/tls_domain entry requests its bare host name too
+	if _, _, err = GenCSR(&serviceConfig, "edgex-vault", serviceDir); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	cert, err = SignCSR(&cf, filepath.Join(serviceDir, "edgex-vault.csr"), "", 0, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if cert.Subject.CommonName != "edgex-vault" || len(cert.DNSNames) != 2 || cert.DNSNames[0] != "edgex-vault" {
+		t.Errorf("Unexpected certificate %v %v", cert.Subject, cert.DNSNames)
+	}
+	cf.csrPolicy.allowBareHosts = false
+	if _, err = SignCSR(&cf, filepath.Join(serviceDir, "edgex-vault.csr"), "", 0, ""); !errors.Is(err, ErrCSRPolicy) || !strings.Contains(err.Error(), "allow_bare_hosts") {
+		t.Errorf("Expected bare host names to be denied, got %v", err)
+	}
+}
+
+func TestSignCSRPolicy(t *testing.T) {
+	cf, _, _ := newTestCA(t, csrConfig)
+
+	tests := []struct {
+		name     string
+		template x509.CertificateRequest
+		profile  string
+		days     int
+		denied   string
+	}{
+		{"default validity", x509.CertificateRequest{DNSNames: []string{"edgex-kong.local"}}, "", 0, ""},
+		{"client by service name", x509.CertificateRequest{Subject: pkix.Name{CommonName: "edgex-vaultworker"}}, ProfileClient, 0, ""},
+		{"outside domain", x509.CertificateRequest{DNSNames: []string{"example.com"}}, "", 0, `DNS name "example.com"`},
+		{"outside IP range", x509.CertificateRequest{DNSNames: []string{"edgex-kong.local"}, IPAddresses: []net.IP{net.ParseIP("192.168.0.1")}}, "", 0, "IP address 192.168.0.1"},
+		{"server without SAN", x509.CertificateRequest{Subject: pkix.Name{CommonName: "edgex-kong"}}, "", 0, "no subject alternative name"},
+		{"common name outside domain", x509.CertificateRequest{Subject: pkix.Name{CommonName: "www.example.com"}, DNSNames: []string{"edgex-kong.local"}}, "", 0, "common name"},
+		{"validity", x509.CertificateRequest{DNSNames: []string{"edgex-kong.local"}}, "", 365, "exceeds 90 days"},
+		{"profile", x509.CertificateRequest{DNSNames: []string{"edgex-kong.local"}}, ProfileCodeSigning, 0, `profile "code-signing"`},
+		{"URI below prefix", x509.CertificateRequest{URIs: []*url.URL{{Scheme: "spiffe", Host: "edgex", Path: "/ns/vault"}}}, "", 0, ""},
+		{"URI beside prefix", x509.CertificateRequest{URIs: []*url.URL{{Scheme: "spiffe", Host: "edgex", Path: "/ns-other/vault"}}}, "", 0, "outside of the allowed prefixes"},
+	}
+	for _, tt := range tests {
+		csrFile := writeCSR(t, t.TempDir(), &tt.template)
+		_, err := SignCSR(&cf, csrFile, tt.profile, tt.days, "")
+		if tt.denied == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", tt.name, err.Error())
+			}
+			continue
+		}
+		if !errors.Is(err, ErrCSRPolicy) || !strings.Contains(err.Error(), tt.denied) {
+			t.Errorf("%s: expected a policy error about %s, got %v", tt.name, tt.denied, err)
+		}
+	}
+
+	// A tampered request does not verify
+	csrFile := writeCSR(t, t.TempDir(), &x509.CertificateRequest{DNSNames: []string{"edgex-kong.local"}})
+	data, _ := ioutil.ReadFile(csrFile)
+	block, _ := pem.Decode(data)
+	block.Bytes[len(block.Bytes)-1] ^= 0xff
+	ioutil.WriteFile(csrFile, pem.EncodeToMemory(block), 0644)
+	if _, err := SignCSR(&cf, csrFile, "", 0, ""); !errors.Is(err, ErrCSRInvalid) {
+		t.Errorf("Expected ErrCSRInvalid, got %v", err)
+	}
+}
+
+func TestCSRPolicyValidation(t *testing.T) {
+	_, err := ParseConfig([]byte(`{
+        "x509_root_ca_parameters": {"ca_name": "CA"},
+        "x509_csr_policy": {
+            "allowed_domains": ["*.local"],
+            "key_types": ["rsa-1024"],
+            "profiles": ["ca"]
+        },
+        "x509_tls_server_parameters": {"tls_host": "edgex-kong", "tls_domain": "local"}
+    }`))
+	expected := []string{
+		"x509_csr_policy.allowed_domains[0]",
+		"x509_csr_policy.key_types[0]",
+		"x509_csr_policy.profiles[0]",
+	}
+	paths := errorPaths(t, err)
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected errors at %v, got %v (%v)", expected, paths, err)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("Expected errors at %v, got %v", expected, paths)
+			break
+		}
+	}
+}
@@ -0,0 +1,72 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+)
+
+// Errors returned by the PKI setup steps, wrapped with the file or setting at fault.
+// Callers match them with errors.Is.
+var (
+	ErrWorkingDir       = errors.New("unusable working directory")
+	ErrPKIDir           = errors.New("unusable CA PKI setup directory")
+	ErrKeyScheme        = errors.New("unsupported key scheme")
+	ErrKeyGeneration    = errors.New("private key generation failed")
+	ErrCertGeneration   = errors.New("certificate generation failed")
+	ErrCACertUnreadable = errors.New("unreadable Root CA certificate")
+	ErrCAKeyUnreadable  = errors.New("unreadable Root CA private key")
+	ErrCertTypeMismatch = errors.New("unexpected PEM block type")
+	ErrWriteFailed      = errors.New("failed to save PKI material")
+	ErrUnknownServer    = errors.New("no such TLS server in the configuration")
+	ErrIndex            = errors.New("unusable issuance index")
+	ErrNotIssued        = errors.New("certificate not in the issuance index")
+	ErrAlreadyRevoked   = errors.New("certificate already revoked")
+	ErrCSRInvalid       = errors.New("invalid certificate signing request")
+	ErrCSRPolicy        = errors.New("certificate signing request denied by policy")
+	ErrKeyUnreadable    = errors.New("unreadable private key")
+	ErrKeyPassword      = errors.New("private key password unavailable")
+	ErrPEMUnreadable    = errors.New("unreadable PEM file")
+	ErrExternalCA       = errors.New("unusable external CA")
+)
+
+// Logger receives the progress messages of the PKI setup. Any *log.Logger fits; the standard
+// log package output is used by default.
+type Logger interface {
+	Printf(format string, v ...interface{})
+	Println(v ...interface{})
+}
+
+// stdLogger forwards to the standard log package, as configured by the caller
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) { log.Printf(format, v...) }
+func (stdLogger) Println(v ...interface{})               { log.Println(v...) }
+
+var lg Logger = stdLogger{}
+
+// SetLogger replaces the logger of the PKI setup; nil discards every message
+func SetLogger(l Logger) {
+	if l == nil {
+		l = log.New(ioutil.Discard, "", 0)
+	}
+	lg = l
+}
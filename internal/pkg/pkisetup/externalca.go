@@ -0,0 +1,307 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// externalCAParams locates the external CA imported in place of a generated Root CA
+type externalCAParams struct {
+	certFile      string
+	keyFile       string
+	pkcs12File    string
+	chainFiles    []string
+	password      []byte // of an encrypted key or of the PKCS#12 bundle, if any
+	allowWeakKeys bool
+}
+
+// newExternalCAParams reads the password of the external CA settings, if any, from its file or
+// environment variable when the CA is imported, the only time it is needed
+func newExternalCAParams(eca *ExternalCA, allowWeakKeys bool, importing bool) (*externalCAParams, error) {
+	e := &externalCAParams{
+		certFile:      eca.CertFile,
+		keyFile:       eca.KeyFile,
+		pkcs12File:    eca.PKCS12File,
+		chainFiles:    eca.ChainFiles,
+		allowWeakKeys: allowWeakKeys,
+	}
+	if importing && (eca.PasswordFile != "" || eca.PasswordEnv != "") {
+		var err error
+		if e.password, err = readPassword(eca.PasswordFile, eca.PasswordEnv); err != nil {
+			return nil, err
+		}
+	}
+	return e, nil
+}
+
+// validate reports the inconsistent external CA settings. The external CA issues the TLS server
+// certificates itself, there is no intermediate CA of pkisetup below it.
+func (eca *ExternalCA) validate(intermediate bool, errs *ConfigErrors) {
+	path := "x509_external_ca_parameters"
+	switch {
+	case eca.PKCS12File != "":
+		if eca.CertFile != "" || eca.KeyFile != "" {
+			errs.add(path+".pkcs12_file", "conflicts with cert_file and key_file, set only one CA source")
+		}
+		if eca.PasswordFile == "" && eca.PasswordEnv == "" {
+			errs.add(path+".pkcs12_file", "requires password_file or password_env")
+		}
+	case eca.CertFile == "" && eca.KeyFile == "":
+		errs.add(path, "either pkcs12_file, or cert_file and key_file, is required")
+	case eca.CertFile == "":
+		errs.add(path+".cert_file", "is required with key_file")
+	case eca.KeyFile == "":
+		errs.add(path+".key_file", "is required with cert_file")
+	}
+	if eca.PasswordFile != "" && eca.PasswordEnv != "" {
+		errs.add(path+".password_env", "conflicts with password_file, set only one password source")
+	}
+	if intermediate {
+		errs.add(path, "conflicts with x509_intermediate_ca_parameters, the external CA issues the TLS server certificates")
+	}
+}
+
+// encrypted tells whether the key of the external CA is protected at its source: a PKCS#12 bundle
+// or an encrypted key, both with a password
+func (eca *ExternalCA) encrypted() bool {
+	return eca.PKCS12File != "" || eca.PasswordFile != "" || eca.PasswordEnv != ""
+}
+
+/*ImportCA imports the external CA of the configuration in place of a generated Root CA. Its certificate must be a CA allowed to sign certificates, matching its private key, valid now and chained up to a self-signed enterprise root. The certificate, private key and chain are saved to the PKI setup directory as the Root CA files.*/
+func ImportCA(cf *CertConfig) (*x509.Certificate, crypto.PrivateKey, error) {
+	lg.Println("")
+	lg.Println("<Phase 1> Importing the external CA PKI materials")
+
+	e := cf.external
+	if e == nil {
+		return nil, nil, fmt.Errorf("%w: x509_external_ca_parameters is not set", ErrExternalCA)
+	}
+	caCert, caSK, certs, err := e.read()
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, file := range e.chainFiles {
+		lg.Printf("Loading external CA chain certificates: %s", file)
+		chain, err := readCertificates(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		certs = append(certs, chain...)
+	}
+
+	lg.Printf("Checking external CA certificate %s", caCert.Subject)
+	if err = e.check(caCert, caSK, time.Now()); err != nil {
+		return nil, nil, err
+	}
+	chain, err := chainToRoot(caCert, certs)
+	if err != nil {
+		return nil, nil, err
+	}
+	lg.Printf("- Chained up to the enterprise root %s", chain[len(chain)-1].Subject)
+
+	lg.Printf("Saving external CA private key to PEM file: %s", cf.caKeyFile)
+	if err = cf.protection.writeCAKey(cf.caKeyFile, caSK, 0400); err != nil {
+		return nil, nil, err
+	}
+	lg.Printf("Saving external CA certificate to PEM file: %s", cf.caCertFile)
+	if err = ioutil.WriteFile(cf.caCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caCert.Raw}), 0644); err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrWriteFailed, cf.caCertFile, err)
+	}
+	lg.Printf("Saving external CA full-chain certificate to PEM file: %s", cf.caChainFile)
+	if err = writeCertChain(cf.caChainFile, chain); err != nil {
+		return nil, nil, err
+	}
+
+	lg.Printf("External CA successfully imported!")
+
+	return caCert, caSK, nil
+}
+
+// read loads the certificate and private key of the external CA, with the other certificates
+// of its files
+func (e *externalCAParams) read() (*x509.Certificate, crypto.PrivateKey, []*x509.Certificate, error) {
+	if e.pkcs12File != "" {
+		lg.Printf("Loading external CA PKCS#12 bundle: %s", e.pkcs12File)
+		data, err := ioutil.ReadFile(e.pkcs12File)
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: %s: %v", ErrExternalCA, e.pkcs12File, err)
+		}
+		sk, cert, certs, err := pkcs12.DecodeChain(data, string(e.password))
+		if err != nil {
+			return nil, nil, nil, fmt.Errorf("%w: %s: %v", ErrExternalCA, e.pkcs12File, err)
+		}
+		return cert, sk, certs, nil
+	}
+
+	lg.Printf("Loading external CA certificate: %s", e.certFile)
+	certs, err := readCertificates(e.certFile)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	lg.Printf("Loading external CA private key: %s", e.keyFile)
+	sk, err := readExternalKey(e.keyFile, e.password)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return certs[0], sk, certs[1:], nil
+}
+
+// check reports every reason why the external CA cannot issue the TLS server certificates
+func (e *externalCAParams) check(caCert *x509.Certificate, caSK crypto.PrivateKey, now time.Time) error {
+	var problems []string
+	if !caCert.BasicConstraintsValid || !caCert.IsCA {
+		problems = append(problems, "not a CA certificate, its basic constraints lack CA:TRUE")
+	}
+	if caCert.KeyUsage&x509.KeyUsageCertSign == 0 {
+		problems = append(problems, "its key usage lacks certSign")
+	}
+	if !keyMatches(caSK, caCert.PublicKey) {
+		problems = append(problems, "the private key does not match the certificate")
+	}
+	if now.Before(caCert.NotBefore) || now.After(caCert.NotAfter) {
+		problems = append(problems, fmt.Sprintf("not valid now, only from %s to %s", caCert.NotBefore.UTC().Format(time.RFC3339), caCert.NotAfter.UTC().Format(time.RFC3339)))
+	}
+	alg := keyAlgorithm(caCert.PublicKey)
+	switch {
+	case containsString(keyAlgorithms, alg):
+	case containsString(weakKeyAlgorithms, alg) && e.allowWeakKeys:
+	default:
+		problems = append(problems, fmt.Sprintf("key algorithm %s is unsupported or below the minimum key strength", alg))
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%w: %s: %s", ErrExternalCA, caCert.Subject, strings.Join(problems, "; "))
+	}
+	if caCert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		lg.Println("- Its key usage lacks cRLSign, it cannot sign CRLs")
+	}
+	return nil
+}
+
+// chainToRoot orders the CA certificate and the certificates above it, found among certs, up to
+// a self-signed root. Each one must be signed by the next.
+func chainToRoot(caCert *x509.Certificate, certs []*x509.Certificate) ([]*x509.Certificate, error) {
+	chain := []*x509.Certificate{caCert}
+	for cert := caCert; !isSelfSigned(cert); {
+		var parent *x509.Certificate
+		for _, c := range certs {
+			if string(c.RawSubject) == string(cert.RawIssuer) && cert.CheckSignatureFrom(c) == nil {
+				parent = c
+				break
+			}
+		}
+		if parent == nil || len(chain) > len(certs) {
+			return nil, fmt.Errorf("%w: no CA certificate issuing %s, chain_files must lead to the enterprise root", ErrExternalCA, cert.Subject)
+		}
+		chain = append(chain, parent)
+		cert = parent
+	}
+	return chain, nil
+}
+
+func isSelfSigned(cert *x509.Certificate) bool {
+	return string(cert.RawIssuer) == string(cert.RawSubject) && cert.CheckSignatureFrom(cert) == nil
+}
+
+// readCertificates reads the certificates of a PEM file, skipping its other blocks, or of a DER file
+func readCertificates(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrExternalCA, file, err)
+	}
+	block, rest := pem.Decode(data)
+	if block == nil {
+		// Without PEM armor, DER certificates possibly concatenated
+		certs, err := x509.ParseCertificates(data)
+		if err != nil || len(certs) == 0 {
+			return nil, fmt.Errorf("%w: %s: neither PEM nor DER certificates: %v", ErrExternalCA, file, err)
+		}
+		return certs, nil
+	}
+	var certs []*x509.Certificate
+	for ; block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrExternalCA, file, err)
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("%w: %w: %s: expected a CERTIFICATE block", ErrExternalCA, ErrCertTypeMismatch, file)
+	}
+	return certs, nil
+}
+
+// readExternalKey reads a PEM or DER private key: PKCS#8, encrypted PKCS#8, PKCS#1 RSA or SEC 1 EC
+func readExternalKey(file string, password []byte) (crypto.PrivateKey, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrExternalCA, file, err)
+	}
+	block, rest := pem.Decode(data)
+	if block == nil {
+		sk, err := parseKeyDER(data)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrExternalCA, file, err)
+		}
+		return sk, nil
+	}
+	for ; block != nil; block, rest = pem.Decode(rest) {
+		var sk crypto.PrivateKey
+		switch block.Type {
+		case encryptedKeyBlockType:
+			sk, err = decodePrivateKey(pem.EncodeToMemory(block), password)
+		case "PRIVATE KEY", "RSA PRIVATE KEY", "EC PRIVATE KEY":
+			sk, err = parseKeyDER(block.Bytes)
+		default:
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrExternalCA, file, err)
+		}
+		return sk, nil
+	}
+	return nil, fmt.Errorf("%w: %w: %s: expected a private key block", ErrExternalCA, ErrCertTypeMismatch, file)
+}
+
+// parseKeyDER parses an unencrypted PKCS#8, PKCS#1 RSA or SEC 1 EC private key
+func parseKeyDER(der []byte) (crypto.PrivateKey, error) {
+	if sk, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return sk, nil
+	}
+	if sk, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return sk, nil
+	}
+	if sk, err := x509.ParseECPrivateKey(der); err == nil {
+		return sk, nil
+	}
+	return nil, errors.New("not a PKCS#8, PKCS#1 or SEC 1 private key")
+}
@@ -0,0 +1,291 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const externalCAConfig = `{
+    "create_new_rootca": true,
+    "working_dir": "%s",
+    "key_scheme": {"key_algorithm": "ecdsa-p256"},
+    "x509_root_ca_parameters": {"ca_name": "TestCA"},
+    "x509_crl_parameters": {"distribution_points": ["http://edgex-vault:8080/crl/{ca}.crl"]},
+    "x509_tls_server_parameters": [
+        {"tls_host": "edgex-vault", "tls_domain": "local"},
+        {"tls_host": "edgex-kong", "tls_domain": "local"}
+    ]
+}`
+
+// newEnterpriseCA creates a certificate of an enterprise PKI, self-signed without parent
+func newEnterpriseCA(t *testing.T, cn string, isCA bool, keyUsage x509.KeyUsage, parent *x509.Certificate, parentSK *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	sk, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: cn, Organization: []string{"Enterprise"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              keyUsage,
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+	}
+	if parent == nil {
+		parent, parentSK = template, sk
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &sk.PublicKey, parentSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, sk
+}
+
+func writeFile(t *testing.T, file string, data ...[]byte) string {
+	var content []byte
+	for _, d := range data {
+		content = append(content, d...)
+	}
+	if err := ioutil.WriteFile(file, content, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func certPEM(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+// importExternalCA sets up a PKI setup directory with the external CA, and the key protection
+// if not nil
+func importExternalCA(t *testing.T, eca ExternalCA, kp *KeyProtection) (CertConfig, error) {
+	x509config := parseTestConfig(t, externalCAConfig)
+	x509config.ExternalCA = &eca
+	x509config.KeyProtection = kp
+	cf, err := CreateEnv(&x509config)
+	if err != nil {
+		return cf, err
+	}
+	_, _, err = ImportCA(&cf)
+	return cf, err
+}
+
+func TestImportCA(t *testing.T) {
+	root, rootSK := newEnterpriseCA(t, "Enterprise Root CA", true, x509.KeyUsageCertSign|x509.KeyUsageCRLSign, nil, nil)
+	issuing, issuingSK := newEnterpriseCA(t, "Enterprise Issuing CA", true, x509.KeyUsageCertSign|x509.KeyUsageCRLSign, root, rootSK)
+
+	dir := t.TempDir()
+	sec1, err := x509.MarshalECPrivateKey(issuingSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8DER, err := x509.MarshalPKCS8PrivateKey(issuingSK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pfx, err := pkcs12.Modern.Encode(issuingSK, issuing, []*x509.Certificate{root}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PKISETUP_TEST_CA_PASSWORD", "s3cret")
+
+	protection := &KeyProtection{EncryptKeys: true, PasswordEnv: "PKISETUP_TEST_CA_PASSWORD"}
+
+	tests := []struct {
+		name string
+		eca  ExternalCA
+		kp   *KeyProtection
+	}{
+		{"PEM with its chain", ExternalCA{
+			CertFile: writeFile(t, filepath.Join(dir, "ca-chain.pem"), certPEM(issuing), certPEM(root)),
+			KeyFile:  writeFile(t, filepath.Join(dir, "ca.key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})),
+		}, nil},
+		{"DER with chain files", ExternalCA{
+			CertFile:   writeFile(t, filepath.Join(dir, "ca.der"), issuing.Raw),
+			KeyFile:    writeFile(t, filepath.Join(dir, "ca.key.der"), pkcs8DER),
+			ChainFiles: []string{writeFile(t, filepath.Join(dir, "root.der"), root.Raw)},
+		}, nil},
+		{"PKCS#12", ExternalCA{
+			PKCS12File:  writeFile(t, filepath.Join(dir, "ca.p12"), pfx),
+			PasswordEnv: "PKISETUP_TEST_CA_PASSWORD",
+		}, protection},
+	}
+	for _, tt := range tests {
+		cf, err := importExternalCA(t, tt.eca, tt.kp)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.name, err.Error())
+		}
+		// The key encrypted at its source stays encrypted
+		data, _ := ioutil.ReadFile(cf.caKeyFile)
+		if block, _ := pem.Decode(data); block == nil || (block.Type == encryptedKeyBlockType) != (tt.kp != nil) {
+			t.Errorf("%s: unexpected protection of the saved CA key", tt.name)
+		}
+		ca, _, err := LoadCA(&cf)
+		if err != nil || !ca.Equal(issuing) {
+			t.Fatalf("%s: external CA not imported: %v", tt.name, err)
+		}
+		certs, _, err := GenCerts(&cf)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.name, err.Error())
+		}
+
+		// The full chain includes the enterprise root
+		chain := readCerts(t, cf.servers[0].tlsChainFile)
+		if len(chain) != 3 || !chain[0].Equal(certs[0]) || !chain[1].Equal(issuing) || !chain[2].Equal(root) {
+			t.Errorf("%s: unexpected full chain of %d certificates", tt.name, len(chain))
+		}
+		// The imported CA is known by its configuration name
+		if dp := certs[0].CRLDistributionPoints; len(dp) != 1 || dp[0] != "http://edgex-vault:8080/crl/TestCA.crl" {
+			t.Errorf("%s: unexpected CRL distribution points %v", tt.name, dp)
+		}
+		index, err := ReadIndex(&cf)
+		if err != nil || len(index.Certificates) != 2 || index.Certificates[0].Issuer != "TestCA" {
+			t.Errorf("%s: unexpected issuance index %v %v", tt.name, index, err)
+		}
+
+		results, err := Verify(&cf, "", time.Now())
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.name, err.Error())
+		}
+		for _, r := range results {
+			if len(r.Problems) > 0 {
+				t.Errorf("%s: unexpected problems of %s: %v", tt.name, r.Name, r.Problems)
+			}
+		}
+
+		// The external CA signs the CRL of its revocations
+		if _, err = Revoke(&cf, cf.servers[1].tlsCertFile, 0, time.Now()); err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.name, err.Error())
+		}
+		data, err = ioutil.ReadFile(cf.CRLFile("TestCA"))
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", tt.name, err.Error())
+		}
+		block, _ := pem.Decode(data)
+		crl, err := x509.ParseRevocationList(block.Bytes)
+		if err != nil || crl.CheckSignatureFrom(issuing) != nil || len(crl.RevokedCertificateEntries) != 1 {
+			t.Errorf("%s: unexpected CRL: %v", tt.name, err)
+		}
+	}
+}
+
+func TestImportCARejected(t *testing.T) {
+	root, rootSK := newEnterpriseCA(t, "Enterprise Root CA", true, x509.KeyUsageCertSign, nil, nil)
+	leaf, leafSK := newEnterpriseCA(t, "Enterprise Server", false, x509.KeyUsageDigitalSignature, root, rootSK)
+	noSign, noSignSK := newEnterpriseCA(t, "Enterprise CRL Signer", true, x509.KeyUsageCRLSign, root, rootSK)
+	issuing, issuingSK := newEnterpriseCA(t, "Enterprise Issuing CA", true, x509.KeyUsageCertSign, root, rootSK)
+	orphan, orphanSK := newEnterpriseCA(t, "Enterprise Team CA", true, x509.KeyUsageCertSign, issuing, issuingSK)
+
+	dir := t.TempDir()
+	keyFile := func(name string, sk *ecdsa.PrivateKey) string {
+		der, err := x509.MarshalPKCS8PrivateKey(sk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return writeFile(t, filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	}
+	tests := []struct {
+		name     string
+		eca      ExternalCA
+		expected string
+	}{
+		{"not a CA", ExternalCA{CertFile: writeFile(t, filepath.Join(dir, "leaf.pem"), certPEM(leaf), certPEM(root)), KeyFile: keyFile("leaf.key", leafSK)}, "CA:TRUE"},
+		{"no certSign", ExternalCA{CertFile: writeFile(t, filepath.Join(dir, "crl.pem"), certPEM(noSign), certPEM(root)), KeyFile: keyFile("crl.key", noSignSK)}, "certSign"},
+		{"key mismatch", ExternalCA{CertFile: writeFile(t, filepath.Join(dir, "root.pem"), certPEM(root)), KeyFile: keyFile("other.key", leafSK)}, "does not match"},
+		{"no root", ExternalCA{CertFile: writeFile(t, filepath.Join(dir, "orphan.pem"), certPEM(orphan)), KeyFile: keyFile("orphan.key", orphanSK)}, "enterprise root"},
+		{"no certificate", ExternalCA{CertFile: keyFile("key.pem", rootSK), KeyFile: keyFile("root.key", rootSK)}, "CERTIFICATE"},
+	}
+	for _, tt := range tests {
+		if _, err := importExternalCA(t, tt.eca, nil); !errors.Is(err, ErrExternalCA) || !strings.Contains(err.Error(), tt.expected) {
+			t.Errorf("%s: expected an external CA error about %s, got %v", tt.name, tt.expected, err)
+		}
+	}
+}
+
+func TestImportEncryptedCA(t *testing.T) {
+	root, rootSK := newEnterpriseCA(t, "Enterprise Root CA", true, x509.KeyUsageCertSign, nil, nil)
+	issuing, issuingSK := newEnterpriseCA(t, "Enterprise Issuing CA", true, x509.KeyUsageCertSign, root, rootSK)
+	pfx, err := pkcs12.Modern.Encode(issuingSK, issuing, []*x509.Certificate{root}, "s3cret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PKISETUP_TEST_CA_PASSWORD", "s3cret")
+	eca := ExternalCA{PKCS12File: writeFile(t, filepath.Join(t.TempDir(), "ca.p12"), pfx), PasswordEnv: "PKISETUP_TEST_CA_PASSWORD"}
+
+	// The key encrypted at its source is not saved in clear
+	_, err = importExternalCA(t, eca, nil)
+	if paths := errorPaths(t, err); len(paths) != 1 || paths[0] != "x509_key_protection_parameters.encrypt_keys" {
+		t.Errorf("Expected an error at x509_key_protection_parameters.encrypt_keys, got %v (%v)", paths, err)
+	}
+	if _, err = importExternalCA(t, eca, &KeyProtection{PKCS12: true, PasswordEnv: "PKISETUP_TEST_CA_PASSWORD"}); err == nil {
+		t.Errorf("Expected pkcs12 alone to be refused")
+	}
+	cf, err := importExternalCA(t, eca, &KeyProtection{EncryptKeys: true, PasswordEnv: "PKISETUP_TEST_CA_PASSWORD"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if _, err = readPrivateKey(cf.caKeyFile, nil); !errors.Is(err, ErrKeyUnreadable) {
+		t.Errorf("Expected the saved CA key to be encrypted, got %v", err)
+	}
+}
+
+func TestExternalCAValidation(t *testing.T) {
+	_, err := ParseConfig([]byte(`{
+        "x509_root_ca_parameters": {"ca_name": "CA"},
+        "x509_intermediate_ca_parameters": {"ca_name": "SubCA"},
+        "x509_external_ca_parameters": {"key_file": "ca.key", "password_file": "pass", "password_env": "PASS"},
+        "x509_tls_server_parameters": {"tls_host": "edgex-kong", "tls_domain": "local"}
+    }`))
+	expected := []string{
+		"x509_external_ca_parameters",
+		"x509_external_ca_parameters.cert_file",
+		"x509_external_ca_parameters.password_env",
+		"x509_key_protection_parameters.encrypt_keys",
+	}
+	paths := errorPaths(t, err)
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected errors at %v, got %v (%v)", expected, paths, err)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("Expected errors at %v, got %v", expected, paths)
+			break
+		}
+	}
+}
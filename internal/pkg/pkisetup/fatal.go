@@ -1,30 +0,0 @@
-/*
-   Copyright 2018 ForgeRock AS.
-
-   Licensed under the Apache License, Version 2.0 (the "License");
-   you may not use this file except in compliance with the License.
-   You may obtain a copy of the License at
-
-       http://www.apache.org/licenses/LICENSE-2.0
-
-   Unless required by applicable law or agreed to in writing, software
-   distributed under the License is distributed on an "AS IS" BASIS,
-   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
-   See the License for the specific language governing permissions and
-   limitations under the License.
-
-  @author: Alain Pulluelo, ForgeRock (created: July 27, 2018)
-  @author: Tingyu Zeng, DELL (updated: May 21, 2019)
-  @version: 1.0.0
-*/
-
-package pkisetup
-
-import "log"
-
-/*FatalIfErr =  Printf() followed by a call to os.Exit(1)*/
-func FatalIfErr(err error, msg string) {
-	if err != nil {
-		log.Fatalf("ERROR: %s: %s", msg, err)
-	}
-}
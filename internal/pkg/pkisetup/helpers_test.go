@@ -0,0 +1,60 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto"
+	"crypto/x509"
+	"fmt"
+	"testing"
+)
+
+// parseTestConfig parses a JSON configuration whose first verb is the working directory, a new
+// temporary directory, followed by args
+func parseTestConfig(t *testing.T, config string, args ...interface{}) X509Config {
+	t.Helper()
+	x509config, err := ParseConfig([]byte(fmt.Sprintf(config, append([]interface{}{t.TempDir()}, args...)...)))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	return x509config
+}
+
+// newTestEnv sets up the PKI setup directory of a configuration, see parseTestConfig
+func newTestEnv(t *testing.T, config string, args ...interface{}) CertConfig {
+	t.Helper()
+	x509config := parseTestConfig(t, config, args...)
+	cf, err := CreateEnv(&x509config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	return cf
+}
+
+// newTestCA sets up the PKI setup directory of a configuration with its Root CA, see
+// parseTestConfig
+func newTestCA(t *testing.T, config string, args ...interface{}) (CertConfig, *x509.Certificate, crypto.PrivateKey) {
+	t.Helper()
+	cf := newTestEnv(t, config, args...)
+	ca, caSK, err := GenCA(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	return cf, ca, caSK
+}
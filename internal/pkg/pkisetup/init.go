@@ -22,11 +22,10 @@ package pkisetup
 
 import (
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
+	"time"
 )
 
 /* CertConfig holds information required to create PKI environment */
@@ -45,25 +44,103 @@ type CertConfig struct {
 	caState    string
 	caLocality string
 	caOrg      string
+	caDomain   string // domain of the CA contact address
+	caValidity validityPeriod
 
-	// TLS Server Certificate
-	tlsHost     string
-	tlsDomain   string
-	tlsFQDN     string
-	tlsAltFQDN  string
-	tlsKeyFile  string
-	tlsCertFile string
-	tlsCountry  string
-	tlsState    string
-	tlsLocality string
-	tlsOrg      string
-
-	// Key Generation
-	dumpKeys   bool // Dump the keys to console: debug only!
-	rsaScheme  bool
-	rsaKeySize int
-	ecScheme   bool
-	ecCurve    string
+	// External CA imported in place of a generated Root CA, if any, and its full chain up to the
+	// enterprise root
+	external    *externalCAParams
+	caChainFile string
+
+	// NotBefore backdating of every certificate
+	backdate time.Duration
+	allowCap bool
+
+	// Intermediate CA issuing the TLS server certificates, if any
+	intermediate *intermediateParams
+
+	// CRL next update and distribution points of the issued certificates
+	crlNextUpdateDays        int
+	crlDistributionPointURLs []string
+
+	// OCSP responder URLs of the issued certificates and ocsp-serve settings
+	ocspResponderURLs      []string
+	ocspListenAddress      string
+	ocspNextUpdateHours    int
+	ocspDelegatedSigner    bool
+	ocspSignerValidityDays int
+
+	// Policy of the certificate signing requests signed by the sign command
+	csrPolicy csrPolicyParams
+
+	// Renewal window and key reuse of the renew command
+	renewBeforeDays int
+	renewReuseKey   bool
+
+	// Password protection of the private keys and PKCS#12 bundles
+	protection keyProtection
+
+	// Root and intermediate CA Key Generation
+	keyParams
+
+	// TLS Server Certificates, issued in order
+	servers []serverParams
+}
+
+/* keyParams selects how a private key is generated */
+type keyParams struct {
+	dumpKeys  bool   // Dump the keys to console: debug only!
+	algorithm string // rsa-<size>, ecdsa-p<curve> or ed25519
+}
+
+/* rsaKey tells whether the key is RSA, the only one used for key encipherment */
+func (k keyParams) rsaKey() bool {
+	return strings.HasPrefix(k.algorithm, "rsa-")
+}
+
+/* serverParams holds the settings of one TLS server certificate */
+type serverParams struct {
+	keyParams
+	tlsHost       string
+	tlsDomain     string
+	tlsNames      subjectAltNames
+	tlsKeyFile    string
+	tlsCertFile   string
+	tlsChainFile  string // full chain, only written below an intermediate or external CA
+	tlsPKCS12File string // PKCS#12 bundle, only written if set up so
+	tlsCountry    string
+	tlsState      string
+	tlsLocality   string
+	tlsOrg        string
+	validity      validityPeriod
+	profile       string
+}
+
+func newKeyParams(ks KeyScheme) keyParams {
+	return keyParams{
+		dumpKeys:  bool(ks.DumpKeys),
+		algorithm: ks.algorithm(),
+	}
+}
+
+/* newServerParams returns the settings of a TLS server whose PEM files are saved to dir */
+func newServerParams(x509config *X509Config, t TLSServer, dir string) serverParams {
+	return serverParams{
+		keyParams:     newKeyParams(x509config.keyScheme(t)),
+		tlsHost:       t.TLSHost,
+		tlsDomain:     t.TLSDomain,
+		tlsNames:      t.names(),
+		tlsKeyFile:    filepath.Join(dir, t.TLSHost+skFileExt),
+		tlsCertFile:   filepath.Join(dir, t.TLSHost+certFileExt),
+		tlsChainFile:  filepath.Join(dir, t.TLSHost+chainFileExt),
+		tlsPKCS12File: filepath.Join(dir, t.TLSHost+pkcs12FileExt),
+		tlsCountry:    t.TLSCountry,
+		tlsState:      t.TLSSate,
+		tlsLocality:   t.TLSLocality,
+		tlsOrg:        t.TLSOrg,
+		validity:      newValidityPeriod(t.ValidityDays, t.Validity, t.NotAfter, defaultValidity),
+		profile:       t.Profile,
+	}
 }
 
 /* CreateEnv creates enviroment for the PKI certs */
@@ -71,58 +148,96 @@ func CreateEnv(x509config *X509Config) (CertConfig, error) {
 
 	cf := CertConfig{}
 
+	// Settings are checked up front, so that a typo cannot silently become false or 0
+	if err := x509config.Validate(); err != nil {
+		return cf, err
+	}
+
 	// Abs returns an absolute representation of path.
 	// If the path is not absolute it will be joined with the current working directory
 	// to turn it into an absolute path.
 	wDir, err := filepath.Abs(x509config.WorkingDir)
 	if err != nil {
-		FatalIfErr(err, "ERROR: failed to build the working directory absolute path from JSON config")
+		return cf, fmt.Errorf("%w: %s: %v", ErrWorkingDir, x509config.WorkingDir, err)
 	}
-	log.Printf("Working directory: %s", wDir)
+	lg.Printf("Working directory: %s", wDir)
 
 	// pkiCaDir: Concatenate working dir absolute path with PKI setup dir, using separator "/"
 	cf.pkiCaDir = strings.Join([]string{wDir, x509config.PKISetupDir, x509config.RootCA.CAName}, "/")
 
-	// Convert create_new_ca JSON string "true|false" to boolean
-	cf.newCA, err = strconv.ParseBool(x509config.CreateNewRootCA)
-	// Convert dump_config JSON string "true|false" to boolean
-	cf.dumpConfig, err = strconv.ParseBool(x509config.DumpConfig)
-	// Convert dump_keys JSON string "true|flase| to boolean
-	cf.dumpKeys, err = strconv.ParseBool(x509config.KeyScheme.DumpKeys)
-	// Convert rsa JSON string "true|false" to boolean
-	cf.rsaScheme, err = strconv.ParseBool(x509config.KeyScheme.RSA)
-	// Convert rsa_key_size JSON string to integer
-	cf.rsaKeySize, err = strconv.Atoi(x509config.KeyScheme.RSAKeySize)
-	// Convert ec JSON string "true|false" to boolean
-	cf.ecScheme, err = strconv.ParseBool(x509config.KeyScheme.EC)
-	// EC chosen curve
-	cf.ecCurve = x509config.KeyScheme.ECCurve
+	cf.newCA = bool(x509config.CreateNewRootCA)
+	cf.dumpConfig = bool(x509config.DumpConfig)
+	cf.keyParams = newKeyParams(x509config.KeyScheme)
+
 	// Init: CA name and PEM key/cert filenames
 	cf.caName = x509config.RootCA.CAName
 	cf.caKeyFile = filepath.Join(cf.pkiCaDir, cf.caName+skFileExt)
 	cf.caCertFile = filepath.Join(cf.pkiCaDir, cf.caName+certFileExt)
-	// Init: TLS host.domain and PEM key/cert filenames
-	cf.tlsHost = x509config.TLSServer.TLSHost
-	cf.tlsDomain = x509config.TLSServer.TLSDomain
-	if cf.tlsDomain == "local" {
-		cf.tlsFQDN = cf.tlsHost
-		cf.tlsAltFQDN = cf.tlsHost + "." + cf.tlsDomain
-	} else {
-		cf.tlsFQDN = cf.tlsHost + "." + cf.tlsDomain
-		cf.tlsAltFQDN = ""
-	}
-	cf.tlsKeyFile = filepath.Join(cf.pkiCaDir, cf.tlsHost+skFileExt)
-	cf.tlsCertFile = filepath.Join(cf.pkiCaDir, cf.tlsHost+certFileExt)
+	cf.caChainFile = filepath.Join(cf.pkiCaDir, cf.caName+chainFileExt)
 	// CA subjects
 	cf.caCountry = x509config.RootCA.CACountry
 	cf.caState = x509config.RootCA.CAState
 	cf.caLocality = x509config.RootCA.CALocality
 	cf.caOrg = x509config.RootCA.CAOrg
-	// TLS subjects
-	cf.tlsCountry = x509config.TLSServer.TLSCountry
-	cf.tlsState = x509config.TLSServer.TLSSate
-	cf.tlsLocality = x509config.TLSServer.TLSLocality
-	cf.tlsOrg = x509config.TLSServer.TLSOrg
+	cf.caValidity = newValidityPeriod(x509config.RootCA.ValidityDays, x509config.RootCA.Validity, x509config.RootCA.NotAfter, defaultValidity)
+	cf.backdate, _ = parseDuration(x509config.Backdate)
+	cf.allowCap = bool(x509config.AllowCap)
+	// Init: CRL settings
+	cf.crlNextUpdateDays = defaultCRLUpdate
+	if crl := x509config.CRL; crl != nil {
+		if crl.NextUpdateDays > 0 {
+			cf.crlNextUpdateDays = int(crl.NextUpdateDays)
+		}
+		cf.crlDistributionPointURLs = crl.DistributionPoints
+	}
+	// Init: OCSP settings
+	cf.ocspListenAddress = defaultOCSPListen
+	cf.ocspNextUpdateHours = defaultOCSPUpdate
+	cf.ocspSignerValidityDays = defaultOCSPSigner
+	if ocsp := x509config.OCSP; ocsp != nil {
+		cf.ocspResponderURLs = ocsp.ResponderURLs
+		if ocsp.ListenAddress != "" {
+			cf.ocspListenAddress = ocsp.ListenAddress
+		}
+		if ocsp.NextUpdateHours > 0 {
+			cf.ocspNextUpdateHours = int(ocsp.NextUpdateHours)
+		}
+		cf.ocspDelegatedSigner = bool(ocsp.DelegatedSigner)
+		if ocsp.SignerValidityDays > 0 {
+			cf.ocspSignerValidityDays = int(ocsp.SignerValidityDays)
+		}
+	}
+	// Init: CSR policy
+	cf.csrPolicy = newCSRPolicyParams(x509config.CSRPolicy)
+	// Init: renewal settings
+	cf.renewBeforeDays = defaultRenewBefore
+	if renewal := x509config.Renewal; renewal != nil {
+		if renewal.RenewBeforeDays > 0 {
+			cf.renewBeforeDays = int(renewal.RenewBeforeDays)
+		}
+		cf.renewReuseKey = bool(renewal.ReuseKey)
+	}
+	// Init: private key protection, failing before the PKI setup directory is cleaned up
+	if cf.protection, err = newKeyProtection(x509config.KeyProtection); err != nil {
+		return cf, err
+	}
+	// Init: external CA files and password, also read before the cleanup
+	if x509config.ExternalCA != nil {
+		if cf.external, err = newExternalCAParams(x509config.ExternalCA, bool(x509config.KeyScheme.AllowWeakKeys), cf.newCA); err != nil {
+			return cf, err
+		}
+	}
+	// Init: intermediate CA name, PEM key/cert/chain filenames and constraints
+	if x509config.IntermediateCA != nil {
+		cf.intermediate = newIntermediateParams(x509config.IntermediateCA, cf.pkiCaDir)
+	}
+	// Init: TLS servers host.domain, subjects and PEM key/cert filenames
+	for _, t := range x509config.TLSServers {
+		cf.servers = append(cf.servers, newServerParams(x509config, t, cf.pkiCaDir))
+		if cf.caDomain == "" {
+			cf.caDomain = t.TLSDomain
+		}
+	}
 
 	// Print the JSON parameters to console
 	if cf.dumpConfig {
@@ -133,34 +248,34 @@ func CreateEnv(x509config *X509Config) (CertConfig, error) {
 	if cf.newCA {
 		// Remove eventual previous PKI setup directory
 		// Create a new empty PKI setup directory
-		log.Println("New CA creation requested by configuration")
-		log.Println("Cleaning up CA PKI setup directory")
+		lg.Println("New CA creation requested by configuration")
+		lg.Println("Cleaning up CA PKI setup directory")
 
 		err = os.RemoveAll(cf.pkiCaDir) // Remove pkiCaDir
 		if err != nil {
-			return cf, fmt.Errorf("Failed to remove the existing CA PKI configuration directory: %s (%s)", cf.pkiCaDir, err)
+			return cf, fmt.Errorf("%w: failed to remove %s: %v", ErrPKIDir, cf.pkiCaDir, err)
 		}
 
-		log.Printf("Creating CA PKI setup directory: %s", cf.pkiCaDir)
+		lg.Printf("Creating CA PKI setup directory: %s", cf.pkiCaDir)
 		err = os.MkdirAll(cf.pkiCaDir, 0750) // Create pkiCaDir
 		if err != nil {
-			return cf, fmt.Errorf("Failed to create the CA PKI configuration directory: %s (%s)", cf.pkiCaDir, err)
+			return cf, fmt.Errorf("%w: failed to create %s: %v", ErrPKIDir, cf.pkiCaDir, err)
 		}
 	} else { // Using an existing PKI setup directory, if new CA is *NOT* requested
-		log.Println("No new CA creation requested by configuration")
+		lg.Println("No new CA creation requested by configuration")
 
 		// Is the CA there? (if nil then OK... but could be something else than a directory)
 		stat, err := os.Stat(cf.pkiCaDir)
 		if err != nil {
 			if os.IsNotExist(err) {
-				return cf, fmt.Errorf("CA PKI setup directory does not exist: %s", cf.pkiCaDir)
+				return cf, fmt.Errorf("%w: %s does not exist", ErrPKIDir, cf.pkiCaDir)
 			}
-			return cf, fmt.Errorf("CA PKI setup directory cannot be reached: %s (%s)", cf.pkiCaDir, err)
+			return cf, fmt.Errorf("%w: %s cannot be reached: %v", ErrPKIDir, cf.pkiCaDir, err)
 		}
 		if stat.IsDir() {
-			log.Printf("Existing CA PKI setup directory: %s", cf.pkiCaDir)
+			lg.Printf("Existing CA PKI setup directory: %s", cf.pkiCaDir)
 		} else {
-			return cf, fmt.Errorf("Existing CA PKI setup directory is not a directory: %s", cf.pkiCaDir)
+			return cf, fmt.Errorf("%w: %s is not a directory", ErrPKIDir, cf.pkiCaDir)
 		}
 	}
 	return cf, nil
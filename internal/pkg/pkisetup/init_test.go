@@ -20,14 +20,18 @@
 package pkisetup
 
 import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"errors"
 	"testing"
+	"time"
 )
 
 var testKeyScheme = KeyScheme{
-	DumpKeys:   "false",
-	RSA:        "false",
-	RSAKeySize: "4096",
-	EC:         "true",
+	DumpKeys:   false,
+	RSA:        false,
+	RSAKeySize: 4096,
+	EC:         true,
 	ECCurve:    "384",
 }
 
@@ -49,13 +53,13 @@ var testTLSServer = TLSServer{
 }
 
 var testX509Config = X509Config{
-	CreateNewRootCA: "true",
+	CreateNewRootCA: true,
 	WorkingDir:      "./testconfig",
 	PKISetupDir:     "pki",
-	DumpConfig:      "true",
+	DumpConfig:      true,
 	KeyScheme:       testKeyScheme,
 	RootCA:          testRootCA,
-	TLSServer:       testTLSServer,
+	TLSServers:      TLSServerList{testTLSServer},
 }
 
 func TestCreateEnvWithValidConfig(t *testing.T) {
@@ -66,3 +70,72 @@ func TestCreateEnvWithValidConfig(t *testing.T) {
 		t.Errorf("Failed to create X509 env with correct configuration data.")
 	}
 }
+
+func TestCreateEnvMissingPKIDir(t *testing.T) {
+	myconfig := testX509Config
+	myconfig.CreateNewRootCA = false
+	myconfig.WorkingDir = t.TempDir()
+	_, err := CreateEnv(&myconfig)
+	if !errors.Is(err, ErrPKIDir) {
+		t.Errorf("Expected %v, got %v", ErrPKIDir, err)
+	}
+}
+
+func TestGenCertsMultipleServers(t *testing.T) {
+	x509config, err := ParseConfig([]byte(`{
+        "create_new_rootca": true,
+        "working_dir": "` + t.TempDir() + `",
+        "key_scheme": {"ec": true, "ec_curve": "256"},
+        "x509_root_ca_parameters": {"ca_name": "TestCA"},
+        "x509_tls_server_parameters": [
+            {"tls_host": "edgex-vault", "tls_domain": "local"},
+            {"tls_host": "edgex-kong", "dns_names": ["edgex-kong"], "validity_days": 90,
+             "key_scheme": {"rsa": true, "rsa_key_size": 2048}}
+        ]
+    }`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	cf, err := CreateEnv(&x509config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if _, _, err = GenCA(&cf); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	certs, keys, err := GenCerts(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(certs) != 2 || len(keys) != 2 {
+		t.Fatalf("Expected 2 certificates, got %d", len(certs))
+	}
+	if _, ok := keys[0].(*ecdsa.PrivateKey); !ok || certs[0].DNSNames[1] != "edgex-vault.local" {
+		t.Errorf("Unexpected edgex-vault certificate: %v %T", certs[0].DNSNames, keys[0])
+	}
+	if _, ok := keys[1].(*rsa.PrivateKey); !ok || certs[1].NotAfter.After(time.Now().AddDate(0, 0, 91)) {
+		t.Errorf("Unexpected edgex-kong certificate: %s %T", certs[1].NotAfter, keys[1])
+	}
+
+	// A single host is issued again on renewal
+	if _, _, err = GenCert(&cf, "edgex-kong"); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+	if _, _, err = GenCert(&cf, "edgex-mqtt"); !errors.Is(err, ErrUnknownServer) {
+		t.Errorf("Expected %v, got %v", ErrUnknownServer, err)
+	}
+}
+
+func TestDuplicateServers(t *testing.T) {
+	_, err := ParseConfig([]byte(`{
+        "x509_root_ca_parameters": {"ca_name": "CA"},
+        "x509_tls_server_parameters": [
+            {"tls_host": "edgex-kong", "tls_domain": "local"},
+            {"tls_host": "edgex-kong", "tls_domain": "local", "key_scheme": {"ec_curve": "111"}}
+        ]
+    }`))
+	paths := errorPaths(t, err)
+	if len(paths) != 2 || paths[0] != "x509_tls_server_parameters[1].key_scheme.ec_curve" || paths[1] != "x509_tls_server_parameters[1].tls_host" {
+		t.Errorf("Unexpected errors %v", paths)
+	}
+}
@@ -0,0 +1,284 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// PEMInfo describes a PEM block found by the inspect command. Private keys are never decoded
+// beyond their algorithm.
+type PEMInfo struct {
+	File         string           `json:"file"`
+	Type         string           `json:"type"` // PEM block type, e.g. CERTIFICATE
+	Certificate  *CertificateInfo `json:"certificate,omitempty"`
+	KeyAlgorithm string           `json:"key_algorithm,omitempty"` // private keys and certificate requests
+	Error        string           `json:"error,omitempty"`         // block not parsable
+}
+
+// CertificateInfo describes a certificate found by the inspect command. IssuedBy and
+// IssuerFingerprint link it to its issuer when the issuer is among the inspected certificates.
+type CertificateInfo struct {
+	Subject            string    `json:"subject"`
+	Issuer             string    `json:"issuer"`
+	Serial             string    `json:"serial"` // hexadecimal
+	DNSNames           []string  `json:"dns_names,omitempty"`
+	IPAddresses        []string  `json:"ip_addresses,omitempty"`
+	URIs               []string  `json:"uris,omitempty"`
+	EmailAddresses     []string  `json:"email_addresses,omitempty"`
+	KeyAlgorithm       string    `json:"key_algorithm"`
+	SignatureAlgorithm string    `json:"signature_algorithm"`
+	NotBefore          time.Time `json:"not_before"`
+	NotAfter           time.Time `json:"not_after"`
+	SHA256Fingerprint  string    `json:"sha256_fingerprint"`
+	SHA1Fingerprint    string    `json:"sha1_fingerprint"`
+	IsCA               bool      `json:"is_ca"`
+	KeyUsage           []string  `json:"key_usage,omitempty"`
+	ExtKeyUsage        []string  `json:"ext_key_usage,omitempty"`
+	Extensions         []string  `json:"extensions,omitempty"`
+	SelfSigned         bool      `json:"self_signed"`
+	IssuedBy           string    `json:"issued_by,omitempty"` // file of the issuer
+	IssuerFingerprint  string    `json:"issuer_sha256_fingerprint,omitempty"`
+
+	cert *x509.Certificate
+}
+
+var keyUsageNames = []string{
+	"digitalSignature", "contentCommitment", "keyEncipherment", "dataEncipherment",
+	"keyAgreement", "keyCertSign", "cRLSign", "encipherOnly", "decipherOnly",
+}
+
+var extKeyUsageNames = map[x509.ExtKeyUsage]string{
+	x509.ExtKeyUsageAny:             "any",
+	x509.ExtKeyUsageServerAuth:      "serverAuth",
+	x509.ExtKeyUsageClientAuth:      "clientAuth",
+	x509.ExtKeyUsageCodeSigning:     "codeSigning",
+	x509.ExtKeyUsageEmailProtection: "emailProtection",
+	x509.ExtKeyUsageTimeStamping:    "timeStamping",
+	x509.ExtKeyUsageOCSPSigning:     "OCSPSigning",
+}
+
+var extensionNames = map[string]string{
+	"2.5.29.14":            "subjectKeyIdentifier",
+	"2.5.29.15":            "keyUsage",
+	"2.5.29.17":            "subjectAltName",
+	"2.5.29.19":            "basicConstraints",
+	"2.5.29.30":            "nameConstraints",
+	"2.5.29.31":            "cRLDistributionPoints",
+	"2.5.29.35":            "authorityKeyIdentifier",
+	"2.5.29.37":            "extKeyUsage",
+	"1.3.6.1.5.5.7.1.1":    "authorityInfoAccess",
+	"1.3.6.1.5.5.7.48.1.5": "ocspNoCheck",
+}
+
+// Inspect describes every PEM block of a file, or of the files below a directory. The issuer of
+// each certificate is looked up among the inspected ones.
+func Inspect(path string) ([]PEMInfo, error) {
+	var infos []PEMInfo
+	err := filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+			infos = append(infos, inspectBlock(file, block))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrPEMUnreadable, path, err)
+	}
+	linkIssuers(infos)
+	return infos, nil
+}
+
+func inspectBlock(file string, block *pem.Block) PEMInfo {
+	info := PEMInfo{File: file, Type: block.Type}
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			info.Error = err.Error()
+			break
+		}
+		info.Certificate = newCertificateInfo(cert)
+	case "CERTIFICATE REQUEST":
+		csr, err := x509.ParseCertificateRequest(block.Bytes)
+		if err != nil {
+			info.Error = err.Error()
+			break
+		}
+		info.KeyAlgorithm = keyAlgorithm(csr.PublicKey)
+	case "PRIVATE KEY":
+		sk, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			info.Error = err.Error()
+			break
+		}
+		if signer, ok := sk.(crypto.Signer); ok {
+			info.KeyAlgorithm = keyAlgorithm(signer.Public())
+		}
+	}
+	return info
+}
+
+func newCertificateInfo(cert *x509.Certificate) *CertificateInfo {
+	sha1Sum := sha1.Sum(cert.Raw)
+	c := &CertificateInfo{
+		Subject:            cert.Subject.String(),
+		Issuer:             cert.Issuer.String(),
+		Serial:             serialHex(cert.SerialNumber),
+		DNSNames:           cert.DNSNames,
+		EmailAddresses:     cert.EmailAddresses,
+		KeyAlgorithm:       keyAlgorithm(cert.PublicKey),
+		SignatureAlgorithm: cert.SignatureAlgorithm.String(),
+		NotBefore:          cert.NotBefore,
+		NotAfter:           cert.NotAfter,
+		SHA256Fingerprint:  Fingerprint(cert),
+		SHA1Fingerprint:    hex.EncodeToString(sha1Sum[:]),
+		IsCA:               cert.IsCA,
+		cert:               cert,
+	}
+	for _, ip := range cert.IPAddresses {
+		c.IPAddresses = append(c.IPAddresses, ip.String())
+	}
+	for _, u := range cert.URIs {
+		c.URIs = append(c.URIs, u.String())
+	}
+	for i, name := range keyUsageNames {
+		if cert.KeyUsage&(1<<uint(i)) != 0 {
+			c.KeyUsage = append(c.KeyUsage, name)
+		}
+	}
+	for _, usage := range cert.ExtKeyUsage {
+		c.ExtKeyUsage = append(c.ExtKeyUsage, extKeyUsageNames[usage])
+	}
+	for _, ext := range cert.Extensions {
+		name := extensionName(ext.Id)
+		if ext.Critical {
+			name += " (critical)"
+		}
+		c.Extensions = append(c.Extensions, name)
+	}
+	c.SelfSigned = isSelfSigned(cert)
+	return c
+}
+
+func extensionName(oid asn1.ObjectIdentifier) string {
+	if name, ok := extensionNames[oid.String()]; ok {
+		return name
+	}
+	return oid.String()
+}
+
+// linkIssuers sets the file and fingerprint of the issuer of every certificate, the first one
+// found whose subject is the certificate issuer and whose key verifies its signature
+func linkIssuers(infos []PEMInfo) {
+	for _, info := range infos {
+		c := info.Certificate
+		if c == nil || c.SelfSigned {
+			continue
+		}
+		for _, candidate := range infos {
+			issuer := candidate.Certificate
+			if issuer != nil && string(issuer.cert.RawSubject) == string(c.cert.RawIssuer) && c.cert.CheckSignatureFrom(issuer.cert) == nil {
+				c.IssuedBy, c.IssuerFingerprint = candidate.File, issuer.SHA256Fingerprint
+				break
+			}
+		}
+	}
+}
+
+// WriteInspection prints the PEM blocks described by Inspect, as indented JSON if jsonOutput is set
+func WriteInspection(w io.Writer, infos []PEMInfo, jsonOutput bool) error {
+	if jsonOutput {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(infos)
+	}
+	for _, info := range infos {
+		fmt.Fprintf(w, "%s: %s\n", info.File, info.Type)
+		if info.Error != "" {
+			fmt.Fprintf(w, "  error:           %s\n", info.Error)
+		}
+		if info.KeyAlgorithm != "" {
+			fmt.Fprintf(w, "  key algorithm:   %s\n", info.KeyAlgorithm)
+		}
+		c := info.Certificate
+		if c == nil {
+			continue
+		}
+		fmt.Fprintf(w, "  subject:         %s\n", c.Subject)
+		fmt.Fprintf(w, "  issuer:          %s\n", c.Issuer)
+		fmt.Fprintf(w, "  serial:          %s\n", c.Serial)
+		if sans := c.subjectAltNames(); len(sans) > 0 {
+			fmt.Fprintf(w, "  names:           %s\n", strings.Join(sans, ", "))
+		}
+		fmt.Fprintf(w, "  key algorithm:   %s\n", c.KeyAlgorithm)
+		fmt.Fprintf(w, "  signature:       %s\n", c.SignatureAlgorithm)
+		fmt.Fprintf(w, "  validity:        %s - %s\n", c.NotBefore.UTC().Format(time.RFC3339), c.NotAfter.UTC().Format(time.RFC3339))
+		fmt.Fprintf(w, "  SHA-256:         %s\n", c.SHA256Fingerprint)
+		fmt.Fprintf(w, "  SHA-1:           %s\n", c.SHA1Fingerprint)
+		fmt.Fprintf(w, "  CA:              %t\n", c.IsCA)
+		if len(c.KeyUsage) > 0 {
+			fmt.Fprintf(w, "  key usage:       %s\n", strings.Join(c.KeyUsage, ", "))
+		}
+		if len(c.ExtKeyUsage) > 0 {
+			fmt.Fprintf(w, "  ext key usage:   %s\n", strings.Join(c.ExtKeyUsage, ", "))
+		}
+		fmt.Fprintf(w, "  extensions:      %s\n", strings.Join(c.Extensions, ", "))
+		switch {
+		case c.SelfSigned:
+			fmt.Fprintln(w, "  issued by:       itself (self-signed)")
+		case c.IssuedBy != "":
+			fmt.Fprintf(w, "  issued by:       %s (SHA-256 %s)\n", c.IssuedBy, c.IssuerFingerprint)
+		default:
+			fmt.Fprintln(w, "  issued by:       not among the inspected certificates")
+		}
+	}
+	return nil
+}
+
+func (c *CertificateInfo) subjectAltNames() []string {
+	var names []string
+	names = append(names, c.DNSNames...)
+	names = append(names, c.IPAddresses...)
+	names = append(names, c.URIs...)
+	names = append(names, c.EmailAddresses...)
+	return names
+}
@@ -0,0 +1,84 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestInspect(t *testing.T) {
+	cf, root, _ := newTestCA(t, intermediateConfig)
+	intermediate, _, err := GenIntermediateCA(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	certs, _, err := GenCerts(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	infos, err := Inspect(cf.pkiCaDir)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	byFile := map[string]PEMInfo{}
+	for _, info := range infos {
+		byFile[info.File] = info
+	}
+	ca := byFile[cf.caCertFile].Certificate
+	if ca == nil || !ca.SelfSigned || !ca.IsCA || ca.SHA256Fingerprint != Fingerprint(root) {
+		t.Errorf("Unexpected Root CA description %+v", ca)
+	}
+	leaf := byFile[cf.servers[0].tlsCertFile].Certificate
+	if leaf == nil || leaf.SelfSigned || leaf.KeyAlgorithm != "ecdsa-p256" || leaf.Serial != serialHex(certs[0].SerialNumber) {
+		t.Fatalf("Unexpected TLS server description %+v", leaf)
+	}
+	if leaf.DNSNames[0] != "edgex-kong" || leaf.IPAddresses[0] != "10.0.0.5" || leaf.ExtKeyUsage[0] != "serverAuth" {
+		t.Errorf("Unexpected TLS server names and usages %v %v %v", leaf.DNSNames, leaf.IPAddresses, leaf.ExtKeyUsage)
+	}
+	if leaf.IssuedBy == "" || leaf.IssuerFingerprint != Fingerprint(intermediate) {
+		t.Errorf("TLS server not linked to its issuer: %q %s", leaf.IssuedBy, leaf.IssuerFingerprint)
+	}
+	if key := byFile[cf.servers[0].tlsKeyFile]; key.Type != "PRIVATE KEY" || key.KeyAlgorithm != "ecdsa-p256" || key.Certificate != nil {
+		t.Errorf("Unexpected private key description %+v", key)
+	}
+
+	var out bytes.Buffer
+	if err = WriteInspection(&out, infos, true); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	var decoded []PEMInfo
+	if err = json.Unmarshal(out.Bytes(), &decoded); err != nil || len(decoded) != len(infos) {
+		t.Errorf("Unexpected JSON output: %v", err)
+	}
+	out.Reset()
+	WriteInspection(&out, infos, false)
+	if !strings.Contains(out.String(), "issued by:       itself (self-signed)") {
+		t.Errorf("Unexpected text output:\n%s", out.String())
+	}
+
+	if _, err = Inspect(filepath.Join(cf.pkiCaDir, "missing.pem")); !errors.Is(err, ErrPEMUnreadable) {
+		t.Errorf("Expected ErrPEMUnreadable, got %v", err)
+	}
+}
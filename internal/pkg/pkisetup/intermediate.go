@@ -0,0 +1,293 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const chainFileExt = ".fullchain.pem"
+
+/* intermediateParams holds the settings of the intermediate CA */
+type intermediateParams struct {
+	caName       string
+	caKeyFile    string
+	caCertFile   string
+	caChainFile  string // intermediate followed by the Root CA
+	caCountry    string
+	caState      string
+	caLocality   string
+	caOrg        string
+	pathLen      int
+	validity     validityPeriod
+	permittedDNS []string
+	excludedDNS  []string
+	permittedIPs []*net.IPNet
+	excludedIPs  []*net.IPNet
+}
+
+func newIntermediateParams(ica *IntermediateCA, pkiCaDir string) *intermediateParams {
+	ip := &intermediateParams{
+		caName:       ica.CAName,
+		caKeyFile:    filepath.Join(pkiCaDir, ica.CAName+skFileExt),
+		caCertFile:   filepath.Join(pkiCaDir, ica.CAName+certFileExt),
+		caChainFile:  filepath.Join(pkiCaDir, ica.CAName+chainFileExt),
+		caCountry:    ica.CACountry,
+		caState:      ica.CAState,
+		caLocality:   ica.CALocality,
+		caOrg:        ica.CAOrg,
+		pathLen:      int(ica.PathLen),
+		validity:     newValidityPeriod(ica.ValidityDays, ica.Validity, ica.NotAfter, defaultCAValidity),
+		permittedDNS: ica.PermittedDNSDomains,
+		excludedDNS:  ica.ExcludedDNSDomains,
+		permittedIPs: parseIPRanges(ica.PermittedIPRanges),
+		excludedIPs:  parseIPRanges(ica.ExcludedIPRanges),
+	}
+	return ip
+}
+
+func parseIPRanges(ranges []string) []*net.IPNet {
+	var nets []*net.IPNet
+	for _, r := range ranges {
+		if _, n, err := net.ParseCIDR(r); err == nil {
+			nets = append(nets, n)
+		}
+	}
+	return nets
+}
+
+// validate reports the inconsistent intermediate CA settings. Its files must not overwrite the
+// ones of the Root CA or of a TLS server.
+func (ica IntermediateCA) validate(rootName string, hosts map[string]bool, errs *ConfigErrors) {
+	const path = "x509_intermediate_ca_parameters"
+	switch {
+	case ica.CAName == "":
+		errs.add(path+".ca_name", "is required")
+	case strings.ContainsAny(ica.CAName, `/\`):
+		errs.add(path+".ca_name", "must not contain a path separator")
+	case ica.CAName == rootName || hosts[ica.CAName]:
+		errs.add(path+".ca_name", "%q is already used, the key and certificate files would be overwritten", ica.CAName)
+	}
+	if ica.PathLen < 0 {
+		errs.add(path+".path_len", "must be positive")
+	}
+	if ica.ValidityDays < 0 {
+		errs.add(path+".validity_days", "must be positive")
+	}
+	validateValidity(path, ica.ValidityDays, ica.Validity, ica.NotAfter, errs)
+	for _, d := range []struct {
+		key     string
+		domains []string
+	}{{"permitted_dns_domains", ica.PermittedDNSDomains}, {"excluded_dns_domains", ica.ExcludedDNSDomains}} {
+		for i, domain := range d.domains {
+			if strings.Contains(domain, "*") || checkDNSName(strings.TrimPrefix(domain, ".")) != nil {
+				errs.add(fmt.Sprintf("%s.%s[%d]", path, d.key, i), "%q is not a DNS domain", domain)
+			}
+		}
+	}
+	for _, r := range []struct {
+		key    string
+		ranges []string
+	}{{"permitted_ip_ranges", ica.PermittedIPRanges}, {"excluded_ip_ranges", ica.ExcludedIPRanges}} {
+		for i, cidr := range r.ranges {
+			if _, _, err := net.ParseCIDR(cidr); err != nil {
+				errs.add(fmt.Sprintf("%s.%s[%d]", path, r.key, i), "%q is not a CIDR IP range", cidr)
+			}
+		}
+	}
+}
+
+// checkNames reports the TLS server names the intermediate CA name constraints forbid, since the
+// certificate would be issued but rejected by every client
+func (ica IntermediateCA) checkNames(path string, san subjectAltNames, errs *ConfigErrors) {
+	for _, name := range san.dnsNames {
+		if !domainAllowed(name, ica.PermittedDNSDomains, ica.ExcludedDNSDomains) {
+			errs.add(path, "DNS name %q is outside of the intermediate CA name constraints", name)
+		}
+	}
+	for _, ip := range san.ips {
+		if !ipAllowed(ip, parseIPRanges(ica.PermittedIPRanges), parseIPRanges(ica.ExcludedIPRanges)) {
+			errs.add(path, "IP address %s is outside of the intermediate CA name constraints", ip)
+		}
+	}
+}
+
+// domainMatches applies a RFC 5280 DNS name constraint: "example.com" matches the domain and its
+// subdomains, ".example.com" its subdomains only
+func domainMatches(name string, constraint string) bool {
+	name, constraint = strings.ToLower(strings.TrimSuffix(name, ".")), strings.ToLower(constraint)
+	if strings.HasPrefix(constraint, ".") {
+		return strings.HasSuffix(name, constraint)
+	}
+	return name == constraint || strings.HasSuffix(name, "."+constraint)
+}
+
+func domainAllowed(name string, permitted []string, excluded []string) bool {
+	for _, c := range excluded {
+		if domainMatches(name, c) {
+			return false
+		}
+	}
+	if len(permitted) == 0 {
+		return true
+	}
+	for _, c := range permitted {
+		if domainMatches(name, c) {
+			return true
+		}
+	}
+	return false
+}
+
+func ipAllowed(ip net.IP, permitted []*net.IPNet, excluded []*net.IPNet) bool {
+	for _, n := range excluded {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	if len(permitted) == 0 {
+		return true
+	}
+	for _, n := range permitted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+/*GenIntermediateCA creates a new intermediate CA signed by the Root CA, saves its key, certificate and chain to PEM files and returns the x509 certificate and crypto private key. The Root CA private key is not needed afterwards to issue the TLS server certificates.*/
+func GenIntermediateCA(cf *CertConfig) (*x509.Certificate, crypto.PrivateKey, error) {
+	ip := cf.intermediate
+	if ip == nil {
+		return nil, nil, fmt.Errorf("%w: no x509_intermediate_ca_parameters", ErrCertGeneration)
+	}
+
+	lg.Println("")
+	lg.Println("<Phase 1b> Generating intermediate CA PKI materials")
+	rootCert, rootSK, err := cf.loadCAFiles(cf.caCertFile, cf.caKeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	lg.Println("Generating intermediate CA key pair (sk,pk)")
+	caSK, err := genSK(cf.keyParams)
+	if err != nil {
+		return nil, nil, err
+	}
+	caPK := caSK.(crypto.Signer).Public()
+	if cf.dumpKeys {
+		dumpKeyPair(caSK, caPK)
+	}
+
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, "serial number", err)
+	}
+	skid, err := subjectKeyID(caPK)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The intermediate CA cannot outlive the Root CA
+	notBefore, notAfter, err := ip.validity.bounds(time.Now(), cf.backdate, rootCert, cf.allowCap)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s", err, ip.caCertFile)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			CommonName:         ip.caName,
+			Organization:       []string{ip.caName},
+			OrganizationalUnit: []string{ip.caOrg},
+			Locality:           []string{ip.caLocality},
+			Province:           []string{ip.caState},
+			Country:            []string{ip.caCountry},
+		},
+
+		SubjectKeyId: skid,
+
+		NotAfter:  notAfter,
+		NotBefore: notBefore,
+
+		KeyUsage: x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+
+		CRLDistributionPoints: cf.crlDistributionPoints(rootCert.Subject.CommonName),
+		OCSPServer:            cf.ocspServers(rootCert.Subject.CommonName),
+
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            ip.pathLen,
+		MaxPathLenZero:        ip.pathLen == 0,
+
+		PermittedDNSDomainsCritical: true,
+		PermittedDNSDomains:         ip.permittedDNS,
+		ExcludedDNSDomains:          ip.excludedDNS,
+		PermittedIPRanges:           ip.permittedIPs,
+		ExcludedIPRanges:            ip.excludedIPs,
+
+		SignatureAlgorithm: signatureAlgorithm(rootSK),
+	}
+
+	lg.Printf("Generating intermediate CA certificate (signed with our local Root CA)")
+	caDER, err := x509.CreateCertificate(rand.Reader, template, rootCert, caPK, rootSK)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, ip.caCertFile, err)
+	}
+	caCert, err := x509.ParseCertificate(caDER)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrCertGeneration, ip.caCertFile, err)
+	}
+
+	lg.Printf("Saving intermediate CA private key to PEM file: %s", ip.caKeyFile)
+	if err = cf.protection.writeCAKey(ip.caKeyFile, caSK, 0400); err != nil {
+		return nil, nil, err
+	}
+
+	lg.Printf("Saving intermediate CA certificate to PEM file: %s", ip.caCertFile)
+	err = ioutil.WriteFile(ip.caCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0644)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%w: %s: %v", ErrWriteFailed, ip.caCertFile, err)
+	}
+
+	if err = cf.recordIssued(caCert, ip.caCertFile); err != nil {
+		return nil, nil, err
+	}
+
+	lg.Printf("Saving intermediate CA chain to PEM file: %s", ip.caChainFile)
+	if err = writeCertChain(ip.caChainFile, []*x509.Certificate{caCert, rootCert}); err != nil {
+		return nil, nil, err
+	}
+
+	lg.Printf("New intermediate CA successfully created! The Root CA private key %s can now be moved offline.", cf.caKeyFile)
+
+	return caCert, caSK, nil
+}
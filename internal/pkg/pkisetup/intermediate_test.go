@@ -0,0 +1,146 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+const intermediateConfig = `{
+    "create_new_rootca": true,
+    "working_dir": "%s",
+    "key_scheme": {"ec": true, "ec_curve": "256"},
+    "x509_root_ca_parameters": {"ca_name": "TestCA"},
+    "x509_intermediate_ca_parameters": {
+        "ca_name": "TestIntermediateCA",
+        "permitted_dns_domains": ["local", "edgex-kong"],
+        "permitted_ip_ranges": ["10.0.0.0/8"]
+    },
+    "x509_tls_server_parameters": [
+        {"tls_host": "edgex-kong", "tls_domain": "local", "ip_addresses": ["10.0.0.5"]}
+    ]
+}`
+
+func readCerts(t *testing.T, file string) []*x509.Certificate {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs
+}
+
+func TestIntermediateCA(t *testing.T) {
+	cf, root, _ := newTestCA(t, intermediateConfig)
+	intermediate, _, err := GenIntermediateCA(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if root.MaxPathLen != 1 || intermediate.MaxPathLen != 0 || !intermediate.MaxPathLenZero || len(intermediate.PermittedDNSDomains) != 2 {
+		t.Errorf("Unexpected path lengths %d/%d or name constraints %v", root.MaxPathLen, intermediate.MaxPathLen, intermediate.PermittedDNSDomains)
+	}
+	if chain := readCerts(t, cf.intermediate.caChainFile); len(chain) != 2 || !chain[1].Equal(root) {
+		t.Errorf("Unexpected intermediate CA chain of %d certificates", len(chain))
+	}
+
+	// The Root CA private key is not needed anymore to issue the TLS server certificates
+	os.Chmod(cf.caKeyFile, 0600)
+	if err = os.Remove(cf.caKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	certs, _, err := GenCerts(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if certs[0].CheckSignatureFrom(intermediate) != nil {
+		t.Errorf("TLS server certificate not signed by the intermediate CA")
+	}
+
+	chain := readCerts(t, cf.servers[0].tlsChainFile)
+	if len(chain) != 2 || !chain[0].Equal(certs[0]) || !chain[1].Equal(intermediate) {
+		t.Fatalf("Unexpected full chain of %d certificates", len(chain))
+	}
+	roots, intermediates := x509.NewCertPool(), x509.NewCertPool()
+	roots.AddCert(root)
+	intermediates.AddCert(chain[1])
+	if _, err = chain[0].Verify(x509.VerifyOptions{DNSName: "edgex-kong.local", Roots: roots, Intermediates: intermediates}); err != nil {
+		t.Errorf("Full chain not verified: %s", err.Error())
+	}
+}
+
+func TestIntermediateCAValidation(t *testing.T) {
+	_, err := ParseConfig([]byte(`{
+        "x509_root_ca_parameters": {"ca_name": "CA"},
+        "x509_intermediate_ca_parameters": {
+            "ca_name": "edgex-kong",
+            "path_len": -1,
+            "permitted_dns_domains": ["*.local", "example.com"],
+            "excluded_ip_ranges": ["10.0.0.5"]
+        },
+        "x509_tls_server_parameters": {"tls_host": "edgex-kong", "tls_domain": "local"}
+    }`))
+	expected := []string{
+		"x509_intermediate_ca_parameters.ca_name",
+		"x509_intermediate_ca_parameters.excluded_ip_ranges[0]",
+		"x509_intermediate_ca_parameters.path_len",
+		"x509_intermediate_ca_parameters.permitted_dns_domains[0]",
+		"x509_tls_server_parameters",
+		"x509_tls_server_parameters",
+	}
+	paths := errorPaths(t, err)
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected errors at %v, got %v (%v)", expected, paths, err)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("Expected errors at %v, got %v", expected, paths)
+			break
+		}
+	}
+}
+
+func TestDomainMatches(t *testing.T) {
+	tests := []struct {
+		name, constraint string
+		expected         bool
+	}{
+		{"edgex-kong.local", "local", true},
+		{"local", "local", true},
+		{"local", ".local", false},
+		{"a.b.local", ".local", true},
+		{"notlocal", "local", false},
+		{"EDGEX.Local.", "local", true},
+	}
+	for _, tt := range tests {
+		if domainMatches(tt.name, tt.constraint) != tt.expected {
+			t.Errorf("%s against %s: expected %t", tt.name, tt.constraint, tt.expected)
+		}
+	}
+}
@@ -23,65 +23,107 @@ package pkisetup
 import (
 	"crypto"
 	"crypto/ecdsa"
+	"crypto/ed25519"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/x509"
 	"fmt"
-	"log"
+	"strconv"
 )
 
-/*GenSK creates a new RSA or EC based private key (sk)*/
-func genSK(cf *CertConfig) (crypto.PrivateKey, error) {
+/*GenSK creates a new RSA, ECDSA or Ed25519 private key (sk) of the key algorithm*/
+func genSK(cf keyParams) (crypto.PrivateKey, error) {
 
-	if cf.rsaScheme {
-		log.Printf("- Generating private key with RSA scheme %d", cf.rsaKeySize)
-		return rsa.GenerateKey(rand.Reader, cf.rsaKeySize)
+	lg.Printf("- Generating private key with algorithm %s", cf.algorithm)
+	var sk crypto.PrivateKey
+	var err error
+	switch cf.algorithm {
+	case "rsa-1024", "rsa-2048", "rsa-3072", "rsa-4096":
+		bits, _ := strconv.Atoi(cf.algorithm[len("rsa-"):])
+		sk, err = rsa.GenerateKey(rand.Reader, bits)
+	case "ecdsa-p224": // secp224r1 NIST P-224
+		sk, err = ecdsa.GenerateKey(elliptic.P224(), rand.Reader)
+	case "ecdsa-p256": // secp256v1 NIST P-256
+		sk, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case "ecdsa-p384": // secp384r1 NIST P-384
+		sk, err = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case "ecdsa-p521": // secp521r1 NIST P-521
+		sk, err = ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case "ed25519":
+		_, sk, err = ed25519.GenerateKey(rand.Reader)
+	default:
+		return nil, fmt.Errorf("%w: unknown key algorithm %q", ErrKeyScheme, cf.algorithm)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrKeyGeneration, cf.algorithm, err)
 	}
+	return sk, nil
+}
 
-	if cf.ecScheme {
-		log.Printf("- Generating private key with EC scheme %s", cf.ecCurve)
-		var curve elliptic.Curve
-		switch cf.ecCurve {
-		case "224": // secp224r1 NIST P-224
-			curve = elliptic.P224()
-		case "256": // secp256v1 NIST P-256
-			curve = elliptic.P256()
-		case "384": // secp384r1 NIST P-384
-			curve = elliptic.P384()
-		case "521": // secp521r1 NIST P-521
-			curve = elliptic.P521()
-		default:
-			return nil, fmt.Errorf("Unknown elliptic curve: %q", cf.ecCurve)
-		}
-		return ecdsa.GenerateKey(curve, rand.Reader)
+// keyAlgorithm names the algorithm of a public key as in key_algorithm, empty if unsupported
+func keyAlgorithm(pk crypto.PublicKey) string {
+	switch k := pk.(type) {
+	case *rsa.PublicKey:
+		return "rsa-" + strconv.Itoa(k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ecdsa-p" + strconv.Itoa(k.Curve.Params().BitSize)
+	case ed25519.PublicKey:
+		return "ed25519"
 	}
+	return ""
+}
 
-	return nil, fmt.Errorf("Unknown key scheme: RSA[%t] EC[%t]", cf.rsaScheme, cf.ecScheme)
+// signatureAlgorithm returns the algorithm a CA signs with, its hash matching the strength of
+// the CA key: SHA-384 for RSA 4096 and P-384, SHA-512 for P-521, SHA-256 otherwise
+func signatureAlgorithm(caSK crypto.PrivateKey) x509.SignatureAlgorithm {
+	switch k := caSK.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() >= 4096 {
+			return x509.SHA384WithRSA
+		}
+		return x509.SHA256WithRSA
+	case *ecdsa.PrivateKey:
+		switch k.Curve {
+		case elliptic.P384():
+			return x509.ECDSAWithSHA384
+		case elliptic.P521():
+			return x509.ECDSAWithSHA512
+		}
+		return x509.ECDSAWithSHA256
+	case ed25519.PrivateKey:
+		return x509.PureEd25519
+	}
+	return x509.UnknownSignatureAlgorithm
 }
 
-/*dumpKeyPair output sk,pk keypair (RSA or EC) to console. !!! Debug only for obvious security reasons...*/
+/*dumpKeyPair output sk,pk keypair (RSA, EC or Ed25519) to console. !!! Debug only for obvious security reasons...*/
 func dumpKeyPair(sk crypto.PrivateKey, pk crypto.PublicKey) error {
 
-	log.Println("")
+	lg.Println("")
 	switch sk.(type) {
 	case *rsa.PrivateKey:
-		log.Printf(">> RSA SK: %q", sk)
+		lg.Printf(">> RSA SK: %q", sk)
 	case *ecdsa.PrivateKey:
-		log.Printf(">> ECDSA SK: %q", sk)
+		lg.Printf(">> ECDSA SK: %q", sk)
+	case ed25519.PrivateKey:
+		lg.Printf(">> Ed25519 SK: %q", sk)
 	default:
-		log.Println("Unsupported Private Key")
+		lg.Println("Unsupported Private Key")
 	}
 
-	log.Println("")
+	lg.Println("")
 	switch pk.(type) {
 	case *rsa.PublicKey:
-		log.Printf(">> RSA PK: %q", pk)
+		lg.Printf(">> RSA PK: %q", pk)
 	case *ecdsa.PublicKey:
-		log.Printf(">> ECDSA PK: %q", pk)
+		lg.Printf(">> ECDSA PK: %q", pk)
+	case ed25519.PublicKey:
+		lg.Printf(">> Ed25519 PK: %q", pk)
 	default:
-		log.Println("Unsupported Public Key")
+		lg.Println("Unsupported Public Key")
 	}
-	log.Println("")
+	lg.Println("")
 
 	return nil
 }
@@ -20,14 +20,121 @@
 package pkisetup
 
 import (
+	"crypto"
+	"crypto/x509"
 	"testing"
 )
 
 func TestGenSKWithValidConfig(t *testing.T) {
 	myconfig := testConfig
-	_, err := genSK(&myconfig)
+	_, err := genSK(myconfig.keyParams)
 
 	if err != nil {
 		t.Errorf("Failed to create privatekey with correct configuration data.")
 	}
 }
+
+const keyAlgorithmConfig = `{
+    "create_new_rootca": true,
+    "working_dir": "%s",
+    "key_scheme": {"key_algorithm": "%s", "allow_weak_keys": true},
+    "x509_root_ca_parameters": {"ca_name": "TestCA"},
+    "x509_tls_server_parameters": {"tls_host": "edgex-vault", "tls_domain": "local"}
+}`
+
+func TestKeyAlgorithms(t *testing.T) {
+	signatures := map[string]x509.SignatureAlgorithm{
+		"rsa-1024":   x509.SHA256WithRSA,
+		"rsa-2048":   x509.SHA256WithRSA,
+		"rsa-3072":   x509.SHA256WithRSA,
+		"rsa-4096":   x509.SHA384WithRSA,
+		"ecdsa-p224": x509.ECDSAWithSHA256,
+		"ecdsa-p256": x509.ECDSAWithSHA256,
+		"ecdsa-p384": x509.ECDSAWithSHA384,
+		"ecdsa-p521": x509.ECDSAWithSHA512,
+		"ed25519":    x509.PureEd25519,
+	}
+	algorithms := append(append([]string{}, keyAlgorithms...), weakKeyAlgorithms...)
+
+	// One leaf key per algorithm, signed by a CA of every algorithm
+	leafKeys := map[string]crypto.PublicKey{}
+	for _, algorithm := range algorithms {
+		sk, err := genSK(keyParams{algorithm: algorithm})
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", algorithm, err.Error())
+		}
+		if got := keyAlgorithm(sk.(crypto.Signer).Public()); got != algorithm {
+			t.Errorf("%s: generated a %s key", algorithm, got)
+		}
+		leafKeys[algorithm] = sk.(crypto.Signer).Public()
+	}
+	for _, caAlgorithm := range algorithms {
+		t.Run(caAlgorithm, func(t *testing.T) {
+			cf, ca, caSK := newTestCA(t, keyAlgorithmConfig, caAlgorithm)
+			if ca.SignatureAlgorithm != signatures[caAlgorithm] {
+				t.Errorf("%s: Root CA signed with %s", caAlgorithm, ca.SignatureAlgorithm)
+			}
+			for _, leafAlgorithm := range algorithms {
+				s := cf.servers[0]
+				s.algorithm = leafAlgorithm
+				cert, err := cf.signCert(ca, caSK, s, leafKeys[leafAlgorithm], s.subject())
+				if err != nil {
+					t.Errorf("%s CA, %s leaf: unexpected error: %s", caAlgorithm, leafAlgorithm, err.Error())
+					continue
+				}
+				if err = cert.CheckSignatureFrom(ca); err != nil {
+					t.Errorf("%s CA, %s leaf: %s", caAlgorithm, leafAlgorithm, err.Error())
+				}
+				if cert.SignatureAlgorithm != signatures[caAlgorithm] {
+					t.Errorf("%s CA, %s leaf: expected a %s signature, got %s", caAlgorithm, leafAlgorithm, signatures[caAlgorithm], cert.SignatureAlgorithm)
+				}
+				if encipherment := cert.KeyUsage&x509.KeyUsageKeyEncipherment != 0; encipherment != s.rsaKey() {
+					t.Errorf("%s CA, %s leaf: unexpected key encipherment usage %t", caAlgorithm, leafAlgorithm, encipherment)
+				}
+			}
+		})
+	}
+}
+
+func TestKeyAlgorithmValidation(t *testing.T) {
+	_, err := ParseConfig([]byte(`{
+        "key_scheme": {"key_algorithm": "rsa-1024"},
+        "x509_root_ca_parameters": {"ca_name": "CA"},
+        "x509_tls_server_parameters": [
+            {"tls_host": "edgex-kong", "tls_domain": "local", "key_scheme": {"ec": true, "ec_curve": "224"}},
+            {"tls_host": "edgex-vault", "tls_domain": "local", "key_scheme": {"key_algorithm": "dsa-1024"}},
+            {"tls_host": "edgex-redis", "tls_domain": "local", "key_scheme": {"key_algorithm": "ed25519", "rsa": true}},
+            {"tls_host": "edgex-mqtt", "tls_domain": "local", "key_scheme": {"key_algorithm": "ecdsa-p224", "allow_weak_keys": true}}
+        ]
+    }`))
+	expected := []string{
+		"key_scheme.key_algorithm",
+		"x509_tls_server_parameters[0].key_scheme.ec_curve",
+		"x509_tls_server_parameters[1].key_scheme.key_algorithm",
+		"x509_tls_server_parameters[2].key_scheme.key_algorithm",
+	}
+	paths := errorPaths(t, err)
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected errors at %v, got %v (%v)", expected, paths, err)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("Expected errors at %v, got %v", expected, paths)
+			break
+		}
+	}
+
+	// Weak keys allowed globally are allowed for every server, not for OCSP with ed25519 keys
+	x509config, err := ParseConfig([]byte(`{
+        "key_scheme": {"key_algorithm": "ed25519", "allow_weak_keys": true},
+        "x509_root_ca_parameters": {"ca_name": "CA"},
+        "x509_ocsp_parameters": {},
+        "x509_tls_server_parameters": {"tls_host": "edgex-kong", "tls_domain": "local", "key_scheme": {"rsa": true, "rsa_key_size": 1024}}
+    }`))
+	if paths = errorPaths(t, err); len(paths) != 1 || paths[0] != "x509_ocsp_parameters" {
+		t.Errorf("Expected an error at x509_ocsp_parameters, got %v", err)
+	}
+	if alg := x509config.keyScheme(x509config.TLSServers[0]).algorithm(); alg != "rsa-1024" {
+		t.Errorf("Expected rsa-1024, got %s", alg)
+	}
+}
@@ -0,0 +1,352 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const (
+	ocspSignerSuffix = "-ocsp"
+	maxOCSPRequest   = 10 * 1024 // bytes
+)
+
+// ocspNoCheckExtension tells the clients not to check the revocation of a delegated OCSP signing
+// certificate (id-pkix-ocsp-nocheck, RFC 6960 4.2.2.2.1)
+var ocspNoCheckExtension = pkix.Extension{Id: asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 48, 1, 5}, Value: asn1.NullRawValue.FullBytes}
+
+// validate reports the inconsistent OCSP settings. The delegated signer files must not overwrite
+// the ones of a TLS server.
+func (o OCSPParameters) validate(c *X509Config, hosts map[string]bool, errs *ConfigErrors) {
+	const path = "x509_ocsp_parameters"
+	for i, u := range o.ResponderURLs {
+		if err := checkURI(strings.Replace(u, "{ca}", "ca", -1)); err != nil {
+			errs.add(fmt.Sprintf("%s.responder_urls[%d]", path, i), "%s", err.Error())
+		}
+	}
+	if o.ListenAddress != "" {
+		if _, _, err := net.SplitHostPort(o.ListenAddress); err != nil {
+			errs.add(path+".listen_address", "%q is not a host:port address", o.ListenAddress)
+		}
+	}
+	if o.NextUpdateHours < 0 {
+		errs.add(path+".next_update_hours", "must be positive")
+	}
+	if o.SignerValidityDays < 0 {
+		errs.add(path+".signer_validity_days", "must be positive")
+	}
+	// The CA and delegated signer keys share the global key scheme
+	if c.KeyScheme.algorithm() == "ed25519" {
+		errs.add(path, "OCSP responses cannot be signed with ed25519 keys, use an RSA or ECDSA key_algorithm")
+	}
+	if o.DelegatedSigner {
+		names := []string{c.RootCA.CAName}
+		if c.IntermediateCA != nil {
+			names = append(names, c.IntermediateCA.CAName)
+		}
+		for _, name := range names {
+			if hosts[name+ocspSignerSuffix] {
+				errs.add(path+".delegated_signer", "%q is already used, the key and certificate files would be overwritten", name+ocspSignerSuffix)
+			}
+		}
+	}
+}
+
+// ocspServers returns the OCSP responder URLs of the certificates issued by a CA, where {ca}
+// stands for the CA name
+func (cf *CertConfig) ocspServers(issuer string) []string {
+	return expandCAName(cf.ocspResponderURLs, issuer)
+}
+
+// ocspSigner returns the settings of the delegated OCSP signing certificate of a CA
+func (cf *CertConfig) ocspSigner(name string) serverParams {
+	host := name + ocspSignerSuffix
+	return serverParams{
+		keyParams:    cf.keyParams,
+		tlsHost:      host,
+		tlsNames:     subjectAltNames{commonName: name + " OCSP Responder"},
+		tlsKeyFile:   filepath.Join(cf.pkiCaDir, host+skFileExt),
+		tlsCertFile:  filepath.Join(cf.pkiCaDir, host+certFileExt),
+		tlsChainFile: filepath.Join(cf.pkiCaDir, host+chainFileExt),
+		tlsCountry:   cf.caCountry,
+		tlsState:     cf.caState,
+		tlsLocality:  cf.caLocality,
+		tlsOrg:       cf.caOrg,
+		validity:     days(cf.ocspSignerValidityDays),
+		profile:      profileOCSPSigning,
+	}
+}
+
+// GenOCSPSigners issues the delegated OCSP signing certificate of every CA whose private key is
+// at hand, so that the responder does not need the CA private keys
+func GenOCSPSigners(cf *CertConfig) ([]*x509.Certificate, error) {
+	lg.Println("")
+	lg.Println("<Phase 3> Generating delegated OCSP signing PKI materials")
+
+	var certs []*x509.Certificate
+	for _, name := range cf.onlineCAs("issuing its OCSP signing certificate") {
+		certFile, keyFile, err := cf.caFiles(name)
+		if err != nil {
+			return nil, err
+		}
+		caCert, caSK, err := cf.loadCAFiles(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		cert, _, err := cf.issueCert(caCert, caSK, cf.ocspSigner(name))
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// ocspIssuer is a CA the responder answers for, with the certificate and key signing its responses
+type ocspIssuer struct {
+	name      string
+	cert      *x509.Certificate
+	responder *x509.Certificate // the delegated OCSP signing certificate, or the CA itself
+	signer    crypto.Signer
+}
+
+// matches tells whether a request asks about a certificate issued by the CA: RFC 6960 identifies
+// the issuer by the hashes of its name and public key
+func (i ocspIssuer) matches(req *ocsp.Request) bool {
+	if !req.HashAlgorithm.Available() {
+		return false
+	}
+	var spki struct {
+		Algorithm pkix.AlgorithmIdentifier
+		PublicKey asn1.BitString
+	}
+	if _, err := asn1.Unmarshal(i.cert.RawSubjectPublicKeyInfo, &spki); err != nil {
+		return false
+	}
+	nameHash := req.HashAlgorithm.New()
+	nameHash.Write(i.cert.RawSubject)
+	keyHash := req.HashAlgorithm.New()
+	keyHash.Write(spki.PublicKey.RightAlign())
+	return bytes.Equal(nameHash.Sum(nil), req.IssuerNameHash) && bytes.Equal(keyHash.Sum(nil), req.IssuerKeyHash)
+}
+
+// OCSPResponder answers RFC 6960 requests from the issuance index, read again for every request
+// so that revocations apply without a restart
+type OCSPResponder struct {
+	cf      *CertConfig
+	issuers []ocspIssuer
+	now     func() time.Time
+}
+
+// NewOCSPResponder loads the signers of the responses: the delegated OCSP signing certificates if
+// configured, the CA private keys otherwise. A CA whose key was moved offline is skipped.
+func NewOCSPResponder(cf *CertConfig) (*OCSPResponder, error) {
+	r := &OCSPResponder{cf: cf, now: time.Now}
+	names := []string{cf.caName}
+	if cf.intermediate != nil {
+		names = append(names, cf.intermediate.caName)
+	}
+	for _, name := range names {
+		caCertFile, caKeyFile, err := cf.caFiles(name)
+		if err != nil {
+			return nil, err
+		}
+		certFile, keyFile := caCertFile, caKeyFile
+		if cf.ocspDelegatedSigner {
+			signer := cf.ocspSigner(name)
+			certFile, keyFile = signer.tlsCertFile, signer.tlsKeyFile
+		}
+		if _, err = os.Stat(keyFile); os.IsNotExist(err) && cf.intermediate != nil && name == cf.caName {
+			lg.Printf("OCSP signing key %s is offline, not answering for %s", keyFile, name)
+			continue
+		}
+		responder, sk, err := cf.loadCAFiles(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		issuer := ocspIssuer{name: name, cert: responder, responder: responder, signer: sk.(crypto.Signer)}
+		if cf.ocspDelegatedSigner {
+			if issuer.cert, err = readCertFile(caCertFile); err != nil {
+				return nil, err
+			}
+			if responder.CheckSignatureFrom(issuer.cert) != nil {
+				return nil, fmt.Errorf("%w: %s: not issued by %s", ErrCACertUnreadable, certFile, name)
+			}
+		}
+		r.issuers = append(r.issuers, issuer)
+	}
+	if len(r.issuers) == 0 {
+		return nil, fmt.Errorf("%w: no OCSP signing key at hand", ErrCAKeyUnreadable)
+	}
+	return r, nil
+}
+
+// readCertFile reads a PEM certificate file
+func readCertFile(certFile string) (*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCACertUnreadable, certFile, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, fmt.Errorf("%w: %w: %s: expected a CERTIFICATE block", ErrCACertUnreadable, ErrCertTypeMismatch, certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrCACertUnreadable, certFile, err)
+	}
+	return cert, nil
+}
+
+// getRequest reads the OCSP request of a GET from the last segment of its path, after the
+// responder URL path such as /{ca}. RFC 6960 clients URL-encode the base64 request, escaping its
+// '/'; the unescaped ones are tolerated by extending the request over the previous segments.
+func getRequest(escapedPath string) ([]byte, error) {
+	segments := strings.Split(strings.TrimPrefix(escapedPath, "/"), "/")
+	for i := len(segments) - 1; i >= 0; i-- {
+		b64, err := url.PathUnescape(strings.Join(segments[i:], "/"))
+		if err != nil {
+			return nil, err
+		}
+		if der, err := base64.StdEncoding.DecodeString(b64); err == nil {
+			if _, err = ocsp.ParseRequest(der); err == nil {
+				return der, nil
+			}
+		}
+	}
+	return nil, errors.New("no base64 OCSP request in the path")
+}
+
+// ServeHTTP answers the OCSP requests sent by POST, or base64 encoded in the path of a GET
+func (r *OCSPResponder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var der []byte
+	var err error
+	switch req.Method {
+	case http.MethodPost:
+		der, err = ioutil.ReadAll(http.MaxBytesReader(w, req.Body, maxOCSPRequest))
+	case http.MethodGet:
+		der, err = getRequest(req.URL.EscapedPath())
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "OCSP requests are sent by GET or POST", http.StatusMethodNotAllowed)
+		return
+	}
+	resp := ocsp.MalformedRequestErrorResponse
+	if err == nil {
+		resp = r.respond(der)
+	}
+	w.Header().Set("Content-Type", "application/ocsp-response")
+	w.Write(resp)
+}
+
+// respond returns the signed response to a DER request, or an RFC 6960 error response
+func (r *OCSPResponder) respond(der []byte) []byte {
+	req, err := ocsp.ParseRequest(der)
+	if err != nil {
+		lg.Printf("Malformed OCSP request: %v", err)
+		return ocsp.MalformedRequestErrorResponse
+	}
+	var issuer *ocspIssuer
+	for i := range r.issuers {
+		if r.issuers[i].matches(req) {
+			issuer = &r.issuers[i]
+			break
+		}
+	}
+	if issuer == nil {
+		lg.Printf("OCSP request for serial %s of an unknown CA", serialHex(req.SerialNumber))
+		return ocsp.UnauthorizedErrorResponse
+	}
+	index, err := ReadIndex(r.cf)
+	if err != nil {
+		lg.Printf("OCSP request for serial %s: %v", serialHex(req.SerialNumber), err)
+		return ocsp.InternalErrorErrorResponse
+	}
+
+	now := r.now()
+	template := ocsp.Response{
+		Status:       ocsp.Unknown,
+		SerialNumber: req.SerialNumber,
+		ThisUpdate:   now,
+		NextUpdate:   now.Add(time.Duration(r.cf.ocspNextUpdateHours) * time.Hour),
+	}
+	// A delegated signer is embedded for the clients to verify it was issued by the CA
+	if issuer.responder != issuer.cert {
+		template.Certificate = issuer.responder
+	}
+	serial := serialHex(req.SerialNumber)
+	for _, entry := range index.Certificates {
+		if entry.Serial != serial || entry.Issuer != issuer.name {
+			continue
+		}
+		template.Status = ocsp.Good
+		if entry.Status == StatusRevoked {
+			template.Status, template.RevokedAt, template.RevocationReason = ocsp.Revoked, *entry.RevokedAt, entry.Reason
+		}
+		break
+	}
+	resp, err := ocsp.CreateResponse(issuer.cert, issuer.responder, template, issuer.signer)
+	if err != nil {
+		lg.Printf("OCSP request for serial %s: %v", serial, err)
+		return ocsp.InternalErrorErrorResponse
+	}
+	lg.Printf("OCSP request for serial %s of %s: %s", serial, issuer.name, ocspStatus(template.Status))
+	return resp
+}
+
+func ocspStatus(status int) string {
+	switch status {
+	case ocsp.Good:
+		return "good"
+	case ocsp.Revoked:
+		return "revoked"
+	}
+	return "unknown"
+}
+
+// ServeOCSP runs the OCSP responder on addr, the configured listen_address if empty
+func ServeOCSP(cf *CertConfig, addr string) error {
+	r, err := NewOCSPResponder(cf)
+	if err != nil {
+		return err
+	}
+	if addr == "" {
+		addr = cf.ocspListenAddress
+	}
+	lg.Printf("OCSP responder listening on %s", addr)
+	return http.ListenAndServe(addr, r)
+}
@@ -0,0 +1,199 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+const ocspConfig = `{
+    "create_new_rootca": true,
+    "working_dir": "%s",
+    "key_scheme": {"ec": true, "ec_curve": "256"},
+    "x509_root_ca_parameters": {"ca_name": "TestCA"},
+    "x509_ocsp_parameters": {
+        "responder_urls": ["http://edgex-ocsp.local:8888/{ca}"],
+        "next_update_hours": 1,
+        "delegated_signer": %t
+    },
+    "x509_tls_server_parameters": [
+        {"tls_host": "edgex-vault", "tls_domain": "local"},
+        {"tls_host": "edgex-kong", "tls_domain": "local"}
+    ]
+}`
+
+// queryOCSP sends an OCSP request for cert with the x/crypto/ocsp client, by POST or GET
+func queryOCSP(t *testing.T, serverURL string, cert, issuer *x509.Certificate, get bool) *ocsp.Response {
+	der, err := ocsp.CreateRequest(cert, issuer, &ocsp.RequestOptions{Hash: crypto.SHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The responder URL advertised in the certificate, on the test server
+	aia, err := url.Parse(cert.OCSPServer[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	responderURL := serverURL + aia.Path
+	var resp *http.Response
+	if get {
+		resp, err = http.Get(responderURL + "/" + url.PathEscape(base64.StdEncoding.EncodeToString(der)))
+	} else {
+		resp, err = http.Post(responderURL, "application/ocsp-request", bytes.NewReader(der))
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ocsp.ParseResponseForCert(body, cert, issuer)
+	if err != nil {
+		t.Fatalf("Unexpected OCSP response: %s", err.Error())
+	}
+	return parsed
+}
+
+func TestOCSPResponder(t *testing.T) {
+	for _, delegated := range []bool{false, true} {
+		t.Run(fmt.Sprintf("delegated=%t", delegated), func(t *testing.T) {
+			cf, ca, _ := newTestCA(t, ocspConfig, delegated)
+			certs, _, err := GenCerts(&cf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			if aia := certs[0].OCSPServer; len(aia) != 1 || aia[0] != "http://edgex-ocsp.local:8888/TestCA" {
+				t.Errorf("Unexpected OCSP responder URLs %v", aia)
+			}
+			if delegated {
+				signers, err := GenOCSPSigners(&cf)
+				if err != nil {
+					t.Fatalf("Unexpected error: %s", err.Error())
+				}
+				if len(signers) != 1 || signers[0].ExtKeyUsage[0] != x509.ExtKeyUsageOCSPSigning || len(signers[0].OCSPServer) != 0 {
+					t.Fatalf("Unexpected OCSP signing certificates %v", signers)
+				}
+			}
+			now := time.Now().Truncate(time.Second)
+			if _, err = Revoke(&cf, cf.servers[1].tlsCertFile, RevocationReasons["keyCompromise"], now); err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+
+			responder, err := NewOCSPResponder(&cf)
+			if err != nil {
+				t.Fatalf("Unexpected error: %s", err.Error())
+			}
+			responder.now = func() time.Time { return now }
+			server := httptest.NewServer(responder)
+			defer server.Close()
+
+			good := queryOCSP(t, server.URL, certs[0], ca, false)
+			if good.Status != ocsp.Good || !good.NextUpdate.Equal(now.Add(time.Hour)) {
+				t.Errorf("Expected a good status until %s, got %d until %s", now.Add(time.Hour), good.Status, good.NextUpdate)
+			}
+			if delegated != (good.Certificate != nil) {
+				t.Errorf("Delegated signer embedded: %t", good.Certificate != nil)
+			}
+			revoked := queryOCSP(t, server.URL, certs[1], ca, true)
+			if revoked.Status != ocsp.Revoked || revoked.RevocationReason != ocsp.KeyCompromise || !revoked.RevokedAt.Equal(now) {
+				t.Errorf("Expected a revoked status, got %d (reason %d at %s)", revoked.Status, revoked.RevocationReason, revoked.RevokedAt)
+			}
+
+			// A serial number the CA never issued
+			unknown := *certs[0]
+			unknown.SerialNumber = big.NewInt(42)
+			if resp := queryOCSP(t, server.URL, &unknown, ca, false); resp.Status != ocsp.Unknown {
+				t.Errorf("Expected an unknown status, got %d", resp.Status)
+			}
+		})
+	}
+}
+
+func TestOCSPResponderErrors(t *testing.T) {
+	cf, _, _ := newTestCA(t, ocspConfig, false)
+	responder, err := NewOCSPResponder(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if resp := responder.respond([]byte("not an OCSP request")); !bytes.Equal(resp, ocsp.MalformedRequestErrorResponse) {
+		t.Errorf("Expected a malformed request response")
+	}
+
+	// A certificate of another CA, unrelated to the pkisetup configuration
+	_, other, _ := newTestCA(t, ocspConfig, false)
+	der, err := ocsp.CreateRequest(other, other, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp := responder.respond(der); !bytes.Equal(resp, ocsp.UnauthorizedErrorResponse) {
+		t.Errorf("Expected an unauthorized response")
+	}
+
+	// GET requests under the responder URL path, with their '/' escaped or not
+	b64 := base64.StdEncoding.EncodeToString(der)
+	for _, path := range []string{"/TestCA/" + url.PathEscape(b64), "/TestCA/" + b64, "/" + b64} {
+		if got, err := getRequest(path); err != nil || !bytes.Equal(got, der) {
+			t.Errorf("%s: request not read: %v", path, err)
+		}
+	}
+	if _, err = getRequest("/TestCA/bm90IGFuIE9DU1AgcmVxdWVzdA=="); err == nil {
+		t.Errorf("Expected a malformed GET request to be rejected")
+	}
+}
+
+func TestOCSPValidation(t *testing.T) {
+	_, err := ParseConfig([]byte(`{
+        "x509_root_ca_parameters": {"ca_name": "CA"},
+        "x509_ocsp_parameters": {
+            "responder_urls": ["edgex-ocsp"],
+            "listen_address": "8888",
+            "delegated_signer": true
+        },
+        "x509_tls_server_parameters": {"tls_host": "CA-ocsp", "tls_domain": "local"}
+    }`))
+	expected := []string{
+		"x509_ocsp_parameters.delegated_signer",
+		"x509_ocsp_parameters.listen_address",
+		"x509_ocsp_parameters.responder_urls[0]",
+	}
+	paths := errorPaths(t, err)
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected errors at %v, got %v (%v)", expected, paths, err)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("Expected errors at %v, got %v", expected, paths)
+			break
+		}
+	}
+}
@@ -0,0 +1,93 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/url"
+)
+
+// Certificate profiles selectable per leaf with the "profile" setting
+const (
+	ProfileServer       = "server"        // TLS server authentication, the default
+	ProfileClient       = "client"        // TLS client authentication, e.g. mutual TLS to Vault
+	ProfileServerClient = "server+client" // both, for services accepting and opening mutual TLS connections
+	ProfileCodeSigning  = "code-signing"  // signing of software artifacts
+)
+
+// profileOCSPSigning is the profile of the delegated OCSP signing certificates issued by pkisetup
+const profileOCSPSigning = "ocsp-signing"
+
+var validProfiles = []string{ProfileServer, ProfileClient, ProfileServerClient, ProfileCodeSigning}
+
+// profileUsage returns the key usages of a profile. Key encipherment is only meaningful with
+// RSA keys: the other key usages rely on digital signatures.
+func profileUsage(profile string, rsaKey bool) (x509.KeyUsage, []x509.ExtKeyUsage) {
+	usage := x509.KeyUsageDigitalSignature
+	if rsaKey && profile != ProfileCodeSigning && profile != profileOCSPSigning {
+		usage |= x509.KeyUsageKeyEncipherment
+	}
+	switch profile {
+	case ProfileClient:
+		return usage, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	case ProfileServerClient:
+		return usage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}
+	case ProfileCodeSigning:
+		return usage, []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}
+	case profileOCSPSigning:
+		return usage, []x509.ExtKeyUsage{x509.ExtKeyUsageOCSPSigning}
+	}
+	return usage, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+}
+
+// clientProfile tells whether certificates of a profile identify a client
+func clientProfile(profile string) bool {
+	return profile == ProfileClient || profile == ProfileServerClient
+}
+
+// serviceURI is the SPIFFE ID of a service: spiffe://<trust_domain>/service/<service_name>
+func serviceURI(trustDomain, serviceName string) *url.URL {
+	return &url.URL{Scheme: "spiffe", Host: trustDomain, Path: "/service/" + serviceName}
+}
+
+// validateProfile reports an unknown profile, or service identity settings not fitting it, under path
+func (t TLSServer) validateProfile(path string, errs *ConfigErrors) {
+	if t.Profile != "" && !containsString(validProfiles, t.Profile) {
+		errs.add(path+".profile", "unknown profile %q, expected one of %v", t.Profile, validProfiles)
+	}
+	if t.TrustDomain != "" {
+		if t.ServiceName == "" {
+			errs.add(path+".trust_domain", "requires service_name")
+		} else if err := checkURI(serviceURI(t.TrustDomain, t.ServiceName).String()); err != nil {
+			errs.add(path+".trust_domain", "%s", err.Error())
+		}
+	}
+	if t.ServiceName != "" && !clientProfile(t.Profile) {
+		errs.add(path+".service_name", "only applies to the %s and %s profiles", ProfileClient, ProfileServerClient)
+	}
+}
+
+// profileName describes a profile for the logs
+func profileName(profile string) string {
+	if profile == "" {
+		return fmt.Sprintf("%s (default)", ProfileServer)
+	}
+	return profile
+}
@@ -0,0 +1,113 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto/x509"
+	"testing"
+)
+
+func TestProfileUsage(t *testing.T) {
+	tests := []struct {
+		profile  string
+		rsa      bool
+		usage    x509.KeyUsage
+		extUsage []x509.ExtKeyUsage
+	}{
+		{"", true, x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}},
+		{ProfileServer, false, x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}},
+		{ProfileClient, false, x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}},
+		{ProfileServerClient, false, x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}},
+		{ProfileCodeSigning, true, x509.KeyUsageDigitalSignature, []x509.ExtKeyUsage{x509.ExtKeyUsageCodeSigning}},
+	}
+	for _, tt := range tests {
+		usage, extUsage := profileUsage(tt.profile, tt.rsa)
+		if usage != tt.usage || len(extUsage) != len(tt.extUsage) {
+			t.Errorf("%q: unexpected usages %v %v", tt.profile, usage, extUsage)
+			continue
+		}
+		for i := range extUsage {
+			if extUsage[i] != tt.extUsage[i] {
+				t.Errorf("%q: unexpected extended usages %v", tt.profile, extUsage)
+			}
+		}
+	}
+}
+
+func TestClientProfile(t *testing.T) {
+	x509config, err := ParseConfig([]byte(`{
+        "create_new_rootca": true,
+        "working_dir": "` + t.TempDir() + `",
+        "key_scheme": {"ec": true, "ec_curve": "256"},
+        "x509_root_ca_parameters": {"ca_name": "TestCA"},
+        "x509_tls_server_parameters": [
+            {"tls_host": "edgex-vaultworker", "profile": "client", "service_name": "edgex-vaultworker", "trust_domain": "edgexfoundry.org"}
+        ]
+    }`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	cf, err := CreateEnv(&x509config)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if _, _, err = GenCA(&cf); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	cert, _, err := GenCert(&cf, "edgex-vaultworker")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if cert.Subject.CommonName != "edgex-vaultworker" || len(cert.DNSNames) != 0 {
+		t.Errorf("Unexpected subject %s and DNS names %v", cert.Subject, cert.DNSNames)
+	}
+	if len(cert.URIs) != 1 || cert.URIs[0].String() != "spiffe://edgexfoundry.org/service/edgex-vaultworker" {
+		t.Errorf("Unexpected URIs %v", cert.URIs)
+	}
+	if len(cert.ExtKeyUsage) != 1 || cert.ExtKeyUsage[0] != x509.ExtKeyUsageClientAuth {
+		t.Errorf("Unexpected extended key usages %v", cert.ExtKeyUsage)
+	}
+}
+
+func TestInvalidProfile(t *testing.T) {
+	_, err := ParseConfig([]byte(`{
+        "x509_root_ca_parameters": {"ca_name": "CA"},
+        "x509_tls_server_parameters": [
+            {"tls_host": "a", "tls_domain": "local", "profile": "email"},
+            {"tls_host": "b", "tls_domain": "local", "service_name": "b"},
+            {"tls_host": "c", "profile": "client", "trust_domain": "edgexfoundry.org"}
+        ]
+    }`))
+	expected := []string{
+		"x509_tls_server_parameters[0].profile",
+		"x509_tls_server_parameters[1].service_name",
+		"x509_tls_server_parameters[2]",
+		"x509_tls_server_parameters[2].trust_domain",
+	}
+	paths := errorPaths(t, err)
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected errors at %v, got %v", expected, paths)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("Expected errors at %v, got %v", expected, paths)
+			break
+		}
+	}
+}
@@ -0,0 +1,183 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/youmark/pkcs8"
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const (
+	pkcs12FileExt         = ".p12"
+	encryptedKeyBlockType = "ENCRYPTED PRIVATE KEY"
+)
+
+// keyEncryption is the PBES2 scheme of the encrypted PKCS#8 private keys
+var keyEncryption = &pkcs8.Opts{
+	Cipher: pkcs8.AES256CBC,
+	KDFOpts: pkcs8.PBKDF2Opts{
+		SaltSize:       16,
+		IterationCount: 100000,
+		HMACHash:       crypto.SHA256,
+	},
+}
+
+/* keyProtection holds how the private keys are saved, and the password protecting them */
+type keyProtection struct {
+	password    []byte
+	encryptKeys bool // encrypted PKCS#8 instead of plain PKCS#8, for the CA keys
+	pkcs12      bool // PKCS#12 bundle of every TLS server
+}
+
+// validate reports the inconsistent key protection settings
+func (kp KeyProtection) validate(errs *ConfigErrors) {
+	const path = "x509_key_protection_parameters"
+	if !kp.EncryptKeys && !kp.PKCS12 {
+		errs.add(path, "neither encrypt_keys nor pkcs12 is enabled, the password would protect nothing")
+	}
+	if kp.PasswordFile != "" && kp.PasswordEnv != "" {
+		errs.add(path+".password_env", "conflicts with password_file, set only one password source")
+	}
+}
+
+// newKeyProtection reads the password of the key protection settings, if any, from its file or
+// environment variable
+func newKeyProtection(kp *KeyProtection) (keyProtection, error) {
+	if kp == nil {
+		return keyProtection{}, nil
+	}
+	k := keyProtection{encryptKeys: bool(kp.EncryptKeys), pkcs12: bool(kp.PKCS12)}
+	env := kp.PasswordEnv
+	if env == "" {
+		env = defaultPasswordEnv
+	}
+	var err error
+	k.password, err = readPassword(kp.PasswordFile, env)
+	return k, err
+}
+
+// readPassword reads a password from file if set, else from the env environment variable
+func readPassword(file string, env string) ([]byte, error) {
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrKeyPassword, file, err)
+		}
+		password := []byte(strings.TrimRight(string(data), "\r\n"))
+		if len(password) == 0 {
+			return nil, fmt.Errorf("%w: %s is empty", ErrKeyPassword, file)
+		}
+		return password, nil
+	}
+	password := []byte(os.Getenv(env))
+	if len(password) == 0 {
+		return nil, fmt.Errorf("%w: environment variable %s is not set", ErrKeyPassword, env)
+	}
+	return password, nil
+}
+
+// writeCAKey saves the private key of a Root or intermediate CA to a PKCS#8 PEM file, encrypted
+// with the password if set up so
+func (k keyProtection) writeCAKey(keyFile string, sk crypto.PrivateKey, perm os.FileMode) error {
+	if !k.encryptKeys {
+		return writePrivateKey(keyFile, sk, perm)
+	}
+	der, err := pkcs8.MarshalPrivateKey(sk, k.password, keyEncryption)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrKeyGeneration, keyFile, err)
+	}
+	return writeKeyBlock(keyFile, &pem.Block{Type: encryptedKeyBlockType, Bytes: der}, perm)
+}
+
+// writePrivateKey saves a private key to a plain PKCS#8 PEM file. The TLS server keys are never
+// encrypted: Vault, Kong and vaultworker read them in clear.
+func writePrivateKey(keyFile string, sk crypto.PrivateKey, perm os.FileMode) error {
+	der, err := x509.MarshalPKCS8PrivateKey(sk)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrKeyGeneration, keyFile, err)
+	}
+	return writeKeyBlock(keyFile, &pem.Block{Type: "PRIVATE KEY", Bytes: der}, perm)
+}
+
+// writeKeyBlock saves a private key PEM block to keyFile
+func writeKeyBlock(keyFile string, block *pem.Block, perm os.FileMode) error {
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(block), perm); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrWriteFailed, keyFile, err)
+	}
+	return nil
+}
+
+// decodePrivateKey parses a PKCS#8 PEM private key, decrypting it with password if encrypted
+func decodePrivateKey(data []byte, password []byte) (crypto.PrivateKey, error) {
+	block, _ := pem.Decode(data)
+	switch {
+	case block == nil:
+	case block.Type == "PRIVATE KEY":
+		return x509.ParsePKCS8PrivateKey(block.Bytes)
+	case block.Type == encryptedKeyBlockType:
+		if len(password) == 0 {
+			return nil, errors.New("encrypted private key without password, see x509_key_protection_parameters")
+		}
+		return pkcs8.ParsePKCS8PrivateKey(block.Bytes, password)
+	}
+	return nil, fmt.Errorf("%w: expected a PRIVATE KEY or %s block", ErrCertTypeMismatch, encryptedKeyBlockType)
+}
+
+// writePKCS12 bundles the private key and certificate of a TLS server with its chain, up to the
+// Root CA, in a password protected PKCS#12 file if set up so
+func (cf *CertConfig) writePKCS12(s serverParams, sk crypto.PrivateKey, cert *x509.Certificate, caCert *x509.Certificate) error {
+	if !cf.protection.pkcs12 || s.tlsPKCS12File == "" {
+		return nil
+	}
+	chain, err := cf.issuerChain(caCert)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cf.external != nil:
+		// Already up to the enterprise root
+	case len(chain) > 0:
+		root, err := readCertFile(cf.caCertFile)
+		if err != nil {
+			return err
+		}
+		chain = append(chain, root)
+	default:
+		chain = []*x509.Certificate{caCert}
+	}
+
+	lg.Printf("Saving TLS server PKCS#12 bundle: %s", s.tlsPKCS12File)
+	pfx, err := pkcs12.Modern.Encode(sk, cert, chain, string(cf.protection.password))
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrWriteFailed, s.tlsPKCS12File, err)
+	}
+	if err = ioutil.WriteFile(s.tlsPKCS12File, pfx, 0600); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrWriteFailed, s.tlsPKCS12File, err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto/ecdsa"
+	"crypto/tls"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+const protectionConfig = `{
+    "create_new_rootca": true,
+    "working_dir": "%s",
+    "key_scheme": {"ec": true, "ec_curve": "256"},
+    "x509_root_ca_parameters": {"ca_name": "TestCA"},
+    "x509_intermediate_ca_parameters": {"ca_name": "TestIntermediateCA"},
+    "x509_key_protection_parameters": {"encrypt_keys": true, "pkcs12": true, "password_env": "PKISETUP_TEST_PASSWORD"},
+    "x509_tls_server_parameters": [
+        {"tls_host": "edgex-kong", "tls_domain": "local"}
+    ]
+}`
+
+func TestKeyProtection(t *testing.T) {
+	t.Setenv("PKISETUP_TEST_PASSWORD", "s3cret")
+	cf, root, _ := newTestCA(t, protectionConfig)
+	// The encrypted Root CA key is read back to sign the intermediate CA, whose encrypted key
+	// signs the TLS server certificate
+	intermediate, _, err := GenIntermediateCA(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	cert, sk, err := GenCert(&cf, "edgex-kong")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	for _, keyFile := range []string{cf.caKeyFile, cf.intermediate.caKeyFile} {
+		data, _ := ioutil.ReadFile(keyFile)
+		if block, _ := pem.Decode(data); block == nil || block.Type != "ENCRYPTED PRIVATE KEY" {
+			t.Errorf("%s: expected an encrypted private key", keyFile)
+		}
+		if _, err = readPrivateKey(keyFile, nil); !errors.Is(err, ErrKeyUnreadable) {
+			t.Errorf("%s: expected ErrKeyUnreadable without password, got %v", keyFile, err)
+		}
+	}
+	// The TLS server key stays in clear, for Vault, Kong and vaultworker
+	saved, err := readPrivateKey(cf.servers[0].tlsKeyFile, nil)
+	if err != nil || !saved.(*ecdsa.PrivateKey).Equal(sk) {
+		t.Errorf("Private key not read back without password: %v", err)
+	}
+	if _, err = tls.LoadX509KeyPair(cf.servers[0].tlsCertFile, cf.servers[0].tlsKeyFile); err != nil {
+		t.Errorf("TLS server key pair not loaded: %v", err)
+	}
+
+	// The bundle holds the key, the certificate and its chain up to the Root CA
+	pfx, err := ioutil.ReadFile(filepath.Join(cf.pkiCaDir, "edgex-kong.p12"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	bundledSK, bundledCert, chain, err := pkcs12.DecodeChain(pfx, "s3cret")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if !bundledSK.(*ecdsa.PrivateKey).Equal(sk) || !bundledCert.Equal(cert) {
+		t.Errorf("Unexpected PKCS#12 key and certificate")
+	}
+	if len(chain) != 2 || !chain[0].Equal(intermediate) || !chain[1].Equal(root) {
+		t.Errorf("Unexpected PKCS#12 chain of %d certificates", len(chain))
+	}
+
+	cf.protection.password = []byte("wrong")
+	if _, _, err = LoadCA(&cf); !errors.Is(err, ErrCAKeyUnreadable) {
+		t.Errorf("Expected ErrCAKeyUnreadable, got %v", err)
+	}
+}
+
+func TestKeyPassword(t *testing.T) {
+	passwordFile := filepath.Join(t.TempDir(), "password")
+	ioutil.WriteFile(passwordFile, []byte("s3cret\n"), 0600)
+	k, err := newKeyProtection(&KeyProtection{EncryptKeys: true, PasswordFile: passwordFile})
+	if err != nil || string(k.password) != "s3cret" || !k.encryptKeys {
+		t.Errorf("Unexpected key protection %+v (%v)", k, err)
+	}
+
+	t.Setenv(defaultPasswordEnv, "")
+	if _, err = newKeyProtection(&KeyProtection{PKCS12: true}); !errors.Is(err, ErrKeyPassword) {
+		t.Errorf("Expected ErrKeyPassword, got %v", err)
+	}
+	t.Setenv(defaultPasswordEnv, "changeit")
+	if k, err = newKeyProtection(&KeyProtection{PKCS12: true}); err != nil || string(k.password) != "changeit" {
+		t.Errorf("Expected the %s password, got %q (%v)", defaultPasswordEnv, k.password, err)
+	}
+
+	_, err = ParseConfig([]byte(`{
+        "x509_root_ca_parameters": {"ca_name": "CA"},
+        "x509_key_protection_parameters": {"password_file": "password", "password_env": "PASSWORD"},
+        "x509_tls_server_parameters": {"tls_host": "edgex-kong", "tls_domain": "local"}
+    }`))
+	expected := []string{
+		"x509_key_protection_parameters",
+		"x509_key_protection_parameters.password_env",
+	}
+	paths := errorPaths(t, err)
+	if len(paths) != len(expected) || paths[0] != expected[0] || paths[1] != expected[1] {
+		t.Errorf("Expected errors at %v, got %v (%v)", expected, paths, err)
+	}
+}
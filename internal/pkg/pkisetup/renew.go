@@ -0,0 +1,170 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// backupTimeFormat is the timestamp suffix of the files replaced by the renew command
+const backupTimeFormat = "20060102T150405Z"
+
+// RenewalResult reports the certificate of a TLS server after the renew command
+type RenewalResult struct {
+	Host        string
+	Renewed     bool
+	Reason      string
+	Fingerprint string // SHA-256 of the certificate, hexadecimal
+	NotAfter    time.Time
+	Backups     []string // previous files kept with a timestamp suffix
+}
+
+// Fingerprint returns the SHA-256 fingerprint of a certificate
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// Renew re-issues the certificates of the TLS servers, or only of host if not empty, expiring
+// within the renewal window. The previous files are kept with a timestamp suffix. The CA is
+// reused and only loaded when a certificate is due.
+func Renew(cf *CertConfig, host string, now time.Time) ([]RenewalResult, error) {
+	lg.Println("")
+	lg.Println("<Phase 2> Renewing TLS server PKI materials")
+
+	var results []RenewalResult
+	var caCert *x509.Certificate
+	var caSK crypto.PrivateKey
+	window := time.Duration(cf.renewBeforeDays) * 24 * time.Hour
+	for _, s := range cf.servers {
+		if host != "" && s.tlsHost != host {
+			continue
+		}
+		result := RenewalResult{Host: s.tlsHost}
+		current, err := readCertFile(s.tlsCertFile)
+		switch {
+		case err != nil:
+			result.Reason = fmt.Sprintf("no usable certificate: %v", err)
+		case current.NotAfter.Sub(now) > window:
+			result.Reason = fmt.Sprintf("certificate expires %s, after the %d days renewal window", current.NotAfter.UTC().Format(time.RFC3339), cf.renewBeforeDays)
+			result.Fingerprint, result.NotAfter = Fingerprint(current), current.NotAfter
+			lg.Printf("TLS server %s: %s, not renewed", s.tlsHost, result.Reason)
+			results = append(results, result)
+			continue
+		default:
+			result.Reason = fmt.Sprintf("certificate expires %s, within the %d days renewal window", current.NotAfter.UTC().Format(time.RFC3339), cf.renewBeforeDays)
+		}
+		lg.Printf("TLS server %s: %s, renewing", s.tlsHost, result.Reason)
+
+		if caCert == nil {
+			if caCert, caSK, err = LoadCA(cf); err != nil {
+				return results, err
+			}
+		}
+		cert, err := cf.renewCert(caCert, caSK, s, now, &result)
+		if err != nil {
+			return results, err
+		}
+		result.Renewed, result.Fingerprint, result.NotAfter = true, Fingerprint(cert), cert.NotAfter
+		lg.Printf("TLS server %s renewed: SHA-256 fingerprint %s, expires %s", s.tlsHost, result.Fingerprint, result.NotAfter.UTC().Format(time.RFC3339))
+		results = append(results, result)
+	}
+	if host != "" && len(results) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownServer, host)
+	}
+	return results, nil
+}
+
+// renewCert keeps the files of a TLS server about to be replaced, then issues its certificate
+// with its current private key or a new one
+func (cf *CertConfig) renewCert(caCert *x509.Certificate, caSK crypto.PrivateKey, s serverParams, now time.Time, result *RenewalResult) (*x509.Certificate, error) {
+	var sk crypto.PrivateKey
+	replaced := []string{s.tlsCertFile, s.tlsChainFile, s.tlsPKCS12File}
+	if cf.renewReuseKey {
+		var err error
+		if sk, err = readPrivateKey(s.tlsKeyFile, cf.protection.password); err != nil {
+			return nil, err
+		}
+		s.algorithm = keyAlgorithm(sk.(crypto.Signer).Public())
+		lg.Printf("Reusing TLS server private key: %s", s.tlsKeyFile)
+	} else {
+		replaced = append(replaced, s.tlsKeyFile)
+	}
+
+	suffix := "." + now.UTC().Format(backupTimeFormat)
+	for _, file := range replaced {
+		kept, err := backupFile(file, file+suffix)
+		if err != nil {
+			return nil, err
+		}
+		if kept {
+			lg.Printf("Keeping previous file: %s", file+suffix)
+			result.Backups = append(result.Backups, file+suffix)
+		}
+	}
+
+	if sk == nil {
+		cert, _, err := cf.issueCert(caCert, caSK, s)
+		return cert, err
+	}
+	cert, err := cf.signCert(caCert, caSK, s, sk.(crypto.Signer).Public(), s.subject())
+	if err != nil {
+		return nil, err
+	}
+	return cert, cf.writePKCS12(s, sk, cert, caCert)
+}
+
+// backupFile copies file to backup with the same permissions, telling whether there was a file to keep
+func backupFile(file string, backup string) (bool, error) {
+	info, err := os.Stat(file)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("%w: %s: %v", ErrWriteFailed, backup, err)
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return false, fmt.Errorf("%w: %s: %v", ErrWriteFailed, backup, err)
+	}
+	if err = ioutil.WriteFile(backup, data, info.Mode().Perm()); err != nil {
+		return false, fmt.Errorf("%w: %s: %v", ErrWriteFailed, backup, err)
+	}
+	return true, nil
+}
+
+// readPrivateKey reads a PKCS#8 PEM private key file, decrypting it with password if encrypted
+func readPrivateKey(keyFile string, password []byte) (crypto.PrivateKey, error) {
+	data, err := ioutil.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrKeyUnreadable, keyFile, err)
+	}
+	sk, err := decodePrivateKey(data, password)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrKeyUnreadable, keyFile, err)
+	}
+	return sk, nil
+}
@@ -0,0 +1,109 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto/ecdsa"
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+const renewalConfig = `{
+    "create_new_rootca": true,
+    "working_dir": "%s",
+    "key_scheme": {"ec": true, "ec_curve": "256"},
+    "x509_root_ca_parameters": {"ca_name": "TestCA"},
+    "x509_renewal_parameters": {"renew_before_days": 30, "reuse_key": true},
+    "x509_tls_server_parameters": [
+        {"tls_host": "edgex-vault", "tls_domain": "local", "validity_days": 10},
+        {"tls_host": "edgex-kong", "tls_domain": "local"}
+    ]
+}`
+
+func TestRenew(t *testing.T) {
+	cf, _, _ := newTestCA(t, renewalConfig)
+	certs, keys, err := GenCerts(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	// Only the certificate expiring within 30 days is renewed, with the same key
+	now := time.Now()
+	results, err := Renew(&cf, "", now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(results) != 2 || !results[0].Renewed || results[1].Renewed {
+		t.Fatalf("Unexpected renewal results %+v", results)
+	}
+	if results[1].Fingerprint != Fingerprint(certs[1]) || !results[1].NotAfter.Equal(certs[1].NotAfter) {
+		t.Errorf("Unexpected report of the fresh certificate %+v", results[1])
+	}
+	renewed, err := readCertFile(cf.servers[0].tlsCertFile)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if renewed.Equal(certs[0]) || results[0].Fingerprint != Fingerprint(renewed) {
+		t.Errorf("Certificate not renewed")
+	}
+	if !renewed.PublicKey.(*ecdsa.PublicKey).Equal(keys[0].(*ecdsa.PrivateKey).Public()) {
+		t.Errorf("Private key not reused")
+	}
+	suffix := "." + now.UTC().Format(backupTimeFormat)
+	if len(results[0].Backups) != 1 || results[0].Backups[0] != cf.servers[0].tlsCertFile+suffix {
+		t.Fatalf("Unexpected backups %v", results[0].Backups)
+	}
+	if previous, err := readCertFile(results[0].Backups[0]); err != nil || !previous.Equal(certs[0]) {
+		t.Errorf("Previous certificate not kept: %v", err)
+	}
+
+	// A new key is generated otherwise, the previous one is kept too
+	cf.renewReuseKey = false
+	later := now.Add(time.Second)
+	results, err = Renew(&cf, "edgex-vault", later)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(results) != 1 || len(results[0].Backups) != 2 {
+		t.Fatalf("Unexpected renewal results %+v", results)
+	}
+	sk, err := readPrivateKey(cf.servers[0].tlsKeyFile, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if sk.(*ecdsa.PrivateKey).Equal(keys[0]) {
+		t.Errorf("Private key not replaced")
+	}
+	if _, err = os.Stat(cf.servers[0].tlsKeyFile + "." + later.UTC().Format(backupTimeFormat)); err != nil {
+		t.Errorf("Previous private key not kept: %s", err.Error())
+	}
+
+	if _, err = Renew(&cf, "edgex-mqtt", now); !errors.Is(err, ErrUnknownServer) {
+		t.Errorf("Expected ErrUnknownServer, got %v", err)
+	}
+
+	// The key to reuse must be there
+	cf.renewReuseKey = true
+	os.Remove(cf.servers[0].tlsKeyFile)
+	if _, err = Renew(&cf, "edgex-vault", now.Add(2*time.Second)); !errors.Is(err, ErrKeyUnreadable) {
+		t.Errorf("Expected ErrKeyUnreadable, got %v", err)
+	}
+}
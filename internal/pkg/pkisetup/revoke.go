@@ -0,0 +1,316 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	indexFileName = "index.json"
+	crlFileExt    = ".crl"
+)
+
+// Status of the certificates in the issuance index
+const (
+	StatusValid   = "valid"
+	StatusRevoked = "revoked"
+)
+
+// RevocationReasons maps the RFC 5280 reason names accepted by the revoke command to their codes
+var RevocationReasons = map[string]int{
+	"unspecified":          0,
+	"keyCompromise":        1,
+	"cACompromise":         2,
+	"affiliationChanged":   3,
+	"superseded":           4,
+	"cessationOfOperation": 5,
+	"privilegeWithdrawn":   9,
+}
+
+// IndexEntry is a certificate issued by one of the pkisetup CAs
+type IndexEntry struct {
+	Serial    string     `json:"serial"` // hexadecimal
+	Subject   string     `json:"subject"`
+	Issuer    string     `json:"issuer"` // name of the issuing CA
+	NotAfter  time.Time  `json:"not_after"`
+	Status    string     `json:"status"`
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+	Reason    int        `json:"reason,omitempty"`
+	File      string     `json:"file"`
+}
+
+// Index is the issuance index kept in the CA PKI setup directory
+type Index struct {
+	CRLNumber    int64        `json:"crl_number"`
+	Certificates []IndexEntry `json:"certificates"`
+}
+
+func (cf *CertConfig) indexFile() string {
+	return filepath.Join(cf.pkiCaDir, indexFileName)
+}
+
+// ReadIndex returns the issuance index, empty if nothing was issued yet
+func ReadIndex(cf *CertConfig) (Index, error) {
+	index := Index{}
+	data, err := ioutil.ReadFile(cf.indexFile())
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return index, fmt.Errorf("%w: %s: %v", ErrIndex, cf.indexFile(), err)
+	}
+	if err = json.Unmarshal(data, &index); err != nil {
+		return index, fmt.Errorf("%w: %s: %v", ErrIndex, cf.indexFile(), err)
+	}
+	return index, nil
+}
+
+func writeIndex(cf *CertConfig, index Index) error {
+	data, err := json.MarshalIndent(index, "", "    ")
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrIndex, cf.indexFile(), err)
+	}
+	if err = writeFileAtomic(cf.indexFile(), data, 0644); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrWriteFailed, cf.indexFile(), err)
+	}
+	return nil
+}
+
+// writeFileAtomic replaces a file by renaming a temporary file over it, so that neither a crash
+// nor a concurrent reader such as ocsp-serve ever sees it truncated
+func writeFileAtomic(file string, data []byte, perm os.FileMode) (err error) {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+// serialHex formats a serial number as stored in the index
+func serialHex(serial *big.Int) string {
+	return strings.ToUpper(serial.Text(16))
+}
+
+// recordIssued adds a certificate saved to file to the issuance index
+func (cf *CertConfig) recordIssued(cert *x509.Certificate, file string) error {
+	index, err := ReadIndex(cf)
+	if err != nil {
+		return err
+	}
+	index.Certificates = append(index.Certificates, IndexEntry{
+		Serial:   serialHex(cert.SerialNumber),
+		Subject:  cert.Subject.String(),
+		Issuer:   cf.issuerName(cert.Issuer.CommonName),
+		NotAfter: cert.NotAfter.UTC(),
+		Status:   StatusValid,
+		File:     file,
+	})
+	return writeIndex(cf, index)
+}
+
+// parseSerial reads the serial of a certificate: a PEM certificate file, or a hexadecimal serial
+// number optionally separated by colons
+func parseSerial(serialOrFile string) (string, error) {
+	if data, err := ioutil.ReadFile(serialOrFile); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil || block.Type != "CERTIFICATE" {
+			return "", fmt.Errorf("%w: %s: expected a CERTIFICATE block", ErrCertTypeMismatch, serialOrFile)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("%w: %s: %v", ErrNotIssued, serialOrFile, err)
+		}
+		return serialHex(cert.SerialNumber), nil
+	}
+	serial, ok := new(big.Int).SetString(strings.Replace(serialOrFile, ":", "", -1), 16)
+	if !ok {
+		return "", fmt.Errorf("%w: %q is neither a certificate file nor a hexadecimal serial number", ErrNotIssued, serialOrFile)
+	}
+	return serialHex(serial), nil
+}
+
+// Revoke marks a certificate of the issuance index as revoked and re-signs the CRL of its issuer
+func Revoke(cf *CertConfig, serialOrFile string, reason int, now time.Time) (IndexEntry, error) {
+	serial, err := parseSerial(serialOrFile)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	index, err := ReadIndex(cf)
+	if err != nil {
+		return IndexEntry{}, err
+	}
+	for i := range index.Certificates {
+		entry := &index.Certificates[i]
+		if entry.Serial != serial {
+			continue
+		}
+		if entry.Status == StatusRevoked {
+			return *entry, fmt.Errorf("%w: %s", ErrAlreadyRevoked, serial)
+		}
+		revokedAt := now.UTC()
+		entry.Status, entry.RevokedAt, entry.Reason = StatusRevoked, &revokedAt, reason
+		// The index is only saved with the new CRL, so that a revocation whose CRL cannot be
+		// signed is not recorded and can be retried
+		if err = writeCRL(cf, entry.Issuer, index, now); err != nil {
+			return *entry, err
+		}
+		lg.Printf("Revoked certificate %s (%s) issued by %s", serial, entry.Subject, entry.Issuer)
+		return *entry, nil
+	}
+	return IndexEntry{}, fmt.Errorf("%w: %s", ErrNotIssued, serial)
+}
+
+// caFiles returns the certificate and key files of a pkisetup CA by name
+func (cf *CertConfig) caFiles(name string) (string, string, error) {
+	switch {
+	case name == cf.caName:
+		return cf.caCertFile, cf.caKeyFile, nil
+	case cf.intermediate != nil && name == cf.intermediate.caName:
+		return cf.intermediate.caCertFile, cf.intermediate.caKeyFile, nil
+	}
+	return "", "", fmt.Errorf("%w: no such CA %q in the configuration", ErrCACertUnreadable, name)
+}
+
+// CRLFile is the PEM CRL signed by a CA of the configuration
+func (cf *CertConfig) CRLFile(name string) string {
+	return filepath.Join(cf.pkiCaDir, name+crlFileExt)
+}
+
+// GenCRL signs a new CRL of the certificates revoked by a CA, valid until the configured next update
+func GenCRL(cf *CertConfig, name string, now time.Time) error {
+	index, err := ReadIndex(cf)
+	if err != nil {
+		return err
+	}
+	return writeCRL(cf, name, index, now)
+}
+
+// writeCRL signs the CRL of a CA from index, then saves the CRL and index with its new CRL number.
+// Nothing is saved if the CRL cannot be signed.
+func writeCRL(cf *CertConfig, name string, index Index, now time.Time) error {
+	certFile, keyFile, err := cf.caFiles(name)
+	if err != nil {
+		return err
+	}
+	caCert, caSK, err := cf.loadCAFiles(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	if caCert.KeyUsage&x509.KeyUsageCRLSign == 0 {
+		return fmt.Errorf("%w: %s: the CA is not allowed to sign CRLs, create a new CA", ErrCertGeneration, certFile)
+	}
+
+	var revoked []x509.RevocationListEntry
+	for _, entry := range index.Certificates {
+		if entry.Issuer != name || entry.Status != StatusRevoked {
+			continue
+		}
+		serial, _ := new(big.Int).SetString(entry.Serial, 16)
+		revoked = append(revoked, x509.RevocationListEntry{SerialNumber: serial, RevocationTime: *entry.RevokedAt, ReasonCode: entry.Reason})
+	}
+	sort.Slice(revoked, func(i, j int) bool { return revoked[i].SerialNumber.Cmp(revoked[j].SerialNumber) < 0 })
+
+	index.CRLNumber++
+	template := &x509.RevocationList{
+		RevokedCertificateEntries: revoked,
+		Number:                    big.NewInt(index.CRLNumber),
+		ThisUpdate:                now,
+		NextUpdate:                now.AddDate(0, 0, cf.crlNextUpdateDays),
+		SignatureAlgorithm:        signatureAlgorithm(caSK),
+	}
+	crlDER, err := x509.CreateRevocationList(rand.Reader, template, caCert, caSK.(crypto.Signer))
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrCertGeneration, cf.CRLFile(name), err)
+	}
+
+	lg.Printf("Saving CRL of %s (%d revoked, next update %s) to PEM file: %s", name, len(revoked), template.NextUpdate.Format(time.RFC3339), cf.CRLFile(name))
+	if err = writeFileAtomic(cf.CRLFile(name), pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: crlDER}), 0644); err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrWriteFailed, cf.CRLFile(name), err)
+	}
+	return writeIndex(cf, index)
+}
+
+// GenCRLs re-signs the CRL of every CA whose private key is at hand
+func GenCRLs(cf *CertConfig, now time.Time) error {
+	for _, name := range cf.onlineCAs("re-signing its CRL") {
+		if err := GenCRL(cf, name, now); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// onlineCAs returns the names of the CAs whose private key is at hand, logging what is skipped
+// when the Root CA key was moved offline below an intermediate CA
+func (cf *CertConfig) onlineCAs(skipped string) []string {
+	names := []string{cf.caName}
+	if cf.intermediate == nil {
+		return names
+	}
+	if _, err := os.Stat(cf.caKeyFile); os.IsNotExist(err) {
+		lg.Printf("Root CA private key %s is offline, not %s", cf.caKeyFile, skipped)
+		names = nil
+	}
+	return append(names, cf.intermediate.caName)
+}
+
+// crlDistributionPoints returns the CRL URLs of the certificates issued by a CA: the configured
+// distribution points, where {ca} stands for the CA name
+func (cf *CertConfig) crlDistributionPoints(issuer string) []string {
+	return expandCAName(cf.crlDistributionPointURLs, issuer)
+}
+
+func expandCAName(urls []string, issuer string) []string {
+	var expanded []string
+	for _, u := range urls {
+		expanded = append(expanded, strings.Replace(u, "{ca}", issuer, -1))
+	}
+	return expanded
+}
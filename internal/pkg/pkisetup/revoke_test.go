@@ -0,0 +1,174 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+const revocationConfig = `{
+    "create_new_rootca": true,
+    "working_dir": "%s",
+    "key_scheme": {"ec": true, "ec_curve": "256"},
+    "x509_root_ca_parameters": {"ca_name": "TestCA"},
+    "x509_crl_parameters": {
+        "next_update_days": 2,
+        "distribution_points": ["http://edgex-pki.local/{ca}.crl"]
+    },
+    "x509_tls_server_parameters": [
+        {"tls_host": "edgex-vault", "tls_domain": "local"},
+        {"tls_host": "edgex-kong", "tls_domain": "local"}
+    ]
+}`
+
+func readCRL(t *testing.T, file string) *x509.RevocationList {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "X509 CRL" {
+		t.Fatalf("%s: expected an X509 CRL block", file)
+	}
+	crl, err := x509.ParseRevocationList(block.Bytes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crl
+}
+
+func TestRevoke(t *testing.T) {
+	cf, ca, _ := newTestCA(t, revocationConfig)
+	certs, _, err := GenCerts(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if dp := certs[0].CRLDistributionPoints; len(dp) != 1 || dp[0] != "http://edgex-pki.local/TestCA.crl" {
+		t.Errorf("Unexpected CRL distribution points %v", dp)
+	}
+
+	index, err := ReadIndex(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(index.Certificates) != 2 || index.Certificates[1].Serial != serialHex(certs[1].SerialNumber) ||
+		index.Certificates[1].Issuer != "TestCA" || index.Certificates[1].Status != StatusValid {
+		t.Fatalf("Unexpected issuance index %+v", index.Certificates)
+	}
+	// The index is replaced through a temporary file, none is left behind
+	if tmp, _ := filepath.Glob(filepath.Join(cf.pkiCaDir, "."+indexFileName+".tmp-*")); len(tmp) > 0 {
+		t.Errorf("Temporary index files left: %v", tmp)
+	}
+
+	// Revoke by certificate file, then by colon separated serial number
+	now := time.Now().Truncate(time.Second)
+	if _, err = Revoke(&cf, cf.servers[0].tlsCertFile, RevocationReasons["keyCompromise"], now); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	first := readCRL(t, cf.CRLFile("TestCA"))
+	serial := certs[1].SerialNumber.Text(16)
+	if len(serial)%2 == 1 {
+		serial = "0" + serial
+	}
+	colons := serial[:2]
+	for i := 2; i < len(serial); i += 2 {
+		colons += ":" + serial[i:i+2]
+	}
+	entry, err := Revoke(&cf, colons, RevocationReasons["superseded"], now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if entry.Status != StatusRevoked || entry.Reason != 4 {
+		t.Errorf("Unexpected revoked entry %+v", entry)
+	}
+
+	crl := readCRL(t, cf.CRLFile("TestCA"))
+	if err = crl.CheckSignatureFrom(ca); err != nil {
+		t.Errorf("CRL not signed by the CA: %s", err.Error())
+	}
+	if len(crl.RevokedCertificateEntries) != 2 {
+		t.Fatalf("Expected 2 revoked certificates, got %d", len(crl.RevokedCertificateEntries))
+	}
+	reasons := map[string]int{}
+	for _, rc := range crl.RevokedCertificateEntries {
+		reasons[serialHex(rc.SerialNumber)] = rc.ReasonCode
+	}
+	if reasons[serialHex(certs[0].SerialNumber)] != 1 || reasons[serialHex(certs[1].SerialNumber)] != 4 {
+		t.Errorf("Unexpected revocation reasons %v", reasons)
+	}
+	if !crl.NextUpdate.Equal(now.AddDate(0, 0, 2)) {
+		t.Errorf("Expected next update %s, got %s", now.AddDate(0, 0, 2), crl.NextUpdate)
+	}
+	if crl.Number.Cmp(first.Number) <= 0 {
+		t.Errorf("CRL number %s not increased from %s", crl.Number, first.Number)
+	}
+	// The CRL is replaced through a temporary file too, as the CRL distribution points may be serving it
+	if tmp, _ := filepath.Glob(filepath.Join(cf.pkiCaDir, ".TestCA"+crlFileExt+".tmp-*")); len(tmp) > 0 {
+		t.Errorf("Temporary CRL files left: %v", tmp)
+	}
+
+	if _, err = Revoke(&cf, cf.servers[1].tlsCertFile, 0, now); !errors.Is(err, ErrAlreadyRevoked) {
+		t.Errorf("Expected ErrAlreadyRevoked, got %v", err)
+	}
+	if _, err = Revoke(&cf, "DEADBEEF", 0, now); !errors.Is(err, ErrNotIssued) {
+		t.Errorf("Expected ErrNotIssued, got %v", err)
+	}
+}
+
+func TestRevokeRetryAfterCRLFailure(t *testing.T) {
+	cf, _, _ := newTestCA(t, revocationConfig)
+	certs, _, err := GenCerts(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	// Without the CA key the CRL cannot be signed, and the revocation is not recorded
+	if err = os.Rename(cf.caKeyFile, cf.caKeyFile+".away"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Revoke(&cf, cf.servers[0].tlsCertFile, RevocationReasons["keyCompromise"], time.Now()); err == nil {
+		t.Fatalf("Expected the revocation to fail without the CA key")
+	}
+	index, err := ReadIndex(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if index.Certificates[0].Status != StatusValid {
+		t.Errorf("Revocation recorded without a CRL: %+v", index.Certificates[0])
+	}
+
+	// The retry succeeds once the key is back
+	if err = os.Rename(cf.caKeyFile+".away", cf.caKeyFile); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = Revoke(&cf, cf.servers[0].tlsCertFile, RevocationReasons["keyCompromise"], time.Now()); err != nil {
+		t.Fatalf("Unexpected error on retry: %s", err.Error())
+	}
+	crl := readCRL(t, cf.CRLFile("TestCA"))
+	if len(crl.RevokedCertificateEntries) != 1 || crl.RevokedCertificateEntries[0].SerialNumber.Cmp(certs[0].SerialNumber) != 0 {
+		t.Errorf("Expected the CRL to list %s, got %+v", serialHex(certs[0].SerialNumber), crl.RevokedCertificateEntries)
+	}
+}
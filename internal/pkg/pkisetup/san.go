@@ -0,0 +1,163 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"fmt"
+	"net"
+	"net/mail"
+	"net/url"
+	"strings"
+)
+
+// maxCommonNameLength is the RFC 5280 upper bound of the subject common name
+const maxCommonNameLength = 64
+
+// subjectAltNames holds the names a TLS server certificate is issued for
+type subjectAltNames struct {
+	commonName string
+	dnsNames   []string
+	ips        []net.IP
+	uris       []*url.URL
+	emails     []string
+}
+
+// names returns the names of a TLS server entry. Without explicit dns_names, the legacy names
+// derived from tls_host and tls_domain are used: host.domain, or host and host.local for the
+// "local" domain. The common name is tls_cn, else the service_name of client certificates, else
+// the first legacy DNS name.
+func (t TLSServer) names() subjectAltNames {
+	san := subjectAltNames{commonName: t.TLSCommonName, dnsNames: t.DNSNames, emails: t.EmailAddresses}
+	if len(t.DNSNames) == 0 && t.TLSHost != "" && t.TLSDomain != "" {
+		if t.TLSDomain == "local" {
+			san.dnsNames = []string{t.TLSHost, t.TLSHost + "." + t.TLSDomain}
+		} else {
+			san.dnsNames = []string{t.TLSHost + "." + t.TLSDomain}
+		}
+		if san.commonName == "" {
+			san.commonName = san.dnsNames[0]
+		}
+	}
+	if t.ServiceName != "" {
+		if t.TLSCommonName == "" {
+			san.commonName = t.ServiceName
+		}
+		if t.TrustDomain != "" {
+			san.uris = append(san.uris, serviceURI(t.TrustDomain, t.ServiceName))
+		}
+	}
+	if len(t.EmailAddresses) == 0 && t.TLSDomain != "" {
+		san.emails = []string{"admin@" + t.TLSDomain}
+	}
+	for _, ip := range t.IPAddresses {
+		san.ips = append(san.ips, net.ParseIP(ip))
+	}
+	for _, uri := range t.URIs {
+		if u, err := url.Parse(uri); err == nil {
+			san.uris = append(san.uris, u)
+		}
+	}
+	return san
+}
+
+func (san subjectAltNames) empty() bool {
+	return len(san.dnsNames) == 0 && len(san.ips) == 0 && len(san.uris) == 0 && len(san.emails) == 0
+}
+
+// validateNames reports the malformed names of a TLS server entry under path
+func (t TLSServer) validateNames(path string, errs *ConfigErrors) {
+	if len(t.TLSCommonName) > maxCommonNameLength {
+		errs.add(path+".tls_cn", "longer than %d characters", maxCommonNameLength)
+	}
+	for i, name := range t.DNSNames {
+		if err := checkDNSName(name); err != nil {
+			errs.add(fmt.Sprintf("%s.dns_names[%d]", path, i), "%s", err.Error())
+		}
+	}
+	for i, ip := range t.IPAddresses {
+		if net.ParseIP(ip) == nil {
+			errs.add(fmt.Sprintf("%s.ip_addresses[%d]", path, i), "%q is not an IP address", ip)
+		}
+	}
+	for i, uri := range t.URIs {
+		if err := checkURI(uri); err != nil {
+			errs.add(fmt.Sprintf("%s.uris[%d]", path, i), "%s", err.Error())
+		}
+	}
+	for i, email := range t.EmailAddresses {
+		if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+			errs.add(fmt.Sprintf("%s.email_addresses[%d]", path, i), "%q is not an email address", email)
+		}
+	}
+	// Client certificates may identify their service by the subject alone
+	if san := t.names(); san.empty() && !(clientProfile(t.Profile) && san.commonName != "") {
+		errs.add(path, "no subject alternative name: set dns_names, ip_addresses, uris or email_addresses, or tls_host and tls_domain")
+	}
+}
+
+// checkDNSName accepts a host name whose leftmost label may be the "*" wildcard. A wildcard
+// must cover a whole label and be followed by at least two labels, so *.local or w*.example.com
+// are rejected.
+func checkDNSName(name string) error {
+	if name == "" || len(name) > 253 {
+		return fmt.Errorf("%q is not a DNS name", name)
+	}
+	labels := strings.Split(strings.TrimSuffix(name, "."), ".")
+	for i, label := range labels {
+		if label == "*" && i == 0 {
+			if len(labels) < 3 {
+				return fmt.Errorf("wildcard %q must be followed by at least two labels", name)
+			}
+			continue
+		}
+		if strings.Contains(label, "*") {
+			return fmt.Errorf("wildcard %q must be the whole leftmost label", name)
+		}
+		if !validDNSLabel(label) {
+			return fmt.Errorf("%q has an invalid label %q", name, label)
+		}
+	}
+	return nil
+}
+
+func validDNSLabel(label string) bool {
+	if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// checkURI accepts an absolute URI; SPIFFE IDs must also name their trust domain
+func checkURI(uri string) error {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme == "" || (u.Host == "" && u.Opaque == "" && u.Path == "") {
+		return fmt.Errorf("%q is not an absolute URI", uri)
+	}
+	if u.Scheme == "spiffe" && (u.Host == "" || u.User != nil || u.Port() != "" || u.RawQuery != "" || u.Fragment != "") {
+		return fmt.Errorf("%q is not a SPIFFE ID: spiffe://<trust domain>/<path>", uri)
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLegacyNames(t *testing.T) {
+	san := TLSServer{TLSHost: "edgex-kong", TLSDomain: "local"}.names()
+	if san.commonName != "edgex-kong" || strings.Join(san.dnsNames, ",") != "edgex-kong,edgex-kong.local" {
+		t.Errorf("Unexpected local names: %+v", san)
+	}
+
+	// No empty DNS name outside of the local domain
+	san = TLSServer{TLSHost: "vault", TLSDomain: "example.com"}.names()
+	if san.commonName != "vault.example.com" || len(san.dnsNames) != 1 || san.dnsNames[0] != "vault.example.com" {
+		t.Errorf("Unexpected names: %+v", san)
+	}
+	if len(san.emails) != 1 || san.emails[0] != "admin@example.com" {
+		t.Errorf("Unexpected emails: %v", san.emails)
+	}
+}
+
+func TestExplicitNames(t *testing.T) {
+	config, err := ParseConfig([]byte(`{
+        "x509_root_ca_parameters": {"ca_name": "CA"},
+        "x509_tls_server_parameters": {
+            "tls_host": "edgex-kong",
+            "dns_names": ["edgex-kong", "*.edgex.example.com"],
+            "ip_addresses": ["10.0.0.5", "::1"],
+            "uris": ["spiffe://edgex.example.com/kong"],
+            "email_addresses": ["ops@example.com"]
+        }
+    }`))
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	san := config.TLSServers[0].names()
+	if san.commonName != "" {
+		t.Errorf("Expected no common name, got %q", san.commonName)
+	}
+	if len(san.dnsNames) != 2 || len(san.ips) != 2 || len(san.uris) != 1 || san.uris[0].Host != "edgex.example.com" || len(san.emails) != 1 {
+		t.Errorf("Unexpected names: %+v", san)
+	}
+}
+
+func TestInvalidNames(t *testing.T) {
+	_, err := ParseConfig([]byte(`{
+        "x509_root_ca_parameters": {"ca_name": "CA"},
+        "x509_tls_server_parameters": {
+            "tls_host": "edgex-kong",
+            "tls_cn": "` + strings.Repeat("x", 65) + `",
+            "dns_names": ["*.local", "w*.example.com", "a.*.example.com", "bad_name.example.com", "*.edgex.local"],
+            "ip_addresses": ["10.0.0.256"],
+            "uris": ["kong", "spiffe:///kong"],
+            "email_addresses": ["Ops <ops@example.com>"]
+        }
+    }`))
+	expected := []string{
+		"x509_tls_server_parameters.dns_names[0]",
+		"x509_tls_server_parameters.dns_names[1]",
+		"x509_tls_server_parameters.dns_names[2]",
+		"x509_tls_server_parameters.dns_names[3]",
+		"x509_tls_server_parameters.email_addresses[0]",
+		"x509_tls_server_parameters.ip_addresses[0]",
+		"x509_tls_server_parameters.tls_cn",
+		"x509_tls_server_parameters.uris[0]",
+		"x509_tls_server_parameters.uris[1]",
+	}
+	paths := errorPaths(t, err)
+	if strings.Join(paths, " ") != strings.Join(expected, " ") {
+		t.Errorf("Expected errors at %v, got %v", expected, paths)
+	}
+
+	_, err = ParseConfig([]byte(`{"x509_root_ca_parameters": {"ca_name": "CA"}, "x509_tls_server_parameters": {"tls_host": "h", "dns_names": "h"}}`))
+	if paths := errorPaths(t, err); len(paths) != 1 || paths[0] != "x509_tls_server_parameters.dns_names" {
+		t.Errorf("Expected a type error on dns_names, got %v", paths)
+	}
+}
+
+func TestGenCertSubjectAltNames(t *testing.T) {
+	myconfig := testConfig
+	myconfig.pkiCaDir = t.TempDir() // issuance index
+	cert, _, err := GenCert(&myconfig, "testtlsHost")
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(cert.IPAddresses) != 1 || cert.IPAddresses[0].String() != "127.0.0.1" || len(cert.DNSNames) != 2 {
+		t.Errorf("Unexpected subject alternative names: %v %v", cert.DNSNames, cert.IPAddresses)
+	}
+}
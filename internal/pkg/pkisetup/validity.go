@@ -0,0 +1,128 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto/x509"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const day = 24 * time.Hour
+
+// validityPeriod is how long a certificate is valid: up to an absolute date if set, for a
+// duration from its issuance otherwise. An explicit period was configured, not defaulted.
+type validityPeriod struct {
+	duration time.Duration
+	notAfter time.Time
+	explicit bool
+}
+
+func days(n int) validityPeriod {
+	return validityPeriod{duration: time.Duration(n) * day}
+}
+
+// newValidityPeriod reads the validity settings of a certificate: the not_after date, the
+// validity duration, validity_days, or defaultDays. The settings were validated: at most one is set.
+func newValidityPeriod(validityDays FlexInt, validity string, notAfter string, defaultDays int) validityPeriod {
+	switch {
+	case notAfter != "":
+		t, _ := time.Parse(time.RFC3339, notAfter)
+		return validityPeriod{notAfter: t, explicit: true}
+	case validity != "":
+		d, _ := parseDuration(validity)
+		return validityPeriod{duration: d, explicit: true}
+	case validityDays > 0:
+		return validityPeriod{duration: time.Duration(validityDays) * day, explicit: true}
+	}
+	return days(defaultDays)
+}
+
+// parseDuration accepts a Go duration such as "2160h" or "15m", or a number of days such as "90d"
+func parseDuration(s string) (time.Duration, error) {
+	if n, err := strconv.Atoi(strings.TrimSuffix(s, "d")); err == nil && strings.HasSuffix(s, "d") {
+		return time.Duration(n) * day, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// validateValidity reports a malformed validity duration or not_after date under path, and the
+// settings which conflict: only one of not_after, validity and validity_days may be set
+func validateValidity(path string, validityDays FlexInt, validity string, notAfter string, errs *ConfigErrors) {
+	if notAfter != "" && (validity != "" || validityDays > 0) {
+		errs.add(path+".not_after", "conflicts with validity and validity_days, set only one of them")
+	} else if validity != "" && validityDays > 0 {
+		errs.add(path+".validity", "conflicts with validity_days, set only one of them")
+	}
+	if validity != "" {
+		if d, err := parseDuration(validity); err != nil || d <= 0 {
+			errs.add(path+".validity", "%q is not a positive duration such as \"2160h\" or \"90d\"", validity)
+		}
+	}
+	if notAfter != "" {
+		if t, err := time.Parse(time.RFC3339, notAfter); err != nil {
+			errs.add(path+".not_after", "%q is not a RFC 3339 date such as \"2030-01-01T00:00:00Z\"", notAfter)
+		} else if t.Before(time.Now()) {
+			errs.add(path+".not_after", "%s is already past", notAfter)
+		}
+	}
+}
+
+// validityName describes the validity settings of a certificate for the logs
+func validityName(validityDays FlexInt, validity string, notAfter string) string {
+	switch {
+	case notAfter != "":
+		return "until " + notAfter
+	case validity != "":
+		return validity
+	case validityDays > 0:
+		return fmt.Sprintf("%d days", validityDays)
+	}
+	return "default"
+}
+
+// bounds returns the NotBefore and NotAfter of a certificate issued now. NotBefore is backdated
+// for the clients whose clock is late. A certificate never outlives its issuer, nor predates it:
+// both bounds are capped to the issuer's, nil for a self-signed Root CA. An explicit validity
+// which outlives the issuer is an error, unless allowCap.
+func (v validityPeriod) bounds(now time.Time, backdate time.Duration, issuer *x509.Certificate, allowCap bool) (time.Time, time.Time, error) {
+	notBefore, notAfter := now.Add(-backdate), v.notAfter
+	if notAfter.IsZero() {
+		notAfter = now.Add(v.duration)
+	}
+	if issuer != nil {
+		if notBefore.Before(issuer.NotBefore) {
+			notBefore = issuer.NotBefore
+		}
+		if notAfter.After(issuer.NotAfter) {
+			if v.explicit && !allowCap {
+				return notBefore, notAfter, fmt.Errorf("%w: validity ends %s, after the expiry of the issuer %s on %s, without allow_validity_cap",
+					ErrCertGeneration, notAfter.UTC().Format(time.RFC3339), issuer.Subject.CommonName, issuer.NotAfter.UTC().Format(time.RFC3339))
+			}
+			lg.Printf("- Validity capped to the expiry of the issuer %s: %s", issuer.Subject.CommonName, issuer.NotAfter.UTC().Format(time.RFC3339))
+			notAfter = issuer.NotAfter
+		}
+	}
+	if !notAfter.After(now) {
+		return notBefore, notAfter, fmt.Errorf("%w: validity ends %s, before its issuance", ErrCertGeneration, notAfter.UTC().Format(time.RFC3339))
+	}
+	return notBefore, notAfter, nil
+}
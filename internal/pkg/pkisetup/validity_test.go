@@ -0,0 +1,154 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto/x509"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+const validityConfig = `{
+    "create_new_rootca": true,
+    "working_dir": "%s",
+    "not_before_backdate": "10m",
+    "allow_validity_cap": %t,
+    "key_scheme": {"ec": true, "ec_curve": "256"},
+    "x509_root_ca_parameters": {"ca_name": "TestCA", "validity": "30d"},
+    "x509_tls_server_parameters": [
+        {"tls_host": "edgex-vault", "tls_domain": "local", "validity": "48h"},
+        {"tls_host": "edgex-kong", "tls_domain": "local", "not_after": "%s"}
+    ]
+}`
+
+func TestValidityPeriods(t *testing.T) {
+	farFuture := time.Now().AddDate(1, 0, 0).UTC().Format(time.RFC3339)
+	cf := newTestEnv(t, validityConfig, true, farFuture)
+	before := time.Now()
+	ca, _, err := GenCA(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if d := ca.NotAfter.Sub(ca.NotBefore); d != 30*day+10*time.Minute {
+		t.Errorf("Expected a backdated 30 days Root CA, got %s", d)
+	}
+	if ca.NotBefore.After(before.Add(-10 * time.Minute)) {
+		t.Errorf("Root CA not backdated: %s", ca.NotBefore)
+	}
+
+	certs, _, err := GenCerts(&cf)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if d := certs[0].NotAfter.Sub(certs[0].NotBefore); d != 48*time.Hour+10*time.Minute {
+		t.Errorf("Expected a backdated 48 hours certificate, got %s", d)
+	}
+	// The date beyond the Root CA expiry is capped, as allow_validity_cap is set
+	if !certs[1].NotAfter.Equal(ca.NotAfter) {
+		t.Errorf("Certificate expiring %s outlives its CA expiring %s", certs[1].NotAfter, ca.NotAfter)
+	}
+	for _, cert := range certs {
+		if cert.NotBefore.Before(ca.NotBefore) {
+			t.Errorf("Certificate valid from %s, before its CA %s", cert.NotBefore, ca.NotBefore)
+		}
+	}
+}
+
+func TestValidityCapRefused(t *testing.T) {
+	farFuture := time.Now().AddDate(1, 0, 0).UTC().Format(time.RFC3339)
+	cf, _, _ := newTestCA(t, validityConfig, false, farFuture)
+	if _, _, err := GenCerts(&cf); !errors.Is(err, ErrCertGeneration) || !strings.Contains(err.Error(), "allow_validity_cap") {
+		t.Errorf("Expected a not_after beyond the Root CA expiry to be refused, got %v", err)
+	}
+}
+
+func TestValidityBounds(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	issuer := &x509.Certificate{NotBefore: now.Add(-time.Minute), NotAfter: now.Add(10 * day)}
+
+	notBefore, notAfter, err := days(30).bounds(now, 5*time.Minute, issuer, false)
+	if err != nil || !notBefore.Equal(issuer.NotBefore) || !notAfter.Equal(issuer.NotAfter) {
+		t.Errorf("Expected the issuer bounds, got %s - %s (%v)", notBefore, notAfter, err)
+	}
+	explicit := validityPeriod{duration: 30 * day, explicit: true}
+	if _, _, err = explicit.bounds(now, 0, issuer, false); !errors.Is(err, ErrCertGeneration) {
+		t.Errorf("Expected ErrCertGeneration for an explicit validity outliving its issuer, got %v", err)
+	}
+	if _, notAfter, err = explicit.bounds(now, 0, issuer, true); err != nil || !notAfter.Equal(issuer.NotAfter) {
+		t.Errorf("Expected the issuer expiry, got %s (%v)", notAfter, err)
+	}
+	notBefore, notAfter, err = validityPeriod{notAfter: now.Add(day)}.bounds(now, 0, issuer, false)
+	if err != nil || !notBefore.Equal(now) || !notAfter.Equal(now.Add(day)) {
+		t.Errorf("Expected the not_after date, got %s - %s (%v)", notBefore, notAfter, err)
+	}
+	if _, _, err = (validityPeriod{notAfter: now.Add(-day)}).bounds(now, 0, nil, false); !errors.Is(err, ErrCertGeneration) {
+		t.Errorf("Expected ErrCertGeneration, got %v", err)
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected time.Duration
+		valid    bool
+	}{
+		{"90d", 90 * day, true},
+		{"2160h", 90 * day, true},
+		{"15m", 15 * time.Minute, true},
+		{"d", 0, false},
+		{"1y", 0, false},
+	}
+	for _, tt := range tests {
+		d, err := parseDuration(tt.in)
+		if (err == nil) != tt.valid || d != tt.expected {
+			t.Errorf("%s: expected %s (valid %t), got %s (%v)", tt.in, tt.expected, tt.valid, d, err)
+		}
+	}
+}
+
+func TestValidityValidation(t *testing.T) {
+	_, err := ParseConfig([]byte(`{
+        "not_before_backdate": "-5m",
+        "x509_root_ca_parameters": {"ca_name": "CA", "validity": "forever"},
+        "x509_intermediate_ca_parameters": {"ca_name": "ICA", "validity": "90d", "not_after": "2099-01-01T00:00:00Z"},
+        "x509_tls_server_parameters": [
+            {"tls_host": "edgex-kong", "tls_domain": "local", "not_after": "2001-01-01T00:00:00Z"},
+            {"tls_host": "edgex-vault", "tls_domain": "local", "validity": "48h", "validity_days": 2}
+        ]
+    }`))
+	expected := []string{
+		"not_before_backdate",
+		"x509_intermediate_ca_parameters.not_after",
+		"x509_root_ca_parameters.validity",
+		"x509_tls_server_parameters[0].not_after",
+		"x509_tls_server_parameters[1].validity",
+	}
+	paths := errorPaths(t, err)
+	if len(paths) != len(expected) {
+		t.Fatalf("Expected errors at %v, got %v (%v)", expected, paths, err)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("Expected errors at %v, got %v", expected, paths)
+			break
+		}
+	}
+}
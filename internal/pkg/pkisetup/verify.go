@@ -0,0 +1,243 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"crypto"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+)
+
+// VerifyResult reports the checks of a certificate by the verify command
+type VerifyResult struct {
+	Name     string    `json:"name"` // tls_host, or CA name
+	File     string    `json:"file"`
+	NotAfter time.Time `json:"not_after"`
+	Expiring bool      `json:"expiring"` // within the renewal window
+	Problems []string  `json:"problems,omitempty"`
+}
+
+/* verifier holds what the certificates are checked against */
+type verifier struct {
+	cf      *CertConfig
+	opts    x509.VerifyOptions
+	window  time.Duration
+	revoked map[string]IndexEntry // by serial
+}
+
+// Verify checks the CA certificates, then the certificate of every TLS server, or only of host if
+// not empty: its chain up to the Root CA, or the enterprise root of an external CA, that its
+// private key matches, that it is not revoked, and whether it expires within the renewal window.
+// Unreadable CA certificates are errors, the other failures are reported as problems of the
+// results.
+func Verify(cf *CertConfig, host string, now time.Time) ([]VerifyResult, error) {
+	lg.Println("")
+	lg.Println("Verifying the PKI materials")
+
+	v, err := cf.newVerifier(now)
+	if err != nil {
+		return nil, err
+	}
+	var results []VerifyResult
+	if host == "" {
+		caChainFile := ""
+		if cf.external != nil {
+			caChainFile = cf.caChainFile
+		}
+		results = append(results, v.check(cf.caName, cf.caCertFile, cf.caKeyFile, caChainFile))
+		if ip := cf.intermediate; ip != nil {
+			results = append(results, v.check(ip.caName, ip.caCertFile, ip.caKeyFile, ip.caChainFile))
+		}
+	}
+	for _, s := range cf.servers {
+		if host != "" && s.tlsHost != host {
+			continue
+		}
+		chainFile := ""
+		if cf.intermediate != nil || cf.external != nil {
+			chainFile = s.tlsChainFile
+		}
+		results = append(results, v.check(s.tlsHost, s.tlsCertFile, s.tlsKeyFile, chainFile))
+	}
+	if host != "" && len(results) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownServer, host)
+	}
+	for _, r := range results {
+		if len(r.Problems) > 0 {
+			lg.Printf("%s: %d problem(s) found", r.Name, len(r.Problems))
+		}
+	}
+	return results, nil
+}
+
+func (cf *CertConfig) newVerifier(now time.Time) (*verifier, error) {
+	root, err := readCertFile(cf.caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	v := &verifier{
+		cf: cf,
+		opts: x509.VerifyOptions{
+			Roots:         x509.NewCertPool(),
+			Intermediates: x509.NewCertPool(),
+			CurrentTime:   now,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+		},
+		window:  time.Duration(cf.renewBeforeDays) * 24 * time.Hour,
+		revoked: map[string]IndexEntry{},
+	}
+	if cf.external != nil {
+		// The imported CA and the CAs above it chain up to the enterprise root
+		chain, err := readCertChain(cf.caChainFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(chain) == 0 {
+			return nil, fmt.Errorf("%w: %s: no certificate", ErrPEMUnreadable, cf.caChainFile)
+		}
+		root = chain[len(chain)-1]
+		for _, cert := range chain[:len(chain)-1] {
+			v.opts.Intermediates.AddCert(cert)
+		}
+	}
+	v.opts.Roots.AddCert(root)
+	if cf.intermediate != nil {
+		intermediate, err := readCertFile(cf.intermediate.caCertFile)
+		if err != nil {
+			return nil, err
+		}
+		v.opts.Intermediates.AddCert(intermediate)
+	}
+	index, err := ReadIndex(cf)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range index.Certificates {
+		if entry.Status == StatusRevoked {
+			v.revoked[entry.Serial] = entry
+		}
+	}
+	return v, nil
+}
+
+// check verifies a certificate, its private key and its full chain file if not empty
+func (v *verifier) check(name string, certFile string, keyFile string, chainFile string) VerifyResult {
+	result := VerifyResult{Name: name, File: certFile}
+	cert, err := readCertFile(certFile)
+	if err != nil {
+		result.Problems = append(result.Problems, err.Error())
+		return result
+	}
+	result.NotAfter = cert.NotAfter
+	result.Expiring = cert.NotAfter.Sub(v.opts.CurrentTime) <= v.window
+
+	if _, err = cert.Verify(v.opts); err != nil {
+		result.Problems = append(result.Problems, fmt.Sprintf("chain: %v", err))
+	}
+	if entry, ok := v.revoked[serialHex(cert.SerialNumber)]; ok {
+		result.Problems = append(result.Problems, fmt.Sprintf("revoked at %s", entry.RevokedAt.UTC().Format(time.RFC3339)))
+	}
+
+	// The Root CA private key may be moved offline once the intermediate CA is signed
+	_, err = os.Stat(keyFile)
+	offline := os.IsNotExist(err) && v.cf.intermediate != nil && name == v.cf.caName
+	if !offline {
+		sk, err := readPrivateKey(keyFile, v.cf.protection.password)
+		switch {
+		case err != nil:
+			result.Problems = append(result.Problems, err.Error())
+		case !keyMatches(sk, cert.PublicKey):
+			result.Problems = append(result.Problems, fmt.Sprintf("private key %s does not match the certificate", keyFile))
+		}
+	}
+
+	if chainFile != "" {
+		chain, err := readCertChain(chainFile)
+		switch {
+		case err != nil:
+			result.Problems = append(result.Problems, err.Error())
+		case len(chain) == 0 || !chain[0].Equal(cert):
+			result.Problems = append(result.Problems, fmt.Sprintf("full chain %s does not start with the certificate", chainFile))
+		}
+	}
+	return result
+}
+
+// WriteVerification prints the results of Verify, as indented JSON if jsonOutput is set
+func WriteVerification(w io.Writer, results []VerifyResult, jsonOutput bool) error {
+	if jsonOutput {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(results)
+	}
+	for _, r := range results {
+		status := "OK"
+		switch {
+		case len(r.Problems) > 0:
+			status = "FAILED"
+		case r.Expiring:
+			status = "EXPIRING"
+		}
+		if r.NotAfter.IsZero() {
+			fmt.Fprintf(w, "%s: %s (%s)\n", r.Name, status, r.File)
+		} else {
+			fmt.Fprintf(w, "%s: %s, expires %s (%s)\n", r.Name, status, r.NotAfter.UTC().Format(time.RFC3339), r.File)
+		}
+		for _, problem := range r.Problems {
+			fmt.Fprintf(w, "  - %s\n", problem)
+		}
+	}
+	return nil
+}
+
+// keyMatches tells whether a private key is the one of a public key
+func keyMatches(sk crypto.PrivateKey, pk crypto.PublicKey) bool {
+	signer, ok := sk.(crypto.Signer)
+	if !ok {
+		return false
+	}
+	pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool })
+	return ok && pub.Equal(pk)
+}
+
+// readCertChain reads the certificates of a PEM file, leaf first
+func readCertChain(file string) ([]*x509.Certificate, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %v", ErrPEMUnreadable, file, err)
+	}
+	var certs []*x509.Certificate
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			return nil, fmt.Errorf("%w: %w: %s: expected CERTIFICATE blocks", ErrPEMUnreadable, ErrCertTypeMismatch, file)
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s: %v", ErrPEMUnreadable, file, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
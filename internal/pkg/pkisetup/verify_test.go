@@ -0,0 +1,72 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package pkisetup
+
+import (
+	"errors"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	cf, _, _ := newTestCA(t, renewalConfig)
+	if _, _, err := GenCerts(&cf); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	// Only the certificate valid for 10 days is within the 30 days renewal window
+	now := time.Now()
+	results, err := Verify(&cf, "", now)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	if len(results) != 3 || results[0].Name != "TestCA" || results[1].Name != "edgex-vault" {
+		t.Fatalf("Unexpected results %+v", results)
+	}
+	for i, expiring := range []bool{false, true, false} {
+		if len(results[i].Problems) > 0 || results[i].Expiring != expiring {
+			t.Errorf("Unexpected result %+v", results[i])
+		}
+	}
+
+	// Expired, revoked and mismatching key certificates
+	if results, err = Verify(&cf, "edgex-vault", now.AddDate(0, 0, 20)); err != nil || len(results) != 1 {
+		t.Fatalf("Unexpected results %+v (%v)", results, err)
+	}
+	if len(results[0].Problems) != 1 || !strings.HasPrefix(results[0].Problems[0], "chain:") {
+		t.Errorf("Expected a chain problem, got %v", results[0].Problems)
+	}
+	if _, err = Revoke(&cf, cf.servers[1].tlsCertFile, RevocationReasons["superseded"], now); err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	otherKey, _ := ioutil.ReadFile(cf.servers[0].tlsKeyFile)
+	ioutil.WriteFile(cf.servers[1].tlsKeyFile, otherKey, 0600)
+	if results, err = Verify(&cf, "edgex-kong", now); err != nil || len(results) != 1 {
+		t.Fatalf("Unexpected results %+v (%v)", results, err)
+	}
+	if problems := results[0].Problems; len(problems) != 2 || !strings.HasPrefix(problems[0], "revoked") || !strings.Contains(problems[1], "does not match") {
+		t.Errorf("Expected revocation and key problems, got %v", problems)
+	}
+
+	if _, err = Verify(&cf, "edgex-mqtt", now); !errors.Is(err, ErrUnknownServer) {
+		t.Errorf("Expected ErrUnknownServer, got %v", err)
+	}
+}
@@ -0,0 +1,461 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *
+ * @version: 1.0.0
+ *******************************************************************************/
+package vaultworker
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backup archive layout: magic | PBKDF2 iterations (uint32) | salt | GCM nonce | sealed tar.gz.
+// The header is authenticated as GCM additional data.
+const (
+	backupMagic         = "EDGEXBK1"
+	backupSaltSize      = 16
+	backupIterations    = 600000
+	backupMinIterations = 100000   // bounds of the unauthenticated iteration count read back,
+	backupMaxIterations = 10000000 // checked before deriving the key
+	backupManifestName  = "manifest.json"
+	backupAssetsDir     = "assets"
+	backupPKIDir        = "pki"
+	backupPassphraseEnv = "EDGEX_BACKUP_PASSPHRASE"
+)
+
+// BackupFile describes a file stored in a backup archive
+type BackupFile struct {
+	Name   string `json:"name"`
+	Mode   uint32 `json:"mode"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupManifest is stored first in every backup archive
+type BackupManifest struct {
+	Version      int               `json:"version"`
+	Created      time.Time         `json:"created"`
+	Files        []BackupFile      `json:"files"`
+	PolicyHashes map[string]string `json:"policy_hashes"`
+}
+
+// ReadPassphrase reads the backup passphrase from a file, or from the EDGEX_BACKUP_PASSPHRASE variable
+func ReadPassphrase(passphraseFile string) ([]byte, error) {
+	var passphrase []byte
+	if passphraseFile != "" {
+		raw, err := ioutil.ReadFile(passphraseFile)
+		if err != nil {
+			return nil, err
+		}
+		passphrase = bytes.TrimRight(raw, "\r\n")
+	} else {
+		passphrase = []byte(os.Getenv(backupPassphraseEnv))
+	}
+	if len(passphrase) == 0 {
+		return nil, fmt.Errorf("no backup passphrase: use a passphrase file or set %s", backupPassphraseEnv)
+	}
+	return passphrase, nil
+}
+
+// backupSources lists the archive entries and the files they are read from
+func backupSources(config *tomlConfig) (map[string]string, error) {
+	sources := map[string]string{}
+	tokenFolder := config.SecretService.TokenFolderPath
+
+	initFile := filepath.Join(tokenFolder, config.SecretService.VaultInitParm)
+	if _, err := os.Stat(initFile); err != nil {
+		return nil, fmt.Errorf("cannot back up the Vault init response: %s", err.Error())
+	}
+	sources[path.Join(backupAssetsDir, config.SecretService.VaultInitParm)] = initFile
+
+	tokenFiles, err := filepath.Glob(filepath.Join(tokenFolder, "*"+tokenFileSuffix))
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range tokenFiles {
+		sources[path.Join(backupAssetsDir, filepath.Base(f))] = f
+	}
+
+	pkiDir := filepath.Dir(config.SecretService.CAFilePath)
+	entries, err := ioutil.ReadDir(pkiDir)
+	if err != nil {
+		return nil, fmt.Errorf("cannot back up the PKI CA directory: %s", err.Error())
+	}
+	for _, e := range entries {
+		if e.Mode().IsRegular() {
+			sources[path.Join(backupPKIDir, e.Name())] = filepath.Join(pkiDir, e.Name())
+		}
+	}
+	return sources, nil
+}
+
+// CreateBackup builds the encrypted archive holding the init response, the token files,
+// the policy hashes and the PKI CA directory
+func CreateBackup(config *tomlConfig, passphrase []byte) ([]byte, error) {
+	sources, err := backupSources(config)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := BackupManifest{Version: 1, Created: time.Now().UTC(), PolicyHashes: map[string]string{}}
+	contents := map[string][]byte{}
+	for name, source := range sources {
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, err
+		}
+		raw, err := ioutil.ReadFile(source)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(raw)
+		manifest.Files = append(manifest.Files, BackupFile{Name: name, Mode: uint32(info.Mode().Perm()), Size: int64(len(raw)), SHA256: hex.EncodeToString(sum[:])})
+		contents[name] = raw
+	}
+	// Sorted, so that the archive and its restore follow a stable order
+	sort.Slice(manifest.Files, func(i, j int) bool { return manifest.Files[i].Name < manifest.Files[j].Name })
+	for name, policyFile := range map[string]string{
+		config.SecretService.PolicyName4Admin: config.SecretService.PolicyPath4Admin,
+		config.SecretService.PolicyName4Kong:  config.SecretService.PolicyPath4Kong,
+	} {
+		hashSum, err := HashFile(&policyFile, false)
+		if err != nil {
+			return nil, err
+		}
+		manifest.PolicyHashes[name] = hex.EncodeToString(hashSum)
+	}
+
+	var plain bytes.Buffer
+	gz := gzip.NewWriter(&plain)
+	tw := tar.NewWriter(gz)
+	rawManifest, err := json.MarshalIndent(&manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	entries := append([]BackupFile{{Name: backupManifestName, Mode: 0600}}, manifest.Files...)
+	contents[backupManifestName] = rawManifest
+	for _, f := range entries {
+		hdr := &tar.Header{Name: f.Name, Mode: int64(f.Mode), Size: int64(len(contents[f.Name])), ModTime: manifest.Created}
+		if err = tw.WriteHeader(hdr); err != nil {
+			return nil, err
+		}
+		if _, err = tw.Write(contents[f.Name]); err != nil {
+			return nil, err
+		}
+	}
+	if err = tw.Close(); err != nil {
+		return nil, err
+	}
+	if err = gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return sealBackup(plain.Bytes(), passphrase)
+}
+
+// WriteBackup saves an encrypted archive, readable by its owner only
+func WriteBackup(path string, archive []byte) error {
+	return WriteFileAtomic(path, archive, outputFile{Mode: "0600"})
+}
+
+func backupCipher(passphrase []byte, salt []byte, iterations uint32) (cipher.AEAD, error) {
+	key, err := pbkdf2.Key(sha256.New, string(passphrase), salt, int(iterations), 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealBackup(plain []byte, passphrase []byte) ([]byte, error) {
+	salt := make([]byte, backupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := backupCipher(passphrase, salt, backupIterations)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	header := bytes.NewBufferString(backupMagic)
+	binary.Write(header, binary.BigEndian, uint32(backupIterations))
+	header.Write(salt)
+	header.Write(nonce)
+	return aead.Seal(header.Bytes(), nonce, plain, header.Bytes()), nil
+}
+
+func openBackup(archive []byte, passphrase []byte) ([]byte, error) {
+	if len(archive) < len(backupMagic)+4+backupSaltSize || string(archive[:len(backupMagic)]) != backupMagic {
+		return nil, errors.New("not a vault worker backup archive")
+	}
+	offset := len(backupMagic)
+	iterations := binary.BigEndian.Uint32(archive[offset:])
+	offset += 4
+	if iterations < backupMinIterations || iterations > backupMaxIterations {
+		return nil, fmt.Errorf("invalid backup archive: %d PBKDF2 iterations, expected %d to %d", iterations, backupMinIterations, backupMaxIterations)
+	}
+	salt := archive[offset : offset+backupSaltSize]
+	offset += backupSaltSize
+
+	aead, err := backupCipher(passphrase, salt, iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(archive) < offset+aead.NonceSize() {
+		return nil, errors.New("truncated backup archive")
+	}
+	nonce := archive[offset : offset+aead.NonceSize()]
+	offset += aead.NonceSize()
+
+	plain, err := aead.Open(nil, nonce, archive[offset:], archive[:offset])
+	if err != nil {
+		return nil, errors.New("cannot decrypt the backup archive: wrong passphrase or corrupted file")
+	}
+	return plain, nil
+}
+
+// readBackup decrypts the archive and checks every file against the manifest checksums
+func readBackup(archive []byte, passphrase []byte) (BackupManifest, map[string][]byte, error) {
+	manifest := BackupManifest{}
+	plain, err := openBackup(archive, passphrase)
+	if err != nil {
+		return manifest, nil, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(plain))
+	if err != nil {
+		return manifest, nil, err
+	}
+	tr := tar.NewReader(gz)
+	contents := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, nil, err
+		}
+		raw, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return manifest, nil, err
+		}
+		contents[hdr.Name] = raw
+	}
+
+	if err = json.Unmarshal(contents[backupManifestName], &manifest); err != nil {
+		return manifest, nil, fmt.Errorf("invalid backup manifest: %s", err.Error())
+	}
+	for _, f := range manifest.Files {
+		dir, name := path.Split(f.Name)
+		if (dir != backupAssetsDir+"/" && dir != backupPKIDir+"/") || name == "" || name == "." || name == ".." {
+			return manifest, nil, fmt.Errorf("unexpected file in backup archive: %s", f.Name)
+		}
+		raw, ok := contents[f.Name]
+		if !ok {
+			return manifest, nil, fmt.Errorf("file missing from backup archive: %s", f.Name)
+		}
+		sum := sha256.Sum256(raw)
+		if hex.EncodeToString(sum[:]) != f.SHA256 {
+			return manifest, nil, fmt.Errorf("checksum mismatch for %s", f.Name)
+		}
+	}
+	return manifest, contents, nil
+}
+
+// restoreTarget is where a file of a backup archive is restored
+type restoreTarget struct {
+	name   string
+	path   string
+	access outputFile
+}
+
+// restoreTargets locates every file of the manifest and checks them all before anything is
+// written, so that a refused restore leaves the system untouched. Existing files, the init
+// response or any other, are only replaced when overwriteinit is set.
+func restoreTargets(config *tomlConfig, manifest BackupManifest) ([]restoreTarget, error) {
+	pkiDir := filepath.Dir(config.SecretService.CAFilePath)
+	var targets []restoreTarget
+	for _, f := range manifest.Files {
+		dir, name := path.Split(f.Name)
+		target := restoreTarget{name: f.Name}
+		if dir == backupAssetsDir+"/" {
+			target.path = filepath.Join(config.SecretService.TokenFolderPath, name)
+			target.access = config.fileAccess(target.path)
+		} else {
+			target.path = filepath.Join(pkiDir, name)
+			target.access = outputFile{Mode: fmt.Sprintf("%o", f.Mode)}
+		}
+		info, err := os.Stat(target.path)
+		switch {
+		case os.IsNotExist(err):
+		case err != nil:
+			return nil, err
+		case !info.Mode().IsRegular():
+			return nil, fmt.Errorf("%s is not a regular file, cannot restore %s", target.path, f.Name)
+		case !config.SecretService.OverwriteInit:
+			return nil, fmt.Errorf("%s already exists, refusing to overwrite it without overwriteinit", target.path)
+		}
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// RestoreBackup verifies and unpacks a backup archive into the token folder and the PKI CA directory
+func RestoreBackup(config *tomlConfig, archive []byte, passphrase []byte) (BackupManifest, error) {
+	manifest, contents, err := readBackup(archive, passphrase)
+	if err != nil {
+		return manifest, err
+	}
+
+	targets, err := restoreTargets(config, manifest)
+	if err != nil {
+		return manifest, err
+	}
+	if err = os.MkdirAll(filepath.Dir(config.SecretService.CAFilePath), 0750); err != nil {
+		return manifest, err
+	}
+	for _, target := range targets {
+		if err = replaceFile(target.path, contents[target.name], target.access); err != nil {
+			return manifest, fmt.Errorf("failed to restore %s: %s", target.name, err.Error())
+		}
+		lc.Info(fmt.Sprintf("Restored %s", target.name))
+	}
+
+	// Policy files are not part of the backup, only their hashes: flag any drift
+	for name, policyFile := range map[string]string{
+		config.SecretService.PolicyName4Admin: config.SecretService.PolicyPath4Admin,
+		config.SecretService.PolicyName4Kong:  config.SecretService.PolicyPath4Kong,
+	} {
+		hashSum, err := HashFile(&policyFile, false)
+		if err == nil && manifest.PolicyHashes[name] != "" && hex.EncodeToString(hashSum) != manifest.PolicyHashes[name] {
+			lc.Warn(fmt.Sprintf("Policy file %s differs from the one in use when the backup was created", policyFile))
+		}
+	}
+	return manifest, nil
+}
+
+// RestoreCheck is the outcome of checking one restored asset against the live Vault
+type RestoreCheck struct {
+	Asset  string
+	OK     bool
+	Detail string
+}
+
+// lookupToken checks a token against Vault, returning the HTTP status code of lookup-self
+func lookupToken(token string, config *tomlConfig, httpClient *http.Client) (int, error) {
+	req, err := http.NewRequest(http.MethodGet, config.SecretService.Scheme+"://"+config.SecretService.Server+":"+config.SecretService.Port+vaultTokenLookupSelfAPI, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set(VaultToken, token)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	return resp.StatusCode, nil
+}
+
+// VerifyRestore checks against the live Vault that the restored key shares and tokens actually work
+func VerifyRestore(config *tomlConfig, httpClient *http.Client) ([]RestoreCheck, error) {
+	var checks []RestoreCheck
+	tokenFolder := config.SecretService.TokenFolderPath
+
+	sCode, err := VaultHealthCheck(config, httpClient)
+	if err != nil {
+		return checks, err
+	}
+	switch sCode {
+	case http.StatusServiceUnavailable:
+		_, err = VaultUnseal(config, httpClient, false)
+		check := RestoreCheck{Asset: "key shares", OK: err == nil, Detail: "Vault unsealed with the restored key shares"}
+		if err != nil {
+			check.Detail = "Vault could not be unsealed with the restored key shares"
+		}
+		checks = append(checks, check)
+	case http.StatusOK, http.StatusTooManyRequests:
+		checks = append(checks, RestoreCheck{Asset: "key shares", OK: true, Detail: "Vault is already unsealed, key shares not exercised"})
+	default:
+		return checks, fmt.Errorf("Vault is not initialized or in an unknown state (status code %d), nothing to verify against", sCode)
+	}
+
+	root, err := GetSecret(filepath.Join(tokenFolder, config.SecretService.VaultInitParm))
+	if err != nil {
+		return checks, err
+	}
+	sCode, err = lookupToken(root.Token, config, httpClient)
+	checks = append(checks, RestoreCheck{Asset: "root token", OK: err == nil && sCode == http.StatusOK, Detail: fmt.Sprintf("lookup-self status %d", sCode)})
+
+	tokenFiles, _ := filepath.Glob(filepath.Join(tokenFolder, "*"+tokenFileSuffix))
+	for _, f := range tokenFiles {
+		var tokenID TokenID
+		raw, err := ioutil.ReadFile(f)
+		if err == nil {
+			err = json.Unmarshal(raw, &tokenID)
+		}
+		if err != nil || tokenID.Auth.ClientToken == "" {
+			checks = append(checks, RestoreCheck{Asset: filepath.Base(f), OK: false, Detail: "no client token in file"})
+			continue
+		}
+		sCode, err = lookupToken(tokenID.Auth.ClientToken, config, httpClient)
+		checks = append(checks, RestoreCheck{Asset: filepath.Base(f), OK: err == nil && sCode == http.StatusOK, Detail: fmt.Sprintf("lookup-self status %d", sCode)})
+	}
+	return checks, nil
+}
+
+// RestoreFailed reports whether any restore check failed
+func RestoreFailed(checks []RestoreCheck) bool {
+	for _, c := range checks {
+		if !c.OK {
+			return true
+		}
+	}
+	return false
+}
+
+// String renders a restore check for the operator
+func (c RestoreCheck) String() string {
+	status := "OK"
+	if !c.OK {
+		status = "FAILED"
+	}
+	return fmt.Sprintf("%-6s %-20s %s", status, c.Asset, strings.TrimSpace(c.Detail))
+}
@@ -0,0 +1,165 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package vaultworker
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newBackupConfig returns a test configuration with a token file and a PKI CA directory
+func newBackupConfig(t *testing.T, serverURL string) *tomlConfig {
+	config := newTestConfig(t, serverURL)
+	pkiDir := filepath.Join(t.TempDir(), "EdgeXFoundryCA")
+	os.MkdirAll(pkiDir, 0750)
+	config.SecretService.CAFilePath = filepath.Join(pkiDir, "EdgeXFoundryCA.pem")
+	ioutil.WriteFile(config.SecretService.CAFilePath, []byte("ca certificate"), 0644)
+	ioutil.WriteFile(filepath.Join(config.SecretService.TokenFolderPath, "kong"+tokenFileSuffix),
+		[]byte(`{"auth":{"client_token":"s.kongkongkongkongkongkong","lease_duration":604800}}`), 0600)
+	return config
+}
+
+func TestBackupRoundTrip(t *testing.T) {
+	source := newBackupConfig(t, "http://127.0.0.1:8200")
+	archive, err := CreateBackup(source, []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("Failed to create backup: %s", err.Error())
+	}
+
+	if _, err = RestoreBackup(source, archive, []byte("wrong")); err == nil {
+		t.Errorf("Expected restore to fail with a wrong passphrase")
+	}
+	tampered := append([]byte{}, archive...)
+	tampered[len(tampered)-1] ^= 0xff
+	if _, err = RestoreBackup(source, tampered, []byte("passphrase")); err == nil {
+		t.Errorf("Expected restore to fail with a tampered archive")
+	}
+
+	// The iteration count is checked before deriving the key
+	for _, iterations := range []uint32{0, backupMinIterations - 1, backupMaxIterations + 1} {
+		forged := append([]byte{}, archive...)
+		binary.BigEndian.PutUint32(forged[len(backupMagic):], iterations)
+		if _, err = RestoreBackup(source, forged, []byte("passphrase")); err == nil || !strings.Contains(err.Error(), "PBKDF2 iterations") {
+			t.Errorf("Expected %d iterations to be rejected, got %v", iterations, err)
+		}
+	}
+
+	target := &tomlConfig{}
+	*target = *source
+	target.SecretService.TokenFolderPath = t.TempDir()
+	target.SecretService.CAFilePath = filepath.Join(t.TempDir(), "EdgeXFoundryCA", "EdgeXFoundryCA.pem")
+	manifest, err := RestoreBackup(target, archive, []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("Failed to restore backup: %s", err.Error())
+	}
+	if len(manifest.Files) != 3 || len(manifest.PolicyHashes) != 2 {
+		t.Errorf("Unexpected manifest content: %+v", manifest)
+	}
+	for _, f := range []string{
+		filepath.Join(target.SecretService.TokenFolderPath, "resp-init.json"),
+		filepath.Join(target.SecretService.TokenFolderPath, "kong"+tokenFileSuffix),
+		target.SecretService.CAFilePath,
+	} {
+		if _, err := os.Stat(f); err != nil {
+			t.Errorf("Expected %s to be restored: %s", f, err.Error())
+		}
+	}
+
+	if _, err = RestoreBackup(target, archive, []byte("passphrase")); err == nil {
+		t.Errorf("Expected restore not to overwrite an existing init file")
+	}
+}
+
+func TestRestoreBackupRefused(t *testing.T) {
+	config := newBackupConfig(t, "http://127.0.0.1:8200")
+	archive, err := CreateBackup(config, []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("Failed to create backup: %s", err.Error())
+	}
+	manifest, _, err := readBackup(archive, []byte("passphrase"))
+	if err != nil {
+		t.Fatalf("Failed to read backup: %s", err.Error())
+	}
+	for i := 1; i < len(manifest.Files); i++ {
+		if manifest.Files[i-1].Name > manifest.Files[i].Name {
+			t.Errorf("Manifest files not sorted: %+v", manifest.Files)
+		}
+	}
+
+	// The existing init file refuses the restore before any other file is replaced
+	tokenFile := filepath.Join(config.SecretService.TokenFolderPath, "kong"+tokenFileSuffix)
+	ioutil.WriteFile(tokenFile, []byte("current token"), 0600)
+	ioutil.WriteFile(config.SecretService.CAFilePath, []byte("current ca certificate"), 0644)
+	if _, err = RestoreBackup(config, archive, []byte("passphrase")); err == nil {
+		t.Fatalf("Expected restore not to overwrite existing files")
+	}
+	for file, expected := range map[string]string{tokenFile: "current token", config.SecretService.CAFilePath: "current ca certificate"} {
+		if raw, _ := ioutil.ReadFile(file); string(raw) != expected {
+			t.Errorf("%s replaced by a refused restore: %q", file, raw)
+		}
+		if _, err := os.Stat(file + backupFileExt); err == nil {
+			t.Errorf("Unexpected %s by a refused restore", file+backupFileExt)
+		}
+	}
+
+	// With overwriteinit, the replaced files are kept as .bak files
+	config.SecretService.OverwriteInit = true
+	if _, err = RestoreBackup(config, archive, []byte("passphrase")); err != nil {
+		t.Fatalf("Failed to restore backup: %s", err.Error())
+	}
+	if raw, _ := ioutil.ReadFile(tokenFile + backupFileExt); string(raw) != "current token" {
+		t.Errorf("Previous token file not kept: %q", raw)
+	}
+	if raw, _ := ioutil.ReadFile(tokenFile); string(raw) == "current token" {
+		t.Errorf("Token file not restored")
+	}
+}
+
+func TestVerifyRestore(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case vaultHealthAPI:
+			w.WriteHeader(http.StatusOK)
+		case vaultTokenLookupSelfAPI:
+			if r.Header.Get(VaultToken) == "s.kongkongkongkongkongkong" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer ts.Close()
+
+	checks, err := VerifyRestore(newBackupConfig(t, ts.URL), ts.Client())
+	if err != nil {
+		t.Fatalf("Failed to verify restore: %s", err.Error())
+	}
+	if len(checks) != 3 || !checks[0].OK || !checks[1].OK || checks[2].OK {
+		t.Errorf("Expected a revoked kong token to fail verification, got %v", checks)
+	}
+	if !RestoreFailed(checks) {
+		t.Errorf("Expected the restore verification to fail")
+	}
+}
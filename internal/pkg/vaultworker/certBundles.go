@@ -0,0 +1,220 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *
+ * @version: 1.0.0
+ *******************************************************************************/
+package vaultworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const bundlePolicySuffix = "-tls-read"
+
+// CheckCertBundles verifies that every [[certificates]] entry can be processed
+func CheckCertBundles(config *tomlConfig) error {
+	seen := map[string]bool{}
+	for i, b := range config.CertBundles() {
+		switch {
+		case b.Name == "":
+			return fmt.Errorf("certificates[%d]: name is required", i)
+		case seen[b.Name]:
+			return fmt.Errorf("certificates[%d]: duplicate name %q", i, b.Name)
+		case b.Path == "":
+			return fmt.Errorf("certificates[%d] %s: path is required", i, b.Name)
+		case b.PKIRole != "":
+			if _, ok := config.PKIEngine.role(b.PKIRole); !config.PKIEngine.Enabled || !ok {
+				return fmt.Errorf("certificates[%d] %s: pkirole %q is not a role of an enabled pkiengine", i, b.Name, b.PKIRole)
+			}
+		case b.CertFile == "" || b.KeyFile == "":
+			return fmt.Errorf("certificates[%d] %s: certfile and keyfile are required", i, b.Name)
+		}
+		seen[b.Name] = true
+		for _, consumer := range b.Consumers {
+			if err := checkConsumerName(config, consumer); err != nil {
+				return fmt.Errorf("certificates[%d] %s: %s", i, b.Name, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// checkConsumerName rejects the consumers named after the admin or Kong token, whose files
+// would be overwritten with a token only allowed to read certificates
+func checkConsumerName(config *tomlConfig, consumer string) error {
+	switch consumer {
+	case "":
+		return fmt.Errorf("empty consumer name")
+	case config.SecretService.TokenName4Admin, config.SecretService.TokenName4Kong:
+		return fmt.Errorf("consumer %q is reserved for the tokenname4admin or tokenname4kong token", consumer)
+	}
+	return nil
+}
+
+// chainCAFile returns the CA the bundle certificate must chain to, cafilepath if the bundle has none
+func (b certBundle) chainCAFile(config *tomlConfig) string {
+	if b.CAFile != "" {
+		return b.CAFile
+	}
+	return config.SecretService.CAFilePath
+}
+
+// BundlePolicyName is the Vault policy granting the consumers of a bundle read access to it
+func BundlePolicyName(b certBundle) string {
+	return b.Name + bundlePolicySuffix
+}
+
+// bundlePolicyRules returns the HCL rules of the bundle read policy. Vault policy paths do not
+// carry the API version prefix of the secret store path.
+func bundlePolicyRules(b certBundle) string {
+	return fmt.Sprintf("path \"%s\" {\n  capabilities = [\"read\"]\n}\n", strings.TrimPrefix(strings.Trim(b.Path, "/"), "v1/"))
+}
+
+// ImportCertBundlePolicies creates the read policy of every bundle having consumers
+func ImportCertBundlePolicies(config *tomlConfig, rootToken string, httpClient *http.Client) error {
+	for _, b := range config.CertBundles() {
+		if len(b.Consumers) == 0 {
+			continue
+		}
+		policyRequest, err := json.Marshal(struct {
+			Policy string `json:"policy"`
+		}{bundlePolicyRules(b)})
+		if err != nil {
+			return err
+		}
+		lc.Info(fmt.Sprintf("Importing Vault policy %s for TLS certificate %s.", BundlePolicyName(b), b.Name))
+		if err = ImportPolicy(BundlePolicyName(b), &policyRequest, rootToken, config, httpClient); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// consumerPolicies maps every bundle and PKI role consumer to the policies it is entitled to
+func consumerPolicies(config *tomlConfig) map[string][]string {
+	policies := map[string][]string{}
+	for _, b := range config.CertBundles() {
+		for _, consumer := range b.Consumers {
+			policies[consumer] = append(policies[consumer], BundlePolicyName(b))
+		}
+	}
+	if config.PKIEngine.Enabled {
+		for _, r := range config.PKIEngine.Roles {
+			for _, consumer := range r.Consumers {
+				policies[consumer] = append(policies[consumer], PKIRolePolicyName(config.PKIEngine, r))
+			}
+		}
+	}
+	return policies
+}
+
+// CreateConsumerTokens mints one token per bundle consumer, holding the read policies of all its bundles
+func CreateConsumerTokens(config *tomlConfig, rootToken string, httpClient *http.Client) error {
+	policies := consumerPolicies(config)
+	consumers := make([]string, 0, len(policies))
+	for consumer := range policies {
+		consumers = append(consumers, consumer)
+	}
+	sort.Strings(consumers)
+	for _, consumer := range consumers {
+		lc.Info(fmt.Sprintf("Creating Vault token %s with policies %v.", consumer, policies[consumer]))
+		if err := CreateTokenWithPolicies(consumer, policies[consumer], rootToken, config, httpClient); err != nil {
+			return fmt.Errorf("token %s: %s", consumer, err.Error())
+		}
+	}
+	return nil
+}
+
+// SyncCertBundle brings one bundle of the secret store up to date: the stored pair is kept, re-uploaded
+// or renewed as decided by DecideCertAction (or issued again from the Vault PKI role of the bundle),
+// and any new pair is validated and the previous one archived before uploading. Uploads are retried
+// every wait until they succeed.
+func SyncCertBundle(config *tomlConfig, b certBundle, secretBaseURL string, c *http.Client, debug bool, wait time.Duration) (CertDecision, error) {
+	storedCert, storedKey, err := GetStoredCertKeyPair(config, b, secretBaseURL, c, debug)
+	if err != nil {
+		return CertDecision{}, fmt.Errorf("failed to check if the TLS certificate and key %s are in the secret store: %s", b.Name, err.Error())
+	}
+
+	var cert, sk, ca string
+	renewal := b.renewal(config)
+	decision := CertDecision{}
+	if b.PKIRole != "" {
+		if decision, err = decideIssuedCert(storedCert, renewal, time.Now()); err != nil {
+			return decision, err
+		}
+		lc.Info(fmt.Sprintf("TLS certificate %s action: %s (%s).", b.Name, decision.Action, decision.Reason))
+		if decision.Action == CertKeep {
+			return decision, nil
+		}
+		lc.Info(fmt.Sprintf("Issuing TLS certificate %s from %s.", b.Name, pkiCertDetail(config, b)))
+		if cert, sk, ca, err = IssuePKICert(config, b, c); err != nil {
+			return decision, fmt.Errorf("failed to issue TLS certificate %s: %s", b.Name, err.Error())
+		}
+	} else {
+		cert, sk, err = LoadCertKeyPair(b.CertFile, b.KeyFile)
+		if err != nil && storedCert == "" {
+			return CertDecision{}, fmt.Errorf("failed to load TLS certificate %s and key %s from volume: %s", b.CertFile, b.KeyFile, err.Error())
+		}
+
+		decision, err = DecideCertAction(storedCert, cert, renewal, time.Now())
+		if err != nil {
+			return decision, fmt.Errorf("failed to compare the stored TLS certificate %s with the volume: %s", b.Name, err.Error())
+		}
+		lc.Info(fmt.Sprintf("TLS certificate %s action: %s (%s).", b.Name, decision.Action, decision.Reason))
+
+		switch decision.Action {
+		case CertKeep:
+			return decision, nil
+		case CertRenew:
+			lc.Info(fmt.Sprintf("Issuing a new TLS certificate %s with %s.", b.Name, renewal.PKISetupConfig))
+			if cert, sk, err = RenewCert(renewal, b.pkiSetupHost()); err != nil {
+				return decision, fmt.Errorf("failed to issue a new TLS certificate %s: %s", b.Name, err.Error())
+			}
+		}
+
+		if b.CAFile != "" {
+			if ca, err = LoadCACert(b.CAFile); err != nil {
+				return decision, fmt.Errorf("failed to load the CA chain %s of %s: %s", b.CAFile, b.Name, err.Error())
+			}
+		}
+	}
+
+	report := ValidateCertKeyPair(cert, sk, b.chainCAFile(config), b.SNIList(), config.CertPolicy, time.Now())
+	for _, check := range report.Checks {
+		if check.OK {
+			lc.Info(fmt.Sprintf("Certificate %s check %s: %s", b.Name, check.Name, check.Detail))
+		} else {
+			lc.Error(fmt.Sprintf("Certificate %s check %s FAILED: %s", b.Name, check.Name, check.Detail))
+		}
+	}
+	if report.Failed() {
+		return decision, fmt.Errorf("TLS certificate and key %s rejected, not uploading them:\n%s", b.Name, report.String())
+	}
+
+	if storedCert != "" {
+		if err = ArchiveStoredCert(config, b, secretBaseURL, storedCert, storedKey, c); err != nil {
+			return decision, fmt.Errorf("failed to keep the previous TLS certificate %s for rollback: %s", b.Name, err.Error())
+		}
+	}
+
+	for UploadCertBundle(config, b, secretBaseURL, cert, sk, ca, c) != nil {
+		lc.Info(fmt.Sprintf("Will retry uploading %s in %s.", b.Name, wait))
+		time.Sleep(wait)
+	}
+	return decision, nil
+}
@@ -0,0 +1,209 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package vaultworker
+
+import (
+	"crypto/elliptic"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+const testBundlesConfig = `
+[secretservice]
+certpath = "v1/secret/edgex/pki/tls/edgex-kong"
+snis = "edgex-kong"
+
+[[certificates]]
+name = "edgex-kong"
+certfile = "kong.pem"
+keyfile = "kong.priv.key"
+path = "v1/secret/edgex/pki/tls/edgex-kong"
+snis = "edgex-kong, localhost"
+gateway = true
+
+[[certificates]]
+name = "mqtt"
+certfile = "mqtt.pem"
+keyfile = "mqtt.priv.key"
+cafile = "ca.pem"
+path = "v1/secret/edgex/pki/tls/mqtt"
+consumers = ["mqtt-broker", "device-mqtt"]
+
+[[certificates]]
+name = "vault"
+certfile = "vault.pem"
+keyfile = "vault.priv.key"
+path = "v1/secret/edgex/pki/tls/vault"
+consumers = ["device-mqtt"]
+`
+
+func TestCertBundles(t *testing.T) {
+	config := &tomlConfig{}
+	if _, err := toml.Decode(testBundlesConfig, config); err != nil {
+		t.Fatal(err)
+	}
+	bundles := config.CertBundles()
+	if len(bundles) != 3 || bundles[1].Name != "mqtt" || bundles[1].CAFile != "ca.pem" {
+		t.Fatalf("Unexpected bundles: %+v", bundles)
+	}
+	if strings.Join(bundles[0].SNIList(), ",") != "edgex-kong,localhost" || !bundles[0].Gateway {
+		t.Errorf("Unexpected gateway bundle: %+v", bundles[0])
+	}
+	if err := CheckCertBundles(config); err != nil {
+		t.Errorf("Unexpected error: %s", err.Error())
+	}
+
+	policies := consumerPolicies(config)
+	if strings.Join(policies["device-mqtt"], ",") != "mqtt-tls-read,vault-tls-read" || len(policies["mqtt-broker"]) != 1 {
+		t.Errorf("Unexpected consumer policies: %v", policies)
+	}
+	if rules := bundlePolicyRules(bundles[1]); !strings.Contains(rules, `path "secret/edgex/pki/tls/mqtt"`) {
+		t.Errorf("Unexpected policy rules: %s", rules)
+	}
+
+	config.Certificates[2].Name = "mqtt"
+	if err := CheckCertBundles(config); err == nil {
+		t.Errorf("Expected duplicate bundle names to be rejected")
+	}
+}
+
+func TestCertBundlesReservedConsumers(t *testing.T) {
+	config := &tomlConfig{}
+	if _, err := toml.Decode(testBundlesConfig, config); err != nil {
+		t.Fatal(err)
+	}
+	config.SecretService.TokenName4Admin = "admin-token"
+	config.SecretService.TokenName4Kong = "kong-token"
+	for _, consumer := range []string{"admin-token", "kong-token"} {
+		config.Certificates[1].Consumers = []string{"mqtt-broker", consumer}
+		if err := CheckCertBundles(config); err == nil || !strings.Contains(err.Error(), "reserved") {
+			t.Errorf("Expected consumer %s to be rejected, got %v", consumer, err)
+		}
+	}
+
+	config.Certificates[1].Consumers = nil
+	config.PKIEngine.Enabled = true
+	config.PKIEngine.Mode = pkiModeImport
+	config.PKIEngine.Roles = []pkiRole{{Name: "services", Consumers: []string{"kong-token"}}}
+	if err := CheckPKIEngine(config); err == nil || !strings.Contains(err.Error(), "reserved") {
+		t.Errorf("Expected PKI role consumer kong-token to be rejected, got %v", err)
+	}
+}
+
+func TestCertBundlesLegacy(t *testing.T) {
+	config := &tomlConfig{}
+	config.SecretService.CertPath = "v1/secret/edgex/pki/tls/edgex-kong"
+	config.SecretService.CertFilePath = "kong.pem"
+	config.SecretService.KeyFilePath = "kong.priv.key"
+	config.SecretService.SNIS = "edgex-kong"
+	config.CertRenewal.PKISetupConfig = "pkisetup-kong.json"
+
+	bundles := config.CertBundles()
+	if len(bundles) != 1 {
+		t.Fatalf("Expected a single legacy bundle, got %+v", bundles)
+	}
+	b := bundles[0]
+	if b.Name != "edgex-kong" || b.Path != config.SecretService.CertPath || b.CertFile != "kong.pem" || !b.Gateway || b.PKISetupConfig != "pkisetup-kong.json" {
+		t.Errorf("Unexpected legacy bundle: %+v", b)
+	}
+}
+
+func TestSyncCertBundle(t *testing.T) {
+	var mu sync.Mutex
+	stored := map[string]CertKeyPair{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPost:
+			pair := CertKeyPair{}
+			json.NewDecoder(r.Body).Decode(&pair)
+			stored[r.URL.Path] = pair
+			w.WriteHeader(http.StatusNoContent)
+		case http.MethodGet:
+			pair, ok := stored[r.URL.Path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			json.NewEncoder(w).Encode(CertKeyCollector{Section: pair})
+		}
+	}))
+	defer ts.Close()
+
+	ca := newTestCA(t)
+	now := time.Now()
+	config := newTestConfig(t, ts.URL)
+	dir := config.SecretService.TokenFolderPath
+	for _, name := range []string{"kong", "mqtt"} {
+		cert, key := ca.issue(t, elliptic.P256(), []string{name}, now.Add(-time.Hour), now.AddDate(0, 6, 0))
+		ioutil.WriteFile(filepath.Join(dir, name+".pem"), []byte(cert), 0600)
+		ioutil.WriteFile(filepath.Join(dir, name+".priv.key"), []byte(key), 0600)
+		config.Certificates = append(config.Certificates, certBundle{
+			Name:     name,
+			CertFile: filepath.Join(dir, name+".pem"),
+			KeyFile:  filepath.Join(dir, name+".priv.key"),
+			CAFile:   ca.pemFile,
+			Path:     "v1/secret/edgex/pki/tls/" + name,
+			SNIS:     name,
+		})
+	}
+
+	for _, b := range config.CertBundles() {
+		decision, err := SyncCertBundle(config, b, ts.URL+"/", ts.Client(), false, time.Millisecond)
+		if err != nil {
+			t.Fatalf("%s: %s", b.Name, err.Error())
+		}
+		if decision.Action != CertUpload {
+			t.Errorf("%s: expected %s, got %s", b.Name, CertUpload, decision.Action)
+		}
+	}
+	mqtt := stored["/v1/secret/edgex/pki/tls/mqtt"]
+	if mqtt.Cert == "" || mqtt.Key == "" || !strings.Contains(mqtt.CA, "CERTIFICATE") {
+		t.Errorf("Unexpected stored mqtt bundle: %+v", mqtt)
+	}
+
+	// Nothing changed on the volume: both bundles are kept
+	for _, b := range config.CertBundles() {
+		decision, err := SyncCertBundle(config, b, ts.URL+"/", ts.Client(), false, time.Millisecond)
+		if err != nil || decision.Action != CertKeep {
+			t.Errorf("%s: expected %s, got %+v (%v)", b.Name, CertKeep, decision, err)
+		}
+	}
+
+	// A certificate not covering its SNIs is rejected before reaching the secret store
+	b := config.Certificates[1]
+	b.Path = "v1/secret/edgex/pki/tls/other"
+	b.SNIS = "other.example.com"
+	if _, err := SyncCertBundle(config, b, ts.URL+"/", ts.Client(), false, time.Millisecond); err == nil {
+		t.Errorf("Expected the certificate to be rejected")
+	}
+	if _, ok := stored["/v1/secret/edgex/pki/tls/other"]; ok {
+		t.Errorf("Rejected certificate was uploaded")
+	}
+}
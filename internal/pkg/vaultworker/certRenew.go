@@ -0,0 +1,263 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *
+ * @version: 1.0.0
+ *******************************************************************************/
+package vaultworker
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dghubble/sling"
+	pki "github.com/edgexfoundry/security-secret-store/internal/pkg/pkisetup"
+)
+
+// Actions decided for the TLS certificate held in the secret store
+const (
+	CertUpload   = "upload"   // nothing in the secret store yet
+	CertReupload = "reupload" // the certificate on the volume is newer than the stored one
+	CertRenew    = "renew"    // the stored certificate is within its renewal window: issue a new one
+	CertKeep     = "keep"     // the stored certificate is current
+)
+
+const certHistorySuffix = "-history"
+
+// CertDecision is the action to take on the stored certificate and why
+type CertDecision struct {
+	Action string
+	Reason string
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of the leaf certificate of a PEM bundle
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// renewBefore parses the renewal window, 0 if unset
+func (r certRenewal) renewBefore() (time.Duration, error) {
+	if r.RenewBefore == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(r.RenewBefore)
+}
+
+// DecideCertAction compares the certificate in the secret store with the one on the volume
+// (fingerprint and NotAfter) and decides whether it must be uploaded, replaced or renewed
+func DecideCertAction(stored string, disk string, renewal certRenewal, now time.Time) (CertDecision, error) {
+	if stored == "" {
+		return CertDecision{CertUpload, "no certificate in the secret store"}, nil
+	}
+	window, err := renewal.renewBefore()
+	if err != nil {
+		return CertDecision{}, fmt.Errorf("invalid renewal window %q: %s", renewal.RenewBefore, err.Error())
+	}
+	diskLeaf := (*x509.Certificate)(nil)
+	if diskChain, err := parseCertChain([]byte(disk)); err == nil {
+		diskLeaf = diskChain[0]
+	}
+	storedChain, err := parseCertChain([]byte(stored))
+	if err != nil {
+		if diskLeaf == nil {
+			return CertDecision{CertKeep, fmt.Sprintf("stored certificate cannot be parsed (%s) and no certificate on the volume", err.Error())}, nil
+		}
+		return CertDecision{CertReupload, fmt.Sprintf("stored certificate cannot be parsed: %s", err.Error())}, nil
+	}
+	storedLeaf := storedChain[0]
+
+	if diskLeaf != nil && CertFingerprint(diskLeaf) != CertFingerprint(storedLeaf) && diskLeaf.NotAfter.After(storedLeaf.NotAfter) {
+		return CertDecision{CertReupload, fmt.Sprintf("certificate on the volume (%s, expires %s) is newer than the stored one (%s, expires %s)",
+			CertFingerprint(diskLeaf)[:16], diskLeaf.NotAfter.UTC(), CertFingerprint(storedLeaf)[:16], storedLeaf.NotAfter.UTC())}, nil
+	}
+
+	if window > 0 && storedLeaf.NotAfter.Sub(now) < window {
+		if renewal.PKISetupConfig == "" {
+			return CertDecision{CertKeep, fmt.Sprintf("stored certificate expires %s, within the renewal window, but no pkisetupconfig is set to issue a new one", storedLeaf.NotAfter.UTC())}, nil
+		}
+		return CertDecision{CertRenew, fmt.Sprintf("stored certificate expires %s, within the %s renewal window", storedLeaf.NotAfter.UTC(), window)}, nil
+	}
+	return CertDecision{CertKeep, fmt.Sprintf("stored certificate %s is current (expires %s)", CertFingerprint(storedLeaf)[:16], storedLeaf.NotAfter.UTC())}, nil
+}
+
+// GetStoredCertKeyPair returns the certificate and key of a bundle held in the secret store, empty if not found
+func GetStoredCertKeyPair(config *tomlConfig, b certBundle, secretBaseURL string, c *http.Client, debug bool) (string, string, error) {
+	return getCertKeyPair(config, b, secretBaseURL, c, debug)
+}
+
+// renewal returns the renewal settings of a bundle: the global window and depth, with its own pkisetup configuration
+func (b certBundle) renewal(config *tomlConfig) certRenewal {
+	renewal := config.CertRenewal
+	renewal.PKISetupConfig = b.PKISetupConfig
+	return renewal
+}
+
+// pkiSetupHost is the pkisetup tls_host renewing a bundle: pkisetup names the certificate <tls_host>.pem
+func (b certBundle) pkiSetupHost() string {
+	return strings.TrimSuffix(path.Base(b.CertFile), ".pem")
+}
+
+// pkiLogger forwards the pkisetup library progress messages to the vaultworker logging client
+type pkiLogger struct{}
+
+func (pkiLogger) Printf(format string, v ...interface{}) {
+	lc.Info(fmt.Sprintf(format, v...))
+}
+
+func (pkiLogger) Println(v ...interface{}) {
+	if msg := strings.TrimSpace(fmt.Sprintln(v...)); msg != "" {
+		lc.Info(msg)
+	}
+}
+
+// RenewCert issues a fresh TLS server certificate for the tls_host of the pkisetup configuration,
+// reusing the existing CA. The new PEM files are written where the pkisetup configuration points to
+// and returned.
+func RenewCert(renewal certRenewal, host string) (string, string, error) {
+	pki.SetLogger(pkiLogger{})
+	configFile := renewal.PKISetupConfig
+	x509config, err := pki.ReadConfig(&configFile)
+	if err != nil {
+		return "", "", err
+	}
+	// Renewal must never replace the CA
+	x509config.CreateNewRootCA = false
+	cf, err := pki.CreateEnv(&x509config)
+	if err != nil {
+		return "", "", err
+	}
+	cert, key, err := pki.GenCert(&cf, host)
+	if err != nil {
+		return "", "", err
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8})), nil
+}
+
+// writeSecret posts a JSON body to a secret store path with the root token
+func writeSecret(config *tomlConfig, secretBaseURL string, path string, body interface{}, c *http.Client) error {
+	t, err := GetSecret(config.SecretService.TokenFolderPath + "/" + config.SecretService.VaultInitParm)
+	if err != nil {
+		return err
+	}
+	req, err := sling.New().Set(VaultToken, t.Token).Base(secretBaseURL).Post(path).BodyJSON(body).Request()
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("failed to write %s: %s %s", path, resp.Status, string(b))
+	}
+	return nil
+}
+
+// ArchiveStoredCert keeps the certificate being replaced under <path>-history/<timestamp> for
+// rollback, and prunes the history down to the configured depth
+func ArchiveStoredCert(config *tomlConfig, b certBundle, secretBaseURL string, cert string, key string, c *http.Client) error {
+	historyPath := b.Path + certHistorySuffix
+	version := time.Now().UTC().Format("20060102T150405Z")
+	if err := writeSecret(config, secretBaseURL, historyPath+"/"+version, &CertKeyPair{Cert: cert, Key: key}, c); err != nil {
+		return err
+	}
+	lc.Info(fmt.Sprintf("Previous TLS certificate %s kept for rollback @/%s/%s", b.Name, historyPath, version))
+
+	depth := config.CertRenewal.HistoryDepth
+	if depth <= 0 {
+		return nil
+	}
+	versions, err := listSecrets(config, secretBaseURL, historyPath, c)
+	if err != nil {
+		return err
+	}
+	sort.Strings(versions)
+	for len(versions) > depth {
+		if err = deleteSecret(config, secretBaseURL, historyPath+"/"+versions[0], c); err != nil {
+			return err
+		}
+		lc.Info(fmt.Sprintf("Pruned TLS certificate %s version %s", b.Name, versions[0]))
+		versions = versions[1:]
+	}
+	return nil
+}
+
+// listSecrets returns the keys stored under a secret store path
+func listSecrets(config *tomlConfig, secretBaseURL string, path string, c *http.Client) ([]string, error) {
+	t, err := GetSecret(config.SecretService.TokenFolderPath + "/" + config.SecretService.VaultInitParm)
+	if err != nil {
+		return nil, err
+	}
+	req, err := sling.New().Set(VaultToken, t.Token).Base(secretBaseURL).Get(strings.TrimSuffix(path, "/") + "/?list=true").Request()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list %s: %s", path, resp.Status)
+	}
+	var list struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+	return list.Data.Keys, nil
+}
+
+// deleteSecret removes a secret store path
+func deleteSecret(config *tomlConfig, secretBaseURL string, path string, c *http.Client) error {
+	t, err := GetSecret(config.SecretService.TokenFolderPath + "/" + config.SecretService.VaultInitParm)
+	if err != nil {
+		return err
+	}
+	req, err := sling.New().Set(VaultToken, t.Token).Base(secretBaseURL).Delete(path).Request()
+	if err != nil {
+		return err
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("failed to delete %s: %s", path, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,102 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package vaultworker
+
+import (
+	"crypto/elliptic"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDecideCertAction(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	old, _ := ca.issue(t, elliptic.P256(), []string{"edgex-kong"}, now.AddDate(0, -11, 0), now.AddDate(0, 0, 10))
+	current, _ := ca.issue(t, elliptic.P256(), []string{"edgex-kong"}, now.Add(-time.Hour), now.AddDate(1, 0, 0))
+
+	renewal := certRenewal{RenewBefore: "720h", PKISetupConfig: "pkisetup-kong.json"}
+	tests := []struct {
+		name     string
+		stored   string
+		disk     string
+		renewal  certRenewal
+		expected string
+	}{
+		{"empty store", "", current, renewal, CertUpload},
+		{"same cert", current, current, renewal, CertKeep},
+		{"newer on disk", old, current, renewal, CertReupload},
+		{"older on disk", current, old, renewal, CertKeep},
+		{"expiring", old, old, renewal, CertRenew},
+		{"expiring without pkisetup", old, old, certRenewal{RenewBefore: "720h"}, CertKeep},
+		{"expiring without window", old, old, certRenewal{}, CertKeep},
+	}
+	for _, tt := range tests {
+		decision, err := DecideCertAction(tt.stored, tt.disk, tt.renewal, now)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.name, err.Error())
+			continue
+		}
+		if decision.Action != tt.expected {
+			t.Errorf("%s: expected %s, got %s (%s)", tt.name, tt.expected, decision.Action, decision.Reason)
+		}
+	}
+
+	if _, err := DecideCertAction(current, current, certRenewal{RenewBefore: "30 days"}, now); err == nil {
+		t.Errorf("Expected an invalid renewal window to be rejected")
+	}
+}
+
+func TestArchiveStoredCert(t *testing.T) {
+	var mu sync.Mutex
+	var written, deleted []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodPost:
+			written = append(written, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		case r.Method == http.MethodGet && r.URL.Query().Get("list") == "true":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"data": map[string]interface{}{"keys": []string{"20190101T000000Z", "20190201T000000Z", "20190301T000000Z"}},
+			})
+		case r.Method == http.MethodDelete:
+			deleted = append(deleted, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer ts.Close()
+
+	config := newTestConfig(t, ts.URL)
+	config.CertRenewal.HistoryDepth = 2
+	if err := ArchiveStoredCert(config, config.legacyBundle(), ts.URL+"/", "cert", "key", ts.Client()); err != nil {
+		t.Fatalf("Failed to archive certificate: %s", err.Error())
+	}
+	if len(written) != 1 || !strings.HasPrefix(written[0], "/v1/secret/edgex/pki/tls/edgex-kong-history/") {
+		t.Errorf("Unexpected archive writes: %v", written)
+	}
+	if len(deleted) != 1 || deleted[0] != "/v1/secret/edgex/pki/tls/edgex-kong-history/20190101T000000Z" {
+		t.Errorf("Expected the oldest version to be pruned, got %v", deleted)
+	}
+}
@@ -0,0 +1,228 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *
+ * @version: 1.0.0
+ *******************************************************************************/
+package vaultworker
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	defaultMinRSABits = 2048
+	defaultMinECBits  = 256
+)
+
+// CertCheck is the outcome of a single certificate/key verification
+type CertCheck struct {
+	Name   string
+	OK     bool
+	Detail string
+}
+
+// CertReport lists every verification run on a certificate/key pair
+type CertReport struct {
+	Checks []CertCheck
+}
+
+func (r *CertReport) add(name string, err error, detail string) {
+	if err != nil {
+		r.Checks = append(r.Checks, CertCheck{Name: name, OK: false, Detail: err.Error()})
+		return
+	}
+	r.Checks = append(r.Checks, CertCheck{Name: name, OK: true, Detail: detail})
+}
+
+// Failed reports whether any check failed
+func (r CertReport) Failed() bool {
+	for _, c := range r.Checks {
+		if !c.OK {
+			return true
+		}
+	}
+	return false
+}
+
+// String renders the report, one check per line
+func (r CertReport) String() string {
+	var buf bytes.Buffer
+	for _, c := range r.Checks {
+		status := "OK"
+		if !c.OK {
+			status = "FAILED"
+		}
+		fmt.Fprintf(&buf, "%-6s %-12s %s\n", status, c.Name, c.Detail)
+	}
+	return buf.String()
+}
+
+// parseCertChain decodes every certificate of a PEM bundle, leaf first
+func parseCertChain(certPEM []byte) ([]*x509.Certificate, error) {
+	var chain []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, certPEM = pem.Decode(certPEM)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("no PEM certificate found")
+	}
+	return chain, nil
+}
+
+// parsePrivateKey decodes a PKCS#8, PKCS#1 (RSA) or SEC 1 (EC) PEM private key
+func parsePrivateKey(keyPEM []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(keyPEM)
+	if block == nil {
+		return nil, errors.New("no PEM private key found")
+	}
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block type %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("private key cannot be used for signing")
+	}
+	return signer, nil
+}
+
+// checkKeyStrength applies the key type/size policy to a public key
+func checkKeyStrength(pub crypto.PublicKey, policy certPolicy) (string, error) {
+	minRSA, minEC := policy.MinRSABits, policy.MinECBits
+	if minRSA == 0 {
+		minRSA = defaultMinRSABits
+	}
+	if minEC == 0 {
+		minEC = defaultMinECBits
+	}
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		if k.N.BitLen() < minRSA {
+			return "", fmt.Errorf("RSA key of %d bits, at least %d required", k.N.BitLen(), minRSA)
+		}
+		return fmt.Sprintf("RSA %d bits", k.N.BitLen()), nil
+	case *ecdsa.PublicKey:
+		if k.Curve.Params().BitSize < minEC {
+			return "", fmt.Errorf("EC key on %s, at least %d bits required", k.Curve.Params().Name, minEC)
+		}
+		return fmt.Sprintf("EC %s", k.Curve.Params().Name), nil
+	case ed25519.PublicKey:
+		return "Ed25519", nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T", pub)
+	}
+}
+
+// ValidateCertKeyPair parses and verifies a PEM certificate (optionally followed by its chain)
+// and private key before they are uploaded: key match, validity window, chain verification
+// against caFile, SAN coverage of the SNIs and key type/size policy
+func ValidateCertKeyPair(cert string, key string, caFile string, snis []string, policy certPolicy, now time.Time) CertReport {
+	report := CertReport{}
+
+	chain, err := parseCertChain([]byte(cert))
+	report.add("certificate", err, fmt.Sprintf("%d certificate(s) in bundle", len(chain)))
+	signer, err := parsePrivateKey([]byte(key))
+	report.add("key", err, "private key parsed")
+	if report.Failed() {
+		return report
+	}
+	leaf := chain[0]
+
+	// The private key must be the one certified
+	if pub, ok := signer.Public().(interface{ Equal(crypto.PublicKey) bool }); !ok || !pub.Equal(leaf.PublicKey) {
+		report.add("key match", errors.New("private key does not match the certificate public key"), "")
+	} else {
+		report.add("key match", nil, "private key matches the certificate")
+	}
+
+	// Validity window
+	switch {
+	case now.Before(leaf.NotBefore):
+		report.add("validity", fmt.Errorf("certificate not valid before %s", leaf.NotBefore.UTC()), "")
+	case now.After(leaf.NotAfter):
+		report.add("validity", fmt.Errorf("certificate expired on %s", leaf.NotAfter.UTC()), "")
+	default:
+		report.add("validity", nil, fmt.Sprintf("valid until %s", leaf.NotAfter.UTC()))
+	}
+
+	// Chain verification against the configured CA
+	if !policy.SkipChainVerify {
+		err = nil
+		roots := x509.NewCertPool()
+		caPEM, readErr := ioutil.ReadFile(caFile)
+		switch {
+		case readErr != nil:
+			err = fmt.Errorf("cannot read CA file: %s", readErr.Error())
+		case !roots.AppendCertsFromPEM(caPEM):
+			err = fmt.Errorf("no CA certificate found in %s", caFile)
+		default:
+			intermediates := x509.NewCertPool()
+			for _, c := range chain[1:] {
+				intermediates.AddCert(c)
+			}
+			_, err = leaf.Verify(x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: intermediates,
+				CurrentTime:   now,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			})
+		}
+		report.add("chain", err, fmt.Sprintf("chains to %s", caFile))
+	}
+
+	// Every SNI must be covered by the certificate SANs
+	if !policy.SkipSNICoverage {
+		for _, sni := range snis {
+			report.add("sni "+sni, leaf.VerifyHostname(sni), "covered by the certificate SANs")
+		}
+	}
+
+	// Key type and size
+	detail, err := checkKeyStrength(leaf.PublicKey, policy)
+	report.add("key policy", err, detail)
+
+	return report
+}
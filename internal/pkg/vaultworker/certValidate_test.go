@@ -0,0 +1,147 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package vaultworker
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testCA struct {
+	cert    *x509.Certificate
+	key     crypto.Signer
+	pemFile string
+}
+
+// newTestCA creates a self-signed CA and saves its certificate in a temporary PEM file
+func newTestCA(t *testing.T) testCA {
+	return newPathLenTestCA(t, -1)
+}
+
+// newPathLenTestCA creates a test CA limited to pathLen CAs below it, -1 for no limit
+func newPathLenTestCA(t *testing.T, pathLen int) testCA {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLen:            pathLen,
+		MaxPathLenZero:        pathLen == 0,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pemFile := filepath.Join(t.TempDir(), "ca.pem")
+	ioutil.WriteFile(pemFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	return testCA{cert: cert, key: key, pemFile: pemFile}
+}
+
+// issue returns a PEM server certificate and PKCS#8 key signed by the test CA
+func (ca testCA) issue(t *testing.T, curve elliptic.Curve, dnsNames []string, notBefore time.Time, notAfter time.Time) (string, string) {
+	key, _ := ecdsa.GenerateKey(curve, rand.Reader)
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: dnsNames[0]},
+		DNSNames:     dnsNames,
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}))
+}
+
+func failedChecks(report CertReport) []string {
+	var failed []string
+	for _, c := range report.Checks {
+		if !c.OK {
+			failed = append(failed, c.Name)
+		}
+	}
+	return failed
+}
+
+func TestValidateCertKeyPair(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	cert, key := ca.issue(t, elliptic.P256(), []string{"edgex-kong"}, now.Add(-time.Hour), now.AddDate(0, 1, 0))
+	_, otherKey := ca.issue(t, elliptic.P256(), []string{"edgex-kong"}, now.Add(-time.Hour), now.AddDate(0, 1, 0))
+	expired, expiredKey := ca.issue(t, elliptic.P256(), []string{"edgex-kong"}, now.AddDate(0, -2, 0), now.AddDate(0, -1, 0))
+	weak, weakKey := ca.issue(t, elliptic.P224(), []string{"edgex-kong"}, now.Add(-time.Hour), now.AddDate(0, 1, 0))
+	foreign := newTestCA(t)
+
+	tests := []struct {
+		name     string
+		cert     string
+		key      string
+		caFile   string
+		snis     []string
+		expected []string
+	}{
+		{"valid", cert, key, ca.pemFile, []string{"edgex-kong"}, nil},
+		{"key mismatch", cert, otherKey, ca.pemFile, []string{"edgex-kong"}, []string{"key match"}},
+		{"expired", expired, expiredKey, ca.pemFile, nil, []string{"validity", "chain"}},
+		{"untrusted", cert, key, foreign.pemFile, nil, []string{"chain"}},
+		{"uncovered sni", cert, key, ca.pemFile, []string{"www.edgexfoundry.org"}, []string{"sni www.edgexfoundry.org"}},
+		{"weak key", weak, weakKey, ca.pemFile, nil, []string{"key policy"}},
+		{"garbage", "not a cert", key, ca.pemFile, nil, []string{"certificate"}},
+	}
+	for _, tt := range tests {
+		report := ValidateCertKeyPair(tt.cert, tt.key, tt.caFile, tt.snis, certPolicy{}, now)
+		if strings.Join(failedChecks(report), ",") != strings.Join(tt.expected, ",") {
+			t.Errorf("%s: expected failed checks %v, got report:\n%s", tt.name, tt.expected, report)
+		}
+	}
+}
+
+func TestValidateCertKeyPairPolicySkips(t *testing.T) {
+	ca := newTestCA(t)
+	foreign := newTestCA(t)
+	cert, key := ca.issue(t, elliptic.P256(), []string{"edgex-kong"}, time.Now().Add(-time.Hour), time.Now().AddDate(0, 1, 0))
+
+	policy := certPolicy{SkipChainVerify: true, SkipSNICoverage: true}
+	report := ValidateCertKeyPair(cert, key, foreign.pemFile, []string{"www.edgexfoundry.org"}, policy, time.Now())
+	if report.Failed() {
+		t.Errorf("Expected skipped checks not to fail:\n%s", report)
+	}
+}
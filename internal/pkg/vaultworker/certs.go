@@ -17,6 +17,8 @@
 package vaultworker
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -27,13 +29,14 @@ import (
 
 	"github.com/dghubble/sling"
 	logger "github.com/edgexfoundry/go-mod-core-contracts/clients/logger"
-	model "github.com/edgexfoundry/go-mod-core-contracts/models"
+	"github.com/edgexfoundry/security-secret-store/internal/pkg/logging"
 )
 
 // CertKeyPair X.509 TLS certioficate and associated private key
 type CertKeyPair struct {
 	Cert string `json:"cert,omitempty"`
 	Key  string `json:"key,omitempty"`
+	CA   string `json:"ca,omitempty"`
 }
 
 // CertKeyCollector X.509 TLS certificate and associated private key from Secret Store get req
@@ -43,6 +46,7 @@ type CertKeyCollector struct {
 
 // CertInfo parm
 type CertInfo struct {
+	Name string   `json:"-"` // bundle name, for the error messages
 	Cert string   `json:"cert,omitempty"`
 	Key  string   `json:"key,omitempty"`
 	Snis []string `json:"snis,omitempty"`
@@ -52,37 +56,43 @@ var lc = CreateLogging()
 
 // CreateLogging Logger functionality
 func CreateLogging() logger.LoggingClient {
-	return logger.NewClient(SecurityService, false, fmt.Sprintf("%s-%s.log", SecurityService, time.Now().Format("2006-01-02")), model.InfoLog)
+	return logging.NewClient(SecurityService, fmt.Sprintf("%s-%s.log", SecurityService, time.Now().Format("2006-01-02")))
 }
 
+// LoadKongCerts reconciles the Kong certificates with the gateway certificates held in the secret
+// store, each one for the SNIs configured on its bundle
 func LoadKongCerts(config *tomlConfig, url string, secretBaseURL string, c *http.Client, debug bool) error {
-	cert, key, err := getCertKeyPair(config, secretBaseURL, c, debug)
-	if err != nil {
-		return err
-	}
-	body := &CertInfo{
-		Cert: cert,
-		Key:  key,
-		Snis: []string{config.SecretService.SNIS},
+	var desired []CertInfo
+	for _, b := range config.CertBundles() {
+		if !b.Gateway {
+			continue
+		}
+		cert, key, err := getCertKeyPair(config, b, secretBaseURL, c, debug)
+		if err != nil {
+			return err
+		}
+		if cert == "" || key == "" {
+			return fmt.Errorf("no certificate found in the secret store @/%s", b.Path)
+		}
+		desired = append(desired, CertInfo{
+			Name: b.Name,
+			Cert: cert,
+			Key:  key,
+			Snis: b.SNIList(),
+		})
 	}
-	lc.Info("Trying to upload cert to proxy server.")
-	req, err := sling.New().Base(url).Post(CertificatesPath).BodyJSON(body).Request()
-	resp, err := c.Do(req)
+	lc.Info("Trying to reconcile certificates with the proxy server.")
+	result, err := ReconcileKongCerts(url, desired, config.SecretService.PruneKongCerts, c)
 	if err != nil {
-		lc.Error("Failed to upload cert to proxy server with error %s", err.Error())
+		lc.Error(fmt.Sprintf("Failed to reconcile certificates with the proxy server: %s", err.Error()))
 		return err
 	}
-
-	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusNoContent || resp.StatusCode == http.StatusConflict {
-		lc.Info("Successful to add certificate to the reverse proxy.")
-	} else {
-		s := fmt.Sprintf("Failed to add certificate with errorcode %d.", resp.StatusCode)
-		return errors.New(s)
-	}
+	lc.Info(fmt.Sprintf("Reverse proxy certificates reconciled: %d created, %d updated, %d unchanged, %d deleted.",
+		len(result.Created), len(result.Updated), len(result.Unchanged), len(result.Deleted)))
 	return nil
 }
 
-func getCertKeyPair(config *tomlConfig, secretBaseURL string, c *http.Client, debug bool) (string, string, error) {
+func getCertKeyPair(config *tomlConfig, b certBundle, secretBaseURL string, c *http.Client, debug bool) (string, string, error) {
 
 	t, err := GetSecret(filepath.Join(config.SecretService.TokenFolderPath, config.SecretService.VaultInitParm))
 	if err != nil {
@@ -90,10 +100,10 @@ func getCertKeyPair(config *tomlConfig, secretBaseURL string, c *http.Client, de
 	}
 
 	s := sling.New().Set(VaultToken, t.Token)
-	req, err := s.New().Base(secretBaseURL).Get(config.SecretService.CertPath).Request()
+	req, err := s.New().Base(secretBaseURL).Get(b.Path).Request()
 	resp, err := c.Do(req)
 	if err != nil {
-		errStr := fmt.Sprintf("Failed to retrieve certificate with path as %s with error %s", config.SecretService.CertPath, err.Error())
+		errStr := fmt.Sprintf("Failed to retrieve certificate with path as %s with error %s", b.Path, err.Error())
 		return "", "", errors.New(errStr)
 	}
 	defer resp.Body.Close()
@@ -103,23 +113,24 @@ func getCertKeyPair(config *tomlConfig, secretBaseURL string, c *http.Client, de
 
 	switch resp.StatusCode {
 	case http.StatusOK:
-		lc.Info(fmt.Sprintf("API Gateway TLS certificate/key found in Secret Store @/%s (%s)", config.SecretService.CertPath, resp.Status))
+		lc.Info(fmt.Sprintf("TLS certificate/key %s found in Secret Store @/%s (%s)", b.Name, b.Path, resp.Status))
+		recordCertExpiry(b.Path, collector.Section.Cert)
 		if debug {
-			lc.Info(fmt.Sprintf("\n %s \n \n %s", collector.Section.Cert, collector.Section.Key))
+			lc.Debug(fmt.Sprintf("\n %s \n \n %s", collector.Section.Cert, collector.Section.Key))
 		}
 
 	case http.StatusNotFound:
-		lc.Info(fmt.Sprintf("API Gateway TLS certificate/key NOT found in Secret Store @/%s (%s)", config.SecretService.CertPath, resp.Status))
+		lc.Info(fmt.Sprintf("TLS certificate/key %s NOT found in Secret Store @/%s (%s)", b.Name, b.Path, resp.Status))
 
 	default:
-		lc.Info(fmt.Sprintf("Failed reading API Gateway TLS certificate/key from Secret Store @/%s (%s)", config.SecretService.CertPath, resp.Status))
+		lc.Info(fmt.Sprintf("Failed reading TLS certificate/key %s from Secret Store @/%s (%s)", b.Name, b.Path, resp.Status))
 	}
 
 	return collector.Section.Cert, collector.Section.Key, nil
 }
 
 func CertKeyPairInStore(config *tomlConfig, secretBaseURL string, c *http.Client, debug bool) (bool, error) {
-	cert, key, err := getCertKeyPair(config, secretBaseURL, c, debug)
+	cert, key, err := getCertKeyPair(config, config.legacyBundle(), secretBaseURL, c, debug)
 	if err != nil {
 		return false, err
 	}
@@ -154,3 +165,33 @@ func LoadCertKeyPair(certPath string, keyPath string) (string, string, error) {
 
 	return cert, key, nil
 }
+
+// LoadVaultClientCert returns the client certificate presented to Vault for mutual TLS, none when
+// clientcertfilepath is not set. The certificate must allow TLS client authentication.
+func LoadVaultClientCert(config *tomlConfig) ([]tls.Certificate, error) {
+	certPath, keyPath := config.SecretService.ClientCertFilePath, config.SecretService.ClientKeyFilePath
+	if certPath == "" {
+		return nil, nil
+	}
+	pair, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the Vault client certificate %s and key %s: %s", certPath, keyPath, err.Error())
+	}
+	leaf, err := x509.ParseCertificate(pair.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the Vault client certificate %s: %s", certPath, err.Error())
+	}
+	if len(leaf.ExtKeyUsage) > 0 && !hasExtKeyUsage(leaf, x509.ExtKeyUsageClientAuth) && !hasExtKeyUsage(leaf, x509.ExtKeyUsageAny) {
+		return nil, fmt.Errorf("the Vault client certificate %s does not allow TLS client authentication", certPath)
+	}
+	return []tls.Certificate{pair}, nil
+}
+
+func hasExtKeyUsage(cert *x509.Certificate, usage x509.ExtKeyUsage) bool {
+	for _, u := range cert.ExtKeyUsage {
+		if u == usage {
+			return true
+		}
+	}
+	return false
+}
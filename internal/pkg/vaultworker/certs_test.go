@@ -0,0 +1,80 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package vaultworker
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadVaultClientCert(t *testing.T) {
+	config := &tomlConfig{}
+	if certs, err := LoadVaultClientCert(config); certs != nil || err != nil {
+		t.Errorf("Expected no client certificate, got %v (%v)", certs, err)
+	}
+
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "edgex-vaultworker"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, _ := x509.MarshalPKCS8PrivateKey(key)
+	ioutil.WriteFile(filepath.Join(dir, "client.pem"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "client.priv.key"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}), 0600)
+
+	config.SecretService.ClientCertFilePath = filepath.Join(dir, "client.pem")
+	config.SecretService.ClientKeyFilePath = filepath.Join(dir, "client.priv.key")
+	if certs, err := LoadVaultClientCert(config); err != nil || len(certs) != 1 {
+		t.Errorf("Expected the client certificate, got %v (%v)", certs, err)
+	}
+
+	// A server only certificate cannot authenticate a client
+	cert, serverKey := ca.issue(t, elliptic.P256(), []string{"edgex-kong"}, time.Now().Add(-time.Hour), time.Now().AddDate(1, 0, 0))
+	ioutil.WriteFile(filepath.Join(dir, "server.pem"), []byte(cert), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "server.priv.key"), []byte(serverKey), 0600)
+	config.SecretService.ClientCertFilePath = filepath.Join(dir, "server.pem")
+	config.SecretService.ClientKeyFilePath = filepath.Join(dir, "server.priv.key")
+	if _, err := LoadVaultClientCert(config); err == nil {
+		t.Errorf("Expected the server certificate to be rejected")
+	}
+
+	config.SecretService.ClientKeyFilePath = filepath.Join(dir, "missing.priv.key")
+	if _, err := LoadVaultClientCert(config); err == nil {
+		t.Errorf("Expected an error for a missing key")
+	}
+}
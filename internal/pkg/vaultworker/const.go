@@ -24,12 +24,13 @@ const (
 	VaultToken       = "X-Vault-Token"
 
 	// Vault API endpoints: v1
-	vaultHealthAPI      = "/v1/sys/health"
-	vaultInitAPI        = "/v1/sys/init"
-	vaultUnsealAPI      = "/v1/sys/unseal"
-	vaultPolicyAPI      = "/v1/sys/policy/"
-	vaultTokenCreateAPI = "/v1/auth/token/create"
-	vaultTokenDeleteAPI = "/v1/auth/token/delete"
+	vaultHealthAPI          = "/v1/sys/health"
+	vaultInitAPI            = "/v1/sys/init"
+	vaultUnsealAPI          = "/v1/sys/unseal"
+	vaultPolicyAPI          = "/v1/sys/policy/"
+	vaultTokenCreateAPI     = "/v1/auth/token/create"
+	vaultTokenDeleteAPI     = "/v1/auth/token/delete"
+	vaultTokenLookupSelfAPI = "/v1/auth/token/lookup-self"
 
 	vaultDefaultPolicy = "default"
 	vaultTokenTTL      = "168h"
@@ -0,0 +1,173 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *
+ * @version: 1.0.0
+ *******************************************************************************/
+package vaultworker
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	defaultFileMode = "0600"
+	backupFileExt   = ".bak"
+)
+
+// ErrInitRefused reports that Vault is not initialized because its init response file exists and
+// overwriteinit is not set. Retrying does not help: the operator must move the file or allow it.
+var ErrInitRefused = errors.New("refusing to initialize Vault")
+
+// fileAccess returns the owner/group/mode configured for an output file, matched on its base name
+func (c *tomlConfig) fileAccess(path string) outputFile {
+	name := filepath.Base(path)
+	for _, f := range c.OutputFiles {
+		if f.Name == name {
+			if f.Mode == "" {
+				f.Mode = defaultFileMode
+			}
+			return f
+		}
+	}
+	return outputFile{Name: name, Mode: defaultFileMode}
+}
+
+// lookupID resolves a user or group name (or numeric ID) to its numeric ID; -1 keeps the current one
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
+}
+
+func lookupUser(name string) (string, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return "", err
+	}
+	return u.Uid, nil
+}
+
+func lookupGroup(name string) (string, error) {
+	g, err := user.LookupGroup(name)
+	if err != nil {
+		return "", err
+	}
+	return g.Gid, nil
+}
+
+// WriteFileAtomic writes data to a temporary file in the destination directory, applies the
+// requested mode and ownership, fsyncs it and renames it over path. Readers therefore see
+// either the previous content or the new one, never a truncated file.
+func WriteFileAtomic(path string, data []byte, access outputFile) (err error) {
+	mode, err := strconv.ParseUint(access.Mode, 8, 32)
+	if err != nil {
+		return fmt.Errorf("invalid file mode %q for %s: %s", access.Mode, path, err.Error())
+	}
+	uid, err := lookupID(access.Owner, lookupUser)
+	if err != nil {
+		return fmt.Errorf("invalid owner %q for %s: %s", access.Owner, path, err.Error())
+	}
+	gid, err := lookupID(access.Group, lookupGroup)
+	if err != nil {
+		return fmt.Errorf("invalid group %q for %s: %s", access.Group, path, err.Error())
+	}
+
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = tmp.Chmod(os.FileMode(mode)); err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		if err = tmp.Chown(uid, gid); err != nil {
+			return err
+		}
+	}
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// Persist the rename itself
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// writeInitFile saves the Vault init response. An existing file is only replaced when
+// overwriteinit is set, in which case its previous content is kept as a .bak file.
+func writeInitFile(config *tomlConfig, data []byte) error {
+	initFile := filepath.Join(config.SecretService.TokenFolderPath, config.SecretService.VaultInitParm)
+	if _, err := os.Stat(initFile); err == nil && !config.SecretService.OverwriteInit {
+		return fmt.Errorf("%s already exists, refusing to overwrite it without overwriteinit", initFile)
+	}
+	return replaceFile(initFile, data, config.fileAccess(initFile))
+}
+
+// replaceFile writes a file atomically, keeping its previous content, if any, as a .bak file
+func replaceFile(path string, data []byte, access outputFile) error {
+	previous, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return err
+	default:
+		lc.Warn(fmt.Sprintf("Replacing %s, previous content saved to %s", path, path+backupFileExt))
+		if err = WriteFileAtomic(path+backupFileExt, previous, access); err != nil {
+			return err
+		}
+	}
+	return WriteFileAtomic(path, data, access)
+}
+
+// checkInitFile fails if an init response would be overwritten without overwriteinit
+func checkInitFile(config *tomlConfig) error {
+	initFile := filepath.Join(config.SecretService.TokenFolderPath, config.SecretService.VaultInitParm)
+	if _, err := os.Stat(initFile); err == nil && !config.SecretService.OverwriteInit {
+		return fmt.Errorf("%w: %s already exists and would be overwritten without overwriteinit", ErrInitRefused, initFile)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package vaultworker
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "admin-token.json")
+
+	if err := WriteFileAtomic(path, []byte("first"), outputFile{Mode: "0640"}); err != nil {
+		t.Fatalf("Failed to write file: %s", err.Error())
+	}
+	if err := WriteFileAtomic(path, []byte("second"), outputFile{Mode: "0640"}); err != nil {
+		t.Fatalf("Failed to replace file: %s", err.Error())
+	}
+
+	raw, _ := ioutil.ReadFile(path)
+	if string(raw) != "second" {
+		t.Errorf("Expected the new content, got %q", raw)
+	}
+	info, _ := os.Stat(path)
+	if info.Mode().Perm() != 0640 {
+		t.Errorf("Expected mode 0640, got %o", info.Mode().Perm())
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected no leftover temporary file, found %d entries", len(entries))
+	}
+}
+
+func TestWriteFileAtomicInvalidMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "resp-init.json")
+	if err := WriteFileAtomic(path, []byte("{}"), outputFile{Mode: "rw-------"}); err == nil {
+		t.Errorf("Expected an error with an invalid mode")
+	}
+}
+
+func TestWriteInitFile(t *testing.T) {
+	config := &tomlConfig{}
+	config.SecretService.TokenFolderPath = t.TempDir()
+	config.SecretService.VaultInitParm = "resp-init.json"
+	config.OutputFiles = []outputFile{{Name: "resp-init.json", Mode: "0400"}}
+	initFile := filepath.Join(config.SecretService.TokenFolderPath, "resp-init.json")
+
+	if err := writeInitFile(config, []byte("first")); err != nil {
+		t.Fatalf("Failed to write init file: %s", err.Error())
+	}
+	if info, _ := os.Stat(initFile); info.Mode().Perm() != 0400 {
+		t.Errorf("Expected the configured mode 0400, got %o", info.Mode().Perm())
+	}
+
+	if err := checkInitFile(config); !errors.Is(err, ErrInitRefused) {
+		t.Errorf("Expected initialization to be refused with an existing init file, got %v", err)
+	}
+	if err := writeInitFile(config, []byte("second")); err == nil {
+		t.Errorf("Expected the existing init file not to be overwritten")
+	}
+
+	config.SecretService.OverwriteInit = true
+	if err := writeInitFile(config, []byte("second")); err != nil {
+		t.Fatalf("Failed to overwrite init file: %s", err.Error())
+	}
+	raw, _ := ioutil.ReadFile(initFile)
+	backup, _ := ioutil.ReadFile(initFile + backupFileExt)
+	if string(raw) != "second" || string(backup) != "first" {
+		t.Errorf("Expected new content and a .bak copy, got %q and %q", raw, backup)
+	}
+}
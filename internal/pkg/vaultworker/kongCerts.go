@@ -0,0 +1,244 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *
+ * @version: 1.0.0
+ *******************************************************************************/
+package vaultworker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/dghubble/sling"
+)
+
+// ----------------------------------------------------------
+// Information:
+//    https://docs.konghq.com/1.0.x/admin-api/#certificate-object
+// ----------------------------------------------------------
+
+// KongCertificate is a certificate object as returned by the Kong admin API
+type KongCertificate struct {
+	ID   string   `json:"id,omitempty"`
+	Cert string   `json:"cert,omitempty"`
+	Key  string   `json:"key,omitempty"`
+	Snis []string `json:"snis"`
+}
+
+// kongCertificatePage is one page of the Kong certificates listing
+type kongCertificatePage struct {
+	Data []KongCertificate `json:"data"`
+	Next string            `json:"next"`
+}
+
+// KongReconcileResult lists what a reconciliation changed in Kong, by certificate ID or SNIs
+type KongReconcileResult struct {
+	Created   []string
+	Updated   []string
+	Unchanged []string
+	Deleted   []string
+}
+
+// sameCert compares two PEM certificates on their leaf fingerprint
+func sameCert(a string, b string) bool {
+	chainA, errA := parseCertChain([]byte(a))
+	chainB, errB := parseCertChain([]byte(b))
+	if errA != nil || errB != nil {
+		return strings.TrimSpace(a) == strings.TrimSpace(b)
+	}
+	return CertFingerprint(chainA[0]) == CertFingerprint(chainB[0])
+}
+
+func sameSnis(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	set := map[string]bool{}
+	for _, sni := range a {
+		set[sni] = true
+	}
+	for _, sni := range b {
+		if !set[sni] {
+			return false
+		}
+	}
+	return true
+}
+
+// kongAdmin is a minimal client of the Kong admin API certificates endpoint
+type kongAdmin struct {
+	base string
+	c    *http.Client
+}
+
+func (k kongAdmin) do(method string, path string, body interface{}, out interface{}) error {
+	s := sling.New().Base(k.base)
+	switch method {
+	case http.MethodGet:
+		s = s.Get(path)
+	case http.MethodPost:
+		s = s.Post(path).BodyJSON(body)
+	case http.MethodPatch:
+		s = s.Patch(path).BodyJSON(body)
+	case http.MethodDelete:
+		s = s.Delete(path)
+	}
+	req, err := s.Request()
+	if err != nil {
+		return err
+	}
+	resp, err := k.c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		b, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s %s failed with errorcode %d: %s", method, path, resp.StatusCode, string(b))
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// list returns every certificate, following the pagination
+func (k kongAdmin) list() ([]KongCertificate, error) {
+	var certs []KongCertificate
+	next := CertificatesPath
+	for next != "" {
+		page := kongCertificatePage{}
+		if err := k.do(http.MethodGet, next, nil, &page); err != nil {
+			return nil, err
+		}
+		certs = append(certs, page.Data...)
+		next = strings.TrimPrefix(page.Next, "/")
+	}
+	return certs, nil
+}
+
+// ReconcileKongCerts makes the Kong certificates match the desired ones. Existing certificates
+// are looked up by SNI and patched when their fingerprint or SNI list differ, missing ones are
+// created, SNIs moved to another certificate are detached from their previous holder, and
+// certificates left without any SNI (orphans) are deleted when prune is set. An SNI wanted by two
+// certificates is an error, nothing is changed.
+func ReconcileKongCerts(kongURL string, desired []CertInfo, prune bool, c *http.Client) (KongReconcileResult, error) {
+	result := KongReconcileResult{}
+	kong := kongAdmin{base: kongURL, c: c}
+
+	owners := map[string]string{}
+	for i, want := range desired {
+		name := want.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+		for _, sni := range want.Snis {
+			if owner, ok := owners[sni]; ok && owner != name {
+				return result, fmt.Errorf("SNI %s is wanted by both certificate bundles %s and %s", sni, owner, name)
+			}
+			owners[sni] = name
+		}
+	}
+
+	existing, err := kong.list()
+	if err != nil {
+		return result, err
+	}
+	claimed := map[string]bool{}
+
+	for _, want := range desired {
+		wanted := map[string]bool{}
+		for _, sni := range want.Snis {
+			wanted[sni] = true
+		}
+
+		// Pick the existing certificate holding most of the wanted SNIs
+		match, best := -1, 0
+		for i, cert := range existing {
+			overlap := 0
+			for _, sni := range cert.Snis {
+				if wanted[sni] {
+					overlap++
+				}
+			}
+			if overlap > best && !claimed[cert.ID] {
+				match, best = i, overlap
+			}
+		}
+
+		// SNIs are unique in Kong: detach the wanted ones from any other certificate first
+		for i := range existing {
+			if i == match {
+				continue
+			}
+			kept, moved := []string{}, []string{}
+			for _, sni := range existing[i].Snis {
+				if wanted[sni] {
+					moved = append(moved, sni)
+				} else {
+					kept = append(kept, sni)
+				}
+			}
+			if len(moved) == 0 {
+				continue
+			}
+			lc.Info(fmt.Sprintf("Detaching SNIs %v from Kong certificate %s.", moved, existing[i].ID))
+			if err = kong.do(http.MethodPatch, CertificatesPath+existing[i].ID, &KongCertificate{Snis: kept}, nil); err != nil {
+				return result, err
+			}
+			existing[i].Snis = kept
+		}
+
+		body := &KongCertificate{Cert: want.Cert, Key: want.Key, Snis: want.Snis}
+		switch {
+		case match == -1:
+			created := KongCertificate{}
+			if err = kong.do(http.MethodPost, CertificatesPath, body, &created); err != nil {
+				return result, err
+			}
+			claimed[created.ID] = true
+			result.Created = append(result.Created, strings.Join(want.Snis, ","))
+			lc.Info(fmt.Sprintf("Kong certificate created for SNIs %v.", want.Snis))
+		case sameCert(existing[match].Cert, want.Cert) && sameSnis(existing[match].Snis, want.Snis):
+			claimed[existing[match].ID] = true
+			result.Unchanged = append(result.Unchanged, existing[match].ID)
+			lc.Info(fmt.Sprintf("Kong certificate %s already up to date for SNIs %v.", existing[match].ID, want.Snis))
+		default:
+			if err = kong.do(http.MethodPatch, CertificatesPath+existing[match].ID, body, nil); err != nil {
+				return result, err
+			}
+			claimed[existing[match].ID] = true
+			existing[match].Snis = want.Snis
+			result.Updated = append(result.Updated, existing[match].ID)
+			lc.Info(fmt.Sprintf("Kong certificate %s updated for SNIs %v.", existing[match].ID, want.Snis))
+		}
+	}
+
+	if !prune {
+		return result, nil
+	}
+	for _, cert := range existing {
+		if claimed[cert.ID] || len(cert.Snis) > 0 {
+			continue
+		}
+		if err = kong.do(http.MethodDelete, CertificatesPath+cert.ID, nil, nil); err != nil {
+			return result, err
+		}
+		result.Deleted = append(result.Deleted, cert.ID)
+		lc.Info(fmt.Sprintf("Orphaned Kong certificate %s deleted.", cert.ID))
+	}
+	return result, nil
+}
@@ -0,0 +1,227 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package vaultworker
+
+import (
+	"crypto/elliptic"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeKong is an in-memory Kong admin API certificates endpoint, enforcing SNI uniqueness
+// and paginating its listing two certificates at a time
+type fakeKong struct {
+	mu     sync.Mutex
+	certs  map[string]*KongCertificate
+	nextID int
+	calls  []string
+}
+
+func newFakeKong(certs ...KongCertificate) (*fakeKong, *httptest.Server) {
+	k := &fakeKong{certs: map[string]*KongCertificate{}}
+	for _, c := range certs {
+		c := c
+		k.certs[c.ID] = &c
+	}
+	return k, httptest.NewServer(k)
+}
+
+func (k *fakeKong) sniTaken(snis []string, except string) bool {
+	for id, c := range k.certs {
+		if id == except {
+			continue
+		}
+		for _, held := range c.Snis {
+			for _, sni := range snis {
+				if held == sni {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+func (k *fakeKong) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.calls = append(k.calls, r.Method)
+	id := strings.TrimPrefix(r.URL.Path, "/certificates")
+	id = strings.Trim(id, "/")
+
+	switch {
+	case r.Method == http.MethodGet && id == "":
+		var ids []string
+		for cid := range k.certs {
+			ids = append(ids, cid)
+		}
+		sort.Strings(ids)
+		offset := 0
+		fmt.Sscanf(r.URL.Query().Get("offset"), "%d", &offset)
+		page := kongCertificatePage{Data: []KongCertificate{}}
+		for i := offset; i < len(ids) && i < offset+2; i++ {
+			page.Data = append(page.Data, *k.certs[ids[i]])
+		}
+		if offset+2 < len(ids) {
+			page.Next = fmt.Sprintf("/certificates?offset=%d", offset+2)
+		}
+		json.NewEncoder(w).Encode(page)
+	case r.Method == http.MethodPost && id == "":
+		c := KongCertificate{}
+		json.NewDecoder(r.Body).Decode(&c)
+		if k.sniTaken(c.Snis, "") {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		k.nextID++
+		c.ID = fmt.Sprintf("new-%d", k.nextID)
+		k.certs[c.ID] = &c
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(c)
+	case r.Method == http.MethodPatch && k.certs[id] != nil:
+		patch := KongCertificate{Snis: nil}
+		json.NewDecoder(r.Body).Decode(&patch)
+		if patch.Snis != nil && k.sniTaken(patch.Snis, id) {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		c := k.certs[id]
+		if patch.Cert != "" {
+			c.Cert, c.Key = patch.Cert, patch.Key
+		}
+		if patch.Snis != nil {
+			c.Snis = patch.Snis
+		}
+		json.NewEncoder(w).Encode(c)
+	case r.Method == http.MethodDelete && k.certs[id] != nil:
+		delete(k.certs, id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func TestReconcileKongCerts(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	oldCert, oldKey := ca.issue(t, elliptic.P256(), []string{"edgex-kong"}, now.Add(-time.Hour), now.Add(time.Hour))
+	newCert, newKey := ca.issue(t, elliptic.P256(), []string{"edgex-kong"}, now.Add(-time.Hour), now.Add(48*time.Hour))
+	otherCert, otherKey := ca.issue(t, elliptic.P256(), []string{"other"}, now.Add(-time.Hour), now.Add(48*time.Hour))
+
+	kong, ts := newFakeKong(
+		KongCertificate{ID: "a", Cert: oldCert, Key: oldKey, Snis: []string{"edgex-kong", "www.edgexfoundry.org"}},
+		KongCertificate{ID: "b", Cert: otherCert, Key: otherKey, Snis: []string{"other", "localhost"}},
+		KongCertificate{ID: "c", Cert: oldCert, Key: oldKey, Snis: []string{}},
+	)
+	defer ts.Close()
+
+	desired := []CertInfo{
+		{Cert: newCert, Key: newKey, Snis: []string{"edgex-kong", "www.edgexfoundry.org", "localhost"}},
+		{Cert: otherCert, Key: otherKey, Snis: []string{"other"}},
+		{Cert: otherCert, Key: otherKey, Snis: []string{"api.example.com"}},
+	}
+	result, err := ReconcileKongCerts(ts.URL+"/", desired, true, ts.Client())
+	if err != nil {
+		t.Fatalf("reconcile failed: %s", err.Error())
+	}
+
+	if fmt.Sprint(result.Updated) != "[a]" || fmt.Sprint(result.Unchanged) != "[b]" || len(result.Created) != 1 || fmt.Sprint(result.Deleted) != "[c]" {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	if !sameCert(kong.certs["a"].Cert, newCert) || !sameSnis(kong.certs["a"].Snis, desired[0].Snis) {
+		t.Errorf("certificate a not replaced: %+v", kong.certs["a"].Snis)
+	}
+	if !sameSnis(kong.certs["b"].Snis, []string{"other"}) {
+		t.Errorf("localhost not moved away from certificate b: %v", kong.certs["b"].Snis)
+	}
+	if kong.certs["new-1"] == nil || !sameSnis(kong.certs["new-1"].Snis, []string{"api.example.com"}) {
+		t.Errorf("missing certificate not created")
+	}
+
+	// A second run has nothing left to change
+	kong.calls = nil
+	result, err = ReconcileKongCerts(ts.URL+"/", desired, true, ts.Client())
+	if err != nil {
+		t.Fatalf("second reconcile failed: %s", err.Error())
+	}
+	if len(result.Unchanged) != 3 || len(result.Updated)+len(result.Created)+len(result.Deleted) != 0 {
+		t.Errorf("second run not idempotent: %+v", result)
+	}
+	for _, method := range kong.calls {
+		if method != http.MethodGet {
+			t.Errorf("second run issued a %s request", method)
+		}
+	}
+}
+
+func TestReconcileKongCertsKeepsOrphansWithoutPrune(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	cert, key := ca.issue(t, elliptic.P256(), []string{"edgex-kong"}, now.Add(-time.Hour), now.Add(time.Hour))
+
+	kong, ts := newFakeKong(KongCertificate{ID: "orphan", Cert: cert, Key: key, Snis: []string{}})
+	defer ts.Close()
+
+	result, err := ReconcileKongCerts(ts.URL+"/", []CertInfo{{Cert: cert, Key: key, Snis: []string{"edgex-kong"}}}, false, ts.Client())
+	if err != nil {
+		t.Fatalf("reconcile failed: %s", err.Error())
+	}
+	if len(result.Created) != 1 || len(result.Deleted) != 0 || kong.certs["orphan"] == nil {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestReconcileKongCertsDuplicateSNI(t *testing.T) {
+	ca := newTestCA(t)
+	now := time.Now()
+	cert, key := ca.issue(t, elliptic.P256(), []string{"edgex-kong", "edgex-kong.local"}, now.Add(-time.Hour), now.Add(time.Hour))
+
+	kong, ts := newFakeKong()
+	defer ts.Close()
+
+	desired := []CertInfo{
+		{Name: "gateway", Cert: cert, Key: key, Snis: []string{"edgex-kong"}},
+		{Name: "gateway-local", Cert: cert, Key: key, Snis: []string{"edgex-kong.local", "edgex-kong"}},
+	}
+	_, err := ReconcileKongCerts(ts.URL+"/", desired, true, ts.Client())
+	if err == nil || !strings.Contains(err.Error(), "gateway and gateway-local") {
+		t.Errorf("expected an error naming both bundles, got %v", err)
+	}
+	if len(kong.certs) != 0 {
+		t.Errorf("expected Kong to be left unchanged, got %d certificates", len(kong.certs))
+	}
+}
+
+func TestReconcileKongCertsListFailure(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer ts.Close()
+
+	if _, err := ReconcileKongCerts(ts.URL+"/", nil, false, ts.Client()); err == nil {
+		t.Error("expected an error when the certificate listing fails")
+	}
+}
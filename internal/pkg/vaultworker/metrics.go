@@ -0,0 +1,308 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *
+ * @version: 1.0.0
+ *******************************************************************************/
+package vaultworker
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metric names exposed in the Prometheus text format. They are documented in
+// the README and are part of the monitoring contract: do not rename them.
+const (
+	MetricVaultSealed          = "edgex_secretstore_vault_sealed"
+	MetricVaultStandby         = "edgex_secretstore_vault_standby"
+	MetricVaultInitialized     = "edgex_secretstore_vault_initialized"
+	MetricUnsealAttempts       = "edgex_secretstore_unseal_attempts_total"
+	MetricPolicyImports        = "edgex_secretstore_policy_imports_total"
+	MetricTokenExpiry          = "edgex_secretstore_token_expiry_seconds"
+	MetricCertExpiry           = "edgex_secretstore_tls_cert_expiry_seconds"
+	MetricVaultRequests        = "edgex_secretstore_vault_requests_total"
+	MetricVaultRequestDuration = "edgex_secretstore_vault_request_duration_seconds"
+)
+
+const (
+	metricGauge     = "gauge"
+	metricCounter   = "counter"
+	metricHistogram = "histogram"
+)
+
+type metricDesc struct {
+	name  string
+	help  string
+	mtype string
+}
+
+// metricDescs lists every exported metric, in exposition order
+var metricDescs = []metricDesc{
+	{MetricVaultSealed, "Whether Vault reported itself sealed on the last health check (1 sealed, 0 unsealed).", metricGauge},
+	{MetricVaultStandby, "Whether Vault reported itself in standby mode on the last health check.", metricGauge},
+	{MetricVaultInitialized, "Whether Vault reported itself initialized on the last health check.", metricGauge},
+	{MetricUnsealAttempts, "Number of Vault unseal attempts by result.", metricCounter},
+	{MetricPolicyImports, "Number of Vault policy imports by policy and result.", metricCounter},
+	{MetricTokenExpiry, "Seconds until the service token issued by the worker expires.", metricGauge},
+	{MetricCertExpiry, "Seconds until the TLS certificate held in the secret store expires.", metricGauge},
+	{MetricVaultRequests, "Number of HTTP requests sent to Vault by endpoint, method and status code.", metricCounter},
+	{MetricVaultRequestDuration, "Latency of HTTP requests sent to Vault by endpoint and method.", metricHistogram},
+}
+
+// latencyBuckets upper bounds (seconds) for the request duration histogram
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	counts []uint64 // one per latency bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// metricsRegistry holds every series observed by the worker. Series are keyed
+// by metric name and then by their rendered label set.
+type metricsRegistry struct {
+	mu         sync.Mutex
+	values     map[string]map[string]float64
+	deadlines  map[string]map[string]time.Time
+	histograms map[string]map[string]*histogram
+}
+
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		values:     map[string]map[string]float64{},
+		deadlines:  map[string]map[string]time.Time{},
+		histograms: map[string]map[string]*histogram{},
+	}
+}
+
+// labelString renders label pairs ("k1", "v1", "k2", "v2") as {k1="v1",k2="v2"}
+func labelString(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%q", pairs[i], pairs[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func (r *metricsRegistry) set(name string, value float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.values[name] == nil {
+		r.values[name] = map[string]float64{}
+	}
+	r.values[name][labelString(labels...)] = value
+}
+
+func (r *metricsRegistry) inc(name string, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.values[name] == nil {
+		r.values[name] = map[string]float64{}
+	}
+	r.values[name][labelString(labels...)]++
+}
+
+// expireAt records a deadline, rendered as the number of seconds left at scrape time
+func (r *metricsRegistry) expireAt(name string, deadline time.Time, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.deadlines[name] == nil {
+		r.deadlines[name] = map[string]time.Time{}
+	}
+	r.deadlines[name][labelString(labels...)] = deadline
+}
+
+func (r *metricsRegistry) observe(name string, seconds float64, labels ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.histograms[name] == nil {
+		r.histograms[name] = map[string]*histogram{}
+	}
+	key := labelString(labels...)
+	h := r.histograms[name][key]
+	if h == nil {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		r.histograms[name][key] = h
+	}
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch series := m.(type) {
+	case map[string]float64:
+		for k := range series {
+			keys = append(keys, k)
+		}
+	case map[string]time.Time:
+		for k := range series {
+			keys = append(keys, k)
+		}
+	case map[string]*histogram:
+		for k := range series {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// withLabel appends an extra label to an already rendered label set
+func withLabel(labels string, name string, value string) string {
+	extra := fmt.Sprintf("%s=%q", name, value)
+	if labels == "" {
+		return "{" + extra + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + extra + "}"
+}
+
+// WriteTo renders every known series in the Prometheus text exposition format
+func (r *metricsRegistry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var buf bytes.Buffer
+	now := time.Now()
+	for _, desc := range metricDescs {
+		fmt.Fprintf(&buf, "# HELP %s %s\n", desc.name, desc.help)
+		fmt.Fprintf(&buf, "# TYPE %s %s\n", desc.name, desc.mtype)
+		for _, key := range sortedKeys(r.values[desc.name]) {
+			fmt.Fprintf(&buf, "%s%s %g\n", desc.name, key, r.values[desc.name][key])
+		}
+		for _, key := range sortedKeys(r.deadlines[desc.name]) {
+			fmt.Fprintf(&buf, "%s%s %g\n", desc.name, key, r.deadlines[desc.name][key].Sub(now).Seconds())
+		}
+		for _, key := range sortedKeys(r.histograms[desc.name]) {
+			h := r.histograms[desc.name][key]
+			var cumulative uint64
+			for i, bound := range latencyBuckets {
+				cumulative += h.counts[i]
+				fmt.Fprintf(&buf, "%s_bucket%s %d\n", desc.name, withLabel(key, "le", fmt.Sprintf("%g", bound)), cumulative)
+			}
+			fmt.Fprintf(&buf, "%s_bucket%s %d\n", desc.name, withLabel(key, "le", "+Inf"), h.count)
+			fmt.Fprintf(&buf, "%s_sum%s %g\n", desc.name, key, h.sum)
+			fmt.Fprintf(&buf, "%s_count%s %d\n", desc.name, key, h.count)
+		}
+	}
+	n, err := w.Write(buf.Bytes())
+	return int64(n), err
+}
+
+// MetricsHandler serves the worker metrics to a Prometheus scraper
+func MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		if _, err := metrics.WriteTo(w); err != nil {
+			lc.Error(fmt.Sprintf("Failed to write metrics: %s", err.Error()))
+		}
+	})
+}
+
+// WriteMetricsFile dumps the worker metrics to a file, suitable for the node_exporter textfile collector
+func WriteMetricsFile(path string) error {
+	var buf bytes.Buffer
+	if _, err := metrics.WriteTo(&buf); err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, buf.Bytes(), outputFile{Mode: "0644"})
+}
+
+// instrumentedTransport records latency and status code of every request sent through it
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t *instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	endpoint := req.URL.Path
+	code := "error"
+	if err == nil {
+		code = fmt.Sprintf("%d", resp.StatusCode)
+	}
+	metrics.observe(MetricVaultRequestDuration, time.Since(start).Seconds(), "endpoint", endpoint, "method", req.Method)
+	metrics.inc(MetricVaultRequests, "endpoint", endpoint, "method", req.Method, "code", code)
+	return resp, err
+}
+
+// InstrumentClient wraps the HTTP client transport so that every Vault request is measured
+func InstrumentClient(c *http.Client) *http.Client {
+	next := c.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	c.Transport = &instrumentedTransport{next: next}
+	return c
+}
+
+// recordHealth translates a Vault health check status code into the seal state gauges
+func recordHealth(sCode int) {
+	switch sCode {
+	case http.StatusOK:
+		metrics.set(MetricVaultInitialized, 1)
+		metrics.set(MetricVaultSealed, 0)
+		metrics.set(MetricVaultStandby, 0)
+	case http.StatusTooManyRequests:
+		metrics.set(MetricVaultInitialized, 1)
+		metrics.set(MetricVaultSealed, 0)
+		metrics.set(MetricVaultStandby, 1)
+	case http.StatusNotImplemented:
+		metrics.set(MetricVaultInitialized, 0)
+		metrics.set(MetricVaultSealed, 1)
+		metrics.set(MetricVaultStandby, 0)
+	case http.StatusServiceUnavailable:
+		metrics.set(MetricVaultInitialized, 1)
+		metrics.set(MetricVaultSealed, 1)
+		metrics.set(MetricVaultStandby, 0)
+	}
+}
+
+func resultLabel(err error) string {
+	if err != nil {
+		return "failure"
+	}
+	return "success"
+}
+
+// recordCertExpiry parses the first PEM certificate and records its expiry under the given path
+func recordCertExpiry(path string, cert string) {
+	block, _ := pem.Decode([]byte(cert))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return
+	}
+	c, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return
+	}
+	metrics.expireAt(MetricCertExpiry, c.NotAfter, "path", path)
+}
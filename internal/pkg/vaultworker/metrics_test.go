@@ -0,0 +1,83 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package vaultworker
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	saved := metrics
+	metrics = newMetricsRegistry()
+	defer func() { metrics = saved }()
+
+	recordHealth(http.StatusServiceUnavailable)
+	metrics.inc(MetricUnsealAttempts, "result", "success")
+	metrics.expireAt(MetricTokenExpiry, time.Now().Add(time.Hour), "token", "kong")
+
+	var buf bytes.Buffer
+	if _, err := metrics.WriteTo(&buf); err != nil {
+		t.Fatalf("Failed to render metrics: %s", err.Error())
+	}
+	out := buf.String()
+
+	for _, expected := range []string{
+		"# TYPE edgex_secretstore_vault_sealed gauge",
+		"edgex_secretstore_vault_sealed 1",
+		`edgex_secretstore_unseal_attempts_total{result="success"} 1`,
+		`edgex_secretstore_token_expiry_seconds{token="kong"} 3`,
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("Expected %q in metrics output:\n%s", expected, out)
+		}
+	}
+}
+
+func TestInstrumentClient(t *testing.T) {
+	saved := metrics
+	metrics = newMetricsRegistry()
+	defer func() { metrics = saved }()
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer ts.Close()
+
+	client := InstrumentClient(&http.Client{})
+	resp, err := client.Get(ts.URL + vaultHealthAPI)
+	if err != nil {
+		t.Fatalf("Request failed: %s", err.Error())
+	}
+	resp.Body.Close()
+
+	var buf bytes.Buffer
+	metrics.WriteTo(&buf)
+	out := buf.String()
+	if !strings.Contains(out, `edgex_secretstore_vault_requests_total{endpoint="/v1/sys/health",method="GET",code="429"} 1`) {
+		t.Errorf("Request counter missing from metrics output:\n%s", out)
+	}
+	if !strings.Contains(out, `edgex_secretstore_vault_request_duration_seconds_count{endpoint="/v1/sys/health",method="GET"} 1`) {
+		t.Errorf("Request latency missing from metrics output:\n%s", out)
+	}
+}
@@ -0,0 +1,493 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *
+ * @version: 1.0.0
+ *******************************************************************************/
+package vaultworker
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dghubble/sling"
+	"github.com/youmark/pkcs8"
+)
+
+// ----------------------------------------------------------
+// Information:
+//    https://www.vaultproject.io/api/secret/pki/index.html
+//    https://www.vaultproject.io/api/system/mounts.html
+// ----------------------------------------------------------
+
+const (
+	pkiModeImport       = "import"
+	pkiModeIntermediate = "intermediate"
+	pkiDefaultMount     = "pki"
+	pkiDefaultKeyPwdEnv = "PKCS12_PASSWORD"
+	encryptedKeyBlock   = "ENCRYPTED PRIVATE KEY"
+	vaultMountsAPI      = "/v1/sys/mounts"
+)
+
+// pkiIssued is the data returned by the issue endpoint of a PKI role
+type pkiIssued struct {
+	Data struct {
+		Certificate string   `json:"certificate"`
+		PrivateKey  string   `json:"private_key"`
+		IssuingCA   string   `json:"issuing_ca"`
+		CAChain     []string `json:"ca_chain"`
+	} `json:"data"`
+}
+
+// mountPath returns the engine mount without surrounding slashes
+func (e pkiEngine) mountPath() string {
+	if m := strings.Trim(e.Mount, "/"); m != "" {
+		return m
+	}
+	return pkiDefaultMount
+}
+
+// caKeyFile returns the private key of the CA in cafilepath
+func (e pkiEngine) caKeyFile(config *tomlConfig) string {
+	if e.CAKeyFile != "" {
+		return e.CAKeyFile
+	}
+	return strings.TrimSuffix(config.SecretService.CAFilePath, ".pem") + ".priv.key"
+}
+
+// caKeyPassword reads the password of an encrypted CA key, from CAKeyPasswordFile if set, else from
+// CAKeyPasswordEnv like pkisetup does
+func (e pkiEngine) caKeyPassword() ([]byte, error) {
+	if e.CAKeyPasswordFile != "" {
+		raw, err := ioutil.ReadFile(e.CAKeyPasswordFile)
+		if err != nil {
+			return nil, err
+		}
+		password := bytes.TrimRight(raw, "\r\n")
+		if len(password) == 0 {
+			return nil, fmt.Errorf("CA key password file %s is empty", e.CAKeyPasswordFile)
+		}
+		return password, nil
+	}
+	env := e.CAKeyPasswordEnv
+	if env == "" {
+		env = pkiDefaultKeyPwdEnv
+	}
+	password := []byte(os.Getenv(env))
+	if len(password) == 0 {
+		return nil, fmt.Errorf("no CA key password: use cakeypasswordfile or set %s", env)
+	}
+	return password, nil
+}
+
+// decryptCAKey returns the CA key as a plain PKCS#8 PEM, decrypting it if pkisetup saved it encrypted.
+// The clear key is only kept in memory, for Vault or for signing the intermediate.
+func (e pkiEngine) decryptCAKey(keyPEM string, keyFile string) (string, error) {
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil || block.Type != encryptedKeyBlock {
+		return keyPEM, nil
+	}
+	password, err := e.caKeyPassword()
+	if err != nil {
+		return "", fmt.Errorf("%s is encrypted: %s", keyFile, err.Error())
+	}
+	key, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, password)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt %s: %s", keyFile, err.Error())
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+}
+
+// role returns the named role of the engine
+func (e pkiEngine) role(name string) (pkiRole, bool) {
+	for _, r := range e.Roles {
+		if r.Name == name {
+			return r, true
+		}
+	}
+	return pkiRole{}, false
+}
+
+// PKIRolePolicyName is the Vault policy allowing the consumers of a role to issue certificates from it
+func PKIRolePolicyName(e pkiEngine, r pkiRole) string {
+	return e.mountPath() + "-" + r.Name + "-issue"
+}
+
+// CheckPKIEngine verifies the [pkiengine] section
+func CheckPKIEngine(config *tomlConfig) error {
+	e := config.PKIEngine
+	if !e.Enabled {
+		return nil
+	}
+	if e.Mode != pkiModeImport && e.Mode != pkiModeIntermediate {
+		return fmt.Errorf("pkiengine: mode must be %q or %q, not %q", pkiModeImport, pkiModeIntermediate, e.Mode)
+	}
+	seen := map[string]bool{}
+	for i, r := range e.Roles {
+		if r.Name == "" {
+			return fmt.Errorf("pkiengine.roles[%d]: name is required", i)
+		}
+		if seen[r.Name] {
+			return fmt.Errorf("pkiengine.roles[%d]: duplicate name %q", i, r.Name)
+		}
+		seen[r.Name] = true
+		for _, consumer := range r.Consumers {
+			if err := checkConsumerName(config, consumer); err != nil {
+				return fmt.Errorf("pkiengine.roles[%d] %s: %s", i, r.Name, err.Error())
+			}
+		}
+	}
+	if _, ok := e.role(e.KongRole); e.KongRole != "" && !ok {
+		return fmt.Errorf("pkiengine: kongrole %q is not defined in pkiengine.roles", e.KongRole)
+	}
+	return nil
+}
+
+// vaultRequest sends a GET, or a POST of a JSON body, to the Vault API and decodes the JSON response
+// into out, if any. It returns the HTTP status code; only transport and decoding failures are errors.
+func vaultRequest(config *tomlConfig, method string, apiPath string, token string, body interface{}, out interface{}, httpClient *http.Client) (int, error) {
+	secretBaseURL := fmt.Sprintf("%s://%s:%s/", config.SecretService.Scheme, config.SecretService.Server, config.SecretService.Port)
+	s := sling.New().Set(VaultToken, token).Base(secretBaseURL)
+	switch method {
+	case http.MethodGet:
+		s = s.Get(strings.TrimPrefix(apiPath, "/"))
+	case http.MethodPost:
+		s = s.Post(strings.TrimPrefix(apiPath, "/")).BodyJSON(body)
+	default:
+		return 0, fmt.Errorf("unsupported Vault request method %s", method)
+	}
+	req, err := s.Request()
+	if err != nil {
+		return 0, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if out != nil && resp.StatusCode == http.StatusOK {
+		if err = json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
+
+// vaultExpect turns an unexpected status code into an error
+func vaultExpect(what string, sCode int, err error) error {
+	if err != nil {
+		return fmt.Errorf("%s: %s", what, err.Error())
+	}
+	if sCode != http.StatusOK && sCode != http.StatusNoContent {
+		return fmt.Errorf("%s: HTTP status code %d", what, sCode)
+	}
+	return nil
+}
+
+// pkiMounted tells whether a secrets engine is mounted at the engine path
+func pkiMounted(config *tomlConfig, token string, httpClient *http.Client) (bool, error) {
+	var mounts map[string]json.RawMessage
+	sCode, err := vaultRequest(config, http.MethodGet, vaultMountsAPI, token, nil, &mounts, httpClient)
+	if err = vaultExpect("list secrets engines", sCode, err); err != nil {
+		return false, err
+	}
+	key := config.PKIEngine.mountPath() + "/"
+	if _, ok := mounts[key]; ok {
+		return true, nil
+	}
+	// Recent Vault versions only list the mounts under "data"
+	var data map[string]json.RawMessage
+	if raw, ok := mounts["data"]; ok && json.Unmarshal(raw, &data) == nil {
+		_, ok = data[key]
+		return ok, nil
+	}
+	return false, nil
+}
+
+// pkiCACert returns the CA certificate of the engine, empty if none was configured yet
+func pkiCACert(config *tomlConfig, token string, httpClient *http.Client) (string, error) {
+	var ca struct {
+		Data struct {
+			Certificate string `json:"certificate"`
+		} `json:"data"`
+	}
+	sCode, err := vaultRequest(config, http.MethodGet, "/v1/"+config.PKIEngine.mountPath()+"/cert/ca", token, nil, &ca, httpClient)
+	if err != nil {
+		return "", err
+	}
+	if sCode != http.StatusOK {
+		return "", nil
+	}
+	return strings.TrimSpace(ca.Data.Certificate), nil
+}
+
+// loadCA reads the CA certificate and private key from the volume, decrypting the key if needed. In
+// intermediate mode, the CA must allow an intermediate below it.
+func loadCA(config *tomlConfig) (*x509.Certificate, string, string, error) {
+	keyFile := config.PKIEngine.caKeyFile(config)
+	caPEM, keyPEM, err := LoadCertKeyPair(config.SecretService.CAFilePath, keyFile)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if keyPEM, err = config.PKIEngine.decryptCAKey(keyPEM, keyFile); err != nil {
+		return nil, "", "", err
+	}
+	chain, err := parseCertChain([]byte(caPEM))
+	if err != nil {
+		return nil, "", "", err
+	}
+	if !chain[0].IsCA {
+		return nil, "", "", fmt.Errorf("%s is not a CA certificate", config.SecretService.CAFilePath)
+	}
+	// The leaves issued by the Vault intermediate would fail the path length check of the CA
+	if config.PKIEngine.Mode == pkiModeIntermediate && chain[0].MaxPathLen == 0 {
+		return nil, "", "", fmt.Errorf("%s has a path length of 0 and cannot sign the Vault intermediate CA: use pkiengine mode %q, or a CA allowing a path length of at least 1",
+			config.SecretService.CAFilePath, pkiModeImport)
+	}
+	return chain[0], caPEM, keyPEM, nil
+}
+
+// signIntermediate signs the CSR generated by Vault with the CA read from the volume, and returns the
+// intermediate certificate followed by the CA certificate
+func signIntermediate(csrPEM string, ttl time.Duration, caCert *x509.Certificate, caPEM string, caKeyPEM string) (string, error) {
+	block, _ := pem.Decode([]byte(csrPEM))
+	if block == nil {
+		return "", errors.New("no certificate request returned by Vault")
+	}
+	csr, err := x509.ParseCertificateRequest(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	if err = csr.CheckSignature(); err != nil {
+		return "", err
+	}
+	signer, err := parsePrivateKey([]byte(caKeyPEM))
+	if err != nil {
+		return "", err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return "", err
+	}
+	notAfter := time.Now().Add(ttl)
+	if notAfter.After(caCert.NotAfter) {
+		notAfter = caCert.NotAfter
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               csr.Subject,
+		NotBefore:             time.Now().Add(-time.Minute),
+		NotAfter:              notAfter,
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, caCert, csr.PublicKey, signer)
+	if err != nil {
+		return "", err
+	}
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})) + strings.TrimSpace(caPEM) + "\n", nil
+}
+
+// SetupPKIEngine mounts the Vault PKI secrets engine, gives it the EdgeXFoundryCA (imported, or as the
+// issuer of a Vault generated intermediate) unless it already has a CA, and writes the roles along with
+// the policies allowing their consumers to issue certificates
+func SetupPKIEngine(config *tomlConfig, rootToken string, httpClient *http.Client) error {
+	e := config.PKIEngine
+	mount := e.mountPath()
+
+	mounted, err := pkiMounted(config, rootToken, httpClient)
+	if err != nil {
+		return err
+	}
+	if !mounted {
+		lc.Info(fmt.Sprintf("Mounting the Vault PKI secrets engine @/%s.", mount))
+		body := map[string]interface{}{"type": "pki", "config": map[string]string{"max_lease_ttl": e.MaxLeaseTTL}}
+		sCode, err := vaultRequest(config, http.MethodPost, vaultMountsAPI+"/"+mount, rootToken, body, nil, httpClient)
+		if err = vaultExpect("mount the PKI secrets engine", sCode, err); err != nil {
+			return err
+		}
+	}
+
+	existing, err := pkiCACert(config, rootToken, httpClient)
+	if err != nil {
+		return err
+	}
+	if existing != "" {
+		lc.Info(fmt.Sprintf("Vault PKI secrets engine @/%s already has a CA, keeping it.", mount))
+	} else {
+		caCert, caPEM, caKeyPEM, err := loadCA(config)
+		if err != nil {
+			return err
+		}
+		switch e.Mode {
+		case pkiModeImport:
+			lc.Info(fmt.Sprintf("Importing %s as the CA of the Vault PKI secrets engine @/%s.", config.SecretService.CAFilePath, mount))
+			body := map[string]string{"pem_bundle": strings.TrimSpace(caPEM) + "\n" + strings.TrimSpace(caKeyPEM) + "\n"}
+			sCode, err := vaultRequest(config, http.MethodPost, "/v1/"+mount+"/config/ca", rootToken, body, nil, httpClient)
+			if err = vaultExpect("import the CA", sCode, err); err != nil {
+				return err
+			}
+		case pkiModeIntermediate:
+			ttl, err := time.ParseDuration(e.TTL)
+			if err != nil {
+				return fmt.Errorf("invalid pkiengine ttl %q: %s", e.TTL, err.Error())
+			}
+			lc.Info(fmt.Sprintf("Generating an intermediate CA %q in the Vault PKI secrets engine @/%s.", e.CommonName, mount))
+			var generated struct {
+				Data struct {
+					CSR string `json:"csr"`
+				} `json:"data"`
+			}
+			body := map[string]string{"common_name": e.CommonName, "ttl": e.TTL}
+			sCode, err := vaultRequest(config, http.MethodPost, "/v1/"+mount+"/intermediate/generate/internal", rootToken, body, &generated, httpClient)
+			if err = vaultExpect("generate the intermediate CA", sCode, err); err != nil {
+				return err
+			}
+			signed, err := signIntermediate(generated.Data.CSR, ttl, caCert, caPEM, caKeyPEM)
+			if err != nil {
+				return fmt.Errorf("sign the intermediate CA: %s", err.Error())
+			}
+			sCode, err = vaultRequest(config, http.MethodPost, "/v1/"+mount+"/intermediate/set-signed", rootToken, map[string]string{"certificate": signed}, nil, httpClient)
+			if err = vaultExpect("set the signed intermediate CA", sCode, err); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, r := range e.Roles {
+		lc.Info(fmt.Sprintf("Writing Vault PKI role %s (domains %v).", r.Name, r.AllowedDomains))
+		body := map[string]interface{}{
+			"allowed_domains":    r.AllowedDomains,
+			"allow_subdomains":   r.AllowSubdomains,
+			"allow_bare_domains": r.AllowBareDomains,
+			"allow_localhost":    r.AllowLocalhost,
+			"allow_ip_sans":      r.AllowIPSANs,
+			"server_flag":        r.ServerFlag,
+			"client_flag":        r.ClientFlag,
+		}
+		if r.KeyType != "" {
+			body["key_type"] = r.KeyType
+		}
+		if r.KeyBits != 0 {
+			body["key_bits"] = r.KeyBits
+		}
+		if r.TTL != "" {
+			body["ttl"] = r.TTL
+		}
+		if r.MaxTTL != "" {
+			body["max_ttl"] = r.MaxTTL
+		}
+		sCode, err := vaultRequest(config, http.MethodPost, "/v1/"+mount+"/roles/"+r.Name, rootToken, body, nil, httpClient)
+		if err = vaultExpect("write role "+r.Name, sCode, err); err != nil {
+			return err
+		}
+
+		if len(r.Consumers) == 0 {
+			continue
+		}
+		policyRequest, err := json.Marshal(struct {
+			Policy string `json:"policy"`
+		}{fmt.Sprintf("path \"%s/issue/%s\" {\n  capabilities = [\"create\", \"update\"]\n}\n", mount, r.Name)})
+		if err != nil {
+			return err
+		}
+		lc.Info(fmt.Sprintf("Importing Vault policy %s for PKI role %s.", PKIRolePolicyName(e, r), r.Name))
+		if err = ImportPolicy(PKIRolePolicyName(e, r), &policyRequest, rootToken, config, httpClient); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// IssuePKICert requests a certificate for the bundle from its PKI role. The returned certificate is
+// followed by the intermediates of the engine, and ca holds its whole CA chain.
+func IssuePKICert(config *tomlConfig, b certBundle, httpClient *http.Client) (cert string, key string, ca string, err error) {
+	t, err := GetSecret(config.SecretService.TokenFolderPath + "/" + config.SecretService.VaultInitParm)
+	if err != nil {
+		return "", "", "", err
+	}
+	snis := b.SNIList()
+	commonName := b.CommonName
+	if commonName == "" && len(snis) > 0 {
+		commonName = snis[0]
+	}
+	body := map[string]string{"common_name": commonName, "alt_names": strings.Join(snis, ",")}
+
+	issued := pkiIssued{}
+	sCode, err := vaultRequest(config, http.MethodPost, "/v1/"+config.PKIEngine.mountPath()+"/issue/"+b.PKIRole, t.Token, body, &issued, httpClient)
+	if err = vaultExpect("issue a certificate from role "+b.PKIRole, sCode, err); err != nil {
+		return "", "", "", err
+	}
+
+	chain := issued.Data.CAChain
+	if len(chain) == 0 && issued.Data.IssuingCA != "" {
+		chain = []string{issued.Data.IssuingCA}
+	}
+	cert = strings.TrimSpace(issued.Data.Certificate) + "\n"
+	for _, c := range chain {
+		parsed, err := parseCertChain([]byte(c))
+		if err != nil {
+			return "", "", "", err
+		}
+		if !bytes.Equal(parsed[0].RawIssuer, parsed[0].RawSubject) {
+			cert += strings.TrimSpace(c) + "\n"
+		}
+		ca += strings.TrimSpace(c) + "\n"
+	}
+	return cert, issued.Data.PrivateKey, ca, nil
+}
+
+// decideIssuedCert tells whether a certificate issued from a PKI role must be issued again: once
+// a third of its lifetime is left, or within the renewal window if it is shorter
+func decideIssuedCert(stored string, renewal certRenewal, now time.Time) (CertDecision, error) {
+	if stored == "" {
+		return CertDecision{CertUpload, "no certificate in the secret store, issuing one"}, nil
+	}
+	window, err := renewal.renewBefore()
+	if err != nil {
+		return CertDecision{}, fmt.Errorf("invalid renewal window %q: %s", renewal.RenewBefore, err.Error())
+	}
+	chain, err := parseCertChain([]byte(stored))
+	if err != nil {
+		return CertDecision{CertRenew, fmt.Sprintf("stored certificate cannot be parsed: %s", err.Error())}, nil
+	}
+	leaf := chain[0]
+	if third := leaf.NotAfter.Sub(leaf.NotBefore) / 3; window == 0 || window > third {
+		window = third
+	}
+	if leaf.NotAfter.Sub(now) < window {
+		return CertDecision{CertRenew, fmt.Sprintf("stored certificate expires %s, within %s", leaf.NotAfter.UTC(), window)}, nil
+	}
+	return CertDecision{CertKeep, fmt.Sprintf("stored certificate %s is current (expires %s)", CertFingerprint(leaf)[:16], leaf.NotAfter.UTC())}, nil
+}
+
+// pkiCertDetail describes the PKI issuance of a bundle for the bootstrap plan
+func pkiCertDetail(config *tomlConfig, b certBundle) string {
+	return fmt.Sprintf("role %s of the PKI engine @/%s", b.PKIRole, config.PKIEngine.mountPath())
+}
@@ -0,0 +1,278 @@
+/*******************************************************************************
+ * Copyright 2019 Dell Inc.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License"); you may not use this file except
+ * in compliance with the License. You may obtain a copy of the License at
+ *
+ * http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software distributed under the License
+ * is distributed on an "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express
+ * or implied. See the License for the specific language governing permissions and limitations under
+ * the License.
+ *
+ * @version: 1.0.0
+ *******************************************************************************/
+package vaultworker
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// PlanStep is a single action the bootstrap would perform (or skip)
+type PlanStep struct {
+	Phase  string
+	Action string
+	Detail string
+}
+
+// Plan is the ordered list of actions a bootstrap run would perform against the current Vault state
+type Plan struct {
+	Steps []PlanStep
+}
+
+// Plan actions
+const (
+	PlanNone    = "none"
+	PlanInit    = "init"
+	PlanUnseal  = "unseal"
+	PlanCreate  = "create"
+	PlanUpdate  = "update"
+	PlanKeep    = "unchanged"
+	PlanMint    = "mint"
+	PlanUpload  = "upload"
+	PlanSkip    = "skip"
+	PlanUnknown = "unknown"
+)
+
+func (p *Plan) add(phase string, action string, format string, args ...interface{}) {
+	p.Steps = append(p.Steps, PlanStep{Phase: phase, Action: action, Detail: fmt.Sprintf(format, args...)})
+}
+
+// String renders the plan as a numbered list
+func (p Plan) String() string {
+	var buf bytes.Buffer
+	for i, step := range p.Steps {
+		fmt.Fprintf(&buf, "%2d. [%-7s] %-9s %s\n", i+1, step.Phase, step.Action, step.Detail)
+	}
+	return buf.String()
+}
+
+// normalizePolicy strips comment lines and whitespace differences so that a policy file and
+// the rules stored in Vault (built by GetPolicyFromFile) can be compared
+func normalizePolicy(rules string) string {
+	var kept []string
+	for _, line := range strings.Split(rules, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		kept = append(kept, line)
+	}
+	return strings.Join(strings.Fields(strings.Join(kept, " ")), " ")
+}
+
+// BuildPlan evaluates the current Vault state and returns the actions a bootstrap would
+// perform, without changing anything in Vault or on the file system
+func BuildPlan(config *tomlConfig, httpClient *http.Client) (Plan, error) {
+	plan := Plan{}
+	initFile := filepath.Join(config.SecretService.TokenFolderPath, config.SecretService.VaultInitParm)
+
+	// Health and init status -----------------------------------------------------------
+	sCode, err := VaultHealthCheck(config, httpClient)
+	if err != nil {
+		return plan, err
+	}
+	ready, fresh := false, false
+	switch sCode {
+	case http.StatusOK:
+		plan.add("health", PlanNone, "Vault is initialized and unsealed")
+		ready = true
+	case http.StatusTooManyRequests:
+		plan.add("health", PlanNone, "Vault is unsealed and in standby mode")
+		ready = true
+	case http.StatusNotImplemented:
+		plan.add("health", PlanInit, "Vault is not initialized: would initialize with %d key shares (threshold %d) and save the response to %s",
+			config.SecretService.VaultSecretShares, config.SecretService.VaultSecretThreshold, initFile)
+		if err := checkInitFile(config); err != nil {
+			plan.add("health", PlanSkip, "Initialization would be refused, the bootstrap would stop here: %s", err.Error())
+			return plan, nil
+		} else if _, err := os.Stat(initFile); err == nil {
+			plan.add("health", PlanInit, "The existing %s would be kept as %s", initFile, initFile+backupFileExt)
+		}
+		plan.add("health", PlanUnseal, "Would unseal Vault with the new key shares")
+		fresh = true
+	case http.StatusServiceUnavailable:
+		if _, err := GetSecret(initFile); err != nil {
+			plan.add("health", PlanUnseal, "Vault is sealed, but the key shares cannot be read from %s: %s", initFile, err.Error())
+		} else {
+			plan.add("health", PlanUnseal, "Vault is sealed: would unseal with the key shares from %s", initFile)
+		}
+	default:
+		plan.add("health", PlanUnknown, "Vault is in an unknown state (status code %d): the bootstrap would keep retrying", sCode)
+	}
+
+	rootToken := ""
+	if ready {
+		secret, err := GetSecret(initFile)
+		if err != nil {
+			return plan, fmt.Errorf("failed to read the Vault root token from %s: %s", initFile, err.Error())
+		}
+		rootToken = secret.Token
+	}
+
+	// Policies -------------------------------------------------------------------------
+	policies := []struct{ name, path string }{
+		{config.SecretService.PolicyName4Admin, config.SecretService.PolicyPath4Admin},
+		{config.SecretService.PolicyName4Kong, config.SecretService.PolicyPath4Kong},
+	}
+	for _, policy := range policies {
+		policyFile := policy.path
+		hashSum, err := HashFile(&policyFile, false)
+		if err != nil {
+			return plan, err
+		}
+		local, err := ioutil.ReadFile(policyFile)
+		if err != nil {
+			return plan, err
+		}
+		if fresh {
+			plan.add("policy", PlanCreate, "Would create policy %q from %s (SHA256 %x)", policy.name, policyFile, hashSum)
+			continue
+		}
+		if !ready {
+			plan.add("policy", PlanUnknown, "Policy %q cannot be read until Vault is unsealed: would import %s (SHA256 %x)", policy.name, policyFile, hashSum)
+			continue
+		}
+		remote, sCode, err := ReadPolicy(policy.name, rootToken, config, httpClient)
+		switch {
+		case err != nil:
+			return plan, err
+		case sCode == http.StatusNotFound:
+			plan.add("policy", PlanCreate, "Would create policy %q from %s (SHA256 %x)", policy.name, policyFile, hashSum)
+		case sCode != http.StatusOK:
+			plan.add("policy", PlanUnknown, "Cannot read policy %q from Vault (status code %d): would import %s", policy.name, sCode, policyFile)
+		case normalizePolicy(remote) == normalizePolicy(string(local)):
+			plan.add("policy", PlanKeep, "Policy %q matches %s (SHA256 %x): would re-import it unchanged", policy.name, policyFile, hashSum)
+		default:
+			plan.add("policy", PlanUpdate, "Would update policy %q from %s (SHA256 %x)", policy.name, policyFile, hashSum)
+		}
+	}
+
+	for _, b := range config.CertBundles() {
+		if len(b.Consumers) > 0 {
+			plan.add("policy", PlanUpdate, "Would import policy %q granting read access to @/%s", BundlePolicyName(b), b.Path)
+		}
+	}
+
+	// Tokens ---------------------------------------------------------------------------
+	tokens := []struct{ name, policy string }{
+		{config.SecretService.TokenName4Admin, config.SecretService.PolicyName4Admin},
+		{config.SecretService.TokenName4Kong, config.SecretService.PolicyName4Kong},
+	}
+	for _, token := range tokens {
+		tokenFile := filepath.Join(config.SecretService.TokenFolderPath, token.name+tokenFileSuffix)
+		detail := ""
+		if _, err := os.Stat(tokenFile); err == nil {
+			detail = ", replacing the existing file"
+		}
+		plan.add("token", PlanMint, "Would mint token %q with policies [%s %s] (TTL %s) and save it to %s%s",
+			token.name, token.policy, vaultDefaultPolicy, vaultTokenTTL, tokenFile, detail)
+	}
+	consumers := consumerPolicies(config)
+	names := make([]string, 0, len(consumers))
+	for consumer := range consumers {
+		names = append(names, consumer)
+	}
+	sort.Strings(names)
+	for _, consumer := range names {
+		tokenFile := filepath.Join(config.SecretService.TokenFolderPath, consumer+tokenFileSuffix)
+		plan.add("token", PlanMint, "Would mint token %q with policies [%s %s] (TTL %s) and save it to %s",
+			consumer, strings.Join(consumers[consumer], " "), vaultDefaultPolicy, vaultTokenTTL, tokenFile)
+	}
+
+	// Vault PKI secrets engine ---------------------------------------------------------
+	if e := config.PKIEngine; e.Enabled {
+		mounted, ca := false, ""
+		if ready {
+			if mounted, err = pkiMounted(config, rootToken, httpClient); err != nil {
+				return plan, err
+			}
+			if mounted {
+				if ca, err = pkiCACert(config, rootToken, httpClient); err != nil {
+					return plan, err
+				}
+			}
+		}
+		if mounted {
+			plan.add("pki", PlanKeep, "PKI secrets engine already mounted @/%s", e.mountPath())
+		} else {
+			plan.add("pki", PlanCreate, "Would mount the PKI secrets engine @/%s (max lease TTL %s)", e.mountPath(), e.MaxLeaseTTL)
+		}
+		switch {
+		case ca != "":
+			plan.add("pki", PlanKeep, "PKI secrets engine @/%s already has a CA", e.mountPath())
+		case e.Mode == pkiModeIntermediate:
+			plan.add("pki", PlanCreate, "Would generate the intermediate CA %q (TTL %s) and sign it with %s", e.CommonName, e.TTL, config.SecretService.CAFilePath)
+		default:
+			plan.add("pki", PlanCreate, "Would import %s and %s as the engine CA", config.SecretService.CAFilePath, e.caKeyFile(config))
+		}
+		for _, r := range e.Roles {
+			plan.add("pki", PlanUpdate, "Would write role %q (domains %v, TTL %s, max TTL %s)", r.Name, r.AllowedDomains, r.TTL, r.MaxTTL)
+			if len(r.Consumers) > 0 {
+				plan.add("policy", PlanUpdate, "Would import policy %q allowing to issue from role %q", PKIRolePolicyName(e, r), r.Name)
+			}
+		}
+	}
+
+	// TLS certificates -----------------------------------------------------------------
+	secretBaseURL := fmt.Sprintf("%s://%s:%s/", config.SecretService.Scheme, config.SecretService.Server, config.SecretService.Port)
+	for _, b := range config.CertBundles() {
+		storedCert := ""
+		if ready {
+			if storedCert, _, err = getCertKeyPair(config, b, secretBaseURL, httpClient, false); err != nil {
+				return plan, err
+			}
+		}
+		if b.PKIRole != "" {
+			decision, err := decideIssuedCert(storedCert, b.renewal(config), time.Now())
+			if err != nil {
+				return plan, err
+			}
+			if decision.Action == CertKeep {
+				plan.add("cert", PlanSkip, "TLS certificate %s @/%s kept: %s", b.Name, b.Path, decision.Reason)
+			} else {
+				plan.add("cert", PlanUpload, "Would issue TLS certificate %s from %s and upload it to @/%s: %s", b.Name, pkiCertDetail(config, b), b.Path, decision.Reason)
+			}
+			continue
+		}
+		diskCert, _, diskErr := LoadCertKeyPair(b.CertFile, b.KeyFile)
+		decision, err := DecideCertAction(storedCert, diskCert, b.renewal(config), time.Now())
+		if err != nil {
+			return plan, err
+		}
+		switch {
+		case decision.Action == CertKeep:
+			plan.add("cert", PlanSkip, "TLS certificate %s @/%s kept: %s", b.Name, b.Path, decision.Reason)
+		case decision.Action == CertRenew:
+			plan.add("cert", PlanUpload, "Would issue a new TLS certificate %s with %s and upload it to @/%s: %s", b.Name, b.PKISetupConfig, b.Path, decision.Reason)
+		case diskErr != nil:
+			plan.add("cert", PlanUpload, "Would upload the TLS certificate %s to @/%s, but the files cannot be loaded: %s", b.Name, b.Path, diskErr.Error())
+		default:
+			plan.add("cert", PlanUpload, "Would upload %s and %s to @/%s: %s", b.CertFile, b.KeyFile, b.Path, decision.Reason)
+		}
+		if storedCert != "" && decision.Action != CertKeep {
+			plan.add("cert", PlanUpload, "Would keep the stored certificate for rollback @/%s%s", b.Path, certHistorySuffix)
+		}
+	}
+
+	return plan, nil
+}
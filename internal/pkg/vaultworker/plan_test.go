@@ -0,0 +1,189 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package vaultworker
+
+import (
+	"crypto/elliptic"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestConfig returns a configuration pointing at the test server, with the token folder
+// holding a copy of the test init response
+func newTestConfig(t *testing.T, serverURL string) *tomlConfig {
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	raw, err := ioutil.ReadFile(filepath.FromSlash(TokenfilepathUnix))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "resp-init.json"), raw, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &tomlConfig{}
+	config.SecretService.Scheme = u.Scheme
+	config.SecretService.Server = u.Hostname()
+	config.SecretService.Port = u.Port()
+	config.SecretService.CertPath = "v1/secret/edgex/pki/tls/edgex-kong"
+	config.SecretService.CertFilePath = filepath.Join(dir, "missing.pem")
+	config.SecretService.KeyFilePath = filepath.Join(dir, "missing.priv.key")
+	config.SecretService.VaultInitParm = "resp-init.json"
+	config.SecretService.VaultSecretShares = 5
+	config.SecretService.VaultSecretThreshold = 3
+	config.SecretService.TokenFolderPath = dir
+	config.SecretService.PolicyPath4Admin = filepath.FromSlash("../../../test/test-vault-policy-admin.hcl")
+	config.SecretService.PolicyName4Admin = "admin"
+	config.SecretService.TokenName4Admin = "admin"
+	config.SecretService.PolicyPath4Kong = filepath.FromSlash("../../../test/test-vault-policy-kong.hcl")
+	config.SecretService.PolicyName4Kong = "kong"
+	config.SecretService.TokenName4Kong = "kong"
+	return config
+}
+
+func TestBuildPlanUnsealedVault(t *testing.T) {
+	admin, err := ioutil.ReadFile(filepath.FromSlash("../../../test/test-vault-policy-admin.hcl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ca := newTestCA(t)
+	stored, storedKey := ca.issue(t, elliptic.P256(), []string{"edgex-kong"}, time.Now().Add(-time.Hour), time.Now().AddDate(1, 0, 0))
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case vaultHealthAPI:
+			w.WriteHeader(http.StatusOK)
+		case vaultPolicyAPI + "admin":
+			json.NewEncoder(w).Encode(PolicyRules{Name: "admin", Rules: string(admin)})
+		case vaultPolicyAPI + "kong":
+			w.WriteHeader(http.StatusNotFound)
+		case "/v1/secret/edgex/pki/tls/edgex-kong":
+			json.NewEncoder(w).Encode(CertKeyCollector{Section: CertKeyPair{Cert: stored, Key: storedKey}})
+		default:
+			t.Errorf("Unexpected request: %s %s", r.Method, r.URL.Path)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+		if r.Method != http.MethodGet {
+			t.Errorf("Dry-run must not change Vault: %s %s", r.Method, r.URL.Path)
+		}
+	}))
+	defer ts.Close()
+
+	plan, err := BuildPlan(newTestConfig(t, ts.URL), ts.Client())
+	if err != nil {
+		t.Fatalf("Failed to build plan: %s", err.Error())
+	}
+
+	expected := []string{PlanNone, PlanKeep, PlanCreate, PlanMint, PlanMint, PlanSkip}
+	if len(plan.Steps) != len(expected) {
+		t.Fatalf("Expected %d steps, got:\n%s", len(expected), plan)
+	}
+	for i, action := range expected {
+		if plan.Steps[i].Action != action {
+			t.Errorf("Step %d: expected action %s, got %s", i+1, action, plan.Steps[i].Action)
+		}
+	}
+}
+
+func TestBuildPlanUninitializedVault(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != vaultHealthAPI {
+			t.Errorf("Unexpected request for an uninitialized Vault: %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusNotImplemented)
+	}))
+	defer ts.Close()
+
+	config := newTestConfig(t, ts.URL)
+	config.SecretService.OverwriteInit = true
+	plan, err := BuildPlan(config, ts.Client())
+	if err != nil {
+		t.Fatalf("Failed to build plan: %s", err.Error())
+	}
+	if plan.Steps[0].Action != PlanInit {
+		t.Errorf("Expected the plan to start with Vault initialization, got:\n%s", plan)
+	}
+	last := plan.Steps[len(plan.Steps)-1]
+	if last.Phase != "cert" || last.Action != PlanUpload {
+		t.Errorf("Expected the plan to end with the certificate upload, got:\n%s", plan)
+	}
+}
+
+func TestBuildPlanInitRefused(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotImplemented)
+	}))
+	defer ts.Close()
+
+	// The test init response exists and overwriteinit is not set
+	plan, err := BuildPlan(newTestConfig(t, ts.URL), ts.Client())
+	if err != nil {
+		t.Fatalf("Failed to build plan: %s", err.Error())
+	}
+	last := plan.Steps[len(plan.Steps)-1]
+	if len(plan.Steps) != 2 || last.Action != PlanSkip || !strings.Contains(last.Detail, "refused") {
+		t.Errorf("Expected the plan to stop at the refused initialization, got:\n%s", plan)
+	}
+}
+
+func TestBuildPlanSealedVault(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != vaultHealthAPI {
+			t.Errorf("Unexpected request for a sealed Vault: %s %s", r.Method, r.URL.Path)
+		}
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	plan, err := BuildPlan(newTestConfig(t, ts.URL), ts.Client())
+	if err != nil {
+		t.Fatalf("Failed to build plan: %s", err.Error())
+	}
+	policies := 0
+	for _, step := range plan.Steps {
+		if step.Phase == "policy" {
+			policies++
+			if step.Action != PlanUnknown {
+				t.Errorf("Expected the policies of a sealed Vault to be unknown, got:\n%s", plan)
+			}
+		}
+	}
+	if policies != 2 {
+		t.Errorf("Expected 2 policy steps, got:\n%s", plan)
+	}
+}
+
+func TestNormalizePolicy(t *testing.T) {
+	file := "# comment\npath \"secret/*\" {\n  capabilities = [\"read\"]\n}\n"
+	stored := ` path "secret/*" { capabilities = ["read"] }`
+	if normalizePolicy(file) != normalizePolicy(stored) {
+		t.Errorf("Expected %q and %q to match", normalizePolicy(file), normalizePolicy(stored))
+	}
+}
@@ -33,6 +33,7 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"time"
 )
 
 // ----------------------------------------------------------
@@ -117,6 +118,10 @@ type AutoGenerated struct {
 */
 type TokenID struct {
 	RequestID string `json:"request_id"`
+	Auth      struct {
+		ClientToken   string `json:"client_token"`
+		LeaseDuration int    `json:"lease_duration"`
+	} `json:"auth"`
 }
 
 func GetPolicyFromFile(policyFilePtr *string) ([]byte, error) {
@@ -159,6 +164,10 @@ func GetPolicyFromFile(policyFilePtr *string) ([]byte, error) {
 
 func ImportPolicy(policyName string, policyRequest *[]byte, rootToken string, config *tomlConfig, httpClient *http.Client) (err error) {
 
+	defer func() {
+		metrics.inc(MetricPolicyImports, "policy", policyName, "result", resultLabel(err))
+	}()
+
 	// Build Vault API full URL
 	url, err := url.Parse(config.SecretService.Scheme + "://" + config.SecretService.Server + ":" + config.SecretService.Port + vaultPolicyAPI + policyName)
 	// Build Vault HTTP/POST Request
@@ -186,12 +195,17 @@ func ImportPolicy(policyName string, policyRequest *[]byte, rootToken string, co
 }
 
 func CreateToken(tokenName string, policyName string, rootToken string, config *tomlConfig, httpClient *http.Client) (err error) {
+	return CreateTokenWithPolicies(tokenName, []string{policyName}, rootToken, config, httpClient)
+}
+
+// CreateTokenWithPolicies mints a token holding several policies (plus the default one) and saves it to <tokenName>-token.json
+func CreateTokenWithPolicies(tokenName string, policyNames []string, rootToken string, config *tomlConfig, httpClient *http.Client) (err error) {
 
 	// Prepare the JSON to be POST'ed
 	userData := Metadata{tokenName + " user"}
 
 	tokenData := TokenData{
-		Policies:    []string{policyName, vaultDefaultPolicy},
+		Policies:    append(append([]string{}, policyNames...), vaultDefaultPolicy),
 		Metadata:    userData,
 		DisplayName: tokenName,
 		TTL:         vaultTokenTTL,
@@ -200,7 +214,7 @@ func CreateToken(tokenName string, policyName string, rootToken string, config *
 
 	tokenDataReq, err := json.Marshal(tokenData)
 	if err != nil {
-		FatalIfErr(err, "Token data request creation failure")
+		return fmt.Errorf("token data request creation failure: %w", err)
 	}
 
 	// Build Vault API full URL
@@ -222,7 +236,7 @@ func CreateToken(tokenName string, policyName string, rootToken string, config *
 	// Get response body
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		FatalIfErr(err, "Read Body failure")
+		return fmt.Errorf("read body failure: %w", err)
 	}
 
 	if resp.StatusCode == http.StatusOK {
@@ -233,12 +247,19 @@ func CreateToken(tokenName string, policyName string, rootToken string, config *
 	}
 
 	// Save created token data to a JSON file
-	err = ioutil.WriteFile(config.SecretService.TokenFolderPath+"/"+tokenName+tokenFileSuffix, body, 0600)
+	tokenFile := config.SecretService.TokenFolderPath + "/" + tokenName + tokenFileSuffix
+	err = WriteFileAtomic(tokenFile, body, config.fileAccess(tokenFile))
 	if err != nil {
 		lc.Error(fmt.Sprintf("Fatal Error Writing %s Token in Vault, HTTP Status: %s", tokenName, resp.Status))
 		return err
 	}
 
+	// Track the token lease so that monitoring can alert before it runs out
+	var tokenID TokenID
+	if err = json.Unmarshal(body, &tokenID); err == nil && tokenID.Auth.LeaseDuration > 0 {
+		metrics.expireAt(MetricTokenExpiry, time.Now().Add(time.Duration(tokenID.Auth.LeaseDuration)*time.Second), "token", tokenName)
+	}
+
 	return nil
 }
 
@@ -266,6 +287,43 @@ func VaultPolicyCheck(policyName string, tokenID string, config *tomlConfig, htt
 	return resp.StatusCode, nil
 }
 
+// PolicyRules structure to deserialize a policy read from Vault
+type PolicyRules struct {
+	Name  string `json:"name"`
+	Rules string `json:"rules"`
+}
+
+// ReadPolicy fetches the rules of an existing policy, returning the HTTP status code (404 if unknown)
+func ReadPolicy(policyName string, tokenID string, config *tomlConfig, httpClient *http.Client) (rules string, sCode int, err error) {
+
+	// Build Vault API full URL
+	url, err := url.Parse(config.SecretService.Scheme + "://" + config.SecretService.Server + ":" + config.SecretService.Port + vaultPolicyAPI + policyName)
+	if err != nil {
+		return "", 0, err
+	}
+	req, err := http.NewRequest(http.MethodGet, url.String(), nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("X-Vault-Token", tokenID)
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.StatusCode, nil
+	}
+
+	var policy PolicyRules
+	if err = json.NewDecoder(resp.Body).Decode(&policy); err != nil {
+		return "", resp.StatusCode, err
+	}
+	return policy.Rules, resp.StatusCode, nil
+}
+
 func HashFile(policyFilePtr *string, debug bool) (hashSum []byte, err error) {
 
 	inputFile, err := os.Open(*policyFilePtr)
@@ -283,7 +341,7 @@ func HashFile(policyFilePtr *string, debug bool) (hashSum []byte, err error) {
 
 	hashSum = hash256.Sum(nil)
 	if debug {
-		lc.Info(fmt.Sprintf("Vault policy file checksum (SHA256): %x", hashSum))
+		lc.Debug(fmt.Sprintf("Vault policy file checksum (SHA256): %x", hashSum))
 	}
 
 	return hashSum, err
@@ -21,6 +21,7 @@ package vaultworker
 
 import (
 	"fmt"
+	"path/filepath"
 	"testing"
 )
 
@@ -28,7 +29,7 @@ const TokenfilepathWin = "..\\..\\..\\test\\test-resp-init.json"
 const TokenfilepathUnix = "../../../test/test-resp-init.json"
 
 func TestGetSecret(t *testing.T) {
-	p := TokenfilepathWin
+	p := filepath.FromSlash(TokenfilepathUnix)
 	token, err := GetSecret(p)
 
 	if err != nil {
@@ -44,7 +45,7 @@ func TestGetSecret(t *testing.T) {
 func TestGetSecretNoExistFile(t *testing.T) {
 	token, err := GetSecret("\\no\\exist\\file")
 	if err != nil {
-		fmt.Printf(err.Error())
+		fmt.Println(err.Error())
 	}
 
 	if len(token.Token) > 1 {
@@ -17,12 +17,20 @@
 package vaultworker
 
 import (
+	"path"
+	"strings"
+
 	"github.com/BurntSushi/toml"
 )
 
 type tomlConfig struct {
 	Title         string
 	SecretService secretservice
+	OutputFiles   []outputFile
+	CertPolicy    certPolicy
+	CertRenewal   certRenewal
+	Certificates  []certBundle
+	PKIEngine     pkiEngine
 }
 
 type secretservice struct {
@@ -44,6 +52,128 @@ type secretservice struct {
 	PolicyName4Kong         string
 	TokenName4Kong          string
 	SNIS                    string
+	OverwriteInit           bool
+	PruneKongCerts          bool
+	ClientCertFilePath      string // client certificate presented to Vault for mutual TLS (none if empty)
+	ClientKeyFilePath       string
+}
+
+// certPolicy rules applied to a certificate/key pair before it is uploaded to the secret store
+type certPolicy struct {
+	MinRSABits      int  // 2048 if not set
+	MinECBits       int  // 256 if not set
+	SkipChainVerify bool // do not verify the chain against CAFilePath
+	SkipSNICoverage bool // do not require the certificate SANs to cover SNIS
+}
+
+// certRenewal controls the replacement of the TLS certificate held in the secret store
+type certRenewal struct {
+	RenewBefore    string // renewal window before NotAfter, e.g. "720h" (disabled if empty)
+	PKISetupConfig string // pkisetup JSON configuration used to issue a new certificate (disabled if empty)
+	HistoryDepth   int    // number of previous certificates kept for rollback (all if 0)
+}
+
+// certBundle is a named TLS certificate/key pair uploaded to the secret store
+type certBundle struct {
+	Name           string   // identifier used in logs and in the name of the consumers read policy
+	CertFile       string   // PEM certificate on the volume
+	KeyFile        string   // PEM private key on the volume
+	CAFile         string   // optional PEM CA chain stored along the pair, verified against (cafilepath if empty)
+	Path           string   // destination in the secret store, e.g. "v1/secret/edgex/pki/tls/mqtt"
+	SNIS           string   // comma separated names the certificate must cover
+	Consumers      []string // tokens minted with read access to Path
+	Gateway        bool     // also loaded into the API gateway by LoadKongCerts
+	PKISetupConfig string   // pkisetup JSON configuration renewing the certificate of the tls_host named as certfile (disabled if empty)
+	PKIRole        string   // issue the certificate from this Vault PKI engine role instead of reading certfile/keyfile
+	CommonName     string   // common name requested from the PKI role, the first SNI if empty
+}
+
+// pkiEngine sets up the Vault PKI secrets engine so that services can request their certificates from Vault
+type pkiEngine struct {
+	Enabled           bool
+	Mount             string // mount path of the engine, "pki" if empty
+	MaxLeaseTTL       string // maximum TTL of the engine, e.g. "87600h"
+	Mode              string // "import" the CA certificate and key, or have Vault generate an "intermediate" signed by it
+	CAKeyFile         string // private key of the CA, <cafilepath without .pem>.priv.key if empty
+	CAKeyPasswordFile string // password of an encrypted CA key (pkisetup encrypt_keys), read from CAKeyPasswordEnv if empty
+	CAKeyPasswordEnv  string // variable holding that password, PKCS12_PASSWORD if empty
+	CommonName        string // common name of the intermediate CA
+	TTL               string // validity of the intermediate CA, e.g. "43800h"
+	KongRole          string // role issuing the API gateway certificate (certfilepath/keyfilepath are used if empty)
+	Roles             []pkiRole
+}
+
+// pkiRole is a Vault PKI role, restricting the certificates a service may request
+type pkiRole struct {
+	Name             string
+	AllowedDomains   []string
+	AllowSubdomains  bool
+	AllowBareDomains bool
+	AllowLocalhost   bool
+	AllowIPSANs      bool
+	ServerFlag       bool
+	ClientFlag       bool
+	KeyType          string   // "rsa" or "ec", "rsa" if empty
+	KeyBits          int      // 2048 (rsa) or 256 (ec) if not set
+	TTL              string   // default certificate TTL, e.g. "72h"
+	MaxTTL           string   // maximum certificate TTL
+	Consumers        []string // tokens minted with permission to issue from the role
+}
+
+// splitList returns the non empty items of a comma separated value
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// SNIList returns the comma separated SNIS value as a list, e.g. "edgex-kong,www.edgexfoundry.org"
+func (s secretservice) SNIList() []string {
+	return splitList(s.SNIS)
+}
+
+// SNIList returns the comma separated SNIS value of the bundle as a list
+func (b certBundle) SNIList() []string {
+	return splitList(b.SNIS)
+}
+
+// legacyBundle is the API gateway certificate described by the secretservice section
+func (c *tomlConfig) legacyBundle() certBundle {
+	b := certBundle{
+		Name:           path.Base(c.SecretService.CertPath),
+		CertFile:       c.SecretService.CertFilePath,
+		KeyFile:        c.SecretService.KeyFilePath,
+		CAFile:         c.SecretService.CAFilePath,
+		Path:           c.SecretService.CertPath,
+		SNIS:           c.SecretService.SNIS,
+		Gateway:        true,
+		PKISetupConfig: c.CertRenewal.PKISetupConfig,
+	}
+	if c.PKIEngine.Enabled {
+		b.PKIRole = c.PKIEngine.KongRole
+	}
+	return b
+}
+
+// CertBundles returns the [[certificates]] entries, or the API gateway certificate of the
+// secretservice section when none is configured
+func (c *tomlConfig) CertBundles() []certBundle {
+	if len(c.Certificates) == 0 {
+		return []certBundle{c.legacyBundle()}
+	}
+	return c.Certificates
+}
+
+// outputFile sets the ownership and permissions of a file written by the worker (matched by file name)
+type outputFile struct {
+	Name  string
+	Owner string // user name or numeric uid, unchanged if empty
+	Group string // group name or numeric gid, unchanged if empty
+	Mode  string // octal permissions, 0600 if empty
 }
 
 // LoadTomlConfig Loading the TOML configuration into structure
@@ -0,0 +1,53 @@
+/*
+   Copyright 2019 DELL Technologies.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+
+  @version: 1.0.0
+*/
+
+package vaultworker
+
+import (
+	"crypto/elliptic"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadTomlConfig(t *testing.T) {
+	for _, f := range []string{"configuration.toml", "configuration-docker.toml"} {
+		config, err := LoadTomlConfig(filepath.Join("..", "..", "..", "cmd", "vaultworker", "res", f))
+		if err != nil {
+			t.Fatalf("Failed to load %s: %s", f, err.Error())
+		}
+		if config.SecretService.CertPath == "" || config.SecretService.VaultSecretShares != 5 {
+			t.Errorf("%s: unexpected secret service section: %+v", f, config.SecretService)
+		}
+		if len(config.OutputFiles) == 0 || config.fileAccess("resp-init.json").Mode != "0600" {
+			t.Errorf("%s: unexpected output files: %+v", f, config.OutputFiles)
+		}
+		if len(config.SecretService.SNIList()) != 2 {
+			t.Errorf("%s: unexpected SNI list: %v", f, config.SecretService.SNIList())
+		}
+		// The default SNIs are covered by the edgex-kong certificate of configs/pkisetup.json
+		if config.CertPolicy.SkipSNICoverage {
+			t.Errorf("%s: SNI coverage check skipped", f)
+		}
+		ca := newTestCA(t)
+		cert, key := ca.issue(t, elliptic.P384(), []string{"edgex-kong", "edgex-kong.local"}, time.Now().Add(-time.Hour), time.Now().AddDate(1, 0, 0))
+		if failed := failedChecks(ValidateCertKeyPair(cert, key, ca.pemFile, config.SecretService.SNIList(), config.CertPolicy, time.Now())); len(failed) > 0 {
+			t.Errorf("%s: default settings reject the edgex-kong certificate: %v", f, failed)
+		}
+	}
+}
@@ -22,14 +22,25 @@ import (
 )
 
 var usageStr = `
-Usage: %s [options]
+Usage: %s [command] [options]
+Commands:
+	bootstrap					Initialize, unseal and provision the secret store (same as --init=true)
+	backup						Write the init response, tokens, policy hashes and PKI CA directory to an encrypted archive
+	restore						Unpack an encrypted archive and check the restored keys and tokens against Vault
 Server Options:
 	--consul=true/false				Indicates if retrieving config from Consul
 	--insureskipverify=true/false			Indicates if skipping the server side SSL cert verifcation, similar to -k of curl
 	--init=true/false				Indicates if security service should be initialized	
 	--configfile=<file.toml>			Use a different config file (default: res/configuration.toml)
 	--wait=<time in seconds>		Indicates how long the program will pause between the vault initialization until it succeeds
-	--debug=true/false				Output sensitive debug informations for security service
+	--debug=true/false				Output debug informations for security service, secrets are redacted
+	--unsafe-debug=true/false			Output debug informations for security service, secrets in clear
+	--overwriteinit=true/false			Allow replacing an existing Vault init response file, or the files of a restore, keeping a .bak copy
+	--backupfile=<file>				Encrypted archive for backup/restore (default: vault-backup.bin)
+	--passphrasefile=<file>				Backup passphrase file (default: EDGEX_BACKUP_PASSPHRASE variable)
+	--dry-run					Print the bootstrap plan for the current Vault state without changing anything
+	--metricsaddr=<host:port>			Serve Prometheus metrics on /metrics at this address
+	--metricsfile=<file.prom>			Write Prometheus metrics to this file when the worker exits
 	Common Options:
 	-h, --help					Show this message
 `
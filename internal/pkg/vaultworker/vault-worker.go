@@ -75,6 +75,7 @@ func VaultHealthCheck(config *tomlConfig, httpClient *http.Client) (sCode int, e
 	defer resp.Body.Close()
 
 	lc.Info(fmt.Sprintf("Vault Health Check HTTP Status: %s (StatusCode: %d)", resp.Status, resp.StatusCode))
+	recordHealth(resp.StatusCode)
 
 	return resp.StatusCode, nil
 }
@@ -89,6 +90,12 @@ func VaultInit(config *tomlConfig, httpClient *http.Client, debug bool) (sCode i
 
 	lc.Info(fmt.Sprintf("Vault Init Strategy (SSS parameters): Shares=%d Threshold=%d", initRequest.SecretShares, initRequest.SecretThreshold))
 
+	// Never initialize Vault if its unseal keys could not be saved afterwards
+	if err = checkInitFile(config); err != nil {
+		lc.Error(err.Error())
+		return 0, err
+	}
+
 	// Build Vault API full URL
 	url, err := url.Parse(config.SecretService.Scheme + "://" + config.SecretService.Server + ":" + config.SecretService.Port + vaultInitAPI)
 	// Build Vault HTTP/POST Request
@@ -131,11 +138,11 @@ func VaultInit(config *tomlConfig, httpClient *http.Client, debug bool) (sCode i
 	}
 
 	if debug {
-		lc.Info(fmt.Sprintf("Vault Init Response: %s", initRequestResponseBody))
+		lc.Debug(fmt.Sprintf("Vault Init Response: %s", initRequestResponseBody))
 	}
 
 	// Save the JSON structure to a file system JSON file
-	err = ioutil.WriteFile(config.SecretService.TokenFolderPath+"/"+config.SecretService.VaultInitParm, initRequestResponseBody, 0600)
+	err = writeInitFile(config, initRequestResponseBody)
 	if err != nil {
 		lc.Error(fmt.Sprintf("Fatal error creating Vault init response %s file, HTTP status: %s", config.SecretService.TokenFolderPath+"/"+config.SecretService.VaultInitParm, err.Error()))
 		return 0, err
@@ -149,6 +156,9 @@ func VaultInit(config *tomlConfig, httpClient *http.Client, debug bool) (sCode i
 func VaultUnseal(config *tomlConfig, httpClient *http.Client, debug bool) (sCode int, err error) {
 
 	lc.Info(fmt.Sprintf("Vault Unsealing Process. Applying key shares."))
+	defer func() {
+		metrics.inc(MetricUnsealAttempts, "result", resultLabel(err))
+	}()
 
 	// Get the resp-init.json file to fetch the Vault key shares
 	var initResponse InitResponse
@@ -177,7 +187,7 @@ func VaultUnseal(config *tomlConfig, httpClient *http.Client, debug bool) (sCode
 		}
 
 		if debug {
-			lc.Info(fmt.Sprintf("Vault Key Share to apply (SSS): %s", key))
+			lc.Debug(fmt.Sprintf("Vault Key Share to apply (SSS): %s", key))
 		}
 
 		// Build Vault HTTP/POST Request
@@ -243,34 +253,42 @@ func VaultUnseal(config *tomlConfig, httpClient *http.Client, debug bool) (sCode
             http://localhost:8200/v1/secret/edgex/pki/tls/edgex-kong
 */
 func UploadProxyCerts(config *tomlConfig, secretBaseURL string, cert string, sk string, c *http.Client) (bool, error) {
+	err := UploadCertBundle(config, config.legacyBundle(), secretBaseURL, cert, sk, "", c)
+	return err == nil, err
+}
+
+// UploadCertBundle writes a certificate, its private key and optional CA chain to the bundle path
+func UploadCertBundle(config *tomlConfig, b certBundle, secretBaseURL string, cert string, sk string, ca string, c *http.Client) error {
 	body := &CertKeyPair{
 		Cert: cert,
 		Key:  sk,
+		CA:   ca,
 	}
 
 	t, err := GetSecret(config.SecretService.TokenFolderPath + "/" + config.SecretService.VaultInitParm)
 	if err != nil {
 		lc.Error(err.Error())
-		return false, err
+		return err
 	}
-	lc.Info("Trying to upload API Gateway TLS certificate and key to the secret store.")
+	lc.Info(fmt.Sprintf("Trying to upload TLS certificate and key %s to the secret store.", b.Name))
 	s := sling.New().Set(VaultToken, t.Token)
-	req, err := s.New().Base(secretBaseURL).Post(config.SecretService.CertPath).BodyJSON(body).Request()
+	req, err := s.New().Base(secretBaseURL).Post(b.Path).BodyJSON(body).Request()
 	resp, err := c.Do(req)
 	if err != nil {
-		lc.Error("Failed to upload API Gateway TLS certificate and key to secret store: %s", err.Error())
-		return false, err
+		lc.Error(fmt.Sprintf("Failed to upload TLS certificate and key %s to secret store: %s", b.Name, err.Error()))
+		return err
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusNoContent {
-		lc.Info("API Gateway TLS certificate and key successfully loaded in the secret store.")
+		lc.Info(fmt.Sprintf("TLS certificate and key %s successfully loaded in the secret store.", b.Name))
+		recordCertExpiry(b.Path, cert)
 	} else {
-		b, _ := ioutil.ReadAll(resp.Body)
-		s := fmt.Sprintf("Failed to load the TLS certificate and key to the secret store: %s,%s.", resp.Status, string(b))
+		respBody, _ := ioutil.ReadAll(resp.Body)
+		s := fmt.Sprintf("Failed to load the TLS certificate and key %s to the secret store: %s,%s.", b.Name, resp.Status, string(respBody))
 		lc.Error(s)
-		return false, errors.New(s)
+		return errors.New(s)
 	}
-	return true, nil
+	return nil
 }